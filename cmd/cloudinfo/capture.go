@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo/cloudinfotest"
+)
+
+// runCapture records the IMDS responses and the node list of the current environment into a
+// sanitized fixture file.
+func runCapture(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("capture", flag.ExitOnError)
+	name := flags.String("name", "", "name of the fixture, e.g. aws-eks")
+	output := flags.String("o", "", "path of the fixture file, <name>.json when empty")
+	kubeconfig := flags.String("kubeconfig", "", "path to the kubeconfig, in-cluster configuration when empty")
+	captureNodes := flags.Bool("nodes", true, "capture the node list of the cluster")
+	captureIMDS := flags.Bool("imds", true, "capture the instance metadata service responses")
+	redact := flags.String("redact", "", "comma-separated additional values to redact, e.g. cluster or resource group names")
+	verbosity := verbosityFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ctx = withLogger(ctx, *verbosity)
+	if *name == "" {
+		return fmt.Errorf("missing fixture name")
+	}
+	if *output == "" {
+		*output = *name + ".json"
+	}
+
+	config := cloudinfotest.CaptureConfig{Name: *name}
+	if *redact != "" {
+		config.Redact = strings.Split(*redact, ",")
+	}
+	if *captureIMDS {
+		config.IMDSClient = cloudinfo.DefaultIMDSClient()
+		config.IMDSConfig = cloudinfo.DefaultIMDSConfig().ApplyEnv(os.Getenv)
+	}
+	if *captureNodes {
+		client, err := kubeClient(*kubeconfig)
+		if err != nil {
+			return err
+		}
+		config.KubeClient = client
+	}
+
+	fixture, err := cloudinfotest.Capture(ctx, config)
+	if err != nil {
+		return err
+	}
+	if err := fixture.Save(*output); err != nil {
+		return err
+	}
+	fmt.Printf("captured %d IMDS exchanges and %d nodes to %s\n", len(fixture.IMDS), len(fixture.Nodes), *output)
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"k8s.io/client-go/kubernetes"
+)
+
+// runDetect detects the cloud info once and prints it, or the report of the detection.
+func runDetect(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("detect", flag.ExitOnError)
+	kubeconfig := flags.String("kubeconfig", "", "path to the kubeconfig, in-cluster configuration when empty")
+	config := configFlag(flags)
+	useNodeLabels := flags.Bool("node-labels", true, "detect from node labels and provider IDs")
+	useRuntime := flags.Bool("runtime", false, "detect from the serverless or container runtime environment")
+	useIMDS := flags.Bool("imds", false, "detect from the instance metadata service")
+	explain := flags.Bool("explain", false, "print the signals, candidates and decision of each detector")
+	output := flags.String("output", "text", "output format: text or json")
+	verbosity := verbosityFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ctx = withLogger(ctx, *verbosity)
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("unknown output format: %s", *output)
+	}
+
+	opts, err := loadOptions(flags, *config, map[string]*bool{
+		cloudinfo.DetectorNodeLabels: useNodeLabels,
+		cloudinfo.DetectorRuntime:    useRuntime,
+		cloudinfo.DetectorIMDS:       useIMDS,
+	})
+	if err != nil {
+		return err
+	}
+
+	var client kubernetes.Interface
+	if slices.Contains(opts.EnabledDetectors(), cloudinfo.DetectorNodeLabels) {
+		client, err = kubeClient(*kubeconfig)
+		if err != nil {
+			return err
+		}
+	}
+	report, err := cloudinfo.ExplainCloudInfo(ctx, client, opts)
+
+	switch {
+	case *explain && *output == "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if encodeErr := encoder.Encode(report); encodeErr != nil {
+			return encodeErr
+		}
+	case *explain:
+		fmt.Print(report.String())
+	case err != nil:
+		return err
+	case *output == "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report.Result)
+	default:
+		fmt.Printf("%s/%s (source: %s)\n", report.Result.Provider, report.Result.Region, report.Result.Source)
+	}
+	return err
+}
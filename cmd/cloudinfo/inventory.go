@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/inventory"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// runInventory detects the cloud info of every context of a kubeconfig, or of a directory of
+// kubeconfigs, and prints the fleet inventory.
+func runInventory(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("inventory", flag.ExitOnError)
+	kubeconfig := flags.String("kubeconfig", "", "path to a kubeconfig or a directory of kubeconfigs, every path of $KUBECONFIG or ~/.kube/config when empty")
+	config := flags.String("config", "", "path to a YAML configuration file of the label keys and region policy")
+	parallelism := flags.Int("parallelism", inventory.DefaultParallelism, "number of clusters detected at once")
+	timeout := flags.Duration("timeout", inventory.DefaultTimeout, "timeout of the detection of each cluster")
+	output := flags.String("output", inventory.FormatTable, "output format: table, json or csv")
+	verbosity := verbosityFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ctx = withLogger(ctx, *verbosity)
+	if *output != inventory.FormatTable && *output != inventory.FormatJSON && *output != inventory.FormatCSV {
+		return fmt.Errorf("unknown output format: %s", *output)
+	}
+
+	paths := []string{*kubeconfig}
+	if *kubeconfig == "" {
+		paths = nil
+		for _, path := range filepath.SplitList(os.Getenv(clientcmd.RecommendedConfigPathEnvVar)) {
+			if path != "" {
+				paths = append(paths, path)
+			}
+		}
+		if len(paths) == 0 {
+			paths = []string{clientcmd.RecommendedHomeFile}
+		}
+	}
+	opts, err := cloudinfo.LoadOptions(*config)
+	if err != nil {
+		return err
+	}
+
+	fleet, err := inventory.RunPaths(ctx, paths, inventory.Config{
+		Parallelism: *parallelism,
+		Timeout:     *timeout,
+		Node:        cloudinfo.NodeConfig{LabelKeys: opts.LabelKeys, RegionPolicy: opts.RegionPolicy},
+	})
+	if err != nil {
+		return err
+	}
+	if err := fleet.Write(os.Stdout, *output); err != nil {
+		return err
+	}
+	if len(fleet.Clusters) == 0 && len(fleet.Failures) > 0 {
+		return fmt.Errorf("all %d clusters failed", len(fleet.Failures))
+	}
+	return nil
+}
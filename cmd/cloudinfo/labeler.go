@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/labeler"
+)
+
+// runLabeler labels the node it runs on, in DaemonSet mode.
+func runLabeler(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("labeler", flag.ExitOnError)
+	kubeconfig := flags.String("kubeconfig", "", "path to the kubeconfig, in-cluster configuration when empty")
+	nodeName := flags.String("node-name", os.Getenv("NODE_NAME"), "name of the node to label")
+	dryRun := flags.Bool("dry-run", false, "print the labels without patching the node")
+	conflictPolicy := flags.String("conflict-policy", string(labeler.NeverOverwrite), "existing labels policy: never or overwrite")
+	interval := flags.Duration("interval", labeler.DefaultInterval, "interval between reconciliations")
+	once := flags.Bool("once", false, "reconcile once and exit")
+	verbosity := verbosityFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ctx = withLogger(ctx, *verbosity)
+
+	client, err := kubeClient(*kubeconfig)
+	if err != nil {
+		return err
+	}
+	imdsConfig := cloudinfo.DefaultIMDSConfig().ApplyEnv(os.Getenv)
+	l, err := labeler.New(client, labeler.Config{
+		NodeName:       *nodeName,
+		DryRun:         *dryRun,
+		ConflictPolicy: labeler.ConflictPolicy(*conflictPolicy),
+		Interval:       *interval,
+		IMDSConfig:     &imdsConfig,
+	})
+	if err != nil {
+		return err
+	}
+
+	if !*once {
+		return l.Run(ctx)
+	}
+	result, err := l.Reconcile(ctx)
+	if err != nil {
+		return err
+	}
+	for key, value := range result.Labels {
+		log.Printf("label %s=%s (dry run: %t)", key, value, *dryRun)
+	}
+	for _, conflict := range result.Conflicts {
+		log.Printf("conflict %s: keeping %s, detected %s", conflict.Key, conflict.Current, conflict.Detected)
+	}
+	return nil
+}
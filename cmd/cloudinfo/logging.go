@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/go-logr/stdr"
+)
+
+// verbosityFlag registers the log verbosity flag of a subcommand.
+func verbosityFlag(flags *flag.FlagSet) *int {
+	return flags.Int("v", 0, "log verbosity: 1 logs detector attempts and decisions, 2 also IMDS requests")
+}
+
+// withLogger returns a context whose detections are logged to stderr at the given verbosity.
+func withLogger(ctx context.Context, verbosity int) context.Context {
+	stdr.SetVerbosity(verbosity)
+	return cloudinfo.WithLogger(ctx, stdr.New(log.New(os.Stderr, "", log.LstdFlags)))
+}
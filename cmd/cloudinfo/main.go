@@ -0,0 +1,51 @@
+// Command cloudinfo detects and publishes the cloud provider and region of Kubernetes clusters.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// command is a cloudinfo subcommand, called with its arguments
+type command func(ctx context.Context, args []string) error
+
+var commands = map[string]command{
+	"capture":   runCapture,
+	"detect":    runDetect,
+	"inventory": runInventory,
+	"labeler":   runLabeler,
+	"publish":   runPublish,
+	"serve":     runServe,
+	"webhook":   runWebhook,
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := commands[os.Args[1]](ctx, os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "cloudinfo %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "usage: cloudinfo <command> [flags]\n\ncommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", name)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+)
+
+// configFlag registers the configuration file flag of a subcommand.
+func configFlag(flags *flag.FlagSet) *string {
+	return flags.String("config", "", "path to a YAML configuration file, overridden by the CLOUDINFO_ environment variables")
+}
+
+// loadOptions loads the options of the configuration file and the environment. The detector
+// flags, keyed by detector, replace the configured detectors when one of them is set.
+func loadOptions(flags *flag.FlagSet, config string, detectorFlags map[string]*bool) (cloudinfo.Options, error) {
+	opts, err := cloudinfo.LoadOptions(config)
+	if err != nil {
+		return cloudinfo.Options{}, err
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if _, ok := detectorFlags[f.Name]; ok {
+			opts.Detectors = nil
+			for _, detector := range []string{cloudinfo.DetectorNodeLabels, cloudinfo.DetectorRuntime, cloudinfo.DetectorIMDS} {
+				if enabled, ok := detectorFlags[detector]; ok && *enabled {
+					opts.Detectors = append(opts.Detectors, detector)
+				}
+			}
+		}
+	})
+	return opts, nil
+}
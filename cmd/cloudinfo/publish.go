@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/publisher"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// runPublish publishes the cluster cloud info into a ConfigMap and, optionally, a ClusterCloudInfo.
+func runPublish(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("publish", flag.ExitOnError)
+	kubeconfig := flags.String("kubeconfig", "", "path to the kubeconfig, in-cluster configuration when empty")
+	namespace := flags.String("namespace", publisher.DefaultNamespace, "namespace of the ConfigMap")
+	name := flags.String("name", publisher.DefaultName, "name of the ConfigMap")
+	configPath := configFlag(flags)
+	useNodeLabels := flags.Bool("node-labels", true, "detect from node labels and provider IDs")
+	useIMDS := flags.Bool("imds", false, "detect from the instance metadata service")
+	customResource := flags.Bool("custom-resource", false, "also publish the ClusterCloudInfo custom resource")
+	interval := flags.Duration("interval", publisher.DefaultInterval, "interval between detections")
+	once := flags.Bool("once", false, "publish once and exit")
+	verbosity := verbosityFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ctx = withLogger(ctx, *verbosity)
+	opts, err := loadOptions(flags, *configPath, map[string]*bool{
+		cloudinfo.DetectorNodeLabels: useNodeLabels,
+		cloudinfo.DetectorIMDS:       useIMDS,
+	})
+	if err != nil {
+		return err
+	}
+
+	config, err := kubeConfig(*kubeconfig)
+	if err != nil {
+		return err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	publisherConfig := publisher.Config{
+		Options:   opts,
+		Namespace: *namespace,
+		Name:      *name,
+		Interval:  *interval,
+	}
+	if *customResource {
+		publisherConfig.Dynamic, err = dynamic.NewForConfig(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	p := publisher.New(client, publisherConfig)
+	if *once {
+		return p.Publish(ctx)
+	}
+	return p.Run(ctx)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/server"
+)
+
+// runServe serves the detected cloud info and the detection metrics over HTTP.
+func runServe(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	kubeconfig := flags.String("kubeconfig", "", "path to the kubeconfig, in-cluster configuration when empty")
+	addr := flags.String("addr", ":8080", "address to listen on")
+	config := configFlag(flags)
+	useNodeLabels := flags.Bool("node-labels", true, "detect from node labels and provider IDs")
+	useIMDS := flags.Bool("imds", false, "detect from the instance metadata service")
+	interval := flags.Duration("interval", server.DefaultInterval, "interval between detections")
+	verbosity := verbosityFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ctx = withLogger(ctx, *verbosity)
+	opts, err := loadOptions(flags, *config, map[string]*bool{
+		cloudinfo.DetectorNodeLabels: useNodeLabels,
+		cloudinfo.DetectorIMDS:       useIMDS,
+	})
+	if err != nil {
+		return err
+	}
+
+	client, err := kubeClient(*kubeconfig)
+	if err != nil {
+		return err
+	}
+	s, err := server.New(client, server.Config{
+		Options:  opts,
+		Interval: *interval,
+	})
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	return s.Run(ctx, listener)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+
+	"github.com/carbon-aware/cloudinfo/pkg/webhook"
+	"k8s.io/client-go/informers"
+)
+
+// runWebhook serves the mutating admission webhook injecting cloud info into pods.
+func runWebhook(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("webhook", flag.ExitOnError)
+	kubeconfig := flags.String("kubeconfig", "", "path to the kubeconfig, in-cluster configuration when empty")
+	addr := flags.String("addr", ":8443", "address to listen on")
+	certFile := flags.String("tls-cert-file", "/etc/webhook/certs/tls.crt", "TLS certificate, reloaded when it changes")
+	keyFile := flags.String("tls-key-file", "/etc/webhook/certs/tls.key", "TLS private key, reloaded when it changes")
+	env := flags.Bool("env", true, "inject environment variables into containers")
+	annotations := flags.Bool("annotations", true, "add annotations to pods")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !*env && !*annotations {
+		return fmt.Errorf("at least one of --env and --annotations must be set")
+	}
+
+	client, err := kubeClient(*kubeconfig)
+	if err != nil {
+		return err
+	}
+	certificates, err := webhook.NewCertificateReloader(*certFile, *keyFile)
+	if err != nil {
+		return err
+	}
+
+	factory := informers.NewSharedInformerFactory(client, 0)
+	nodes := factory.Core().V1().Nodes().Lister()
+	namespaces := factory.Core().V1().Namespaces().Lister()
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	factory.WaitForCacheSync(ctx.Done())
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	w := webhook.New(nodes, namespaces, webhook.Config{Env: *env, Annotations: *annotations})
+	return w.Serve(ctx, listener, certificates)
+}
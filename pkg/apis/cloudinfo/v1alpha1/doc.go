@@ -0,0 +1,6 @@
+// Package v1alpha1 contains the v1alpha1 version of the cloudinfo.carbon-aware.io API.
+// +kubebuilder:object:generate=true
+// +groupName=cloudinfo.carbon-aware.io
+package v1alpha1
+
+//go:generate controller-gen object paths=. crd:crdVersions=v1 output:crd:dir=../../../../deploy/publisher
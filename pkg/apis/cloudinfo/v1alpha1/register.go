@@ -0,0 +1,26 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupVersion is the group version of the cloudinfo API
+var GroupVersion = schema.GroupVersion{Group: "cloudinfo.carbon-aware.io", Version: "v1alpha1"}
+
+// ClusterCloudInfoResource is the group version resource of ClusterCloudInfo
+var ClusterCloudInfoResource = GroupVersion.WithResource("clustercloudinfos")
+
+var (
+	// SchemeBuilder registers the cloudinfo API types
+	SchemeBuilder = runtime.NewSchemeBuilder(addKnownTypes)
+	// AddToScheme adds the cloudinfo API types to a scheme
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(GroupVersion, &ClusterCloudInfo{}, &ClusterCloudInfoList{})
+	metav1.AddToGroupVersion(scheme, GroupVersion)
+	return nil
+}
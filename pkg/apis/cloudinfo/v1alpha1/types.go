@@ -0,0 +1,73 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConditionDetected is the condition type reporting whether the last detection succeeded
+const ConditionDetected = "Detected"
+
+// ClusterCloudInfo is the cloud provider and region of the cluster, published by the cloudinfo
+// publisher. There is a single instance, named "cluster".
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,path=clustercloudinfos,singular=clustercloudinfo
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Provider",type=string,JSONPath=`.status.provider`
+// +kubebuilder:printcolumn:name="Region",type=string,JSONPath=`.status.region`
+// +kubebuilder:printcolumn:name="Source",type=string,JSONPath=`.status.source`
+// +kubebuilder:printcolumn:name="Last Detected",type=date,JSONPath=`.status.lastDetected`
+type ClusterCloudInfo struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status ClusterCloudInfoStatus `json:"status,omitempty"`
+}
+
+// ClusterCloudInfoStatus is the detected cloud info of the cluster
+type ClusterCloudInfoStatus struct {
+	// Cloud provider, e.g. "aws", "gcp" or "azure"
+	// +optional
+	Provider string `json:"provider,omitempty"`
+	// Region of the cluster, empty when the nodes span several regions
+	// +optional
+	Region string `json:"region,omitempty"`
+	// Detection method that produced the result, e.g. "node-labels" or "imds"
+	// +optional
+	Source string `json:"source,omitempty"`
+	// Electricity grid zone of the region
+	// +optional
+	GridZone string `json:"gridZone,omitempty"`
+	// Per-region breakdown of the cluster nodes
+	// +optional
+	// +listType=map
+	// +listMapKey=region
+	Regions []RegionStatus `json:"regions,omitempty"`
+	// Time of the last successful detection
+	// +optional
+	LastDetected *metav1.Time `json:"lastDetected,omitempty"`
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// RegionStatus is the node breakdown of a single region
+type RegionStatus struct {
+	Region string `json:"region"`
+	// Number of nodes in the region
+	Nodes int32 `json:"nodes"`
+	// Number of nodes by capacity type, e.g. "on-demand" or "spot"
+	// +optional
+	CapacityTypes map[string]int32 `json:"capacityTypes,omitempty"`
+	// Electricity grid zone of the region
+	// +optional
+	GridZone string `json:"gridZone,omitempty"`
+}
+
+// ClusterCloudInfoList is a list of ClusterCloudInfo
+// +kubebuilder:object:root=true
+type ClusterCloudInfoList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterCloudInfo `json:"items"`
+}
@@ -3,19 +3,198 @@ package cloudinfo
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 
+	"github.com/go-logr/logr"
 	"k8s.io/client-go/kubernetes"
 )
 
-// DetectCloudInfo detects cloud provider and region using the specified methods.
+// Conflict is a detector result that disagrees with the consensus
+type Conflict struct {
+	Detector   string  `json:"detector"`
+	Provider   string  `json:"provider"`
+	Region     string  `json:"region"`
+	Confidence float64 `json:"confidence"`
+}
+
+// detection is the result of a detector run by DetectCloudInfo
+type detection struct {
+	detector string
+	info     *CloudInfo
+	// Reliability of the result, see detectorConfidence
+	confidence float64
+}
+
+// DetectCloudInfo detects cloud provider and region with all the specified methods and returns
+// their consensus. Results are scored by the reliability of their detector; results that agree
+// on the provider and region reinforce each other, and the best supported one wins. Its
+// confidence is reduced by the support of each disagreeing result, which are returned as
+// conflicts, or as an ErrConflict error with Options.FailOnConflict. Detectors that fail are
+// ignored unless they all fail.
 func DetectCloudInfo(ctx context.Context, client kubernetes.Interface, opts Options) (*CloudInfo, error) {
+	info, _, err := DetectCloudInfoWithNodes(ctx, client, opts)
+	return info, err
+}
+
+// DetectCloudInfoWithNodes detects the cloud info like DetectCloudInfo, and also returns the node
+// attributes read by the node label detector, so callers do not list the nodes again. They are
+// returned even when detection fails, e.g. when the nodes span several regions, and are nil when
+// the node label detector did not run or failed to list the nodes.
+func DetectCloudInfoWithNodes(ctx context.Context, client kubernetes.Interface, opts Options) (info *CloudInfo, attributes *NodeAttributes, err error) {
+	if err := opts.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if opts.Logger.GetSink() != nil {
+		ctx = logr.NewContext(ctx, opts.Logger)
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	ctx, span := startSpan(ctx, "DetectCloudInfo")
+	defer func() { endSpan(span, info, err) }()
+	detectors := opts.EnabledDetectors()
+	logger := logr.FromContextOrDiscard(ctx).V(1)
+	logger.Info("detecting cloud info", "nodeLabels", slices.Contains(detectors, DetectorNodeLabels), "runtime", slices.Contains(detectors, DetectorRuntime),
+		"imds", slices.Contains(detectors, DetectorIMDS), "imdsVerification", opts.IMDSVerification != nil)
+
+	var detections []detection
+	var errs []error
+	run := func(detector string, detect func(ctx context.Context) (*CloudInfo, error)) {
+		ctx := ctx
+		if opts.DetectorTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, opts.DetectorTimeout)
+			defer cancel()
+		}
+		info, err := detect(ctx)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		confidence := detectorConfidence[detector]
+		if detector == DetectorNodeLabels && attributes != nil {
+			confidence *= regionShare(attributes, info.Region)
+		}
+		detections = append(detections, detection{detector: detector, info: info, confidence: confidence})
+	}
+	for _, detector := range detectors {
+		switch {
+		case detector == DetectorNodeLabels:
+			run(detector, func(ctx context.Context) (*CloudInfo, error) {
+				info, nodes, err := detectNodeCloudInfo(ctx, client, opts.nodeConfig())
+				attributes = nodes
+				return info, err
+			})
+		case detector == DetectorRuntime:
+			run(detector, func(ctx context.Context) (*CloudInfo, error) {
+				return DetectRuntimeCloudInfoWithClient(ctx, opts.httpClient(), opts.runtimeConfig())
+			})
+		case detector == DetectorIMDS && opts.IMDSVerification != nil:
+			run("imds-verified", func(ctx context.Context) (*CloudInfo, error) {
+				return DetectVerifiedIMDSCloudInfoWithClient(ctx, opts.httpClient(), opts.imdsConfig(), *opts.IMDSVerification)
+			})
+		case detector == DetectorIMDS:
+			run(detector, func(ctx context.Context) (*CloudInfo, error) {
+				return DetectIMDSCloudInfoWithClient(ctx, opts.httpClient(), opts.imdsConfig())
+			})
+		}
+	}
+
 	switch {
-	case opts.UseNodeLabels:
-		return DetectNodeCloudInfo(ctx, client)
-	case opts.UseIMDS:
-		return DetectIMDSCloudInfo(ctx)
+	case len(detections) > 0:
+		info, err = consensus(detections, opts.FailOnConflict)
+	case len(errs) == 1:
+		err = errs[0]
+	case len(errs) > 1:
+		err = errors.Join(errs...)
 	default:
-		return nil, fmt.Errorf("no cloud info detection method specified")
+		err = fmt.Errorf("no cloud info detection method specified")
+	}
+
+	if err != nil {
+		logger.Info("cloud info detection failed", "error", err.Error())
+		return nil, attributes, err
+	}
+	observerFrom(ctx).ObserveResult(info)
+	logger.Info("detected cloud info", "provider", info.Provider, "region", info.Region, "source", info.Source, "verified", info.Verified, "confidence", info.Confidence, "conflicts", len(info.Conflicts))
+	return info, attributes, nil
+}
+
+// consensus returns the best supported result of the detections. The support of a provider and
+// region is 1 - Π(1 - reliability) over the detectors reporting it, the node label reliability
+// being scaled by the share of nodes in the region; ties go to the detector run first, in the
+// order of Options.Detectors. The most reliable detector of the winning group provides the
+// result, completed with the platform and capacity type of the others.
+func consensus(detections []detection, failOnConflict bool) (*CloudInfo, error) {
+	type group struct {
+		key        string
+		support    float64
+		detections []detection
+	}
+	var groups []*group
+	index := make(map[string]*group)
+	for _, d := range detections {
+		key := d.info.Provider + "/" + d.info.Region
+		g, ok := index[key]
+		if !ok {
+			g = &group{key: key}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.support = 1 - (1-g.support)*(1-d.confidence)
+		g.detections = append(g.detections, d)
+	}
+
+	winner := groups[0]
+	for _, g := range groups[1:] {
+		if g.support > winner.support {
+			winner = g
+		}
+	}
+
+	best := winner.detections[0]
+	for _, d := range winner.detections[1:] {
+		if d.confidence > best.confidence {
+			best = d
+		}
+	}
+	info := *best.info
+	for _, d := range winner.detections {
+		if info.Platform == "" {
+			info.Platform = d.info.Platform
+		}
+		if info.CapacityType == "" {
+			info.CapacityType = d.info.CapacityType
+		}
+	}
+
+	info.Confidence = winner.support
+	for _, g := range groups {
+		if g == winner {
+			continue
+		}
+		info.Confidence *= 1 - g.support
+		for _, d := range g.detections {
+			info.Conflicts = append(info.Conflicts, Conflict{
+				Detector:   d.detector,
+				Provider:   d.info.Provider,
+				Region:     d.info.Region,
+				Confidence: d.confidence,
+			})
+		}
+	}
+
+	if failOnConflict && len(info.Conflicts) > 0 {
+		descriptions := []string{fmt.Sprintf("%s from %s", winner.key, best.detector)}
+		for _, c := range info.Conflicts {
+			descriptions = append(descriptions, fmt.Sprintf("%s/%s from %s", c.Provider, c.Region, c.Detector))
+		}
+		return nil, fmt.Errorf("%w: %s", ErrConflict, strings.Join(descriptions, ", "))
 	}
+	return &info, nil
 }
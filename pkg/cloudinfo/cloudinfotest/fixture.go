@@ -0,0 +1,400 @@
+package cloudinfotest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/yaml"
+)
+
+// Fixture is a recorded environment: the IMDS exchanges of an instance and the nodes of a cluster
+type Fixture struct {
+	Name  string        `json:"name"`
+	IMDS  []Exchange    `json:"imds,omitempty"`
+	Nodes []corev1.Node `json:"nodes,omitempty"`
+}
+
+// Exchange is a recorded IMDS request and its response
+type Exchange struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// Status of the response, 0 when the request failed
+	Status int    `json:"status,omitempty"`
+	Body   string `json:"body,omitempty"`
+	// Error of the failed request, e.g. a connection refused
+	Error string `json:"error,omitempty"`
+}
+
+// LoadFixture reads a fixture file.
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixture: %w", err)
+	}
+	var fixture Fixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("failed to decode fixture %s: %w", path, err)
+	}
+	return &fixture, nil
+}
+
+// Save writes the fixture file.
+func (f *Fixture) Save(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode fixture: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write fixture: %w", err)
+	}
+	return nil
+}
+
+// IMDSClient returns a client replaying the recorded IMDS exchanges.
+func (f *Fixture) IMDSClient() *ReplayClient {
+	return NewReplayClient(f.IMDS)
+}
+
+// IMDSConfig returns the default IMDS configuration without the local file and command
+// detection of OpenStack and vSphere, which the fixture does not record, and without the shared
+// circuit breaker, so that replays do not depend on each other.
+func (f *Fixture) IMDSConfig() cloudinfo.IMDSConfig {
+	config := cloudinfo.DefaultIMDSConfig()
+	config.OpenStackConfigDrivePath = ""
+	config.VSphereSysVendorPath = ""
+	config.VSphereRPCToolPath = ""
+	config.CircuitBreaker = nil
+	return config
+}
+
+// Clientset returns a fake clientset holding the recorded nodes.
+func (f *Fixture) Clientset() *fake.Clientset {
+	objects := make([]runtime.Object, len(f.Nodes))
+	for i := range f.Nodes {
+		objects[i] = f.Nodes[i].DeepCopy()
+	}
+	return fake.NewSimpleClientset(objects...)
+}
+
+// ReplayClient is an IMDS client answering with recorded exchanges. Requests that were not
+// recorded fail like an unreachable endpoint.
+type ReplayClient struct {
+	exchanges map[string]Exchange
+}
+
+// NewReplayClient returns a client replaying the exchanges.
+func NewReplayClient(exchanges []Exchange) *ReplayClient {
+	client := &ReplayClient{exchanges: make(map[string]Exchange)}
+	for _, e := range exchanges {
+		client.exchanges[e.Method+" "+e.URL] = e
+	}
+	return client
+}
+
+// Do answers the request with the recorded exchange of the same method and URL.
+func (c *ReplayClient) Do(req *http.Request) (*http.Response, error) {
+	e, ok := c.exchanges[req.Method+" "+req.URL.String()]
+	if !ok {
+		return nil, fmt.Errorf("no recorded exchange for %s %s", req.Method, req.URL)
+	}
+	if e.Status == 0 {
+		return nil, errors.New(e.Error)
+	}
+	return &http.Response{
+		StatusCode: e.Status,
+		Status:     fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(e.Body)),
+		Request:    req,
+	}, nil
+}
+
+// Recorder is an IMDS client recording the exchanges of another client
+type Recorder struct {
+	client    cloudinfo.IMDSClient
+	mu        sync.Mutex
+	exchanges []Exchange
+}
+
+// NewRecorder returns a client recording the exchanges of the client.
+func NewRecorder(client cloudinfo.IMDSClient) *Recorder {
+	return &Recorder{client: client}
+}
+
+// Do performs the request with the recorded client and records the response.
+func (r *Recorder) Do(req *http.Request) (*http.Response, error) {
+	exchange := Exchange{Method: req.Method, URL: req.URL.String()}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		exchange.Error = err.Error()
+		r.record(exchange)
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IMDS response: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	exchange.Status = resp.StatusCode
+	exchange.Body = string(body)
+	r.record(exchange)
+	return resp, nil
+}
+
+// record appends the exchange to the recorded ones.
+func (r *Recorder) record(exchange Exchange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exchanges = append(r.exchanges, exchange)
+}
+
+// Exchanges returns the recorded exchanges, in order.
+func (r *Recorder) Exchanges() []Exchange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Exchange(nil), r.exchanges...)
+}
+
+// CaptureConfig configures Capture
+type CaptureConfig struct {
+	// Name of the fixture
+	Name string
+	// Client and configuration of the IMDS detection, IMDS is not captured when the client is nil
+	IMDSClient cloudinfo.IMDSClient
+	IMDSConfig cloudinfo.IMDSConfig
+	// Client listing the cluster nodes, nodes are not captured when nil
+	KubeClient kubernetes.Interface
+	// Additional values to redact, e.g. cluster or resource group names
+	Redact []string
+}
+
+// Capture records the IMDS exchanges of an instance identity detection and the nodes of the
+// cluster, and returns them sanitized. IMDS detection failures are recorded, not returned.
+func Capture(ctx context.Context, config CaptureConfig) (*Fixture, error) {
+	fixture := &Fixture{Name: config.Name}
+	redact := append([]string(nil), config.Redact...)
+
+	if config.IMDSClient != nil {
+		recorder := NewRecorder(config.IMDSClient)
+		identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(ctx, recorder, config.IMDSConfig)
+		if err == nil {
+			redact = append(redact, identity.AccountID, identity.InstanceID)
+		}
+		fixture.IMDS = recorder.Exchanges()
+	}
+
+	if config.KubeClient != nil {
+		nodes, err := config.KubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list nodes: %w", err)
+		}
+		for _, node := range nodes.Items {
+			fixture.Nodes = append(fixture.Nodes, corev1.Node{
+				TypeMeta:   metav1.TypeMeta{Kind: "Node", APIVersion: "v1"},
+				ObjectMeta: metav1.ObjectMeta{Name: node.Name, Labels: node.Labels},
+				Spec:       corev1.NodeSpec{ProviderID: node.Spec.ProviderID},
+				Status:     corev1.NodeStatus{Capacity: node.Status.Capacity},
+			})
+			// e.g. "gce://my-project/us-central1-a/my-instance"
+			if project, ok := strings.CutPrefix(node.Spec.ProviderID, "gce://"); ok {
+				redact = append(redact, strings.Split(project, "/")[0])
+			}
+		}
+	}
+
+	if err := Sanitize(fixture, redact...); err != nil {
+		return nil, err
+	}
+	return fixture, nil
+}
+
+// identifierPattern matches the UUIDs, such as Azure subscription and VM IDs, the AWS instance
+// IDs, image IDs and account IDs, the AWS private hostnames and the IPv4 addresses
+var identifierPattern = regexp.MustCompile(`(?P<uuid>[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})` +
+	`|\b(?P<instance>i-[0-9a-f]{8,17})\b` +
+	`|\b(?P<image>ami-[0-9a-f]{8,17})\b` +
+	`|\b(?P<account>\d{12})\b` +
+	`|\b(?P<hostname>ip-\d{1,3}-\d{1,3}-\d{1,3}-\d{1,3})\b` +
+	`|\b(?P<ip>(?:\d{1,3}\.){3}\d{1,3})\b`)
+
+// identifierPlaceholders formats the n-th distinct identifier of each kind
+var identifierPlaceholders = map[string]string{
+	"uuid":     "00000000-0000-0000-0000-%012d",
+	"instance": "i-%017x",
+	"image":    "ami-%017x",
+	"account":  "%012d",
+	"hostname": "ip-10-0-0-%d",
+	"ip":       "10.0.0.%d",
+}
+
+// Sanitize masks the identifiers of the recorded bodies and nodes: the token values, the
+// identifiers matched by identifierPattern, and the given values. The fields of the JSON and
+// YAML bodies not in recordedFields, such as the SSH keys and user data, are dropped. Each distinct identifier is
+// replaced with a numbered placeholder of the same format, consistently across the fixture, so
+// it still parses like the original and its nodes stay distinct. The given values have their
+// letters replaced with "x" and their digits with "1".
+func Sanitize(fixture *Fixture, redact ...string) error {
+	// Longer values first, so a value contained in another does not prevent its redaction
+	redact = slices.Clone(redact)
+	slices.SortFunc(redact, func(a, b string) int { return len(b) - len(a) })
+	placeholders := make(map[string]string)
+	counts := make(map[string]int)
+	mask := func(s string) string {
+		s = identifierPattern.ReplaceAllStringFunc(s, func(identifier string) string {
+			if placeholder, ok := placeholders[identifier]; ok {
+				return placeholder
+			}
+			match := identifierPattern.FindStringSubmatch(identifier)
+			for i, kind := range identifierPattern.SubexpNames() {
+				if kind != "" && match[i] != "" {
+					counts[kind]++
+					placeholders[identifier] = fmt.Sprintf(identifierPlaceholders[kind], counts[kind])
+					break
+				}
+			}
+			return placeholders[identifier]
+		})
+		for _, value := range redact {
+			// Skip values too short to be identifiers
+			if len(value) >= 4 {
+				s = strings.ReplaceAll(s, value, maskValue(value))
+			}
+		}
+		return s
+	}
+
+	for i := range fixture.IMDS {
+		e := &fixture.IMDS[i]
+		if e.Method == http.MethodPut && e.Status == http.StatusOK {
+			e.Body = sanitizeToken(e.Body)
+		}
+		e.Body = mask(dropFields(e.Body))
+	}
+
+	for i := range fixture.Nodes {
+		data, err := json.Marshal(&fixture.Nodes[i])
+		if err != nil {
+			return fmt.Errorf("failed to encode node: %w", err)
+		}
+		var node corev1.Node
+		if err := json.Unmarshal([]byte(mask(string(data))), &node); err != nil {
+			return fmt.Errorf("failed to decode sanitized node: %w", err)
+		}
+		fixture.Nodes[i] = node
+	}
+	return nil
+}
+
+// recordedFields are the lowercase fields of the IMDS documents read by the detection. The others
+// may hold secrets, e.g. the GCP instance attributes (kube-env, ssh-keys, startup-script), the
+// Azure admin username, public keys and tags, or the OCI SSH keys and user data.
+var recordedFields = map[string]bool{
+	// AWS instance identity document and scheduled events
+	"accountid": true, "availabilityzone": true, "imageid": true, "instanceid": true, "instancetype": true,
+	"region": true, "code": true, "description": true, "eventid": true, "notbefore": true, "state": true,
+	"action": true, "time": true,
+	// Azure location, instance metadata and scheduled events
+	"location": true, "compute": true, "subscriptionid": true, "vmid": true, "vmsize": true, "zone": true,
+	"osprofile": true, "computername": true, "storageprofile": true, "imagereference": true, "id": true,
+	"publisher": true, "offer": true, "sku": true, "version": true, "events": true, "eventtype": true,
+	"eventstatus": true,
+	// GCP instance metadata
+	"image": true, "hostname": true, "machinetype": true,
+	// OCI, IBM Cloud, Hetzner, Linode, Vultr, Scaleway and OpenStack documents
+	"canonicalregionname": true, "availabilitydomain": true, "compartmentid": true, "shape": true,
+	"access_token": true, "crn": true, "name": true, "profile": true, "availability-zone": true,
+	"instance-id": true, "label": true, "type": true, "instance-v2-id": true, "regioncode": true,
+	"commercial_type": true, "project": true, "uuid": true, "availability_zone": true, "project_id": true,
+}
+
+// dropFields removes the fields not in recordedFields from a JSON or YAML document, re-encoded as
+// JSON. Other bodies, e.g. plain text, are returned as is.
+func dropFields(body string) string {
+	// Numbers are kept as is, e.g. the 64-bit GCP instance IDs
+	useNumber := func(d *json.Decoder) *json.Decoder {
+		d.UseNumber()
+		return d
+	}
+	var document any
+	if err := yaml.Unmarshal([]byte(body), &document, useNumber); err != nil {
+		return body
+	}
+	switch document.(type) {
+	case map[string]any, []any:
+	default:
+		return body
+	}
+	data, err := json.Marshal(keepRecordedFields(document))
+	if err != nil {
+		return body
+	}
+	return string(data)
+}
+
+// keepRecordedFields returns the value without the object fields not in recordedFields.
+func keepRecordedFields(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, field := range value {
+			if recordedFields[strings.ToLower(key)] {
+				value[key] = keepRecordedFields(field)
+			} else {
+				delete(value, key)
+			}
+		}
+	case []any:
+		for i, item := range value {
+			value[i] = keepRecordedFields(item)
+		}
+	}
+	return value
+}
+
+// maskValue replaces the letters of the value with "x" and its digits with "1", keeping numbers valid.
+func maskValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9':
+			return '1'
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+			return 'x'
+		}
+		return r
+	}, value)
+}
+
+// sanitizeToken replaces the token of a token endpoint response, plain text or the "*token*"
+// fields of a JSON document.
+func sanitizeToken(body string) string {
+	var document map[string]any
+	if err := json.Unmarshal([]byte(body), &document); err != nil {
+		return "sanitized-token"
+	}
+	for key := range document {
+		if strings.Contains(strings.ToLower(key), "token") {
+			document[key] = "sanitized-token"
+		}
+	}
+	data, err := json.Marshal(document)
+	if err != nil {
+		return "sanitized-token"
+	}
+	return string(data)
+}
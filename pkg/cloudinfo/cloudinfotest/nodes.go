@@ -0,0 +1,264 @@
+package cloudinfotest
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// Identifiers shared by the generated nodes
+const (
+	GKEProject        = "my-project"
+	AKSSubscriptionID = "12345678-1234-1234-1234-123456789012"
+)
+
+// Node pool labels set by the managed Kubernetes services
+const (
+	EKSNodeGroupLabel = cloudinfo.EKSNodeGroupLabel
+	GKENodePoolLabel  = cloudinfo.GKENodePoolLabel
+	AKSAgentPoolLabel = cloudinfo.AKSAgentPoolLabel
+)
+
+// NodePool describes a group of identical nodes
+type NodePool struct {
+	// "aws", "gcp", "azure" or "kind"
+	Provider string
+	// Name of the node pool, used in the node names and the node pool label
+	Name   string
+	Region string
+	// Zones the nodes are spread over in turn, in the provider format. Defaults to the first
+	// zone of the region.
+	Zones        []string
+	InstanceType string
+	// cloudinfo.CapacityTypeSpot or cloudinfo.CapacityTypeOnDemand, set with the provider's
+	// capacity type label. No label is set when empty.
+	CapacityType string
+	// CPU and memory capacity of each node, not set when empty
+	CPU    string
+	Memory string
+	Count  int
+}
+
+// Cluster builds the nodes of a fake cluster
+type Cluster struct {
+	nodes   []*corev1.Node
+	indexes map[string]int
+}
+
+// NewCluster returns an empty cluster.
+func NewCluster() *Cluster {
+	return &Cluster{indexes: make(map[string]int)}
+}
+
+// EKSCluster returns an EKS cluster with an on-demand managed node group of count m5.large nodes
+// spread over three zones of the region.
+func EKSCluster(region string, count int) *Cluster {
+	return NewCluster().AddNodePool(eksNodePool(region, count))
+}
+
+// GKECluster returns a GKE cluster with a node pool of count e2-standard-4 nodes spread over
+// three zones of the region.
+func GKECluster(region string, count int) *Cluster {
+	return NewCluster().AddNodePool(gkeNodePool(region, count))
+}
+
+// AKSCluster returns an AKS cluster with a regular node pool of count Standard_D2s_v3 nodes
+// spread over three zones of the region.
+func AKSCluster(region string, count int) *Cluster {
+	return NewCluster().AddNodePool(aksNodePool(region, count))
+}
+
+// KindCluster returns a kind cluster with a control plane and count workers. Its nodes have
+// "kind://" provider IDs and no topology labels, like a local cluster.
+func KindCluster(workers int) *Cluster {
+	return NewCluster().AddNodePool(NodePool{Provider: "kind", Name: "kind", Count: workers + 1})
+}
+
+// MultiRegionCluster returns an EKS, GKE or AKS cluster with the node pool of the preset in each
+// region, e.g. MultiRegionCluster("aws", 2, "us-west-2", "us-east-1").
+func MultiRegionCluster(provider string, count int, regions ...string) *Cluster {
+	presets := map[string]func(string, int) NodePool{"aws": eksNodePool, "gcp": gkeNodePool, "azure": aksNodePool}
+	preset, ok := presets[provider]
+	if !ok {
+		panic(fmt.Sprintf("no multi-region preset for provider %q", provider))
+	}
+	cluster := NewCluster()
+	for _, region := range regions {
+		cluster.AddNodePool(preset(region, count))
+	}
+	return cluster
+}
+
+// eksNodePool, gkeNodePool and aksNodePool return the node pools of the presets
+func eksNodePool(region string, count int) NodePool {
+	return NodePool{
+		Provider: "aws", Name: "default", Region: region, Zones: []string{region + "a", region + "b", region + "c"},
+		InstanceType: "m5.large", CapacityType: cloudinfo.CapacityTypeOnDemand, CPU: "2", Memory: "8Gi", Count: count,
+	}
+}
+
+func gkeNodePool(region string, count int) NodePool {
+	return NodePool{
+		Provider: "gcp", Name: "default-pool", Region: region, Zones: []string{region + "-a", region + "-b", region + "-c"},
+		InstanceType: "e2-standard-4", CPU: "4", Memory: "16Gi", Count: count,
+	}
+}
+
+func aksNodePool(region string, count int) NodePool {
+	return NodePool{
+		Provider: "azure", Name: "nodepool1", Region: region, Zones: []string{region + "-1", region + "-2", region + "-3"},
+		InstanceType: "Standard_D2s_v3", CapacityType: cloudinfo.CapacityTypeOnDemand, CPU: "2", Memory: "8Gi", Count: count,
+	}
+}
+
+// AddNodePool adds count nodes of the pool to the cluster.
+func (c *Cluster) AddNodePool(pool NodePool) *Cluster {
+	zones := pool.Zones
+	if len(zones) == 0 {
+		zones = []string{defaultZone(pool.Provider, pool.Region)}
+	}
+	for i := range pool.Count {
+		// Node indexes continue across the pools of a provider, keeping names and instance IDs unique
+		index := c.indexes[pool.Provider]
+		c.indexes[pool.Provider]++
+		c.nodes = append(c.nodes, newNode(pool, zones[i%len(zones)], index))
+	}
+	return c
+}
+
+// AddNode adds a custom node to the cluster.
+func (c *Cluster) AddNode(node *corev1.Node) *Cluster {
+	c.nodes = append(c.nodes, node.DeepCopy())
+	return c
+}
+
+// Nodes returns copies of the nodes of the cluster.
+func (c *Cluster) Nodes() []*corev1.Node {
+	nodes := make([]*corev1.Node, len(c.nodes))
+	for i, node := range c.nodes {
+		nodes[i] = node.DeepCopy()
+	}
+	return nodes
+}
+
+// Objects returns the nodes of the cluster as objects of a fake clientset.
+func (c *Cluster) Objects() []runtime.Object {
+	objects := make([]runtime.Object, len(c.nodes))
+	for i, node := range c.nodes {
+		objects[i] = node.DeepCopy()
+	}
+	return objects
+}
+
+// Clientset returns a fake clientset holding the nodes of the cluster.
+func (c *Cluster) Clientset() *fake.Clientset {
+	return fake.NewSimpleClientset(c.Objects()...)
+}
+
+// Load creates the nodes of the cluster with the client.
+func (c *Cluster) Load(ctx context.Context, client kubernetes.Interface) error {
+	for _, node := range c.nodes {
+		if _, err := client.CoreV1().Nodes().Create(ctx, node.DeepCopy(), metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create node %s: %w", node.Name, err)
+		}
+	}
+	return nil
+}
+
+// defaultZone returns the first zone of the region in the provider format.
+func defaultZone(provider, region string) string {
+	switch provider {
+	case "aws":
+		return region + "a"
+	case "gcp":
+		return region + "-a"
+	case "azure":
+		return region + "-1"
+	}
+	return ""
+}
+
+// newNode returns the index-th node of the pool in the zone, named and labeled like the
+// provider's managed Kubernetes service does.
+func newNode(pool NodePool, zone string, index int) *corev1.Node {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"kubernetes.io/os": "linux", "kubernetes.io/arch": "amd64"}},
+	}
+	if pool.Region != "" {
+		node.Labels[cloudinfo.RegionLabel] = pool.Region
+	}
+	if zone != "" {
+		node.Labels[cloudinfo.ZoneLabel] = zone
+	}
+	if pool.InstanceType != "" {
+		node.Labels[cloudinfo.InstanceTypeLabel] = pool.InstanceType
+	}
+
+	spot := pool.CapacityType == cloudinfo.CapacityTypeSpot
+	switch pool.Provider {
+	case "aws":
+		instanceID := fmt.Sprintf("i-0a1b2c3d4e5f%05x", index)
+		node.Name = fmt.Sprintf("ip-10-0-%d-%d.%s.compute.internal", index/250, index%250+10, pool.Region)
+		node.Spec.ProviderID = "aws:///" + zone + "/" + instanceID
+		node.Labels[EKSNodeGroupLabel] = pool.Name
+		switch pool.CapacityType {
+		case cloudinfo.CapacityTypeSpot:
+			node.Labels[cloudinfo.EKSCapacityTypeLabel] = "SPOT"
+		case cloudinfo.CapacityTypeOnDemand:
+			node.Labels[cloudinfo.EKSCapacityTypeLabel] = "ON_DEMAND"
+		}
+	case "gcp":
+		node.Name = fmt.Sprintf("gke-cluster-%s-1a2b3c4d-%04d", pool.Name, index)
+		node.Spec.ProviderID = "gce://" + GKEProject + "/" + zone + "/" + node.Name
+		node.Labels[GKENodePoolLabel] = pool.Name
+		if spot {
+			node.Labels[cloudinfo.GKESpotLabel] = "true"
+		}
+	case "azure":
+		scaleSet := fmt.Sprintf("aks-%s-12345678-vmss", pool.Name)
+		node.Name = fmt.Sprintf("%s%06d", scaleSet, index)
+		node.Spec.ProviderID = fmt.Sprintf("azure:///subscriptions/%s/resourceGroups/mc_cluster_%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s/virtualMachines/%d",
+			AKSSubscriptionID, pool.Region, scaleSet, index)
+		node.Labels[AKSAgentPoolLabel] = pool.Name
+		switch pool.CapacityType {
+		case cloudinfo.CapacityTypeSpot:
+			node.Labels[cloudinfo.AKSScaleSetPriorityLabel] = "spot"
+		case cloudinfo.CapacityTypeOnDemand:
+			node.Labels[cloudinfo.AKSScaleSetPriorityLabel] = "regular"
+		}
+	case "kind":
+		// kind names its nodes <cluster>-control-plane, <cluster>-worker, <cluster>-worker2, ...
+		switch index {
+		case 0:
+			node.Name = pool.Name + "-control-plane"
+			node.Labels["node-role.kubernetes.io/control-plane"] = ""
+		case 1:
+			node.Name = pool.Name + "-worker"
+		default:
+			node.Name = fmt.Sprintf("%s-worker%d", pool.Name, index)
+		}
+		node.Spec.ProviderID = "kind://docker/" + pool.Name + "/" + node.Name
+	default:
+		node.Name = fmt.Sprintf("%s-%d", pool.Name, index)
+	}
+	node.Labels["kubernetes.io/hostname"] = node.Name
+
+	if pool.CPU != "" || pool.Memory != "" {
+		node.Status.Capacity = corev1.ResourceList{}
+		if pool.CPU != "" {
+			node.Status.Capacity[corev1.ResourceCPU] = resource.MustParse(pool.CPU)
+		}
+		if pool.Memory != "" {
+			node.Status.Capacity[corev1.ResourceMemory] = resource.MustParse(pool.Memory)
+		}
+		node.Status.Allocatable = node.Status.Capacity.DeepCopy()
+	}
+	return node
+}
@@ -0,0 +1,377 @@
+// Package cloudinfotest provides a fake cloud metadata server emulating the AWS, Azure and GCP
+// instance metadata services, to test code detecting the cloud info with IMDS.
+package cloudinfotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+)
+
+// Paths of the emulated endpoints, used as keys of SetFault
+const (
+	AWSTokenPath             = "/latest/api/token"
+	AWSRegionPath            = "/latest/meta-data/placement/region"
+	AWSLifeCyclePath         = "/latest/meta-data/instance-life-cycle"
+	AWSHostnamePath          = "/latest/meta-data/local-hostname"
+	AWSSpotActionPath        = "/latest/meta-data/spot/instance-action"
+	AWSMaintenancePath       = "/latest/meta-data/events/maintenance/scheduled"
+	AWSIdentityDocumentPath  = "/latest/dynamic/instance-identity/document"
+	AzureLocationPath        = "/metadata/instance/compute/location"
+	AzurePriorityPath        = "/metadata/instance/compute/priority"
+	AzureInstancePath        = "/metadata/instance"
+	AzureScheduledEventsPath = "/metadata/scheduledevents"
+	GCPZonePath              = "/computeMetadata/v1/instance/zone"
+	GCPPreemptiblePath       = "/computeMetadata/v1/instance/scheduling/preemptible"
+	GCPMaintenanceEventPath  = "/computeMetadata/v1/instance/maintenance-event"
+	GCPProjectIDPath         = "/computeMetadata/v1/project/project-id"
+	GCPInstancePath          = "/computeMetadata/v1/instance/"
+)
+
+const (
+	awsTokenHeader    = "X-aws-ec2-metadata-token"
+	awsTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+	gcpProjectNumber  = "123456789"
+)
+
+// Instance is the virtual machine described by the fake metadata server
+type Instance struct {
+	// "aws", "azure" or "gcp", the metadata endpoints of the other providers answer 404
+	Provider string
+	Region   string
+	// Zone in the provider format, e.g. "us-west-2a", "1" for Azure or "us-central1-a". Defaults
+	// to the first zone of the region.
+	Zone      string
+	AccountID string
+	// InstanceID of the instance. GCP instance IDs are numbers, a numeric one is derived from
+	// the others.
+	InstanceID   string
+	InstanceType string
+	ImageID      string
+	Hostname     string
+	// cloudinfo.CapacityTypeSpot or cloudinfo.CapacityTypeOnDemand, the capacity type endpoint
+	// answers 404 when empty
+	CapacityType string
+	// AllowIMDSv1 accepts AWS requests without an IMDSv2 session token
+	AllowIMDSv1 bool
+}
+
+// Fault replaces the answer of an endpoint
+type Fault struct {
+	// Status of the answer, 200 when 0
+	Status int
+	// Body of the answer, e.g. a malformed document
+	Body string
+	// CloseConnection closes the connection without answering, like an unreachable endpoint
+	CloseConnection bool
+}
+
+// Request is a request received by the server
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+}
+
+// Server is a fake metadata server emulating the instance metadata service of its instance
+type Server struct {
+	*httptest.Server
+	instance Instance
+
+	mu       sync.Mutex
+	latency  time.Duration
+	faults   map[string]Fault
+	tokens   map[string]bool
+	requests []Request
+}
+
+// newServer returns an unstarted fake metadata server for the instance.
+func newServer(instance Instance) *Server {
+	if instance.Zone == "" {
+		switch instance.Provider {
+		case "aws":
+			instance.Zone = instance.Region + "a"
+		case "azure":
+			instance.Zone = "1"
+		case "gcp":
+			instance.Zone = instance.Region + "-a"
+		}
+	}
+	s := &Server{instance: instance, faults: make(map[string]Fault), tokens: make(map[string]bool)}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// NewServer starts a fake metadata server for the instance. It must be closed by the caller.
+func NewServer(instance Instance) *Server {
+	s := newServer(instance)
+	s.Start()
+	return s
+}
+
+// NewIPv6Server starts a fake metadata server for the instance listening on the IPv6 loopback
+// address, e.g. to emulate the IPv6 endpoint of AWS. It must be closed by the caller.
+func NewIPv6Server(instance Instance) (*Server, error) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on the IPv6 loopback address: %w", err)
+	}
+	s := newServer(instance)
+	_ = s.Listener.Close()
+	s.Listener = listener
+	s.Start()
+	return s, nil
+}
+
+// Config returns an IMDS configuration with the AWS, Azure and GCP endpoints pointing at the
+// server. The endpoints of the other providers are empty, so their probes are skipped.
+func (s *Server) Config() cloudinfo.IMDSConfig {
+	return cloudinfo.IMDSConfig{
+		AWSTokenEndpoint: s.URL + AWSTokenPath,
+		AWSEndpoint:      s.URL + AWSRegionPath,
+		AzureEndpoint:    s.URL + AzureLocationPath + "?api-version=2021-02-01",
+		GCPEndpoint:      s.URL + GCPZonePath,
+
+		AWSCapacityTypeEndpoint:   s.URL + AWSLifeCyclePath,
+		AzureCapacityTypeEndpoint: s.URL + AzurePriorityPath + "?api-version=2021-02-01&format=text",
+		GCPCapacityTypeEndpoint:   s.URL + GCPPreemptiblePath,
+
+		AWSSpotEventsEndpoint:        s.URL + AWSSpotActionPath,
+		AWSMaintenanceEventsEndpoint: s.URL + AWSMaintenancePath,
+		AzureScheduledEventsEndpoint: s.URL + AzureScheduledEventsPath + "?api-version=2020-07-01",
+		GCPMaintenanceEventEndpoint:  s.URL + GCPMaintenanceEventPath,
+
+		AWSIdentityDocumentEndpoint: s.URL + AWSIdentityDocumentPath,
+		AWSHostnameEndpoint:         s.URL + AWSHostnamePath,
+		AzureInstanceEndpoint:       s.URL + AzureInstancePath + "?api-version=2021-02-01",
+		GCPProjectIDEndpoint:        s.URL + GCPProjectIDPath,
+		GCPInstanceEndpoint:         s.URL + GCPInstancePath + "?recursive=true",
+	}
+}
+
+// SetLatency delays every answer of the server, until the request is cancelled.
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+}
+
+// SetFault replaces the answer of the endpoint at the path, e.g. AWSRegionPath.
+func (s *Server) SetFault(path string, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[path] = fault
+}
+
+// ClearFaults restores the emulated answers of all the endpoints.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = make(map[string]Fault)
+}
+
+// Requests returns the requests received by the server, in order.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// serveHTTP records the request, waits for the latency and answers with the fault or the emulated provider.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone()})
+	latency := s.latency
+	fault, faulty := s.faults[r.URL.Path]
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if faulty {
+		if fault.CloseConnection {
+			if hijacker, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hijacker.Hijack(); err == nil {
+					_ = conn.Close()
+					return
+				}
+			}
+			panic(http.ErrAbortHandler)
+		}
+		if fault.Status != 0 {
+			w.WriteHeader(fault.Status)
+		}
+		_, _ = w.Write([]byte(fault.Body))
+		return
+	}
+
+	status, body := s.answer(r)
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(body))
+}
+
+// answer returns the status and body of the emulated provider for the request.
+func (s *Server) answer(r *http.Request) (int, string) {
+	instance := s.instance
+	switch instance.Provider {
+	case "aws":
+		return s.answerAWS(r)
+	case "azure":
+		if r.Header.Get("Metadata") != "true" {
+			return http.StatusBadRequest, `{"error": "Bad request. Required metadata header not specified"}`
+		}
+		return answerAzure(instance, r)
+	case "gcp":
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			return http.StatusForbidden, "Missing Metadata-Flavor:Google header."
+		}
+		return answerGCP(instance, r)
+	}
+	return http.StatusNotFound, ""
+}
+
+// answerAWS issues IMDSv2 session tokens and requires one unless the instance allows IMDSv1.
+func (s *Server) answerAWS(r *http.Request) (int, string) {
+	instance := s.instance
+	if r.URL.Path == AWSTokenPath {
+		if r.Method != http.MethodPut {
+			return http.StatusMethodNotAllowed, ""
+		}
+		ttl, err := strconv.Atoi(r.Header.Get(awsTokenTTLHeader))
+		if err != nil || ttl < 1 || ttl > 21600 {
+			return http.StatusBadRequest, ""
+		}
+		s.mu.Lock()
+		token := fmt.Sprintf("fake-imds-token-%d", len(s.tokens)+1)
+		s.tokens[token] = true
+		s.mu.Unlock()
+		return http.StatusOK, token
+	}
+
+	s.mu.Lock()
+	authorized := s.tokens[r.Header.Get(awsTokenHeader)]
+	s.mu.Unlock()
+	if !authorized && !instance.AllowIMDSv1 {
+		return http.StatusUnauthorized, ""
+	}
+
+	switch r.URL.Path {
+	case AWSRegionPath:
+		return http.StatusOK, instance.Region
+	case AWSLifeCyclePath:
+		switch instance.CapacityType {
+		case cloudinfo.CapacityTypeSpot:
+			return http.StatusOK, "spot"
+		case cloudinfo.CapacityTypeOnDemand:
+			return http.StatusOK, "on-demand"
+		}
+	case AWSHostnamePath:
+		return http.StatusOK, instance.Hostname
+	case AWSMaintenancePath:
+		return http.StatusOK, "[]"
+	case AWSIdentityDocumentPath:
+		return encode(map[string]string{
+			"accountId":        instance.AccountID,
+			"availabilityZone": instance.Zone,
+			"imageId":          instance.ImageID,
+			"instanceId":       instance.InstanceID,
+			"instanceType":     instance.InstanceType,
+			"region":           instance.Region,
+		})
+	}
+	return http.StatusNotFound, ""
+}
+
+// answerAzure answers the Azure instance metadata requests.
+func answerAzure(instance Instance, r *http.Request) (int, string) {
+	switch r.URL.Path {
+	case AzureLocationPath:
+		return encode(map[string]string{"location": instance.Region})
+	case AzurePriorityPath:
+		switch instance.CapacityType {
+		case cloudinfo.CapacityTypeSpot:
+			return http.StatusOK, "Spot"
+		case cloudinfo.CapacityTypeOnDemand:
+			return http.StatusOK, "Regular"
+		}
+	case AzureScheduledEventsPath:
+		return http.StatusOK, `{"DocumentIncarnation": 0, "Events": []}`
+	case AzureInstancePath:
+		return encode(map[string]any{
+			"compute": map[string]any{
+				"location":       instance.Region,
+				"subscriptionId": instance.AccountID,
+				"vmId":           instance.InstanceID,
+				"vmSize":         instance.InstanceType,
+				"zone":           instance.Zone,
+				"osProfile":      map[string]string{"computerName": instance.Hostname},
+				"storageProfile": map[string]any{"imageReference": map[string]string{"id": instance.ImageID}},
+			},
+		})
+	}
+	return http.StatusNotFound, ""
+}
+
+// answerGCP answers the GCP metadata server requests.
+func answerGCP(instance Instance, r *http.Request) (int, string) {
+	switch r.URL.Path {
+	case GCPZonePath:
+		return http.StatusOK, "projects/" + gcpProjectNumber + "/zones/" + instance.Zone
+	case GCPPreemptiblePath:
+		switch instance.CapacityType {
+		case cloudinfo.CapacityTypeSpot:
+			return http.StatusOK, "TRUE"
+		case cloudinfo.CapacityTypeOnDemand:
+			return http.StatusOK, "FALSE"
+		}
+	case GCPMaintenanceEventPath:
+		return http.StatusOK, "NONE"
+	case GCPProjectIDPath:
+		return http.StatusOK, instance.AccountID
+	case GCPInstancePath:
+		return encode(map[string]any{
+			"id":          gcpInstanceID(instance.InstanceID),
+			"image":       instance.ImageID,
+			"hostname":    instance.Hostname,
+			"machineType": "projects/" + gcpProjectNumber + "/machineTypes/" + instance.InstanceType,
+			"zone":        "projects/" + gcpProjectNumber + "/zones/" + instance.Zone,
+		})
+	}
+	return http.StatusNotFound, ""
+}
+
+// gcpInstanceID returns the numeric GCP instance ID of the instance: the ID when it is a number,
+// else one derived from it, 0 when empty.
+func gcpInstanceID(id string) json.Number {
+	if id == "" {
+		return "0"
+	}
+	if _, err := strconv.ParseUint(id, 10, 64); err == nil {
+		return json.Number(id)
+	}
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(id))
+	return json.Number(strconv.FormatUint(hash.Sum64(), 10))
+}
+
+// encode returns a 200 status with the JSON encoding of the document.
+func encode(document any) (int, string) {
+	body, err := json.Marshal(document)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	return http.StatusOK, string(body)
+}
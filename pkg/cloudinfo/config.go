@@ -0,0 +1,214 @@
+package cloudinfo
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// fileOptions is the format of the configuration file, whose fields override the options they
+// are set in
+type fileOptions struct {
+	Detectors       []string         `json:"detectors,omitempty"`
+	Timeout         *metav1.Duration `json:"timeout,omitempty"`
+	DetectorTimeout *metav1.Duration `json:"detectorTimeout,omitempty"`
+	FailOnConflict  *bool            `json:"failOnConflict,omitempty"`
+	RegionPolicy    RegionPolicy     `json:"regionPolicy,omitempty"`
+	LabelKeys       LabelKeys        `json:"labelKeys,omitempty"`
+	CacheTTL        *metav1.Duration `json:"cacheTTL,omitempty"`
+	IMDS            fileIMDSOptions  `json:"imds,omitempty"`
+}
+
+type fileIMDSOptions struct {
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// Endpoints replaces the base URL of the providers' endpoints, an empty one disables the provider
+	Endpoints      map[string]string   `json:"endpoints,omitempty"`
+	Retry          *fileRetryPolicy    `json:"retry,omitempty"`
+	CircuitBreaker *fileCircuitBreaker `json:"circuitBreaker,omitempty"`
+}
+
+type fileRetryPolicy struct {
+	MaxAttempts      *int             `json:"maxAttempts,omitempty"`
+	InitialBackoff   *metav1.Duration `json:"initialBackoff,omitempty"`
+	MaxBackoff       *metav1.Duration `json:"maxBackoff,omitempty"`
+	RetryUnreachable *bool            `json:"retryUnreachable,omitempty"`
+}
+
+// fileCircuitBreaker replaces the circuit breaker, disabled when the threshold is 0
+type fileCircuitBreaker struct {
+	Threshold int             `json:"threshold"`
+	Cooldown  metav1.Duration `json:"cooldown"`
+}
+
+// LoadOptions returns the default options overridden by the configuration file at path, skipped
+// when empty, then by the environment of the process.
+func LoadOptions(path string) (Options, error) {
+	var opts []Option
+	if path != "" {
+		opts = append(opts, WithConfigFile(path))
+	}
+	return NewOptions(append(opts, WithEnv(os.Getenv))...)
+}
+
+// WithConfigFile applies the YAML or JSON configuration file at path.
+func WithConfigFile(path string) Option {
+	return func(o *Options) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := WithConfig(data)(o); err != nil {
+			return fmt.Errorf("failed to load config file %s: %w", path, err)
+		}
+		return nil
+	}
+}
+
+// WithConfig applies a YAML or JSON configuration. Unknown fields are rejected.
+func WithConfig(data []byte) Option {
+	return func(o *Options) error {
+		var file fileOptions
+		if err := yaml.UnmarshalStrict(data, &file); err != nil {
+			return fmt.Errorf("failed to parse config: %w", err)
+		}
+
+		if len(file.Detectors) > 0 {
+			o.Detectors = file.Detectors
+		}
+		setDuration(&o.Timeout, file.Timeout)
+		setDuration(&o.DetectorTimeout, file.DetectorTimeout)
+		setDuration(&o.CacheTTL, file.CacheTTL)
+		setDuration(&o.IMDSTimeout, file.IMDS.Timeout)
+		if file.FailOnConflict != nil {
+			o.FailOnConflict = *file.FailOnConflict
+		}
+		if file.RegionPolicy != "" {
+			o.RegionPolicy = file.RegionPolicy
+		}
+		o.LabelKeys = overrideLabelKeys(o.LabelKeys, file.LabelKeys)
+
+		if len(file.IMDS.Endpoints) == 0 && file.IMDS.Retry == nil && file.IMDS.CircuitBreaker == nil {
+			return nil
+		}
+		config := o.imdsConfig()
+		for _, provider := range slices.Sorted(maps.Keys(file.IMDS.Endpoints)) {
+			base := strings.TrimSuffix(file.IMDS.Endpoints[provider], "/")
+			if providerEndpoints(&config, provider) == nil {
+				return fmt.Errorf("unknown IMDS provider %q", provider)
+			}
+			if u, err := url.Parse(base); base != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+				return fmt.Errorf("invalid IMDS endpoint of %s: %q", provider, base)
+			}
+			rebaseEndpoints(&config, provider, config.baseURL(provider), base)
+		}
+		if retry := file.IMDS.Retry; retry != nil {
+			if retry.MaxAttempts != nil {
+				config.Retry.MaxAttempts = *retry.MaxAttempts
+			}
+			setDuration(&config.Retry.InitialBackoff, retry.InitialBackoff)
+			setDuration(&config.Retry.MaxBackoff, retry.MaxBackoff)
+			if retry.RetryUnreachable != nil {
+				config.Retry.RetryUnreachable = *retry.RetryUnreachable
+			}
+		}
+		if breaker := file.IMDS.CircuitBreaker; breaker != nil {
+			config.CircuitBreaker = nil
+			if breaker.Threshold > 0 {
+				config.CircuitBreaker = NewCircuitBreaker(breaker.Threshold, breaker.Cooldown.Duration)
+			}
+		}
+		o.IMDSConfig = &config
+		return nil
+	}
+}
+
+// WithEnv applies the environment variables read with getenv, e.g. os.Getenv:
+//   - CLOUDINFO_DETECTORS: comma-separated detectors, e.g. "node-labels,imds".
+//   - CLOUDINFO_TIMEOUT, CLOUDINFO_DETECTOR_TIMEOUT, CLOUDINFO_IMDS_TIMEOUT and CLOUDINFO_CACHE_TTL:
+//     durations, e.g. "30s".
+//   - CLOUDINFO_FAIL_ON_CONFLICT: a boolean.
+//   - CLOUDINFO_REGION_POLICY: "strict" or "majority".
+//   - CLOUDINFO_REGION_LABEL, CLOUDINFO_ZONE_LABEL and CLOUDINFO_INSTANCE_TYPE_LABEL: label keys.
+//   - CLOUDINFO_IMDS_MAX_ATTEMPTS: attempts of the IMDS requests.
+//
+// The IMDS endpoint variables of IMDSConfig.ApplyEnv are applied too.
+func WithEnv(getenv func(string) string) Option {
+	return func(o *Options) error {
+		if value := getenv("CLOUDINFO_DETECTORS"); value != "" {
+			o.Detectors = nil
+			for _, detector := range strings.Split(value, ",") {
+				o.Detectors = append(o.Detectors, strings.TrimSpace(detector))
+			}
+		}
+		durations := map[string]*time.Duration{
+			"CLOUDINFO_TIMEOUT":          &o.Timeout,
+			"CLOUDINFO_DETECTOR_TIMEOUT": &o.DetectorTimeout,
+			"CLOUDINFO_IMDS_TIMEOUT":     &o.IMDSTimeout,
+			"CLOUDINFO_CACHE_TTL":        &o.CacheTTL,
+		}
+		for _, name := range slices.Sorted(maps.Keys(durations)) {
+			if value := getenv(name); value != "" {
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					return fmt.Errorf("invalid %s: %w", name, err)
+				}
+				*durations[name] = d
+			}
+		}
+		if value := getenv("CLOUDINFO_FAIL_ON_CONFLICT"); value != "" {
+			fail, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid CLOUDINFO_FAIL_ON_CONFLICT: %w", err)
+			}
+			o.FailOnConflict = fail
+		}
+		if value := getenv("CLOUDINFO_REGION_POLICY"); value != "" {
+			o.RegionPolicy = RegionPolicy(value)
+		}
+		o.LabelKeys = overrideLabelKeys(o.LabelKeys, LabelKeys{
+			Region:       getenv("CLOUDINFO_REGION_LABEL"),
+			Zone:         getenv("CLOUDINFO_ZONE_LABEL"),
+			InstanceType: getenv("CLOUDINFO_INSTANCE_TYPE_LABEL"),
+		})
+
+		config := o.imdsConfig().ApplyEnv(getenv)
+		if value := getenv("CLOUDINFO_IMDS_MAX_ATTEMPTS"); value != "" {
+			attempts, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid CLOUDINFO_IMDS_MAX_ATTEMPTS: %w", err)
+			}
+			config.Retry.MaxAttempts = attempts
+		}
+		o.IMDSConfig = &config
+		return nil
+	}
+}
+
+// setDuration sets the duration when the file sets it.
+func setDuration(d *time.Duration, value *metav1.Duration) {
+	if value != nil {
+		*d = value.Duration
+	}
+}
+
+// overrideLabelKeys returns the keys with the non-empty overrides applied.
+func overrideLabelKeys(keys, overrides LabelKeys) LabelKeys {
+	if overrides.Region != "" {
+		keys.Region = overrides.Region
+	}
+	if overrides.Zone != "" {
+		keys.Zone = overrides.Zone
+	}
+	if overrides.InstanceType != "" {
+		keys.InstanceType = overrides.InstanceType
+	}
+	return keys
+}
@@ -0,0 +1,278 @@
+package cloudinfo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Base URLs of the metadata services reachable over IPv4 and IPv6
+const (
+	AWSIMDSIPv4 = "http://169.254.169.254"
+	AWSIMDSIPv6 = "http://[fd00:ec2::254]"
+	GCPIMDSIPv4 = "http://metadata.google.internal"
+	GCPIMDSIPv6 = "http://[fd20:ce::254]"
+	OCIIMDSIPv4 = "http://169.254.169.254"
+	OCIIMDSIPv6 = "http://[fd00:c1::a9fe:a9fe]"
+)
+
+// DefaultEndpointCandidates returns the candidate base URLs of the metadata services available
+// over IPv4 and IPv6, keyed by provider.
+func DefaultEndpointCandidates() map[string][]string {
+	return map[string][]string{
+		"aws": {AWSIMDSIPv4, AWSIMDSIPv6},
+		"gcp": {GCPIMDSIPv4, GCPIMDSIPv6},
+		"oci": {OCIIMDSIPv4, OCIIMDSIPv6},
+	}
+}
+
+// providerEndpoints returns the endpoints of the provider in the configuration.
+func providerEndpoints(config *IMDSConfig, provider string) []*string {
+	switch provider {
+	case "aws":
+		return []*string{
+			&config.AWSTokenEndpoint, &config.AWSEndpoint, &config.AWSCapacityTypeEndpoint,
+			&config.AWSSpotEventsEndpoint, &config.AWSMaintenanceEventsEndpoint, &config.AWSIdentityDocumentEndpoint,
+			&config.AWSHostnameEndpoint, &config.AWSIdentitySignatureEndpoint,
+		}
+	case "gcp":
+		return []*string{
+			&config.GCPEndpoint, &config.GCPCapacityTypeEndpoint, &config.GCPMaintenanceEventEndpoint,
+			&config.GCPProjectIDEndpoint, &config.GCPInstanceEndpoint, &config.GCPIdentityTokenEndpoint,
+		}
+	case "azure":
+		return []*string{
+			&config.AzureEndpoint, &config.AzureCapacityTypeEndpoint, &config.AzureScheduledEventsEndpoint,
+			&config.AzureInstanceEndpoint, &config.AzureAttestedDocumentEndpoint,
+		}
+	case "oci":
+		return []*string{&config.OCIEndpoint}
+	case "alibaba":
+		return []*string{&config.AlibabaEndpoint}
+	case "ibm":
+		return []*string{&config.IBMTokenEndpoint, &config.IBMEndpoint}
+	case "digitalocean":
+		return []*string{&config.DigitalOceanEndpoint}
+	case "hetzner":
+		return []*string{&config.HetznerEndpoint}
+	case "linode":
+		return []*string{&config.LinodeTokenEndpoint, &config.LinodeEndpoint}
+	case "vultr":
+		return []*string{&config.VultrEndpoint}
+	case "scaleway":
+		return []*string{&config.ScalewayEndpoint}
+	case "openstack":
+		return []*string{&config.OpenStackEndpoint}
+	}
+	return nil
+}
+
+// rebaseEndpoints moves the endpoints of the provider from a base URL to another, and makes it the
+// only candidate of the provider. The endpoints are cleared when base is empty.
+func rebaseEndpoints(config *IMDSConfig, provider, from, to string) {
+	for _, endpoint := range providerEndpoints(config, provider) {
+		switch {
+		case to == "":
+			*endpoint = ""
+		case strings.HasPrefix(*endpoint, from):
+			*endpoint = to + strings.TrimPrefix(*endpoint, from)
+		}
+	}
+	candidates := make(map[string][]string, len(config.EndpointCandidates))
+	for p, bases := range config.EndpointCandidates {
+		candidates[p] = bases
+	}
+	if to == "" {
+		delete(candidates, provider)
+	} else {
+		candidates[provider] = []string{to}
+	}
+	config.EndpointCandidates = candidates
+}
+
+// ApplyEnv overrides the endpoints of the configuration with the environment variables of the
+// provider SDKs, read with getenv, e.g. os.Getenv:
+//   - AWS_EC2_METADATA_DISABLED set to "true" disables the AWS endpoints.
+//   - AWS_EC2_METADATA_SERVICE_ENDPOINT replaces the AWS base URL, e.g. "http://[fd00:ec2::254]".
+//   - AWS_EC2_METADATA_SERVICE_ENDPOINT_MODE set to "IPv4" or "IPv6" selects the AWS endpoint of
+//     that address family.
+//   - GCE_METADATA_HOST replaces the GCP host, e.g. "169.254.169.254" or "[fd20:ce::254]".
+//
+// DetectIMDSCloudInfo, DetectIMDSInstanceIdentity, WatchIMDSEvents, DetectVerifiedIMDSCloudInfo,
+// LoadOptions and WithEnv apply it to the default configuration, DefaultIMDSConfig does not.
+func (c IMDSConfig) ApplyEnv(getenv func(string) string) IMDSConfig {
+	awsBase := c.baseURL("aws")
+	switch {
+	case strings.EqualFold(getenv("AWS_EC2_METADATA_DISABLED"), "true"):
+		rebaseEndpoints(&c, "aws", awsBase, "")
+	case getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT") != "":
+		rebaseEndpoints(&c, "aws", awsBase, strings.TrimSuffix(getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "/"))
+	case strings.EqualFold(getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT_MODE"), "IPv6"):
+		rebaseEndpoints(&c, "aws", awsBase, AWSIMDSIPv6)
+	case strings.EqualFold(getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT_MODE"), "IPv4"):
+		rebaseEndpoints(&c, "aws", awsBase, AWSIMDSIPv4)
+	}
+	if host := getenv("GCE_METADATA_HOST"); host != "" {
+		rebaseEndpoints(&c, "gcp", c.baseURL("gcp"), "http://"+host)
+	}
+	return c
+}
+
+// baseURL returns the scheme and host of the provider's first candidate, or of its first endpoint.
+func (c *IMDSConfig) baseURL(provider string) string {
+	if candidates := c.EndpointCandidates[provider]; len(candidates) > 0 {
+		return candidates[0]
+	}
+	return c.endpointBase(provider)
+}
+
+// endpointBase returns the scheme and host of the provider's first endpoint.
+func (c *IMDSConfig) endpointBase(provider string) string {
+	for _, endpoint := range providerEndpoints(c, provider) {
+		if u, err := url.Parse(*endpoint); err == nil && u.Host != "" {
+			return u.Scheme + "://" + u.Host
+		}
+	}
+	return ""
+}
+
+type imdsProviderKey struct{}
+
+// withIMDSProvider returns a context whose IMDS requests are sent to the candidate endpoints of the provider.
+func withIMDSProvider(ctx context.Context, provider string) context.Context {
+	return context.WithValue(ctx, imdsProviderKey{}, provider)
+}
+
+// endpointClient sends the requests of a provider to all its candidate endpoints in parallel
+type endpointClient struct {
+	client     IMDSClient
+	candidates map[string][]string
+
+	mu sync.Mutex
+	// selected is the candidate that answered first, per provider
+	selected map[string]string
+}
+
+// withEndpoints returns the client racing the candidate endpoints, or the client itself when there
+// are no candidates or it already races them.
+func withEndpoints(client IMDSClient, candidates map[string][]string) IMDSClient {
+	if _, ok := client.(*endpointClient); ok || len(candidates) == 0 {
+		return client
+	}
+	return &endpointClient{client: client, candidates: candidates, selected: make(map[string]string)}
+}
+
+// imdsClient returns the client applying the retries and endpoint candidates of the configuration.
+func imdsClient(client IMDSClient, config IMDSConfig) IMDSClient {
+	return withEndpoints(withRetry(client, config.Retry), config.EndpointCandidates)
+}
+
+// Do sends the request to the endpoint that answered the provider's previous requests or, until
+// one has, to all the provider's candidates in parallel, returning the first answer. Requests
+// outside the candidates, or without a provider, are sent as is.
+func (c *endpointClient) Do(req *http.Request) (*http.Response, error) {
+	provider, _ := req.Context().Value(imdsProviderKey{}).(string)
+	candidates := c.candidates[provider]
+	path, ok := "", false
+	for _, base := range candidates {
+		if path, ok = strings.CutPrefix(req.URL.String(), base); ok && (path == "" || strings.HasPrefix(path, "/") || strings.HasPrefix(path, "?")) {
+			break
+		}
+		ok = false
+	}
+	if !ok || len(candidates) < 2 {
+		return c.client.Do(req)
+	}
+
+	c.mu.Lock()
+	selected := c.selected[provider]
+	c.mu.Unlock()
+	if selected != "" {
+		if resp, err := c.send(req.Context(), req, selected+path); err == nil {
+			return resp, nil
+		}
+		// The selected endpoint stopped answering, race the candidates again
+		c.mu.Lock()
+		delete(c.selected, provider)
+		c.mu.Unlock()
+	}
+
+	type answer struct {
+		index int
+		resp  *http.Response
+		err   error
+	}
+	answers := make(chan answer, len(candidates))
+	cancels := make([]context.CancelFunc, len(candidates))
+	for i, base := range candidates {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[i] = cancel
+		go func() {
+			resp, err := c.send(ctx, req, base+path)
+			answers <- answer{index: i, resp: resp, err: err}
+		}()
+	}
+
+	var errs []error
+	for received := 1; received <= len(candidates); received++ {
+		a := <-answers
+		if a.err != nil {
+			cancels[a.index]()
+			errs = append(errs, a.err)
+			continue
+		}
+		c.mu.Lock()
+		c.selected[provider] = candidates[a.index]
+		c.mu.Unlock()
+		// Cancel the other attempts and close their answers. The winner's attempt is cancelled
+		// when its body is closed.
+		for i, cancel := range cancels {
+			if i != a.index {
+				cancel()
+			}
+		}
+		go func(remaining int) {
+			for range remaining {
+				if other := <-answers; other.resp != nil {
+					_ = other.resp.Body.Close()
+				}
+			}
+		}(len(candidates) - received)
+		a.resp.Body = &cancelBody{ReadCloser: a.resp.Body, cancel: cancels[a.index]}
+		return a.resp, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// cancelBody cancels the context of its request when closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// send sends a copy of the request to the URL with the context.
+func (c *endpointClient) send(ctx context.Context, req *http.Request, rawURL string) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	clone := req.Clone(ctx)
+	clone.URL = u
+	clone.Host = ""
+	if req.GetBody != nil {
+		if clone.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return c.client.Do(clone)
+}
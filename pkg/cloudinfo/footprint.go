@@ -0,0 +1,280 @@
+package cloudinfo
+
+import (
+	"context"
+	"embed"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// HardwareLifespanHours is the lifespan over which embodied emissions are amortised (4 years).
+const HardwareLifespanHours = 4 * 365 * 24
+
+//go:embed coefficients/*.csv
+var coefficientsFS embed.FS
+
+// FootprintEstimate represents the estimated power envelope and emissions rates of a cluster
+type FootprintEstimate struct {
+	Provider string
+	Region   string
+
+	// Estimated cluster power draw in watts at idle and at full utilisation
+	MinWatts float64
+	MaxWatts float64
+
+	// Grid carbon intensity of the region in gCO2e/kWh, 0 if the region is unknown
+	GridIntensity float64
+	// Electricity grid zone of the region, empty if the region is unknown
+	GridZone string
+
+	// Operational emissions rate in gCO2e per hour at idle and at full utilisation, PUE included
+	MinOperationalRate float64
+	MaxOperationalRate float64
+
+	// Embodied emissions amortised over the hardware lifespan, in gCO2e per hour
+	EmbodiedRate float64
+
+	// Per-node estimates, in the same order as NodeAttributes.Nodes
+	Nodes []NodeFootprint
+
+	// Instance types missing from the coefficients dataset, estimated with provider averages
+	UnknownInstanceTypes []string
+}
+
+// NodeFootprint represents the estimated power envelope and embodied emissions of a single node
+type NodeFootprint struct {
+	Name         string
+	InstanceType string
+	VCPUs        int64
+	MinWatts     float64
+	MaxWatts     float64
+	EmbodiedRate float64
+}
+
+type providerCoefficients struct {
+	pue      float64
+	minWatts float64
+	maxWatts float64
+	// Average embodied emissions per vCPU of the provider's instances, in kgCO2e
+	embodiedPerVCPU float64
+}
+
+type instanceCoefficients struct {
+	vcpus             int64
+	hostVCPUs         int64
+	microarchitecture string
+	hostEmbodied      float64
+}
+
+type coefficients struct {
+	providers          map[string]providerCoefficients
+	microarchitectures map[string][2]float64
+	instances          map[string]instanceCoefficients // keyed by provider + "/" + instance type
+	regions            map[string]float64              // keyed by provider + "/" + region
+	gridZones          map[string]string               // keyed by provider + "/" + region
+}
+
+var loadCoefficients = sync.OnceValues(func() (*coefficients, error) {
+	c := &coefficients{
+		providers:          make(map[string]providerCoefficients),
+		microarchitectures: make(map[string][2]float64),
+		instances:          make(map[string]instanceCoefficients),
+		regions:            make(map[string]float64),
+		gridZones:          make(map[string]string),
+	}
+
+	err := readCoefficients("providers.csv", 4, func(r []string, f []float64) {
+		c.providers[r[0]] = providerCoefficients{pue: f[1], minWatts: f[2], maxWatts: f[3]}
+	}, 1, 2, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	err = readCoefficients("microarchitectures.csv", 3, func(r []string, f []float64) {
+		c.microarchitectures[r[0]] = [2]float64{f[1], f[2]}
+	}, 1, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	err = readCoefficients("instances.csv", 6, func(r []string, f []float64) {
+		c.instances[r[0]+"/"+r[1]] = instanceCoefficients{
+			vcpus:             int64(f[2]),
+			hostVCPUs:         int64(f[3]),
+			microarchitecture: r[4],
+			hostEmbodied:      f[5],
+		}
+	}, 2, 3, 5)
+	if err != nil {
+		return nil, err
+	}
+
+	// Average the embodied emissions per vCPU of each provider, for unknown instance types
+	counts := make(map[string]int)
+	for key, instance := range c.instances {
+		provider, _, _ := strings.Cut(key, "/")
+		coeffs, ok := c.providers[provider]
+		if !ok || instance.hostVCPUs == 0 {
+			continue
+		}
+		coeffs.embodiedPerVCPU += instance.hostEmbodied / float64(instance.hostVCPUs)
+		c.providers[provider] = coeffs
+		counts[provider]++
+	}
+	for provider, count := range counts {
+		coeffs := c.providers[provider]
+		coeffs.embodiedPerVCPU /= float64(count)
+		c.providers[provider] = coeffs
+	}
+
+	err = readCoefficients("regions.csv", 3, func(r []string, f []float64) {
+		c.regions[r[0]+"/"+r[1]] = f[2]
+	}, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	err = readCoefficients("gridzones.csv", 3, func(r []string, _ []float64) {
+		c.gridZones[r[0]+"/"+r[1]] = r[2]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+})
+
+// readCoefficients reads an embedded CSV file, skipping its header, and parses the numeric columns.
+func readCoefficients(name string, columns int, add func([]string, []float64), numeric ...int) error {
+	file, err := coefficientsFS.Open("coefficients/" + name)
+	if err != nil {
+		return fmt.Errorf("failed to open coefficients %s: %w", name, err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = columns
+	if _, err := reader.Read(); err != nil {
+		return fmt.Errorf("failed to read coefficients %s header: %w", name, err)
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read coefficients %s: %w", name, err)
+		}
+		values := make([]float64, columns)
+		for _, i := range numeric {
+			values[i], err = strconv.ParseFloat(record[i], 64)
+			if err != nil {
+				return fmt.Errorf("invalid value %q in coefficients %s: %w", record[i], name, err)
+			}
+		}
+		add(record, values)
+	}
+}
+
+// GridZone returns the Electricity Maps zone of the electricity grid powering a cloud region,
+// e.g. "US-NW-BPAT" for aws/us-west-2. It returns an empty zone if the region is unknown.
+func GridZone(provider, region string) (string, error) {
+	c, err := loadCoefficients()
+	if err != nil {
+		return "", err
+	}
+	return c.gridZones[provider+"/"+region], nil
+}
+
+// EstimateClusterFootprint estimates the power envelope and emissions rates of the cluster nodes.
+func EstimateClusterFootprint(ctx context.Context, client kubernetes.Interface) (*FootprintEstimate, error) {
+	attributes, err := GetNodeAttributes(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := CloudInfoFromNodeAttributes(attributes, RegionPolicyStrict)
+	if err != nil {
+		return nil, err
+	}
+
+	return EstimateFootprint(info.Provider, info.Region, attributes)
+}
+
+// EstimateFootprint estimates the power envelope and emissions rates of the given nodes
+// running on the given provider and region.
+func EstimateFootprint(provider, region string, attributes *NodeAttributes) (*FootprintEstimate, error) {
+	c, err := loadCoefficients()
+	if err != nil {
+		return nil, err
+	}
+
+	providerCoeffs, ok := c.providers[provider]
+	if !ok {
+		return nil, fmt.Errorf("no coefficients for provider: %s", provider)
+	}
+
+	estimate := &FootprintEstimate{
+		Provider:      provider,
+		Region:        region,
+		GridIntensity: c.regions[provider+"/"+region],
+		GridZone:      c.gridZones[provider+"/"+region],
+	}
+
+	for _, node := range attributes.Nodes {
+		nodeEstimate := NodeFootprint{
+			Name:         node.Name,
+			InstanceType: node.InstanceType,
+			VCPUs:        node.VCPUs,
+			MinWatts:     providerCoeffs.minWatts,
+			MaxWatts:     providerCoeffs.maxWatts,
+		}
+
+		// Without an instance type label the node is estimated with provider averages, but it is
+		// not an unknown instance type
+		instance, known := c.instances[provider+"/"+node.InstanceType]
+		if known {
+			if nodeEstimate.VCPUs == 0 {
+				nodeEstimate.VCPUs = instance.vcpus
+			}
+			if watts, ok := c.microarchitectures[instance.microarchitecture]; ok {
+				nodeEstimate.MinWatts, nodeEstimate.MaxWatts = watts[0], watts[1]
+			}
+			// Embodied emissions are shared between the instances on the host in proportion to vCPUs
+			share := float64(nodeEstimate.VCPUs) / float64(instance.hostVCPUs)
+			nodeEstimate.EmbodiedRate = instance.hostEmbodied * 1000 * share / HardwareLifespanHours
+		} else if node.InstanceType != "" && !slices.Contains(estimate.UnknownInstanceTypes, node.InstanceType) {
+			estimate.UnknownInstanceTypes = append(estimate.UnknownInstanceTypes, node.InstanceType)
+		}
+
+		if nodeEstimate.VCPUs == 0 {
+			return nil, fmt.Errorf("unable to determine vCPU count for node: %s", node.Name)
+		}
+		if !known {
+			nodeEstimate.EmbodiedRate = providerCoeffs.embodiedPerVCPU * 1000 * float64(nodeEstimate.VCPUs) / HardwareLifespanHours
+		}
+
+		// Coefficients are per vCPU
+		nodeEstimate.MinWatts *= float64(nodeEstimate.VCPUs)
+		nodeEstimate.MaxWatts *= float64(nodeEstimate.VCPUs)
+
+		estimate.MinWatts += nodeEstimate.MinWatts
+		estimate.MaxWatts += nodeEstimate.MaxWatts
+		estimate.EmbodiedRate += nodeEstimate.EmbodiedRate
+		estimate.Nodes = append(estimate.Nodes, nodeEstimate)
+	}
+
+	// Convert watts to kWh per hour, scale by PUE and grid intensity
+	estimate.MinOperationalRate = estimate.MinWatts / 1000 * providerCoeffs.pue * estimate.GridIntensity
+	estimate.MaxOperationalRate = estimate.MaxWatts / 1000 * providerCoeffs.pue * estimate.GridIntensity
+
+	return estimate, nil
+}
@@ -0,0 +1,242 @@
+package cloudinfo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// InstanceIdentity represents the identity of the instance as reported by IMDS
+type InstanceIdentity struct {
+	Provider string
+	Region   string
+	Zone     string
+	// AWS account ID, Azure subscription ID or GCP project ID
+	AccountID       string
+	InstanceID      string
+	InstanceType    string
+	ImageID         string
+	PrivateHostname string
+	CapacityType    string
+	// Whether the identity was verified against the provider's signed identity
+	Verified bool
+}
+
+// CloudInfo projects the instance identity to the cloud info returned by IMDS detection.
+func (i *InstanceIdentity) CloudInfo() *CloudInfo {
+	return &CloudInfo{
+		Provider:     i.Provider,
+		Region:       i.Region,
+		Source:       "imds",
+		CapacityType: i.CapacityType,
+		Verified:     i.Verified,
+	}
+}
+
+// DetectIMDSInstanceIdentity detects the instance identity using IMDS, configured like DetectIMDSCloudInfo.
+func DetectIMDSInstanceIdentity(ctx context.Context) (*InstanceIdentity, error) {
+	return DetectIMDSInstanceIdentityWithClient(ctx, DefaultIMDSClient(), envIMDSConfig())
+}
+
+// DetectIMDSInstanceIdentityWithClient detects the instance identity using IMDS with a custom client.
+// The provider is detected as in DetectIMDSCloudInfoWithClient, then its identity endpoints are read.
+func DetectIMDSInstanceIdentityWithClient(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	client = imdsClient(client, config)
+	ctx = withAWSTokenCache(ctx)
+	identity, err := detectIMDSProvider(ctx, client, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := readIMDSIdentity(ctx, client, config, identity); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// ReadIMDSInstanceIdentityWithClient reads the instance identity of the provider detected by IMDS
+// in info. Only the probe of that provider runs, and the identity is verified when verification
+// is not nil.
+func ReadIMDSInstanceIdentityWithClient(ctx context.Context, client IMDSClient, config IMDSConfig, info *CloudInfo, verification *IdentityVerification) (*InstanceIdentity, error) {
+	client = imdsClient(client, config)
+	ctx = withAWSTokenCache(ctx)
+	var probe imdsProbe
+	for _, p := range imdsProbes {
+		if p.provider == info.Provider {
+			probe = p.probe
+		}
+	}
+	if probe == nil {
+		return nil, fmt.Errorf("unsupported IMDS provider: %s", info.Provider)
+	}
+	identity, err := probe(withIMDSProvider(ctx, info.Provider), client, config)
+	if err != nil {
+		return nil, err
+	}
+	if identity.Region != info.Region {
+		return nil, fmt.Errorf("IMDS region %s does not match detected region %s", identity.Region, info.Region)
+	}
+
+	if err := readIMDSIdentity(ctx, client, config, identity); err != nil {
+		return nil, err
+	}
+	if verification != nil {
+		if err := verifyIMDSIdentity(ctx, client, config, *verification, identity); err != nil {
+			return nil, err
+		}
+	}
+	return identity, nil
+}
+
+// readIMDSIdentity completes the partial identity of a probe with the identity endpoints of its provider.
+func readIMDSIdentity(ctx context.Context, client IMDSClient, config IMDSConfig, identity *InstanceIdentity) error {
+	ctx = withIMDSProvider(ctx, identity.Provider)
+	switch identity.Provider {
+	case "aws":
+		return readAWSIdentity(ctx, client, config, identity)
+	case "azure":
+		return readAzureIdentity(ctx, client, config, identity)
+	case "gcp":
+		return readGCPIdentity(ctx, client, config, identity)
+	}
+	return nil
+}
+
+// readIdentityEndpoint reads an identity endpoint, returning nil when the endpoint is not configured.
+func readIdentityEndpoint(ctx context.Context, client IMDSClient, endpoint, header, value, name string) ([]byte, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+	status, body, err := fetchIMDS(ctx, client, endpoint, header, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("failed to read %s: unexpected status %d", name, status)
+	}
+	return body, nil
+}
+
+// readAWSIdentity reads the AWS instance identity document and the private hostname.
+func readAWSIdentity(ctx context.Context, client IMDSClient, config IMDSConfig, identity *InstanceIdentity) error {
+	header, token, _ := awsToken(ctx, client, config)
+	body, err := readIdentityEndpoint(ctx, client, config.AWSIdentityDocumentEndpoint, header, token, "AWS instance identity document")
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		var document struct {
+			AccountID        string `json:"accountId"`
+			AvailabilityZone string `json:"availabilityZone"`
+			ImageID          string `json:"imageId"`
+			InstanceID       string `json:"instanceId"`
+			InstanceType     string `json:"instanceType"`
+		}
+		if err := json.Unmarshal(body, &document); err != nil {
+			return fmt.Errorf("failed to decode AWS instance identity document: %w", err)
+		}
+		if document.AvailabilityZone != "" {
+			if err := ValidateZone(document.AvailabilityZone); err != nil {
+				return err
+			}
+		}
+		identity.AccountID = document.AccountID
+		identity.Zone = document.AvailabilityZone
+		identity.ImageID = document.ImageID
+		identity.InstanceID = document.InstanceID
+		identity.InstanceType = document.InstanceType
+	}
+
+	body, err = readIdentityEndpoint(ctx, client, config.AWSHostnameEndpoint, header, token, "AWS local hostname")
+	if err != nil {
+		return err
+	}
+	identity.PrivateHostname = strings.TrimSpace(string(body))
+	return nil
+}
+
+// readAzureIdentity reads the full Azure instance metadata document.
+func readAzureIdentity(ctx context.Context, client IMDSClient, config IMDSConfig, identity *InstanceIdentity) error {
+	body, err := readIdentityEndpoint(ctx, client, config.AzureInstanceEndpoint, "Metadata", "true", "Azure instance metadata")
+	if err != nil || body == nil {
+		return err
+	}
+
+	var document struct {
+		Compute struct {
+			SubscriptionID string `json:"subscriptionId"`
+			VMID           string `json:"vmId"`
+			VMSize         string `json:"vmSize"`
+			Zone           string `json:"zone"`
+			OSProfile      struct {
+				ComputerName string `json:"computerName"`
+			} `json:"osProfile"`
+			StorageProfile struct {
+				ImageReference struct {
+					ID        string `json:"id"`
+					Publisher string `json:"publisher"`
+					Offer     string `json:"offer"`
+					SKU       string `json:"sku"`
+					Version   string `json:"version"`
+				} `json:"imageReference"`
+			} `json:"storageProfile"`
+		} `json:"compute"`
+	}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return fmt.Errorf("failed to decode Azure instance metadata: %w", err)
+	}
+
+	compute := document.Compute
+	identity.AccountID = compute.SubscriptionID
+	identity.InstanceID = compute.VMID
+	identity.InstanceType = compute.VMSize
+	identity.PrivateHostname = compute.OSProfile.ComputerName
+	// Azure zones are numbers, use the "<location>-<zone>" form of the topology labels
+	if compute.Zone != "" {
+		identity.Zone = identity.Region + "-" + compute.Zone
+		if err := ValidateZone(identity.Zone); err != nil {
+			return err
+		}
+	}
+	image := compute.StorageProfile.ImageReference
+	if image.ID != "" {
+		identity.ImageID = image.ID
+	} else if image.Publisher != "" {
+		identity.ImageID = strings.Join([]string{image.Publisher, image.Offer, image.SKU, image.Version}, ":")
+	}
+	return nil
+}
+
+// readGCPIdentity reads the GCP project ID and the instance attributes.
+func readGCPIdentity(ctx context.Context, client IMDSClient, config IMDSConfig, identity *InstanceIdentity) error {
+	body, err := readIdentityEndpoint(ctx, client, config.GCPProjectIDEndpoint, "Metadata-Flavor", "Google", "GCP project ID")
+	if err != nil {
+		return err
+	}
+	identity.AccountID = strings.TrimSpace(string(body))
+
+	body, err = readIdentityEndpoint(ctx, client, config.GCPInstanceEndpoint, "Metadata-Flavor", "Google", "GCP instance metadata")
+	if err != nil || body == nil {
+		return err
+	}
+	var instance struct {
+		ID          json.Number `json:"id"`
+		Image       string      `json:"image"`
+		Hostname    string      `json:"hostname"`
+		MachineType string      `json:"machineType"`
+	}
+	if err := json.Unmarshal(body, &instance); err != nil {
+		return fmt.Errorf("failed to decode GCP instance metadata: %w", err)
+	}
+	identity.InstanceID = instance.ID.String()
+	identity.ImageID = instance.Image
+	identity.PrivateHostname = instance.Hostname
+	// e.g. "projects/123456789/machineTypes/e2-medium"
+	if instance.MachineType != "" {
+		identity.InstanceType = path.Base(instance.MachineType)
+	}
+	return nil
+}
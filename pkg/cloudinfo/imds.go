@@ -3,11 +3,18 @@ package cloudinfo
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/go-logr/logr"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 // IMDSClient is an interface for making HTTP requests to IMDS endpoints.
@@ -15,107 +22,631 @@ type IMDSClient interface {
 	Do(*http.Request) (*http.Response, error)
 }
 
-// DefaultIMDSClient returns a new HTTP client configured for IMDS requests.
+// DefaultIMDSClient returns a new HTTP client configured for IMDS requests. Metadata services are
+// link-local and accept connections within milliseconds, so connections time out after a second
+// and the candidate endpoints dropped by the network fail fast.
 func DefaultIMDSClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: time.Second}).DialContext
 	return &http.Client{
-		Timeout: 5 * time.Second,
+		Timeout:   5 * time.Second,
+		Transport: transport,
 	}
 }
 
 // IMDSConfig holds the configuration for IMDS endpoints.
 type IMDSConfig struct {
-	AWSEndpoint   string
-	AzureEndpoint string
-	GCPEndpoint   string
+	// AWS IMDSv2 session token endpoint, AWS requests fall back to IMDSv1 when empty
+	AWSTokenEndpoint string
+	AWSEndpoint      string
+	AzureEndpoint    string
+	GCPEndpoint      string
+
+	OCIEndpoint      string
+	AlibabaEndpoint  string
+	IBMTokenEndpoint string
+	IBMEndpoint      string
+
+	DigitalOceanEndpoint string
+	HetznerEndpoint      string
+	LinodeTokenEndpoint  string
+	LinodeEndpoint       string
+	VultrEndpoint        string
+	ScalewayEndpoint     string
+
+	// Private clouds, the region is used when the platform has no region concept
+	OpenStackEndpoint        string
+	OpenStackConfigDrivePath string
+	OpenStackRegion          string
+	VSphereSysVendorPath     string
+	VSphereRPCToolPath       string
+	VSphereRegion            string
+
+	// Capacity type endpoints, skipped when empty
+	AWSCapacityTypeEndpoint   string
+	AzureCapacityTypeEndpoint string
+	GCPCapacityTypeEndpoint   string
+
+	// Event endpoints, used by WatchIMDSEvents
+	AWSSpotEventsEndpoint        string
+	AWSMaintenanceEventsEndpoint string
+	AzureScheduledEventsEndpoint string
+	GCPMaintenanceEventEndpoint  string
+
+	// Instance identity endpoints, used by DetectIMDSInstanceIdentity and skipped when empty
+	AWSIdentityDocumentEndpoint string
+	AWSHostnameEndpoint         string
+	AzureInstanceEndpoint       string
+	GCPProjectIDEndpoint        string
+	GCPInstanceEndpoint         string
+
+	// Signed identity endpoints, used by VerifyIMDSInstanceIdentity
+	AWSIdentitySignatureEndpoint  string
+	AzureAttestedDocumentEndpoint string
+	GCPIdentityTokenEndpoint      string
+
+	// Candidate base URLs of the metadata services per provider, e.g. IPv4 and IPv6. The requests of
+	// a provider to one of its candidates are sent to all of them in parallel, and the first one
+	// to answer is used for the following requests.
+	EndpointCandidates map[string][]string
+	// Retry of the requests answered 429 or 5xx, not retried when zero
+	Retry RetryPolicy
+	// CircuitBreaker skipping the probes of unreachable metadata services, disabled when nil
+	CircuitBreaker *CircuitBreaker
 }
 
-// DefaultIMDSConfig returns the default IMDS configuration.
+// defaultCircuitBreaker is the circuit breaker of the default IMDS configurations, shared so that
+// the detections with the default configuration skip the metadata services found unreachable.
+// Configurations with other endpoints have their own circuits.
+var defaultCircuitBreaker = NewCircuitBreaker(3, time.Minute)
+
+// DefaultIMDSConfig returns the default IMDS configuration, without the endpoint overrides of the
+// environment variables, see ApplyEnv. Its circuit breaker is shared by the default
+// configurations.
 func DefaultIMDSConfig() IMDSConfig {
 	return IMDSConfig{
-		AWSEndpoint:   "http://169.254.169.254/latest/meta-data/placement/region",
-		AzureEndpoint: "http://169.254.169.254/metadata/instance/compute/location?api-version=2021-02-01",
-		GCPEndpoint:   "http://metadata.google.internal/computeMetadata/v1/instance/zone",
+		AWSTokenEndpoint: "http://169.254.169.254/latest/api/token",
+		AWSEndpoint:      "http://169.254.169.254/latest/meta-data/placement/region",
+		AzureEndpoint:    "http://169.254.169.254/metadata/instance/compute/location?api-version=2021-02-01",
+		GCPEndpoint:      "http://metadata.google.internal/computeMetadata/v1/instance/zone",
+
+		OCIEndpoint:      "http://169.254.169.254/opc/v2/instance/",
+		AlibabaEndpoint:  "http://100.100.100.200/latest/meta-data/region-id",
+		IBMTokenEndpoint: "http://api.metadata.cloud.ibm.com/identity/v1/token?version=2022-03-01",
+		IBMEndpoint:      "http://api.metadata.cloud.ibm.com/metadata/v1/instance?version=2022-03-01",
+
+		DigitalOceanEndpoint: "http://169.254.169.254/metadata/v1/region",
+		HetznerEndpoint:      "http://169.254.169.254/hetzner/v1/metadata",
+		LinodeTokenEndpoint:  "http://169.254.169.254/v1/token",
+		LinodeEndpoint:       "http://169.254.169.254/v1/instance",
+		VultrEndpoint:        "http://169.254.169.254/v1.json",
+		ScalewayEndpoint:     "http://169.254.42.42/conf?format=json",
+
+		OpenStackEndpoint:        "http://169.254.169.254/openstack/latest/meta_data.json",
+		OpenStackConfigDrivePath: "/mnt/config",
+		VSphereSysVendorPath:     "/sys/class/dmi/id/sys_vendor",
+		VSphereRPCToolPath:       "vmware-rpctool",
+
+		AWSCapacityTypeEndpoint:   "http://169.254.169.254/latest/meta-data/instance-life-cycle",
+		AzureCapacityTypeEndpoint: "http://169.254.169.254/metadata/instance/compute/priority?api-version=2021-02-01&format=text",
+		GCPCapacityTypeEndpoint:   "http://metadata.google.internal/computeMetadata/v1/instance/scheduling/preemptible",
+
+		AWSSpotEventsEndpoint:        "http://169.254.169.254/latest/meta-data/spot/instance-action",
+		AWSMaintenanceEventsEndpoint: "http://169.254.169.254/latest/meta-data/events/maintenance/scheduled",
+		AzureScheduledEventsEndpoint: "http://169.254.169.254/metadata/scheduledevents?api-version=2020-07-01",
+		GCPMaintenanceEventEndpoint:  "http://metadata.google.internal/computeMetadata/v1/instance/maintenance-event",
+
+		AWSIdentityDocumentEndpoint: "http://169.254.169.254/latest/dynamic/instance-identity/document",
+		AWSHostnameEndpoint:         "http://169.254.169.254/latest/meta-data/local-hostname",
+		AzureInstanceEndpoint:       "http://169.254.169.254/metadata/instance?api-version=2021-02-01",
+		GCPProjectIDEndpoint:        "http://metadata.google.internal/computeMetadata/v1/project/project-id",
+		GCPInstanceEndpoint:         "http://metadata.google.internal/computeMetadata/v1/instance/?recursive=true",
+
+		AWSIdentitySignatureEndpoint:  "http://169.254.169.254/latest/dynamic/instance-identity/rsa2048",
+		AzureAttestedDocumentEndpoint: "http://169.254.169.254/metadata/attested/document?api-version=2020-09-01",
+		GCPIdentityTokenEndpoint:      "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity?format=full",
+
+		EndpointCandidates: DefaultEndpointCandidates(),
+		Retry:              DefaultRetryPolicy(),
+		CircuitBreaker:     defaultCircuitBreaker,
 	}
 }
 
-// DetectIMDSCloudInfo detects cloud provider and region using IMDS.
+// envIMDSConfig returns the default IMDS configuration with the environment of the process
+// applied, the configuration of the detection functions without a client.
+func envIMDSConfig() IMDSConfig {
+	return DefaultIMDSConfig().ApplyEnv(os.Getenv)
+}
+
+// DetectIMDSCloudInfo detects cloud provider and region using IMDS, with the default
+// configuration and the endpoint overrides of the environment.
 func DetectIMDSCloudInfo(ctx context.Context) (*CloudInfo, error) {
-	return DetectIMDSCloudInfoWithClient(ctx, DefaultIMDSClient(), DefaultIMDSConfig())
+	return DetectIMDSCloudInfoWithClient(ctx, DefaultIMDSClient(), envIMDSConfig())
 }
 
 // DetectIMDSCloudInfoWithClient detects cloud provider and region using IMDS with a custom client.
 func DetectIMDSCloudInfoWithClient(ctx context.Context, client IMDSClient, config IMDSConfig) (*CloudInfo, error) {
-	// Try AWS first
-	req, err := http.NewRequestWithContext(ctx, "GET", config.AWSEndpoint, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create AWS IMDS request: %w", err)
-	}
-	resp, err := client.Do(req)
-	if err == nil && resp.StatusCode == http.StatusOK {
-		defer resp.Body.Close()
-		region, err := io.ReadAll(resp.Body)
+	client = imdsClient(client, config)
+	ctx = withAWSTokenCache(ctx)
+	return observeDetection(ctx, "imds", func(ctx context.Context) (*CloudInfo, error) {
+		identity, err := detectIMDSProvider(ctx, client, config)
+		if err != nil {
+			return nil, err
+		}
+		return identity.CloudInfo(), nil
+	})
+}
+
+// errIMDSUnavailable is returned by probes when the provider's metadata service does not answer.
+var errIMDSUnavailable = errors.New("IMDS unavailable")
+
+// imdsProbe detects a single provider. It returns errIMDSUnavailable when the provider's
+// metadata service does not answer, errIMDSUnreachable when it cannot be connected to, an
+// IMDSStatusError when it keeps failing, and any other error when it answers with invalid data.
+type imdsProbe func(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error)
+
+// imdsProbes lists the provider probes in the order they are tried.
+var imdsProbes = []struct {
+	provider string
+	probe    imdsProbe
+}{
+	{"aws", probeAWS},
+	{"azure", probeAzure},
+	{"gcp", probeGCP},
+	{"oci", probeOCI},
+	{"alibaba", probeAlibaba},
+	{"ibm", probeIBM},
+	{"digitalocean", probeDigitalOcean},
+	{"hetzner", probeHetzner},
+	{"linode", probeLinode},
+	{"vultr", probeVultr},
+	{"scaleway", probeScaleway},
+	{"openstack", probeOpenStack},
+	{"vsphere", probeVSphere},
+}
+
+// detectIMDSProvider runs the probes in order and returns the partial identity of the first
+// provider that answers: at least provider and region, plus what its probe endpoint reports.
+func detectIMDSProvider(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	observer := observerFrom(ctx)
+	logger := logr.FromContextOrDiscard(ctx).V(2)
+	var statusErr *IMDSStatusError
+	for _, p := range imdsProbes {
+		base := config.endpointBase(p.provider)
+		if !config.CircuitBreaker.allow(p.provider, base) {
+			logger.Info("IMDS probe skipped", "provider", p.provider, "circuit", CircuitOpen)
+			recordSignal(ctx, Signal{Kind: SignalIMDSProbe, Name: p.provider, Value: "skipped", Discarded: "circuit breaker open"})
+			continue
+		}
+		probeCtx, span := startSpan(withIMDSProvider(ctx, p.provider), "probe "+p.provider, semconv.CloudProviderKey.String(p.provider))
+		start := time.Now()
+		identity, err := p.probe(probeCtx, client, config)
+		if err == nil {
+			if err = ValidateRegion(identity.Region); err != nil {
+				identity = nil
+			}
+		}
+		duration := time.Since(start)
+		observer.ObserveIMDSProbe(p.provider, duration, err)
+		if ctx.Err() == nil {
+			config.CircuitBreaker.record(p.provider, base, err)
+		} else {
+			config.CircuitBreaker.release(p.provider, base)
+		}
+
+		if errors.Is(err, errIMDSUnavailable) {
+			// Reachable metadata services answering errors are reported, the provider is likely right
+			result, discarded := "unavailable", "metadata service did not answer"
+			switch {
+			case errors.As(err, &statusErr):
+				result, discarded = "error", statusErr.Error()
+			case errors.Is(err, errIMDSUnreachable):
+				result = "unreachable"
+			}
+			span.SetAttributes(resultKey.String(result))
+			span.End()
+			logger.Info("IMDS probe "+result, "provider", p.provider, "duration", duration)
+			recordSignal(ctx, Signal{Kind: SignalIMDSProbe, Name: p.provider, Value: result, Discarded: discarded})
+			continue
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to read AWS region: %w", err)
+			span.SetAttributes(resultKey.String("error"))
+			logger.Info("IMDS probe failed", "provider", p.provider, "duration", duration, "error", err.Error())
+			recordSignal(ctx, Signal{Kind: SignalIMDSProbe, Name: p.provider, Value: "error", Discarded: err.Error()})
+		} else {
+			span.SetAttributes(resultKey.String("success"))
+			logger.Info("IMDS probe succeeded", "provider", p.provider, "duration", duration, "region", identity.Region)
+			recordSignal(ctx, Signal{Kind: SignalIMDSProbe, Name: p.provider, Value: identity.Region})
 		}
-		return &CloudInfo{
-			Provider: "aws",
-			Region:   string(region),
-			Source:   "imds",
-		}, nil
+		endSpan(span, nil, err)
+		return identity, err
+	}
+
+	if statusErr != nil {
+		return nil, fmt.Errorf("%w: %w", ErrIMDSNotDetected, statusErr)
 	}
+	return nil, ErrIMDSNotDetected
+}
 
-	// Try Azure next
-	req, err = http.NewRequestWithContext(ctx, "GET", config.AzureEndpoint, nil)
+// probeIMDS performs a GET request against a probe endpoint with the given headers.
+// It returns errIMDSUnavailable when the endpoint is not configured or does not answer 200,
+// errIMDSUnreachable when it is unreachable and an IMDSStatusError when it answers 429 or 5xx.
+func probeIMDS(ctx context.Context, client IMDSClient, endpoint string, headers map[string]string) ([]byte, error) {
+	if endpoint == "" {
+		return nil, errIMDSUnavailable
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Azure IMDS request: %w", err)
+		return nil, fmt.Errorf("failed to create IMDS request: %w", err)
 	}
-	req.Header.Set("Metadata", "true")
-	resp, err = client.Do(req)
-	if err == nil && resp.StatusCode == http.StatusOK {
-		defer resp.Body.Close()
-		var result struct {
-			Location string `json:"location"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-			return nil, fmt.Errorf("failed to decode Azure location: %w", err)
-		}
-		return &CloudInfo{
-			Provider: "azure",
-			Region:   result.Location,
-			Source:   "imds",
-		}, nil
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := doIMDS(client, req)
+	if err != nil {
+		return nil, errIMDSUnreachable
+	}
+	defer resp.Body.Close()
+	if err := checkIMDSStatus(resp); err != nil {
+		return nil, err
 	}
+	return readIMDSBody(resp.Body)
+}
 
-	// Try GCP last
-	req, err = http.NewRequestWithContext(ctx, "GET", config.GCPEndpoint, nil)
+// checkIMDSStatus returns nil for a 200 response, an IMDSStatusError for a 429 or 5xx one and
+// errIMDSUnavailable otherwise.
+func checkIMDSStatus(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case retryableStatus(resp.StatusCode):
+		return &IMDSStatusError{URL: resp.Request.URL.String(), StatusCode: resp.StatusCode}
+	default:
+		return errIMDSUnavailable
+	}
+}
+
+// awsTokenHeader carries the IMDSv2 session token of AWS requests
+const awsTokenHeader = "X-aws-ec2-metadata-token"
+
+// awsTokenTTL is the lifetime of the IMDSv2 session tokens, which are reused until awsTokenRenewal
+// before they expire
+const (
+	awsTokenTTL     = 300 * time.Second
+	awsTokenRenewal = 30 * time.Second
+)
+
+type awsTokenCacheKey struct{}
+
+// awsTokenCache holds the IMDSv2 session token shared by the AWS requests of a detection or an
+// events poller
+type awsTokenCache struct {
+	mu       sync.Mutex
+	endpoint string
+	token    string
+	expires  time.Time
+}
+
+// withAWSTokenCache returns a context whose AWS requests share one session token, unless the
+// context already shares one.
+func withAWSTokenCache(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(awsTokenCacheKey{}).(*awsTokenCache); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, awsTokenCacheKey{}, &awsTokenCache{})
+}
+
+// awsToken obtains an IMDSv2 session token and returns the header and value authenticating AWS
+// requests with it. They are empty, falling back to IMDSv1, when the token endpoint is not
+// configured or does not issue a token. It returns errIMDSUnreachable when the endpoint is unreachable.
+// The token of a context from withAWSTokenCache is reused until it is about to expire.
+func awsToken(ctx context.Context, client IMDSClient, config IMDSConfig) (string, string, error) {
+	if config.AWSTokenEndpoint == "" {
+		return "", "", nil
+	}
+	cache, _ := ctx.Value(awsTokenCacheKey{}).(*awsTokenCache)
+	if cache == nil {
+		return requestAWSToken(ctx, client, config)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.token != "" && cache.endpoint == config.AWSTokenEndpoint && time.Now().Before(cache.expires) {
+		return awsTokenHeader, cache.token, nil
+	}
+	requested := time.Now()
+	header, token, err := requestAWSToken(ctx, client, config)
+	if err == nil && token != "" {
+		cache.endpoint, cache.token, cache.expires = config.AWSTokenEndpoint, token, requested.Add(awsTokenTTL-awsTokenRenewal)
+	}
+	return header, token, err
+}
+
+// requestAWSToken requests a new IMDSv2 session token, see awsToken.
+func requestAWSToken(ctx context.Context, client IMDSClient, config IMDSConfig) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", config.AWSTokenEndpoint, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCP IMDS request: %w", err)
+		return "", "", fmt.Errorf("failed to create AWS token request: %w", err)
 	}
-	req.Header.Set("Metadata-Flavor", "Google")
-	resp, err = client.Do(req)
-	if err == nil && resp.StatusCode == http.StatusOK {
-		defer resp.Body.Close()
-		zone, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read GCP zone: %w", err)
-		}
-		// Extract region from zone (e.g., "projects/123456789/zones/us-central1-a" -> "us-central1")
-		parts := strings.Split(string(zone), "/")
-		if len(parts) < 4 {
-			return nil, fmt.Errorf("invalid GCP zone format: %s", zone)
-		}
-		zoneName := parts[len(parts)-1]
-		regionParts := strings.Split(zoneName, "-")
-		if len(regionParts) < 2 {
-			return nil, fmt.Errorf("invalid GCP zone format: %s", zoneName)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(awsTokenTTL.Seconds())))
+	resp, err := doIMDS(client, req)
+	if err != nil {
+		return "", "", errIMDSUnreachable
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", nil
+	}
+	token, err := readIMDSBody(resp.Body)
+	if err != nil || len(token) == 0 {
+		return "", "", nil
+	}
+	return awsTokenHeader, strings.TrimSpace(string(token)), nil
+}
+
+// probeAWS reads the AWS placement region, with an IMDSv2 session token when one is issued.
+func probeAWS(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	if config.AWSEndpoint == "" {
+		return nil, errIMDSUnavailable
+	}
+	header, token, err := awsToken(ctx, client, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read AWS token: %w", err)
+	}
+	var headers map[string]string
+	if header != "" {
+		headers = map[string]string{header: token}
+	}
+	region, err := probeIMDS(ctx, client, config.AWSEndpoint, headers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read AWS region: %w", err)
+	}
+	return &InstanceIdentity{
+		Provider:     "aws",
+		Region:       string(region),
+		CapacityType: detectIMDSCapacityType(ctx, client, config.AWSCapacityTypeEndpoint, header, token),
+	}, nil
+}
+
+// probeAzure reads the Azure compute location.
+func probeAzure(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	body, err := probeIMDS(ctx, client, config.AzureEndpoint, map[string]string{"Metadata": "true"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Azure location: %w", err)
+	}
+	location, err := ParseAzureLocation(body)
+	if err != nil {
+		return nil, err
+	}
+	return &InstanceIdentity{
+		Provider:     "azure",
+		Region:       location,
+		CapacityType: detectIMDSCapacityType(ctx, client, config.AzureCapacityTypeEndpoint, "Metadata", "true"),
+	}, nil
+}
+
+// probeGCP reads the GCP instance zone.
+func probeGCP(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	zone, err := probeIMDS(ctx, client, config.GCPEndpoint, map[string]string{"Metadata-Flavor": "Google"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GCP zone: %w", err)
+	}
+	zoneName, region, err := ParseGCPZone(string(zone))
+	if err != nil {
+		return nil, err
+	}
+	return &InstanceIdentity{
+		Provider:     "gcp",
+		Region:       region,
+		Zone:         zoneName,
+		CapacityType: detectIMDSCapacityType(ctx, client, config.GCPCapacityTypeEndpoint, "Metadata-Flavor", "Google"),
+	}, nil
+}
+
+// probeOCI reads the OCI instance metadata document, which also carries the instance identity.
+func probeOCI(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	body, err := probeIMDS(ctx, client, config.OCIEndpoint, map[string]string{"Authorization": "Bearer Oracle"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCI instance metadata: %w", err)
+	}
+	var instance struct {
+		CanonicalRegionName string `json:"canonicalRegionName"`
+		AvailabilityDomain  string `json:"availabilityDomain"`
+		CompartmentID       string `json:"compartmentId"`
+		ID                  string `json:"id"`
+		Shape               string `json:"shape"`
+		Image               string `json:"image"`
+		Hostname            string `json:"hostname"`
+	}
+	if err := json.Unmarshal(body, &instance); err != nil {
+		return nil, fmt.Errorf("failed to decode OCI instance metadata: %w", err)
+	}
+	if instance.CanonicalRegionName == "" {
+		return nil, fmt.Errorf("missing OCI canonical region name")
+	}
+	return &InstanceIdentity{
+		Provider:        "oci",
+		Region:          instance.CanonicalRegionName,
+		Zone:            instance.AvailabilityDomain,
+		AccountID:       instance.CompartmentID,
+		InstanceID:      instance.ID,
+		InstanceType:    instance.Shape,
+		ImageID:         instance.Image,
+		PrivateHostname: instance.Hostname,
+		CapacityType:    CapacityTypeUnknown,
+	}, nil
+}
+
+// probeAlibaba reads the Alibaba Cloud region ID.
+func probeAlibaba(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	region, err := probeIMDS(ctx, client, config.AlibabaEndpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Alibaba Cloud region: %w", err)
+	}
+	return &InstanceIdentity{
+		Provider:     "alibaba",
+		Region:       strings.TrimSpace(string(region)),
+		CapacityType: CapacityTypeUnknown,
+	}, nil
+}
+
+// probeIBM obtains an IBM Cloud VPC metadata token and reads the instance document.
+func probeIBM(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	if config.IBMTokenEndpoint == "" || config.IBMEndpoint == "" {
+		return nil, errIMDSUnavailable
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", config.IBMTokenEndpoint, strings.NewReader(`{"expires_in": 300}`))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create IBM Cloud token request: %w", err)
+	}
+	req.Header.Set("Metadata-Flavor", "ibm")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := doIMDS(client, req)
+	if err != nil {
+		return nil, errIMDSUnreachable
+	}
+	defer resp.Body.Close()
+	if err := checkIMDSStatus(resp); err != nil {
+		return nil, err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	body, err := readIMDSBody(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IBM Cloud token: %w", err)
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("failed to decode IBM Cloud token: %w", err)
+	}
+
+	body, err = probeIMDS(ctx, client, config.IBMEndpoint, map[string]string{"Authorization": "Bearer " + token.AccessToken})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IBM Cloud instance metadata: %w", err)
+	}
+	var instance struct {
+		ID   string `json:"id"`
+		CRN  string `json:"crn"`
+		Zone struct {
+			Name string `json:"name"`
+		} `json:"zone"`
+		Profile struct {
+			Name string `json:"name"`
+		} `json:"profile"`
+		Image struct {
+			ID string `json:"id"`
+		} `json:"image"`
+	}
+	if err := json.Unmarshal(body, &instance); err != nil {
+		return nil, fmt.Errorf("failed to decode IBM Cloud instance metadata: %w", err)
+	}
+	// e.g. "us-south-1" -> "us-south"
+	i := strings.LastIndex(instance.Zone.Name, "-")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid IBM Cloud zone format: %s", instance.Zone.Name)
+	}
+	if err := ValidateZone(instance.Zone.Name); err != nil {
+		return nil, err
+	}
+
+	identity := &InstanceIdentity{
+		Provider:     "ibm",
+		Region:       instance.Zone.Name[:i],
+		Zone:         instance.Zone.Name,
+		InstanceID:   instance.ID,
+		InstanceType: instance.Profile.Name,
+		ImageID:      instance.Image.ID,
+		CapacityType: CapacityTypeUnknown,
+	}
+	// e.g. "crn:v1:bluemix:public:is:us-south-1:a/<account>::instance:<id>"
+	for _, part := range strings.Split(instance.CRN, ":") {
+		if account, ok := strings.CutPrefix(part, "a/"); ok {
+			identity.AccountID = account
 		}
-		region := strings.Join(regionParts[:len(regionParts)-1], "-")
-		return &CloudInfo{
-			Provider: "gcp",
-			Region:   region,
-			Source:   "imds",
-		}, nil
 	}
+	return identity, nil
+}
 
-	return nil, fmt.Errorf("failed to detect cloud provider using IMDS")
+// ParseGCPZone extracts the zone and region from a GCP zone path,
+// e.g. "projects/123456789/zones/us-central1-a" -> "us-central1-a", "us-central1".
+func ParseGCPZone(zone string) (string, string, error) {
+	parts := strings.Split(zone, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[1] == "" || parts[2] != "zones" {
+		return "", "", fmt.Errorf("invalid GCP zone format: %q", zone)
+	}
+	zoneName := parts[3]
+	i := strings.LastIndex(zoneName, "-")
+	if i <= 0 || i == len(zoneName)-1 {
+		return "", "", fmt.Errorf("invalid GCP zone format: %q", zoneName)
+	}
+	region := zoneName[:i]
+	if err := ValidateRegion(region); err != nil {
+		return "", "", err
+	}
+	if err := ValidateZone(zoneName); err != nil {
+		return "", "", err
+	}
+	return zoneName, region, nil
+}
+
+// ParseAzureLocation extracts the region from an Azure compute location document,
+// e.g. {"location": "westeurope"} -> "westeurope".
+func ParseAzureLocation(body []byte) (string, error) {
+	var result struct {
+		Location string `json:"location"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("failed to decode Azure location: %w", err)
+	}
+	if err := ValidateRegion(result.Location); err != nil {
+		return "", err
+	}
+	return result.Location, nil
+}
+
+// detectIMDSCapacityType queries a capacity type endpoint, returning CapacityTypeUnknown on any failure.
+func detectIMDSCapacityType(ctx context.Context, client IMDSClient, endpoint, header, value string) string {
+	if endpoint == "" {
+		return CapacityTypeUnknown
+	}
+	status, body, err := fetchIMDS(ctx, client, endpoint, header, value)
+	if err != nil || status != http.StatusOK {
+		return CapacityTypeUnknown
+	}
+
+	// AWS instance-life-cycle: "spot", "on-demand" or "scheduled"
+	// Azure compute/priority: "Spot", "Low" or "Regular"
+	// GCP scheduling/preemptible: "TRUE" or "FALSE"
+	switch strings.ToLower(strings.TrimSpace(string(body))) {
+	case "spot", "low", "true":
+		return CapacityTypeSpot
+	case "on-demand", "scheduled", "regular", "false":
+		return CapacityTypeOnDemand
+	default:
+		return CapacityTypeUnknown
+	}
+}
+
+// fetchIMDS performs a GET request against an IMDS endpoint with an optional header.
+// The body is only read for 200 responses.
+func fetchIMDS(ctx context.Context, client IMDSClient, endpoint, header, value string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	resp, err := doIMDS(client, req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil, nil
+	}
+	body, err := readIMDSBody(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	return resp.StatusCode, body, nil
 }
@@ -0,0 +1,269 @@
+package cloudinfo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// IMDSEventType is the kind of disruption announced by an IMDS event
+type IMDSEventType string
+
+const (
+	// IMDSEventSpotInterruption announces the reclaim of a spot or preemptible instance
+	IMDSEventSpotInterruption IMDSEventType = "spot-interruption"
+	// IMDSEventMaintenance announces a scheduled maintenance (reboot, migration, redeploy, ...)
+	IMDSEventMaintenance IMDSEventType = "maintenance"
+)
+
+// IMDSEventStatus is the lifecycle stage of an IMDS event
+type IMDSEventStatus string
+
+const (
+	// IMDSEventScheduled is used for events announced but not yet started
+	IMDSEventScheduled IMDSEventStatus = "scheduled"
+	// IMDSEventStarted is used for events in progress
+	IMDSEventStarted IMDSEventStatus = "started"
+	// IMDSEventCompleted is used for events that completed, were cancelled or are no longer reported
+	IMDSEventCompleted IMDSEventStatus = "completed"
+)
+
+// DefaultIMDSEventInterval is the default polling interval of WatchIMDSEvents.
+const DefaultIMDSEventInterval = 5 * time.Second
+
+// IMDSEvent represents a spot interruption or maintenance event reported by IMDS
+type IMDSEvent struct {
+	Provider string
+	Type     IMDSEventType
+	Status   IMDSEventStatus
+	// Provider event ID, stable across the event lifecycle
+	ID string
+	// Provider-specific action, e.g. "terminate", "system-reboot", "Preempt", "MIGRATE_ON_HOST_MAINTENANCE"
+	Action      string
+	Description string
+	// Earliest time the event may start, zero if not reported
+	NotBefore time.Time
+}
+
+// WatchIMDSEvents polls the IMDS event endpoints of the given provider and emits events
+// on the returned channel until the context is cancelled. It is configured like DetectIMDSCloudInfo.
+func WatchIMDSEvents(ctx context.Context, provider string, interval time.Duration) (<-chan IMDSEvent, error) {
+	return WatchIMDSEventsWithClient(ctx, provider, interval, DefaultIMDSClient(), envIMDSConfig())
+}
+
+// WatchIMDSEventsWithClient polls the IMDS event endpoints of the given provider with a custom client.
+// An event is emitted when it first appears, when its status changes, and with the completed status
+// when it is no longer reported. Failed polls are skipped. The channel is closed when the context is cancelled.
+func WatchIMDSEventsWithClient(ctx context.Context, provider string, interval time.Duration, client IMDSClient, config IMDSConfig) (<-chan IMDSEvent, error) {
+	client = imdsClient(client, config)
+	var poll func(context.Context, IMDSClient, IMDSConfig) ([]IMDSEvent, error)
+	switch provider {
+	case "aws":
+		poll = pollAWSEvents
+	case "azure":
+		poll = pollAzureEvents
+	case "gcp":
+		poll = pollGCPEvents
+	default:
+		return nil, fmt.Errorf("IMDS events not supported for provider: %s", provider)
+	}
+	if interval <= 0 {
+		interval = DefaultIMDSEventInterval
+	}
+	ctx = withAWSTokenCache(withIMDSProvider(ctx, provider))
+
+	events := make(chan IMDSEvent)
+	go func() {
+		defer close(events)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		known := make(map[string]IMDSEvent)
+		for {
+			if current, err := poll(ctx, client, config); err == nil {
+				for _, event := range diffIMDSEvents(known, current) {
+					select {
+					case events <- event:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// diffIMDSEvents updates the known events with the current poll and returns the events to emit.
+func diffIMDSEvents(known map[string]IMDSEvent, current []IMDSEvent) []IMDSEvent {
+	var changed []IMDSEvent
+	seen := make(map[string]struct{}, len(current))
+	for _, event := range current {
+		seen[event.ID] = struct{}{}
+		if previous, ok := known[event.ID]; ok && previous.Status == event.Status {
+			continue
+		}
+		changed = append(changed, event)
+		known[event.ID] = event
+	}
+	for id, event := range known {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		if event.Status != IMDSEventCompleted {
+			event.Status = IMDSEventCompleted
+			changed = append(changed, event)
+		}
+		delete(known, id)
+	}
+	return changed
+}
+
+// pollAWSEvents reads the spot instance action and the scheduled maintenance events.
+func pollAWSEvents(ctx context.Context, client IMDSClient, config IMDSConfig) ([]IMDSEvent, error) {
+	var events []IMDSEvent
+	header, token, _ := awsToken(ctx, client, config)
+
+	// spot/instance-action returns 404 until an interruption is scheduled
+	status, body, err := fetchIMDS(ctx, client, config.AWSSpotEventsEndpoint, header, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read AWS spot instance action: %w", err)
+	}
+	if status == http.StatusOK {
+		var action struct {
+			Action string `json:"action"`
+			Time   string `json:"time"`
+		}
+		if err := json.Unmarshal(body, &action); err != nil {
+			return nil, fmt.Errorf("failed to decode AWS spot instance action: %w", err)
+		}
+		notBefore, _ := time.Parse(time.RFC3339, action.Time)
+		events = append(events, IMDSEvent{
+			Provider:  "aws",
+			Type:      IMDSEventSpotInterruption,
+			Status:    IMDSEventScheduled,
+			ID:        "spot-instance-action",
+			Action:    action.Action,
+			NotBefore: notBefore,
+		})
+	} else if status != http.StatusNotFound {
+		return nil, fmt.Errorf("unexpected AWS spot instance action status: %d", status)
+	}
+
+	status, body, err = fetchIMDS(ctx, client, config.AWSMaintenanceEventsEndpoint, header, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read AWS scheduled events: %w", err)
+	}
+	if status == http.StatusNotFound {
+		return events, nil
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("unexpected AWS scheduled events status: %d", status)
+	}
+	var scheduled []struct {
+		EventID     string `json:"EventId"`
+		Code        string `json:"Code"`
+		Description string `json:"Description"`
+		NotBefore   string `json:"NotBefore"`
+		State       string `json:"State"`
+	}
+	if err := json.Unmarshal(body, &scheduled); err != nil {
+		return nil, fmt.Errorf("failed to decode AWS scheduled events: %w", err)
+	}
+	for _, e := range scheduled {
+		event := IMDSEvent{
+			Provider:    "aws",
+			Type:        IMDSEventMaintenance,
+			Status:      IMDSEventScheduled,
+			ID:          e.EventID,
+			Action:      e.Code,
+			Description: e.Description,
+		}
+		// e.g. "21 Jan 2019 09:00:43 GMT"
+		event.NotBefore, _ = time.Parse("2 Jan 2006 15:04:05 MST", e.NotBefore)
+		if e.State == "completed" || e.State == "canceled" {
+			event.Status = IMDSEventCompleted
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// pollAzureEvents reads the Azure Scheduled Events document.
+func pollAzureEvents(ctx context.Context, client IMDSClient, config IMDSConfig) ([]IMDSEvent, error) {
+	status, body, err := fetchIMDS(ctx, client, config.AzureScheduledEventsEndpoint, "Metadata", "true")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Azure scheduled events: %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("unexpected Azure scheduled events status: %d", status)
+	}
+	var document struct {
+		Events []struct {
+			EventID     string `json:"EventId"`
+			EventType   string `json:"EventType"`
+			EventStatus string `json:"EventStatus"`
+			NotBefore   string `json:"NotBefore"`
+			Description string `json:"Description"`
+		} `json:"Events"`
+	}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil, fmt.Errorf("failed to decode Azure scheduled events: %w", err)
+	}
+
+	events := make([]IMDSEvent, 0, len(document.Events))
+	for _, e := range document.Events {
+		event := IMDSEvent{
+			Provider:    "azure",
+			Type:        IMDSEventMaintenance,
+			Status:      IMDSEventScheduled,
+			ID:          e.EventID,
+			Action:      e.EventType,
+			Description: e.Description,
+		}
+		if e.EventType == "Preempt" {
+			event.Type = IMDSEventSpotInterruption
+		}
+		if e.EventStatus == "Started" {
+			event.Status = IMDSEventStarted
+		}
+		// e.g. "Mon, 19 Sep 2016 18:29:47 GMT", empty once started
+		event.NotBefore, _ = time.Parse(time.RFC1123, e.NotBefore)
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// pollGCPEvents reads the GCP maintenance event, "NONE" when no maintenance is pending.
+func pollGCPEvents(ctx context.Context, client IMDSClient, config IMDSConfig) ([]IMDSEvent, error) {
+	status, body, err := fetchIMDS(ctx, client, config.GCPMaintenanceEventEndpoint, "Metadata-Flavor", "Google")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GCP maintenance event: %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("unexpected GCP maintenance event status: %d", status)
+	}
+
+	action := strings.TrimSpace(string(body))
+	if action == "" || action == "NONE" {
+		return nil, nil
+	}
+	return []IMDSEvent{{
+		Provider: "gcp",
+		Type:     IMDSEventMaintenance,
+		Status:   IMDSEventScheduled,
+		ID:       "maintenance-event",
+		Action:   action,
+	}}, nil
+}
@@ -0,0 +1,167 @@
+package cloudinfo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// probeDigitalOcean reads the DigitalOcean droplet region.
+func probeDigitalOcean(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	region, err := probeIMDS(ctx, client, config.DigitalOceanEndpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DigitalOcean region: %w", err)
+	}
+	return &InstanceIdentity{
+		Provider:     "digitalocean",
+		Region:       strings.TrimSpace(string(region)),
+		CapacityType: CapacityTypeUnknown,
+	}, nil
+}
+
+// probeHetzner reads the Hetzner Cloud metadata document. The region is the server location
+// (e.g. "fsn1"), as in the node labels set by the Hetzner cloud controller manager.
+func probeHetzner(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	body, err := probeIMDS(ctx, client, config.HetznerEndpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Hetzner metadata: %w", err)
+	}
+	// The document is YAML
+	var metadata struct {
+		AvailabilityZone string `json:"availability-zone"`
+		InstanceID       int64  `json:"instance-id"`
+		Hostname         string `json:"hostname"`
+	}
+	if err := yaml.Unmarshal(body, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode Hetzner metadata: %w", err)
+	}
+	// e.g. "fsn1-dc14" -> "fsn1"
+	location, _, ok := strings.Cut(metadata.AvailabilityZone, "-")
+	if !ok || location == "" {
+		return nil, fmt.Errorf("invalid Hetzner availability zone format: %s", metadata.AvailabilityZone)
+	}
+	return &InstanceIdentity{
+		Provider:        "hetzner",
+		Region:          location,
+		Zone:            metadata.AvailabilityZone,
+		InstanceID:      strconv.FormatInt(metadata.InstanceID, 10),
+		PrivateHostname: metadata.Hostname,
+		CapacityType:    CapacityTypeUnknown,
+	}, nil
+}
+
+// probeLinode obtains a Linode metadata token and reads the instance document.
+func probeLinode(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	if config.LinodeTokenEndpoint == "" || config.LinodeEndpoint == "" {
+		return nil, errIMDSUnavailable
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", config.LinodeTokenEndpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Linode token request: %w", err)
+	}
+	req.Header.Set("Metadata-Token-Expiry-Seconds", "300")
+	resp, err := doIMDS(client, req)
+	if err != nil {
+		return nil, errIMDSUnreachable
+	}
+	defer resp.Body.Close()
+	if err := checkIMDSStatus(resp); err != nil {
+		return nil, err
+	}
+	token, err := readIMDSBody(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Linode token: %w", err)
+	}
+
+	body, err := probeIMDS(ctx, client, config.LinodeEndpoint, map[string]string{
+		"Metadata-Token": strings.TrimSpace(string(token)),
+		"Accept":         "application/json",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Linode instance metadata: %w", err)
+	}
+	var instance struct {
+		ID     int64  `json:"id"`
+		Label  string `json:"label"`
+		Region string `json:"region"`
+		Type   string `json:"type"`
+	}
+	if err := json.Unmarshal(body, &instance); err != nil {
+		return nil, fmt.Errorf("failed to decode Linode instance metadata: %w", err)
+	}
+	return &InstanceIdentity{
+		Provider:        "linode",
+		Region:          instance.Region,
+		InstanceID:      strconv.FormatInt(instance.ID, 10),
+		InstanceType:    instance.Type,
+		PrivateHostname: instance.Label,
+		CapacityType:    CapacityTypeUnknown,
+	}, nil
+}
+
+// probeVultr reads the Vultr metadata document.
+func probeVultr(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	body, err := probeIMDS(ctx, client, config.VultrEndpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Vultr metadata: %w", err)
+	}
+	var metadata struct {
+		InstanceV2ID string `json:"instance-v2-id"`
+		Hostname     string `json:"hostname"`
+		Region       struct {
+			RegionCode string `json:"regioncode"`
+		} `json:"region"`
+	}
+	if err := json.Unmarshal(body, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode Vultr metadata: %w", err)
+	}
+	return &InstanceIdentity{
+		Provider: "vultr",
+		// Region codes are upper case in the metadata ("EWR") and lower case in the API ("ewr")
+		Region:          strings.ToLower(metadata.Region.RegionCode),
+		InstanceID:      metadata.InstanceV2ID,
+		PrivateHostname: metadata.Hostname,
+		CapacityType:    CapacityTypeUnknown,
+	}, nil
+}
+
+// probeScaleway reads the Scaleway instance metadata document.
+func probeScaleway(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	body, err := probeIMDS(ctx, client, config.ScalewayEndpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Scaleway metadata: %w", err)
+	}
+	var metadata struct {
+		ID             string `json:"id"`
+		Hostname       string `json:"hostname"`
+		CommercialType string `json:"commercial_type"`
+		Project        string `json:"project"`
+		Zone           string `json:"zone"`
+	}
+	if err := json.Unmarshal(body, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode Scaleway metadata: %w", err)
+	}
+	// e.g. "fr-par-1" -> "fr-par"
+	i := strings.LastIndex(metadata.Zone, "-")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid Scaleway zone format: %s", metadata.Zone)
+	}
+	if err := ValidateZone(metadata.Zone); err != nil {
+		return nil, err
+	}
+	return &InstanceIdentity{
+		Provider:        "scaleway",
+		Region:          metadata.Zone[:i],
+		Zone:            metadata.Zone,
+		AccountID:       metadata.Project,
+		InstanceID:      metadata.ID,
+		InstanceType:    metadata.CommercialType,
+		PrivateHostname: metadata.Hostname,
+		CapacityType:    CapacityTypeUnknown,
+	}, nil
+}
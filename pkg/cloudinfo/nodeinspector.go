@@ -6,6 +6,8 @@ import (
 	"slices"
 	"strings"
 
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
@@ -13,6 +15,35 @@ import (
 const (
 	// RegionLabel is the label key for the region of the node
 	RegionLabel = "topology.kubernetes.io/region"
+	// ZoneLabel is the label key for the zone of the node
+	ZoneLabel = "topology.kubernetes.io/zone"
+	// InstanceTypeLabel is the label key for the instance type of the node
+	InstanceTypeLabel = "node.kubernetes.io/instance-type"
+
+	// EKSCapacityTypeLabel is the EKS managed node group capacity type label ("ON_DEMAND" or "SPOT")
+	EKSCapacityTypeLabel = "eks.amazonaws.com/capacityType"
+	// KarpenterCapacityTypeLabel is the Karpenter capacity type label ("on-demand", "spot" or "reserved")
+	KarpenterCapacityTypeLabel = "karpenter.sh/capacity-type"
+	// GKESpotLabel is set to "true" on GKE Spot VM nodes
+	GKESpotLabel = "cloud.google.com/gke-spot"
+	// GKEPreemptibleLabel is set to "true" on GKE preemptible VM nodes
+	GKEPreemptibleLabel = "cloud.google.com/gke-preemptible"
+	// AKSScaleSetPriorityLabel is the AKS node pool priority label ("spot" or "regular")
+	AKSScaleSetPriorityLabel = "kubernetes.azure.com/scalesetpriority"
+
+	// EKSNodeGroupLabel is the node group label of EKS managed nodes
+	EKSNodeGroupLabel = "eks.amazonaws.com/nodegroup"
+	// GKENodePoolLabel is the node pool label of GKE nodes
+	GKENodePoolLabel = "cloud.google.com/gke-nodepool"
+	// AKSAgentPoolLabel is the agent pool label of AKS nodes
+	AKSAgentPoolLabel = "kubernetes.azure.com/agentpool"
+)
+
+// Managed Kubernetes platforms reported in NodeInfo.Platform
+const (
+	PlatformAWSEKS = "aws_eks"
+	PlatformGKE    = "gcp_kubernetes_engine"
+	PlatformAKS    = "azure_aks"
 )
 
 // NodeAttributes represents the attributes of the nodes in the cluster
@@ -22,17 +53,93 @@ type NodeAttributes struct {
 
 	// List of provider IDs found on nodes
 	ProviderIDs []string
+
+	// Per-node details, in the order returned by the API server
+	Nodes []NodeInfo
+
+	// Node counts by region and capacity type
+	CapacityTypeCounts map[string]map[string]int
+}
+
+// NodeInfo represents the attributes of a single node
+type NodeInfo struct {
+	Name         string
+	ProviderID   string
+	Region       string
+	Zone         string
+	InstanceType string
+	CapacityType string
+	// Managed Kubernetes platform from the node pool label, empty for self-managed nodes
+	Platform string
+	// Number of vCPUs reported in the node capacity, 0 if unknown
+	VCPUs int64
+}
+
+// LabelKeys are the node label keys read by node label detection
+type LabelKeys struct {
+	Region       string `json:"region,omitempty"`
+	Zone         string `json:"zone,omitempty"`
+	InstanceType string `json:"instanceType,omitempty"`
+}
+
+// DefaultLabelKeys returns the well-known region, zone and instance type label keys.
+func DefaultLabelKeys() LabelKeys {
+	return LabelKeys{Region: RegionLabel, Zone: ZoneLabel, InstanceType: InstanceTypeLabel}
+}
+
+// withDefaults returns the keys with the empty ones set to their default.
+func (k LabelKeys) withDefaults() LabelKeys {
+	return overrideLabelKeys(DefaultLabelKeys(), k)
+}
+
+// RegionPolicy selects the region of a cluster whose nodes span several regions
+type RegionPolicy string
+
+const (
+	// RegionPolicyStrict fails with ErrMultipleRegions, the default
+	RegionPolicyStrict RegionPolicy = "strict"
+	// RegionPolicyMajority selects the region of the most nodes, ties going to the region listed first
+	RegionPolicyMajority RegionPolicy = "majority"
+)
+
+// NodeConfig configures node label detection. The zero value uses the default label keys and
+// the strict region policy.
+type NodeConfig struct {
+	LabelKeys    LabelKeys
+	RegionPolicy RegionPolicy
 }
 
 // DetectNodeCloudInfo detects cloud provider and region using node labels and spec.ProviderID.
 func DetectNodeCloudInfo(ctx context.Context, client kubernetes.Interface) (*CloudInfo, error) {
-	// Get node attributes
-	attributes, err := GetNodeAttributes(ctx, client)
+	return DetectNodeCloudInfoWithConfig(ctx, client, NodeConfig{})
+}
 
-	if err != nil {
-		return nil, err
-	}
+// DetectNodeCloudInfoWithConfig detects cloud provider and region using custom node label keys
+// and region policy.
+func DetectNodeCloudInfoWithConfig(ctx context.Context, client kubernetes.Interface, config NodeConfig) (*CloudInfo, error) {
+	info, _, err := detectNodeCloudInfo(ctx, client, config)
+	return info, err
+}
+
+// detectNodeCloudInfo detects cloud provider and region using node labels, and returns the node
+// attributes it read, even when detection fails.
+func detectNodeCloudInfo(ctx context.Context, client kubernetes.Interface, config NodeConfig) (info *CloudInfo, attributes *NodeAttributes, err error) {
+	info, err = observeDetection(ctx, "node-labels", func(ctx context.Context) (*CloudInfo, error) {
+		// Get node attributes
+		attributes, err = GetNodeAttributesWithConfig(ctx, client, config)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return CloudInfoFromNodeAttributes(attributes, config.RegionPolicy)
+	})
+	return info, attributes, err
+}
 
+// CloudInfoFromNodeAttributes derives a single provider and region from node attributes, e.g.
+// read once with GetNodeAttributesWithConfig, using the region policy.
+func CloudInfoFromNodeAttributes(attributes *NodeAttributes, policy RegionPolicy) (*CloudInfo, error) {
 	// Parse provider from provider IDs
 	provider, err := ParseProviderIDs(attributes.ProviderIDs)
 
@@ -40,35 +147,68 @@ func DetectNodeCloudInfo(ctx context.Context, client kubernetes.Interface) (*Clo
 		return nil, err
 	}
 
-	// Check that only one region is found
-	if len(attributes.Regions) != 1 {
-		return nil, fmt.Errorf("multiple regions found: %v", attributes.Regions)
+	region := ""
+	switch {
+	case len(attributes.Regions) == 1:
+		region = attributes.Regions[0]
+	case len(attributes.Regions) > 1 && policy == RegionPolicyMajority:
+		region = majorityRegion(attributes)
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrMultipleRegions, attributes.Regions)
 	}
 
 	return &CloudInfo{
 		Provider: provider,
-		Region:   attributes.Regions[0],
+		Region:   region,
 		Source:   "node-labels",
 	}, nil
 }
 
+// majorityRegion returns the region of the most nodes, the first listed one on ties.
+func majorityRegion(attributes *NodeAttributes) string {
+	counts := make(map[string]int)
+	for _, node := range attributes.Nodes {
+		counts[node.Region]++
+	}
+	majority := attributes.Regions[0]
+	for _, region := range attributes.Regions[1:] {
+		if counts[region] > counts[majority] {
+			majority = region
+		}
+	}
+	return majority
+}
+
 // GetNodeAttributes retrieves nodes and their attributes from the Kubernetes cluster.
 func GetNodeAttributes(ctx context.Context, client kubernetes.Interface) (*NodeAttributes, error) {
+	return GetNodeAttributesWithConfig(ctx, client, NodeConfig{})
+}
+
+// GetNodeAttributesWithConfig retrieves nodes and their attributes from the Kubernetes cluster,
+// reading the label keys of the configuration.
+func GetNodeAttributesWithConfig(ctx context.Context, client kubernetes.Interface, config NodeConfig) (attributes *NodeAttributes, err error) {
+	keys := config.LabelKeys.withDefaults()
+	ctx, span := startSpan(ctx, "list nodes")
+	defer func() { endSpan(span, nil, err) }()
+
 	// Get node list
 	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
+	span.SetAttributes(nodesKey.Int(len(nodes.Items)))
 
 	if len(nodes.Items) == 0 {
-		return nil, fmt.Errorf("no nodes found")
+		return nil, ErrNoNodes
 	}
 
-	attributes := &NodeAttributes{}
+	attributes = &NodeAttributes{
+		CapacityTypeCounts: make(map[string]map[string]int),
+	}
 
 	// Get unique regions and provider IDs
 	for _, node := range nodes.Items {
-		regionLabel := node.Labels[RegionLabel]
+		regionLabel := node.Labels[keys.Region]
 		providerID := node.Spec.ProviderID
 
 		if regionLabel != "" && !slices.Contains(attributes.Regions, regionLabel) {
@@ -77,32 +217,97 @@ func GetNodeAttributes(ctx context.Context, client kubernetes.Interface) (*NodeA
 		if providerID != "" {
 			attributes.ProviderIDs = append(attributes.ProviderIDs, providerID)
 		}
+
+		info := NodeInfo{
+			Name:         node.Name,
+			ProviderID:   providerID,
+			Region:       regionLabel,
+			Zone:         node.Labels[keys.Zone],
+			InstanceType: node.Labels[keys.InstanceType],
+			CapacityType: NodeCapacityType(node.Labels),
+			Platform:     NodePlatform(node.Labels),
+		}
+		if cpu, ok := node.Status.Capacity[corev1.ResourceCPU]; ok {
+			info.VCPUs = cpu.Value()
+		}
+		attributes.Nodes = append(attributes.Nodes, info)
+
+		if attributes.CapacityTypeCounts[regionLabel] == nil {
+			attributes.CapacityTypeCounts[regionLabel] = make(map[string]int)
+		}
+		attributes.CapacityTypeCounts[regionLabel][info.CapacityType]++
 	}
 
+	span.SetAttributes(regionsKey.StringSlice(attributes.Regions))
+	logr.FromContextOrDiscard(ctx).V(1).Info("listed nodes", "nodes", len(nodes.Items), "providerIDs", len(attributes.ProviderIDs), "regions", attributes.Regions)
+	observerFrom(ctx).ObserveNodes(attributes)
+	reportNodes(ctx, attributes, keys.Region)
 	return attributes, nil
 }
 
+// NodeCapacityType returns the capacity type of a node from its labels.
+func NodeCapacityType(labels map[string]string) string {
+	switch strings.ToLower(labels[KarpenterCapacityTypeLabel]) {
+	case "spot":
+		return CapacityTypeSpot
+	case "on-demand", "reserved":
+		return CapacityTypeOnDemand
+	}
+
+	switch labels[EKSCapacityTypeLabel] {
+	case "SPOT":
+		return CapacityTypeSpot
+	case "ON_DEMAND":
+		return CapacityTypeOnDemand
+	}
+
+	if labels[GKESpotLabel] == "true" || labels[GKEPreemptibleLabel] == "true" {
+		return CapacityTypeSpot
+	}
+
+	switch strings.ToLower(labels[AKSScaleSetPriorityLabel]) {
+	case "spot":
+		return CapacityTypeSpot
+	case "regular":
+		return CapacityTypeOnDemand
+	}
+
+	return CapacityTypeUnknown
+}
+
+// NodePlatform returns the managed Kubernetes platform of a node from its node pool label, or an
+// empty string for self-managed nodes.
+func NodePlatform(labels map[string]string) string {
+	switch {
+	case labels[EKSNodeGroupLabel] != "":
+		return PlatformAWSEKS
+	case labels[GKENodePoolLabel] != "":
+		return PlatformGKE
+	case labels[AKSAgentPoolLabel] != "":
+		return PlatformAKS
+	}
+	return ""
+}
+
 // ParseProviderIDs parses a list of provider IDs and returns the unique cloud provider names.
 func ParseProviderIDs(providerIDs []string) (string, error) {
+	if len(providerIDs) == 0 {
+		return "", fmt.Errorf("no provider IDs")
+	}
 	providers := make(map[string]struct{})
 	for _, providerID := range providerIDs {
-		switch {
-		case strings.HasPrefix(providerID, "aws://"):
-			providers["aws"] = struct{}{}
-		case strings.HasPrefix(providerID, "azure://"):
-			providers["azure"] = struct{}{}
-		case strings.HasPrefix(providerID, "gce://"):
-			providers["gcp"] = struct{}{}
-		default:
+		provider, err := ParseProviderID(providerID)
+		if err != nil {
 			return "", fmt.Errorf("provider ID format unknown: %s", providerID)
 		}
+		providers[provider] = struct{}{}
 	}
 	result := make([]string, 0, len(providers))
 	for p := range providers {
 		result = append(result, p)
 	}
 	if len(result) > 1 {
-		return "", fmt.Errorf("multiple cloud providers found: %s", strings.Join(result, ", "))
+		return "", fmt.Errorf("%w: %s", ErrMultipleProviders, strings.Join(result, ", "))
 	}
 	return result[0], nil
 }
@@ -125,6 +330,10 @@ func ParseProviderID(providerID string) (string, error) {
 		return "azure", nil
 	case "gce":
 		return "gcp", nil
+	case "openstack":
+		return "openstack", nil
+	case "vsphere":
+		return "vsphere", nil
 	default:
 		return "", fmt.Errorf("unknown provider ID format: %s", providerID)
 	}
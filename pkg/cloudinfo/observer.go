@@ -0,0 +1,150 @@
+package cloudinfo
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Sentinel errors of the detectors, for use with errors.Is
+var (
+	// ErrNoNodes is returned by node label detection when the cluster has no nodes
+	ErrNoNodes = errors.New("no nodes found")
+	// ErrMultipleRegions is returned by node label detection when nodes span several regions
+	ErrMultipleRegions = errors.New("multiple regions found")
+	// ErrMultipleProviders is returned when provider IDs span several cloud providers
+	ErrMultipleProviders = errors.New("multiple cloud providers found")
+	// ErrIMDSNotDetected is returned by IMDS detection when no provider answers
+	ErrIMDSNotDetected = errors.New("failed to detect cloud provider using IMDS")
+	// ErrRuntimeNotDetected is returned by runtime detection when no platform is detected
+	ErrRuntimeNotDetected = errors.New("failed to detect serverless or container runtime")
+	// ErrConflict is returned by DetectCloudInfo when detectors disagree and Options.FailOnConflict is set
+	ErrConflict = errors.New("detectors disagree")
+	// ErrInvalidRegion is returned when a detector reads a region that fails ValidateRegion
+	ErrInvalidRegion = errors.New("invalid region")
+	// ErrInvalidZone is returned when a detector reads a zone that fails ValidateZone
+	ErrInvalidZone = errors.New("invalid zone")
+	// ErrInvalidOptions is returned by Options.Validate, NewOptions and DetectCloudInfo for invalid options
+	ErrInvalidOptions = errors.New("invalid options")
+)
+
+// Observer receives detection events, e.g. to record metrics. Observers are attached to the
+// context passed to the detection functions with WithObserver.
+type Observer interface {
+	// ObserveDetection is called after each attempt of a detector, named after the CloudInfo
+	// source ("node-labels", "imds", "imds-verified" or "runtime"). info is nil on failure.
+	ObserveDetection(detector string, info *CloudInfo, duration time.Duration, err error)
+	// ObserveIMDSProbe is called after each IMDS provider probe. err is nil when the provider
+	// answered, and ErrorType(err) is "unavailable" when it did not, "unreachable" when it could
+	// not be connected to and "imds_error" when it kept answering 429 or 5xx.
+	ObserveIMDSProbe(provider string, duration time.Duration, err error)
+	// ObserveNodes is called with the node attributes read from the cluster.
+	ObserveNodes(attributes *NodeAttributes)
+	// ObserveResult is called with the consensus of a successful DetectCloudInfo.
+	ObserveResult(info *CloudInfo)
+}
+
+type observerKey struct{}
+
+// WithObserver returns a context whose detections are reported to the observer.
+func WithObserver(ctx context.Context, observer Observer) context.Context {
+	return context.WithValue(ctx, observerKey{}, observer)
+}
+
+// observerFrom returns the observer of the context, or a no-op observer.
+func observerFrom(ctx context.Context) Observer {
+	if observer, ok := ctx.Value(observerKey{}).(Observer); ok {
+		return observer
+	}
+	return nopObserver{}
+}
+
+type nopObserver struct{}
+
+func (nopObserver) ObserveDetection(string, *CloudInfo, time.Duration, error) {}
+func (nopObserver) ObserveIMDSProbe(string, time.Duration, error)             {}
+func (nopObserver) ObserveNodes(*NodeAttributes)                              {}
+func (nopObserver) ObserveResult(*CloudInfo)                                  {}
+
+// observeDetection runs a detector in its own span, then logs it and reports it to the observer
+// and the report of the context.
+func observeDetection(ctx context.Context, detector string, detect func(ctx context.Context) (*CloudInfo, error)) (*CloudInfo, error) {
+	ctx, span := startSpan(ctx, "detect "+detector, detectorKey.String(detector))
+	ctx, report := startDetectorReport(ctx, detector)
+	start := time.Now()
+	info, err := detect(ctx)
+	if err == nil {
+		if err = ValidateRegion(info.Region); err != nil {
+			info = nil
+		}
+	}
+	duration := time.Since(start)
+	endSpan(span, info, err)
+	finishDetectorReport(ctx, report, info, duration, err)
+
+	logger := logr.FromContextOrDiscard(ctx).V(1).WithValues("detector", detector, "duration", duration)
+	if err != nil {
+		logger.Info("detector failed", "errorType", ErrorType(err), "error", err.Error())
+	} else {
+		logger.Info("detector succeeded", "provider", info.Provider, "region", info.Region)
+	}
+	observerFrom(ctx).ObserveDetection(detector, info, duration, err)
+	return info, err
+}
+
+// verificationError is returned when a detected identity fails verification
+type verificationError struct {
+	err error
+}
+
+func (e *verificationError) Error() string { return e.err.Error() }
+func (e *verificationError) Unwrap() error { return e.err }
+
+// ErrorType classifies a detection error for metrics and logs: "no_nodes", "multiple_regions",
+// "multiple_providers", "not_detected", "conflict", "invalid_region", "invalid_zone",
+// "imds_error", "unreachable", "unavailable", "verification", "timeout", "canceled",
+// "kubernetes_api" or "other". It returns an empty string for a nil error.
+func ErrorType(err error) string {
+	var verification *verificationError
+	var statusErr *IMDSStatusError
+	var status apierrors.APIStatus
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrNoNodes):
+		return "no_nodes"
+	case errors.Is(err, ErrMultipleRegions):
+		return "multiple_regions"
+	case errors.Is(err, ErrMultipleProviders):
+		return "multiple_providers"
+	case errors.Is(err, ErrIMDSNotDetected), errors.Is(err, ErrRuntimeNotDetected):
+		return "not_detected"
+	case errors.Is(err, ErrConflict):
+		return "conflict"
+	case errors.Is(err, ErrInvalidRegion):
+		return "invalid_region"
+	case errors.Is(err, ErrInvalidZone):
+		return "invalid_zone"
+	case errors.As(err, &statusErr):
+		return "imds_error"
+	case errors.Is(err, errIMDSUnreachable):
+		return "unreachable"
+	case errors.Is(err, errIMDSUnavailable):
+		return "unavailable"
+	case errors.As(err, &verification):
+		return "verification"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &status):
+		return "kubernetes_api"
+	default:
+		return "other"
+	}
+}
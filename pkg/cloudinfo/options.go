@@ -0,0 +1,345 @@
+package cloudinfo
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Detectors of Options.Detectors
+const (
+	DetectorNodeLabels = "node-labels"
+	DetectorRuntime    = "runtime"
+	DetectorIMDS       = "imds"
+)
+
+// Option sets detection options, see NewOptions
+type Option func(*Options) error
+
+// DefaultOptions returns the default options: node label detection with the default label keys
+// and the strict region policy, a 30s timeout and 10s per detector, the default IMDS
+// configuration with 5s requests, and no caching.
+func DefaultOptions() Options {
+	config := DefaultIMDSConfig()
+	return Options{
+		Detectors:       []string{DetectorNodeLabels},
+		Timeout:         30 * time.Second,
+		DetectorTimeout: 10 * time.Second,
+		IMDSTimeout:     5 * time.Second,
+		IMDSConfig:      &config,
+		LabelKeys:       DefaultLabelKeys(),
+		RegionPolicy:    RegionPolicyStrict,
+	}
+}
+
+// NewOptions returns the default options with the options applied in order, e.g. a configuration
+// file, then the environment, then the settings of the code:
+//
+//	opts, err := cloudinfo.NewOptions(
+//		cloudinfo.WithConfigFile("/etc/cloudinfo/config.yaml"),
+//		cloudinfo.WithEnv(os.Getenv),
+//		cloudinfo.WithDetectionLogger(logger),
+//	)
+func NewOptions(opts ...Option) (Options, error) {
+	o := DefaultOptions()
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return Options{}, err
+		}
+	}
+	if err := o.Validate(); err != nil {
+		return Options{}, err
+	}
+	return o, nil
+}
+
+// WithOptions replaces all the options, e.g. with the ones returned by LoadOptions.
+func WithOptions(options Options) Option {
+	return func(o *Options) error {
+		*o = options
+		return nil
+	}
+}
+
+// WithDetectors sets the detectors to run, in order of precedence on consensus ties.
+func WithDetectors(detectors ...string) Option {
+	return func(o *Options) error {
+		o.Detectors = detectors
+		return nil
+	}
+}
+
+// WithTimeout sets the timeout of the whole detection, none when 0.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *Options) error {
+		o.Timeout = timeout
+		return nil
+	}
+}
+
+// WithDetectorTimeout sets the timeout of each detector, none when 0.
+func WithDetectorTimeout(timeout time.Duration) Option {
+	return func(o *Options) error {
+		o.DetectorTimeout = timeout
+		return nil
+	}
+}
+
+// WithHTTPClient sets the HTTP client of the runtime and IMDS detectors.
+func WithHTTPClient(client IMDSClient) Option {
+	return func(o *Options) error {
+		o.HTTPClient = client
+		return nil
+	}
+}
+
+// WithIMDSTimeout sets the timeout of the IMDS requests of the default HTTP client.
+func WithIMDSTimeout(timeout time.Duration) Option {
+	return func(o *Options) error {
+		o.IMDSTimeout = timeout
+		return nil
+	}
+}
+
+// WithIMDSConfig sets the endpoints, retries and circuit breaker of the IMDS detector.
+func WithIMDSConfig(config IMDSConfig) Option {
+	return func(o *Options) error {
+		o.IMDSConfig = &config
+		return nil
+	}
+}
+
+// WithRuntimeConfig sets the environment and endpoints of the runtime detector.
+func WithRuntimeConfig(config RuntimeConfig) Option {
+	return func(o *Options) error {
+		o.RuntimeConfig = &config
+		return nil
+	}
+}
+
+// WithIMDSVerification makes the IMDS detector verify its results against the provider's signed identity.
+func WithIMDSVerification(verification IdentityVerification) Option {
+	return func(o *Options) error {
+		o.IMDSVerification = &verification
+		return nil
+	}
+}
+
+// WithFailOnConflict makes detection fail with ErrConflict when detectors disagree.
+func WithFailOnConflict(fail bool) Option {
+	return func(o *Options) error {
+		o.FailOnConflict = fail
+		return nil
+	}
+}
+
+// WithLabelKeys sets the node label keys, the default keys for the empty ones.
+func WithLabelKeys(keys LabelKeys) Option {
+	return func(o *Options) error {
+		o.LabelKeys = keys.withDefaults()
+		return nil
+	}
+}
+
+// WithRegionPolicy sets the region policy of clusters whose nodes span several regions.
+func WithRegionPolicy(policy RegionPolicy) Option {
+	return func(o *Options) error {
+		o.RegionPolicy = policy
+		return nil
+	}
+}
+
+// WithCacheTTL sets how long a Detector reuses its result, not cached when 0.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(o *Options) error {
+		o.CacheTTL = ttl
+		return nil
+	}
+}
+
+// WithDetectionLogger sets the logger of the detection, instead of the logger of the context.
+func WithDetectionLogger(logger logr.Logger) Option {
+	return func(o *Options) error {
+		o.Logger = logger
+		return nil
+	}
+}
+
+// Validate returns an ErrInvalidOptions error listing the problems of the options: unknown or
+// duplicate detectors, negative durations, an unknown region policy, invalid label keys or an
+// invalid retry policy.
+func (o Options) Validate() error {
+	var problems []string
+	for i, detector := range o.Detectors {
+		switch {
+		case detector != DetectorNodeLabels && detector != DetectorRuntime && detector != DetectorIMDS:
+			problems = append(problems, fmt.Sprintf("unknown detector %q", detector))
+		case slices.Contains(o.Detectors[:i], detector):
+			problems = append(problems, fmt.Sprintf("duplicate detector %q", detector))
+		}
+	}
+
+	type duration struct {
+		name  string
+		value time.Duration
+	}
+	durations := []duration{
+		{"timeout", o.Timeout},
+		{"detector timeout", o.DetectorTimeout},
+		{"IMDS timeout", o.IMDSTimeout},
+		{"cache TTL", o.CacheTTL},
+	}
+	if o.IMDSConfig != nil {
+		retry := o.IMDSConfig.Retry
+		durations = append(durations, duration{"initial backoff", retry.InitialBackoff}, duration{"max backoff", retry.MaxBackoff})
+		if retry.MaxAttempts < 0 {
+			problems = append(problems, "max attempts must not be negative")
+		}
+		if retry.MaxAttempts > 1 && retry.InitialBackoff > retry.MaxBackoff {
+			problems = append(problems, "initial backoff exceeds max backoff")
+		}
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			problems = append(problems, d.name+" must not be negative")
+		}
+	}
+
+	switch o.RegionPolicy {
+	case "", RegionPolicyStrict, RegionPolicyMajority:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown region policy %q", o.RegionPolicy))
+	}
+
+	for name, key := range map[string]string{"region": o.LabelKeys.Region, "zone": o.LabelKeys.Zone, "instance type": o.LabelKeys.InstanceType} {
+		if key == "" {
+			continue
+		}
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			problems = append(problems, fmt.Sprintf("invalid %s label key %q: %s", name, key, strings.Join(errs, ", ")))
+		}
+	}
+
+	if len(problems) > 0 {
+		slices.Sort(problems)
+		return fmt.Errorf("%w: %s", ErrInvalidOptions, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// EnabledDetectors returns the detectors to run: Detectors, or the detectors of UseNodeLabels,
+// UseRuntime and UseIMDS when it is empty.
+func (o Options) EnabledDetectors() []string {
+	if len(o.Detectors) > 0 {
+		return o.Detectors
+	}
+	var detectors []string
+	if o.UseNodeLabels {
+		detectors = append(detectors, DetectorNodeLabels)
+	}
+	if o.UseRuntime {
+		detectors = append(detectors, DetectorRuntime)
+	}
+	if o.UseIMDS {
+		detectors = append(detectors, DetectorIMDS)
+	}
+	return detectors
+}
+
+// httpClient returns the HTTP client of the runtime and IMDS detectors.
+func (o Options) httpClient() IMDSClient {
+	if o.HTTPClient != nil {
+		return o.HTTPClient
+	}
+	client := DefaultIMDSClient()
+	if o.IMDSTimeout > 0 {
+		client.Timeout = o.IMDSTimeout
+	}
+	return client
+}
+
+// imdsConfig returns the configuration of the IMDS detector.
+func (o Options) imdsConfig() IMDSConfig {
+	if o.IMDSConfig != nil {
+		return *o.IMDSConfig
+	}
+	return DefaultIMDSConfig()
+}
+
+// runtimeConfig returns the configuration of the runtime detector.
+func (o Options) runtimeConfig() RuntimeConfig {
+	if o.RuntimeConfig != nil {
+		return *o.RuntimeConfig
+	}
+	return DefaultRuntimeConfig()
+}
+
+// nodeConfig returns the configuration of the node label detector.
+func (o Options) nodeConfig() NodeConfig {
+	return NodeConfig{LabelKeys: o.LabelKeys, RegionPolicy: o.RegionPolicy}
+}
+
+// Detector detects the cloud info of a cluster with DetectCloudInfo, reusing its last result for
+// Options.CacheTTL. A Detector is safe for concurrent use; concurrent detections wait for the
+// one in progress.
+type Detector struct {
+	client  kubernetes.Interface
+	options Options
+
+	mu      sync.Mutex
+	info    *CloudInfo
+	expires time.Time
+}
+
+// NewDetector returns a detector of the cluster with the default options and the options applied.
+func NewDetector(client kubernetes.Interface, opts ...Option) (*Detector, error) {
+	options, err := NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Detector{client: client, options: options}, nil
+}
+
+// Options returns the options of the detector.
+func (d *Detector) Options() Options {
+	return d.options
+}
+
+// Detect returns the cached cloud info, or detects it. Failed detections are not cached.
+func (d *Detector) Detect(ctx context.Context) (*CloudInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.info != nil && time.Now().Before(d.expires) {
+		return d.copyInfo(), nil
+	}
+	info, err := DetectCloudInfo(ctx, d.client, d.options)
+	if err != nil {
+		return nil, err
+	}
+	if d.options.CacheTTL > 0 {
+		d.info, d.expires = info, time.Now().Add(d.options.CacheTTL)
+		return d.copyInfo(), nil
+	}
+	return info, nil
+}
+
+// Invalidate drops the cached cloud info, so the next Detect detects it again.
+func (d *Detector) Invalidate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.info = nil
+}
+
+// copyInfo returns a copy of the cached cloud info, safe to modify by callers.
+func (d *Detector) copyInfo() *CloudInfo {
+	info := *d.info
+	info.Conflicts = slices.Clone(info.Conflicts)
+	return &info
+}
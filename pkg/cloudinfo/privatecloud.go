@@ -0,0 +1,101 @@
+package cloudinfo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// VSphereRegionGuestInfo is the guestinfo key read for the region of vSphere VMs
+	VSphereRegionGuestInfo = "guestinfo.cloudinfo.region"
+	// VSphereZoneGuestInfo is the guestinfo key read for the zone of vSphere VMs
+	VSphereZoneGuestInfo = "guestinfo.cloudinfo.zone"
+)
+
+// probeOpenStack reads the OpenStack metadata from the config drive, or from the metadata service
+// when no config drive is mounted. OpenStack metadata has no region, so the region must be
+// configured: availability zones such as "nova" are not regions.
+func probeOpenStack(ctx context.Context, client IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	var body []byte
+	var err error
+	if config.OpenStackConfigDrivePath != "" {
+		body, err = os.ReadFile(filepath.Join(config.OpenStackConfigDrivePath, "openstack", "latest", "meta_data.json"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read OpenStack config drive: %w", err)
+		}
+	}
+	if body == nil {
+		body, err = probeIMDS(ctx, client, config.OpenStackEndpoint, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OpenStack metadata: %w", err)
+		}
+	}
+
+	var metadata struct {
+		UUID             string `json:"uuid"`
+		AvailabilityZone string `json:"availability_zone"`
+		Hostname         string `json:"hostname"`
+		ProjectID        string `json:"project_id"`
+	}
+	if err := json.Unmarshal(body, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode OpenStack metadata: %w", err)
+	}
+
+	if config.OpenStackRegion == "" {
+		return nil, fmt.Errorf("no region configured for OpenStack availability zone %q, set IMDSConfig.OpenStackRegion", metadata.AvailabilityZone)
+	}
+	return &InstanceIdentity{
+		Provider:        "openstack",
+		Region:          config.OpenStackRegion,
+		Zone:            metadata.AvailabilityZone,
+		AccountID:       metadata.ProjectID,
+		InstanceID:      metadata.UUID,
+		PrivateHostname: metadata.Hostname,
+		CapacityType:    CapacityTypeUnknown,
+	}, nil
+}
+
+// probeVSphere detects VMware VMs from the DMI system vendor and reads the region and zone from
+// guestinfo using VMware Tools. The configured region takes precedence over guestinfo.
+func probeVSphere(ctx context.Context, _ IMDSClient, config IMDSConfig) (*InstanceIdentity, error) {
+	if config.VSphereSysVendorPath == "" {
+		return nil, errIMDSUnavailable
+	}
+	vendor, err := os.ReadFile(config.VSphereSysVendorPath)
+	if err != nil || !strings.HasPrefix(string(vendor), "VMware") {
+		return nil, errIMDSUnavailable
+	}
+
+	identity := &InstanceIdentity{
+		Provider:     "vsphere",
+		Region:       config.VSphereRegion,
+		Zone:         readGuestInfo(ctx, config.VSphereRPCToolPath, VSphereZoneGuestInfo),
+		CapacityType: CapacityTypeUnknown,
+	}
+	if identity.Region == "" {
+		identity.Region = readGuestInfo(ctx, config.VSphereRPCToolPath, VSphereRegionGuestInfo)
+	}
+	if identity.Region == "" {
+		return nil, fmt.Errorf("no region configured for vSphere")
+	}
+	return identity, nil
+}
+
+// readGuestInfo reads a guestinfo key with vmware-rpctool, returning an empty string when unset.
+func readGuestInfo(ctx context.Context, rpctool, key string) string {
+	if rpctool == "" {
+		return ""
+	}
+	output, err := exec.CommandContext(ctx, rpctool, "info-get "+key).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
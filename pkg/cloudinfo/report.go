@@ -0,0 +1,276 @@
+package cloudinfo
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Kinds of the signals seen by the detectors
+const (
+	// SignalLabel is a node region label, named "<node>/<label>"
+	SignalLabel = "label"
+	// SignalProviderID is the provider of a node spec.providerID, named after the node
+	SignalProviderID = "provider-id"
+	// SignalEnv is a runtime environment variable
+	SignalEnv = "env"
+	// SignalIMDSProbe is the outcome of an IMDS provider probe, named after the provider
+	SignalIMDSProbe = "imds-probe"
+	// SignalIMDSStatus is the HTTP status of an IMDS request, named after its URL
+	SignalIMDSStatus = "imds-status"
+)
+
+// detectorConfidence is the reliability of each detector, the confidence of its candidates.
+// Verified identities cannot be spoofed. Runtime environments are set by the platform. Node
+// labels describe the whole cluster, while IMDS only describes the instance the process runs
+// on, which may be proxied or misconfigured. Node label candidates are scaled by the share of
+// nodes reporting them, see regionShare.
+var detectorConfidence = map[string]float64{
+	"imds-verified": 1.0,
+	"runtime":       0.95,
+	"node-labels":   0.9,
+	"imds":          0.8,
+}
+
+// Report explains a detection: what each detector saw, what it discarded and the candidates it
+// proposed, and the final pick
+type Report struct {
+	Detectors []DetectorReport `json:"detectors"`
+	// Detected cloud info, nil when detection failed
+	Result *CloudInfo `json:"result,omitempty"`
+	// Confidence of the result, between 0 and 1
+	Confidence float64 `json:"confidence,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// DetectorReport is the trace of a single detector attempt
+type DetectorReport struct {
+	Detector   string      `json:"detector"`
+	Duration   string      `json:"duration"`
+	Signals    []Signal    `json:"signals,omitempty"`
+	Candidates []Candidate `json:"candidates,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	ErrorType  string      `json:"errorType,omitempty"`
+}
+
+// Signal is a piece of evidence seen by a detector
+type Signal struct {
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Why the signal was not used, empty when it was
+	Discarded string `json:"discarded,omitempty"`
+}
+
+// Candidate is a provider and region proposed by a detector
+type Candidate struct {
+	Provider   string  `json:"provider"`
+	Region     string  `json:"region"`
+	Confidence float64 `json:"confidence"`
+	// Number of nodes reporting the region, with node label detection
+	Nodes int `json:"nodes,omitempty"`
+}
+
+// ExplainCloudInfo detects the cloud info as DetectCloudInfo and returns the report of the
+// detection. The report is returned even when detection fails, with the detection error.
+func ExplainCloudInfo(ctx context.Context, client kubernetes.Interface, opts Options) (*Report, error) {
+	return Explain(ctx, func(ctx context.Context) (*CloudInfo, error) {
+		return DetectCloudInfo(ctx, client, opts)
+	})
+}
+
+// Explain runs a detection function, such as DetectIMDSCloudInfoWithClient with a custom
+// client, and returns the report of the detectors it called.
+func Explain(ctx context.Context, detect func(ctx context.Context) (*CloudInfo, error)) (*Report, error) {
+	r := &reporter{}
+	info, err := detect(context.WithValue(ctx, reporterKey{}, r))
+	return r.finish(info, err), err
+}
+
+// String renders the report as human-readable text.
+func (r *Report) String() string {
+	var b strings.Builder
+	for _, d := range r.Detectors {
+		fmt.Fprintf(&b, "detector %s (%s)", d.Detector, d.Duration)
+		if d.Error != "" {
+			fmt.Fprintf(&b, ": failed (%s): %s", d.ErrorType, d.Error)
+		}
+		b.WriteString("\n")
+		if len(d.Signals) > 0 {
+			b.WriteString("  signals:\n")
+		}
+		for _, s := range d.Signals {
+			fmt.Fprintf(&b, "    %s %s = %q", s.Kind, s.Name, s.Value)
+			if s.Discarded != "" {
+				fmt.Fprintf(&b, " (discarded: %s)", s.Discarded)
+			}
+			b.WriteString("\n")
+		}
+		if len(d.Candidates) > 0 {
+			b.WriteString("  candidates:\n")
+		}
+		for _, c := range d.Candidates {
+			fmt.Fprintf(&b, "    %s/%s confidence %.2f", c.Provider, c.Region, c.Confidence)
+			if c.Nodes > 0 {
+				fmt.Fprintf(&b, " (%d nodes)", c.Nodes)
+			}
+			b.WriteString("\n")
+		}
+	}
+	if r.Result != nil {
+		fmt.Fprintf(&b, "result: %s/%s from %s, confidence %.2f\n", r.Result.Provider, r.Result.Region, r.Result.Source, r.Confidence)
+	} else {
+		fmt.Fprintf(&b, "error: %s\n", r.Error)
+	}
+	return b.String()
+}
+
+// reporter collects the report of a detection, from the context of the detectors
+type reporter struct {
+	mu        sync.Mutex
+	detectors []*DetectorReport
+}
+
+type reporterKey struct{}
+
+type detectorReportKey struct{}
+
+// startDetectorReport adds the report of a detector attempt, returning a context whose signals
+// are recorded in it. It returns a nil report outside of ExplainCloudInfo.
+func startDetectorReport(ctx context.Context, detector string) (context.Context, *DetectorReport) {
+	r, ok := ctx.Value(reporterKey{}).(*reporter)
+	if !ok {
+		return ctx, nil
+	}
+	d := &DetectorReport{Detector: detector}
+	r.mu.Lock()
+	r.detectors = append(r.detectors, d)
+	r.mu.Unlock()
+	return context.WithValue(ctx, detectorReportKey{}, d), d
+}
+
+// finishDetectorReport records the outcome of a detector attempt. Detectors that did not
+// propose candidates from their signals propose their result.
+func finishDetectorReport(ctx context.Context, d *DetectorReport, info *CloudInfo, duration time.Duration, err error) {
+	if d == nil {
+		return
+	}
+	r := ctx.Value(reporterKey{}).(*reporter)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d.Duration = duration.String()
+	if err != nil {
+		d.Error = err.Error()
+		d.ErrorType = ErrorType(err)
+	}
+	if info != nil && len(d.Candidates) == 0 {
+		d.Candidates = []Candidate{{Provider: info.Provider, Region: info.Region, Confidence: detectorConfidence[d.Detector]}}
+	}
+}
+
+// recordSignal records a signal in the report of the current detector, if any.
+func recordSignal(ctx context.Context, signal Signal) {
+	r, ok := ctx.Value(reporterKey{}).(*reporter)
+	if !ok {
+		return
+	}
+	d, ok := ctx.Value(detectorReportKey{}).(*DetectorReport)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	d.Signals = append(d.Signals, signal)
+	r.mu.Unlock()
+}
+
+// reportNodes records the node labels and provider IDs, and one candidate per region with a
+// confidence scaled by its share of nodes, most common region first.
+func reportNodes(ctx context.Context, attributes *NodeAttributes, regionLabel string) {
+	d, ok := ctx.Value(detectorReportKey{}).(*DetectorReport)
+	if !ok {
+		return
+	}
+
+	counts := make(map[string]int)
+	for _, node := range attributes.Nodes {
+		label := Signal{Kind: SignalLabel, Name: node.Name + "/" + regionLabel, Value: node.Region}
+		if node.Region == "" {
+			label.Discarded = "missing region label"
+		} else {
+			counts[node.Region]++
+		}
+		recordSignal(ctx, label)
+
+		providerID := Signal{Kind: SignalProviderID, Name: node.Name}
+		if node.ProviderID == "" {
+			providerID.Discarded = "missing provider ID"
+		} else if provider, err := ParseProviderID(node.ProviderID); err != nil {
+			providerID.Value = node.ProviderID
+			providerID.Discarded = "unknown provider ID format"
+		} else {
+			providerID.Value = provider
+		}
+		recordSignal(ctx, providerID)
+	}
+
+	provider := ""
+	if len(attributes.ProviderIDs) > 0 {
+		provider, _ = ParseProviderIDs(attributes.ProviderIDs)
+	}
+	r := ctx.Value(reporterKey{}).(*reporter)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	regions := slices.Sorted(maps.Keys(counts))
+	slices.SortStableFunc(regions, func(a, b string) int { return counts[b] - counts[a] })
+	for _, region := range regions {
+		d.Candidates = append(d.Candidates, Candidate{
+			Provider:   provider,
+			Region:     region,
+			Confidence: detectorConfidence[DetectorNodeLabels] * regionShare(attributes, region),
+			Nodes:      counts[region],
+		})
+	}
+}
+
+// regionShare returns the share of the nodes labelled with the region.
+func regionShare(attributes *NodeAttributes, region string) float64 {
+	if len(attributes.Nodes) == 0 {
+		return 0
+	}
+	count := 0
+	for _, node := range attributes.Nodes {
+		if node.Region == region {
+			count++
+		}
+	}
+	return float64(count) / float64(len(attributes.Nodes))
+}
+
+// finish returns the report of the detection. The confidence of the result is the consensus
+// confidence of DetectCloudInfo, or else the highest of the candidates matching it.
+func (r *reporter) finish(info *CloudInfo, err error) *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := &Report{Detectors: make([]DetectorReport, 0, len(r.detectors)), Result: info}
+	for _, d := range r.detectors {
+		report.Detectors = append(report.Detectors, *d)
+		for _, c := range d.Candidates {
+			if info != nil && c.Provider == info.Provider && c.Region == info.Region {
+				report.Confidence = max(report.Confidence, c.Confidence)
+			}
+		}
+	}
+	if info != nil && info.Confidence > 0 {
+		report.Confidence = info.Confidence
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report
+}
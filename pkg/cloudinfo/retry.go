@@ -0,0 +1,287 @@
+package cloudinfo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// errIMDSUnreachable is returned by probes when the provider's metadata service cannot be connected to,
+// e.g. it does not exist on this platform
+var errIMDSUnreachable = fmt.Errorf("%w: unreachable", errIMDSUnavailable)
+
+// IMDSStatusError is returned when a metadata service is reachable but keeps answering a throttling
+// or server error status, 429 or 5xx, after the retries.
+type IMDSStatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *IMDSStatusError) Error() string {
+	return fmt.Sprintf("IMDS %s answered %d", e.URL, e.StatusCode)
+}
+
+// Unwrap makes the error an unavailable metadata service, so detection moves on to the next provider.
+func (e *IMDSStatusError) Unwrap() error { return errIMDSUnavailable }
+
+// retryableStatus reports whether a status is worth retrying: throttling or a server error
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// RetryPolicy configures the retries of the IMDS requests answered 429 or 5xx, and of the requests
+// failing to connect when RetryUnreachable is set. The zero value does not retry.
+type RetryPolicy struct {
+	// MaxAttempts of a request, including the first one. Requests are not retried when 0 or 1.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, doubled for each following one up to
+	// MaxBackoff. Delays are randomised between half and all of their value.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// RetryUnreachable retries the requests failing to connect, e.g. while the instance boots. It
+	// slows down the probes of the providers that do not exist on the platform.
+	RetryUnreachable bool
+}
+
+// DefaultRetryPolicy returns the default retry policy: 3 attempts with a backoff from 100ms to 2s,
+// without retrying unreachable endpoints.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 3, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 2 * time.Second}
+}
+
+// backoff returns the delay before the retry following the attempt, honoring the Retry-After header
+// of the response up to MaxBackoff.
+func (p RetryPolicy) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return min(delay, p.MaxBackoff)
+		}
+	}
+	delay := p.InitialBackoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxBackoff)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// parseRetryAfter parses a Retry-After header in seconds or as an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
+
+// retryClient retries the requests of an IMDS client according to a policy
+type retryClient struct {
+	client IMDSClient
+	policy RetryPolicy
+}
+
+// withRetry returns the client retrying its requests according to the policy, or the client itself
+// when the policy does not retry or it already retries.
+func withRetry(client IMDSClient, policy RetryPolicy) IMDSClient {
+	if _, ok := client.(*retryClient); ok || policy.MaxAttempts <= 1 {
+		return client
+	}
+	return &retryClient{client: client, policy: policy}
+}
+
+// Do sends the request until it gets an answer that is not retryable, the attempts are exhausted or
+// the request context is done.
+func (c *retryClient) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	logger := logr.FromContextOrDiscard(ctx).V(2).WithValues("method", req.Method, "url", req.URL.String())
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+		resp, err := c.client.Do(req)
+		retry := false
+		switch {
+		case err != nil:
+			retry = c.policy.RetryUnreachable && ctx.Err() == nil
+		default:
+			retry = retryableStatus(resp.StatusCode)
+		}
+		if !retry || attempt >= c.policy.MaxAttempts {
+			return resp, err
+		}
+
+		delay := c.policy.backoff(attempt, resp)
+		if err != nil {
+			logger.Info("IMDS request retried", "attempt", attempt, "error", err.Error(), "delay", delay)
+		} else {
+			logger.Info("IMDS request retried", "attempt", attempt, "status", resp.StatusCode, "delay", delay)
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxIMDSBodySize))
+			_ = resp.Body.Close()
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleep waits for the delay, or returns the context error when it is done first.
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Circuit breaker states, reported by CircuitBreaker.State
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// CircuitBreaker skips the IMDS probes of the providers whose metadata service was unreachable a
+// threshold number of times in a row, until a cooldown has passed. A single probe is then let
+// through: the circuit closes again if the metadata service answers, and stays open for another
+// cooldown if not.
+// Answers of any status close the circuit, as they show the metadata service is reachable.
+// Circuits are kept per provider and base URL of its endpoints, so configurations with different
+// endpoints do not open each other's circuits.
+// A CircuitBreaker is safe for concurrent use, and is shared by the detections using its IMDSConfig.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	circuits map[circuitKey]*circuit
+}
+
+// circuitKey identifies the circuit of a provider at a base URL
+type circuitKey struct {
+	provider string
+	base     string
+}
+
+// circuit is the state of the circuit of a provider
+type circuit struct {
+	failures int
+	openedAt time.Time
+	// probing is set while the single probe of a half-open circuit is in flight
+	probing bool
+}
+
+// NewCircuitBreaker returns a circuit breaker opening after threshold consecutive unreachable probes
+// of a provider, for cooldown.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown, circuits: make(map[circuitKey]*circuit)}
+}
+
+// allow reports whether the provider may be probed at the base URL, reserving the probe of a
+// half-open circuit.
+func (b *CircuitBreaker) allow(provider, base string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuits[circuitKey{provider, base}]
+	if c == nil || c.failures < b.threshold {
+		return true
+	}
+	if c.probing || time.Since(c.openedAt) < b.cooldown {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+// record updates the circuit of the provider at the base URL with the outcome of its probe.
+func (b *CircuitBreaker) record(provider, base string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := circuitKey{provider, base}
+	if !errors.Is(err, errIMDSUnreachable) {
+		delete(b.circuits, key)
+		return
+	}
+	c := b.circuits[key]
+	if c == nil {
+		c = &circuit{}
+		b.circuits[key] = c
+	}
+	c.failures++
+	c.probing = false
+	if c.failures >= b.threshold {
+		c.openedAt = time.Now()
+	}
+}
+
+// release gives up the probe of a half-open circuit whose outcome is unknown, e.g. cancelled.
+func (b *CircuitBreaker) release(provider, base string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c := b.circuits[circuitKey{provider, base}]; c != nil {
+		c.probing = false
+	}
+}
+
+// State returns the state of the circuits of the provider: CircuitClosed, CircuitOpen or
+// CircuitHalfOpen. With several base URLs, an open circuit is reported first, then a half-open one.
+func (b *CircuitBreaker) State(provider string) string {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := CircuitClosed
+	for key, c := range b.circuits {
+		switch {
+		case key.provider != provider || c.failures < b.threshold:
+		case c.probing || time.Since(c.openedAt) >= b.cooldown:
+			state = CircuitHalfOpen
+		default:
+			return CircuitOpen
+		}
+	}
+	return state
+}
+
+// Reset closes the circuits of all the providers.
+func (b *CircuitBreaker) Reset() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.circuits = make(map[circuitKey]*circuit)
+}
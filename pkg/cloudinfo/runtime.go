@@ -0,0 +1,209 @@
+package cloudinfo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Platforms reported by runtime detection
+const (
+	PlatformAWSECS             = "aws_ecs"
+	PlatformAWSFargate         = "aws_fargate"
+	PlatformAWSLambda          = "aws_lambda"
+	PlatformGCPCloudRun        = "gcp_cloud_run"
+	PlatformAzureContainerApps = "azure_container_apps"
+	PlatformAzureAppService    = "azure_app_service"
+	PlatformAzureFunctions     = "azure_functions"
+)
+
+// RuntimeConfig represents the configuration of serverless and container runtime detection
+type RuntimeConfig struct {
+	// Getenv looks up the runtime environment variables, os.Getenv when nil
+	Getenv func(string) string
+	// Metadata server endpoint of the Cloud Run instance region
+	CloudRunRegionEndpoint string
+}
+
+// DefaultRuntimeConfig returns the default runtime detection configuration
+func DefaultRuntimeConfig() RuntimeConfig {
+	return RuntimeConfig{
+		Getenv:                 os.Getenv,
+		CloudRunRegionEndpoint: "http://metadata.google.internal/computeMetadata/v1/instance/region",
+	}
+}
+
+// errRuntimeUnavailable is returned by a runtime detector when its platform is not detected
+var errRuntimeUnavailable = errors.New("runtime not detected")
+
+// runtimeDetector detects a single serverless or container platform from its environment
+type runtimeDetector func(ctx context.Context, client IMDSClient, config RuntimeConfig) (*CloudInfo, error)
+
+// runtimeDetectors are tried in order, the first detected platform wins
+var runtimeDetectors = []runtimeDetector{
+	detectLambda,
+	detectECS,
+	detectCloudRun,
+	detectAzureContainerApps,
+	detectAzureAppService,
+}
+
+// DetectRuntimeCloudInfo detects cloud provider, region and platform of serverless and container runtimes.
+func DetectRuntimeCloudInfo(ctx context.Context) (*CloudInfo, error) {
+	return DetectRuntimeCloudInfoWithClient(ctx, DefaultIMDSClient(), DefaultRuntimeConfig())
+}
+
+// DetectRuntimeCloudInfoWithClient detects cloud provider, region and platform of serverless and
+// container runtimes with a custom client.
+func DetectRuntimeCloudInfoWithClient(ctx context.Context, client IMDSClient, config RuntimeConfig) (*CloudInfo, error) {
+	if config.Getenv == nil {
+		config.Getenv = os.Getenv
+	}
+	getenv := config.Getenv
+	return observeDetection(ctx, "runtime", func(ctx context.Context) (*CloudInfo, error) {
+		config.Getenv = func(key string) string {
+			value := getenv(key)
+			if value != "" {
+				recordSignal(ctx, Signal{Kind: SignalEnv, Name: key, Value: value})
+			}
+			return value
+		}
+		for _, detect := range runtimeDetectors {
+			info, err := detect(ctx, client, config)
+			if errors.Is(err, errRuntimeUnavailable) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			return info, nil
+		}
+		return nil, ErrRuntimeNotDetected
+	})
+}
+
+// runtimeCloudInfo returns the cloud info of a detected runtime.
+func runtimeCloudInfo(provider, platform, region string) *CloudInfo {
+	return &CloudInfo{
+		Provider: provider,
+		Region:   region,
+		Platform: platform,
+		Source:   "runtime",
+	}
+}
+
+// detectLambda detects AWS Lambda functions, which set the function name and region.
+func detectLambda(_ context.Context, _ IMDSClient, config RuntimeConfig) (*CloudInfo, error) {
+	if config.Getenv("AWS_LAMBDA_FUNCTION_NAME") == "" {
+		return nil, errRuntimeUnavailable
+	}
+	region := config.Getenv("AWS_REGION")
+	if region == "" {
+		return nil, fmt.Errorf("AWS_REGION not set in Lambda environment")
+	}
+	return runtimeCloudInfo("aws", PlatformAWSLambda, region), nil
+}
+
+// detectECS detects ECS and Fargate tasks from the task metadata endpoint v4.
+func detectECS(ctx context.Context, client IMDSClient, config RuntimeConfig) (*CloudInfo, error) {
+	endpoint := config.Getenv("ECS_CONTAINER_METADATA_URI_V4")
+	if endpoint == "" {
+		return nil, errRuntimeUnavailable
+	}
+	status, body, err := fetchIMDS(ctx, client, strings.TrimSuffix(endpoint, "/")+"/task", "", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ECS task metadata: %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("failed to read ECS task metadata: unexpected status %d", status)
+	}
+	var task struct {
+		TaskARN          string `json:"TaskARN"`
+		AvailabilityZone string `json:"AvailabilityZone"`
+		LaunchType       string `json:"LaunchType"`
+	}
+	if err := json.Unmarshal(body, &task); err != nil {
+		return nil, fmt.Errorf("failed to decode ECS task metadata: %w", err)
+	}
+
+	// e.g. "arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c"
+	var region string
+	if parts := strings.Split(task.TaskARN, ":"); len(parts) > 3 {
+		region = parts[3]
+	}
+	// e.g. "us-west-2a" -> "us-west-2"
+	if region == "" && len(task.AvailabilityZone) > 1 {
+		region = task.AvailabilityZone[:len(task.AvailabilityZone)-1]
+	}
+	if region == "" {
+		return nil, fmt.Errorf("unable to determine region from ECS task metadata")
+	}
+
+	platform := PlatformAWSECS
+	if task.LaunchType == "FARGATE" {
+		platform = PlatformAWSFargate
+	}
+	return runtimeCloudInfo("aws", platform, region), nil
+}
+
+// detectCloudRun detects Cloud Run services and jobs and reads the region from the metadata server.
+func detectCloudRun(ctx context.Context, client IMDSClient, config RuntimeConfig) (*CloudInfo, error) {
+	if config.Getenv("K_SERVICE") == "" && config.Getenv("CLOUD_RUN_JOB") == "" {
+		return nil, errRuntimeUnavailable
+	}
+	status, body, err := fetchIMDS(ctx, client, config.CloudRunRegionEndpoint, "Metadata-Flavor", "Google")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Cloud Run region: %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("failed to read Cloud Run region: unexpected status %d", status)
+	}
+	// e.g. "projects/123456789/regions/us-central1"
+	return runtimeCloudInfo("gcp", PlatformGCPCloudRun, path.Base(strings.TrimSpace(string(body)))), nil
+}
+
+// detectAzureContainerApps detects Azure Container Apps, which set the app name.
+func detectAzureContainerApps(_ context.Context, _ IMDSClient, config RuntimeConfig) (*CloudInfo, error) {
+	if config.Getenv("CONTAINER_APP_NAME") == "" {
+		return nil, errRuntimeUnavailable
+	}
+	region, err := azureRuntimeRegion(config)
+	if err != nil {
+		return nil, err
+	}
+	return runtimeCloudInfo("azure", PlatformAzureContainerApps, region), nil
+}
+
+// detectAzureAppService detects Azure App Service and Azure Functions, which set the site name.
+func detectAzureAppService(_ context.Context, _ IMDSClient, config RuntimeConfig) (*CloudInfo, error) {
+	if config.Getenv("WEBSITE_SITE_NAME") == "" {
+		return nil, errRuntimeUnavailable
+	}
+	region, err := azureRuntimeRegion(config)
+	if err != nil {
+		return nil, err
+	}
+	platform := PlatformAzureAppService
+	if config.Getenv("FUNCTIONS_WORKER_RUNTIME") != "" {
+		platform = PlatformAzureFunctions
+	}
+	return runtimeCloudInfo("azure", platform, region), nil
+}
+
+// azureRuntimeRegion returns the location of Azure runtimes. REGION_NAME is the display name
+// (e.g. "West Europe"), normalised to the location name of the node labels (e.g. "westeurope").
+func azureRuntimeRegion(config RuntimeConfig) (string, error) {
+	region := config.Getenv("REGION_NAME")
+	if region == "" {
+		region = config.Getenv("WEBSITE_REGION_NAME")
+	}
+	if region == "" {
+		return "", fmt.Errorf("REGION_NAME not set in Azure runtime environment")
+	}
+	return strings.ToLower(strings.ReplaceAll(region, " ", "")), nil
+}
@@ -0,0 +1,96 @@
+package cloudinfo
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation scope name of the detection spans
+const TracerName = "github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+
+// Attribute keys of the detection spans, in addition to the cloud.* and http.* semantic conventions
+const (
+	detectorKey  = attribute.Key("cloudinfo.detector")
+	sourceKey    = attribute.Key("cloudinfo.source")
+	resultKey    = attribute.Key("cloudinfo.result")
+	errorTypeKey = attribute.Key("cloudinfo.error_type")
+	nodesKey     = attribute.Key("cloudinfo.nodes")
+	regionsKey   = attribute.Key("cloudinfo.regions")
+)
+
+// WithLogger returns a context whose detections are logged to the logger. Detector attempts,
+// node lists and the final decision are logged at V(1), IMDS requests and probes at V(2).
+// It is equivalent to logr.NewContext.
+func WithLogger(ctx context.Context, logger logr.Logger) context.Context {
+	return logr.NewContext(ctx, logger)
+}
+
+type tracerProviderKey struct{}
+
+// WithTracerProvider returns a context whose detections are traced with the tracer provider.
+// Without it, the global tracer provider is used, which records nothing unless set with
+// otel.SetTracerProvider.
+func WithTracerProvider(ctx context.Context, provider trace.TracerProvider) context.Context {
+	return context.WithValue(ctx, tracerProviderKey{}, provider)
+}
+
+// startSpan starts a span with the tracer provider of the context.
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	provider, ok := ctx.Value(tracerProviderKey{}).(trace.TracerProvider)
+	if !ok {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// endSpan records the outcome of a detection step on its span and ends it.
+func endSpan(span trace.Span, info *CloudInfo, err error) {
+	if err != nil {
+		span.SetAttributes(errorTypeKey.String(ErrorType(err)))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if info != nil {
+		span.SetAttributes(
+			semconv.CloudProviderKey.String(info.Provider),
+			semconv.CloudRegion(info.Region),
+			sourceKey.String(info.Source),
+		)
+	}
+	span.End()
+}
+
+// doIMDS sends an IMDS request, logging and tracing its status code and latency.
+func doIMDS(client IMDSClient, req *http.Request) (*http.Response, error) {
+	ctx, span := startSpan(req.Context(), "IMDS "+req.Method, semconv.HTTPRequestMethodKey.String(req.Method), semconv.URLFull(req.URL.String()))
+	defer span.End()
+
+	start := time.Now()
+	resp, err := client.Do(req.WithContext(ctx))
+	duration := time.Since(start)
+
+	logger := logr.FromContextOrDiscard(ctx).V(2).WithValues("method", req.Method, "url", req.URL.String(), "duration", duration)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		logger.Info("IMDS request failed", "error", err.Error())
+		recordSignal(ctx, Signal{Kind: SignalIMDSStatus, Name: req.URL.String(), Value: "unreachable", Discarded: err.Error()})
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	logger.Info("IMDS request", "status", resp.StatusCode)
+	signal := Signal{Kind: SignalIMDSStatus, Name: req.URL.String(), Value: strconv.Itoa(resp.StatusCode)}
+	if resp.StatusCode != http.StatusOK {
+		signal.Discarded = "unexpected status"
+	}
+	recordSignal(ctx, signal)
+	return resp, nil
+}
@@ -1,16 +1,73 @@
 package cloudinfo
 
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
 // CloudInfo represents the cloud provider and region of the cluster
 type CloudInfo struct {
-	Provider string // e.g. "aws", "gcp", "azure", or "unknown"
-	Region   string
-	Source   string // e.g. "node", "imds", "fallback"
+	Provider string `json:"provider"` // e.g. "aws", "gcp", "azure", or "unknown"
+	Region   string `json:"region"`
+	Source   string `json:"source"` // e.g. "node", "imds", "runtime", "fallback"
+	// Serverless or container platform, empty when not detected from the runtime
+	Platform string `json:"platform,omitempty"` // e.g. "aws_lambda", "gcp_cloud_run"
+	// Capacity type of the instance, empty when not applicable (e.g. cluster-wide detection)
+	CapacityType string `json:"capacityType,omitempty"` // e.g. "on-demand", "spot", "unknown"
+	// Whether the result was cryptographically verified against the provider's signed identity
+	Verified bool `json:"verified"`
+	// Confidence of the consensus between 0 and 1, and the detector results disagreeing with
+	// it. Only set by DetectCloudInfo.
+	Confidence float64    `json:"confidence,omitempty"`
+	Conflicts  []Conflict `json:"conflicts,omitempty"`
 }
 
-// Options represents the options for detecting cloud info
+const (
+	// CapacityTypeOnDemand is the capacity type of regular, non-interruptible instances
+	CapacityTypeOnDemand = "on-demand"
+	// CapacityTypeSpot is the capacity type of spot or preemptible instances
+	CapacityTypeSpot = "spot"
+	// CapacityTypeUnknown is used when the capacity type cannot be determined
+	CapacityTypeUnknown = "unknown"
+)
+
+// Options represents the options for detecting cloud info. The zero value of the fields added
+// after FailOnConflict keeps their default behaviour; NewOptions builds them from functional
+// options, a configuration file and the environment.
 type Options struct {
 	// If should use Kubernetes node labels + spec.ProviderID
 	UseNodeLabels bool
+	// If should use the serverless or container runtime environment to detect cloud info
+	UseRuntime bool
 	// If should use IMDS to detect cloud info
 	UseIMDS bool
+	// If set, IMDS results must be verified against the provider's signed identity
+	IMDSVerification *IdentityVerification
+	// If set, detection fails with ErrConflict when detectors disagree, instead of returning
+	// the consensus
+	FailOnConflict bool
+
+	// Detectors to run, in order, among DetectorNodeLabels, DetectorRuntime and DetectorIMDS. They
+	// replace UseNodeLabels, UseRuntime and UseIMDS when set. Consensus ties go to the first one.
+	Detectors []string
+	// Timeout of the whole detection, and of each detector, none when 0
+	Timeout         time.Duration
+	DetectorTimeout time.Duration
+	// HTTPClient of the runtime and IMDS detectors, DefaultIMDSClient with IMDSTimeout when nil
+	HTTPClient IMDSClient
+	// IMDSTimeout of the requests of the default HTTP client, 5s when 0
+	IMDSTimeout time.Duration
+	// IMDSConfig of the IMDS detector, DefaultIMDSConfig when nil
+	IMDSConfig *IMDSConfig
+	// RuntimeConfig of the runtime detector, DefaultRuntimeConfig when nil
+	RuntimeConfig *RuntimeConfig
+	// LabelKeys read by node label detection, the default keys for the empty ones
+	LabelKeys LabelKeys
+	// RegionPolicy of node label detection, RegionPolicyStrict when empty
+	RegionPolicy RegionPolicy
+	// CacheTTL of the results of a Detector, not cached when 0
+	CacheTTL time.Duration
+	// Logger of the detection, the logger of the context when zero
+	Logger logr.Logger
 }
@@ -0,0 +1,60 @@
+package cloudinfo
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	// maxIMDSBodySize bounds the IMDS response bodies read, the largest documents (Azure instance
+	// metadata, GCP recursive instance) are a few kilobytes
+	maxIMDSBodySize = 1 << 20
+	// MaxRegionLength is the maximum length of a region or zone accepted by ValidateRegion and
+	// ValidateZone
+	MaxRegionLength = 64
+)
+
+// readIMDSBody reads an IMDS response body of at most maxIMDSBodySize bytes.
+func readIMDSBody(r io.Reader) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, maxIMDSBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxIMDSBodySize {
+		return nil, fmt.Errorf("IMDS response larger than %d bytes", maxIMDSBodySize)
+	}
+	return body, nil
+}
+
+// ValidateRegion returns an ErrInvalidRegion error unless the region is 1 to MaxRegionLength
+// ASCII letters, digits, '-', '_' or '.', e.g. "us-west-2", "westeurope" or "RegionOne".
+// Detected regions are validated before they are returned, as they end up in labels, metrics
+// and logs.
+func ValidateRegion(region string) error {
+	return validateName(region, ErrInvalidRegion)
+}
+
+// ValidateZone returns an ErrInvalidZone error unless the zone follows the rules of
+// ValidateRegion, e.g. "us-west-2a", "westeurope-1" or "us-central1-a".
+func ValidateZone(zone string) error {
+	return validateName(zone, ErrInvalidZone)
+}
+
+// validateName returns an error wrapping invalid unless the name is 1 to MaxRegionLength ASCII
+// letters, digits, '-', '_' or '.'.
+func validateName(name string, invalid error) error {
+	if name == "" {
+		return fmt.Errorf("%w: empty", invalid)
+	}
+	if len(name) > MaxRegionLength {
+		return fmt.Errorf("%w: longer than %d characters", invalid, MaxRegionLength)
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return fmt.Errorf("%w: %q", invalid, name)
+		}
+	}
+	return nil
+}
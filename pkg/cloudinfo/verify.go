@@ -0,0 +1,532 @@
+package cloudinfo
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// IdentityVerification holds the trust material used to verify signed instance identities.
+//
+// AWS does not include a nonce in its signed document, so a document copied from another
+// instance in the same region and account verifies successfully. The Azure attested document
+// does not include the location, so Azure identities are attested but their region is not
+// verified.
+type IdentityVerification struct {
+	// AWS RSA-2048 public certificates keyed by region, the "*" key is used for other regions
+	AWSCertificates map[string]*x509.Certificate
+
+	// Roots of the Azure attested document signing chain, system roots when nil
+	AzureRoots *x509.CertPool
+	// Intermediates of the Azure signing chain not embedded in the attested document
+	AzureIntermediates []*x509.Certificate
+	// Expected DNS name suffix of the Azure signing certificate
+	AzureSignerName string
+
+	// GCP identity token signing keys keyed by key ID, fetched from GCPCertsURL when nil
+	GCPKeys map[string]*rsa.PublicKey
+	// URL of the GCP identity token signing keys in JWK format
+	GCPCertsURL string
+	// Audience requested for and expected in the GCP identity token
+	GCPAudience string
+
+	// Clock used for expiry checks, time.Now when nil
+	Now func() time.Time
+}
+
+// DefaultIdentityVerification returns the default identity verification configuration.
+// AWS certificates are not bundled and must be configured, see
+// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/regions-certs.html.
+func DefaultIdentityVerification() IdentityVerification {
+	return IdentityVerification{
+		AzureSignerName: "metadata.azure.com",
+		GCPCertsURL:     "https://www.googleapis.com/oauth2/v3/certs",
+		GCPAudience:     "cloudinfo",
+	}
+}
+
+// ParsePEMCertificates parses all the certificates of a PEM bundle.
+func ParsePEMCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return certificates, nil
+}
+
+// DetectVerifiedIMDSCloudInfo detects cloud provider and region using verified IMDS identity,
+// configured like DetectIMDSCloudInfo.
+func DetectVerifiedIMDSCloudInfo(ctx context.Context, verification IdentityVerification) (*CloudInfo, error) {
+	return DetectVerifiedIMDSCloudInfoWithClient(ctx, DefaultIMDSClient(), envIMDSConfig(), verification)
+}
+
+// DetectVerifiedIMDSCloudInfoWithClient detects cloud provider and region using verified IMDS identity with a custom client.
+// It fails when the provider does not sign the region, e.g. on Azure.
+func DetectVerifiedIMDSCloudInfoWithClient(ctx context.Context, client IMDSClient, config IMDSConfig, verification IdentityVerification) (*CloudInfo, error) {
+	return observeDetection(ctx, "imds-verified", func(ctx context.Context) (*CloudInfo, error) {
+		identity, err := VerifyIMDSInstanceIdentityWithClient(ctx, client, config, verification)
+		if err != nil {
+			return nil, err
+		}
+		if !identity.Verified {
+			return nil, &verificationError{err: fmt.Errorf("region not signed by provider: %s", identity.Provider)}
+		}
+		return identity.CloudInfo(), nil
+	})
+}
+
+// VerifyIMDSInstanceIdentityWithClient detects the instance identity and verifies it against the
+// provider's signed identity: the AWS PKCS7 signature, the Azure attested document or the GCP
+// identity token. Signed values replace the unsigned ones and must agree with the detected region.
+// Verified is only set when the provider signs the region, which Azure does not.
+func VerifyIMDSInstanceIdentityWithClient(ctx context.Context, client IMDSClient, config IMDSConfig, verification IdentityVerification) (*InstanceIdentity, error) {
+	client = imdsClient(client, config)
+	ctx = withAWSTokenCache(ctx)
+	identity, err := DetectIMDSInstanceIdentityWithClient(ctx, client, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyIMDSIdentity(ctx, client, config, verification, identity); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// verifyIMDSIdentity verifies a detected identity against the signed identity of its provider.
+func verifyIMDSIdentity(ctx context.Context, client IMDSClient, config IMDSConfig, verification IdentityVerification, identity *InstanceIdentity) error {
+	if verification.Now == nil {
+		verification.Now = time.Now
+	}
+
+	var err error
+	ctx = withIMDSProvider(ctx, identity.Provider)
+	switch identity.Provider {
+	case "aws":
+		err = verifyAWSIdentity(ctx, client, config, verification, identity)
+	case "azure":
+		err = verifyAzureIdentity(ctx, client, config, verification, identity)
+	case "gcp":
+		err = verifyGCPIdentity(ctx, client, config, verification, identity)
+	default:
+		err = fmt.Errorf("identity verification not supported for provider: %s", identity.Provider)
+	}
+	if err != nil {
+		return &verificationError{err: err}
+	}
+	return nil
+}
+
+// verifyAWSIdentity verifies the RSA-2048 PKCS7 signature of the instance identity document.
+func verifyAWSIdentity(ctx context.Context, client IMDSClient, config IMDSConfig, verification IdentityVerification, identity *InstanceIdentity) error {
+	certificate := verification.AWSCertificates[identity.Region]
+	if certificate == nil {
+		certificate = verification.AWSCertificates["*"]
+	}
+	if certificate == nil {
+		return fmt.Errorf("no AWS certificate for region: %s", identity.Region)
+	}
+
+	header, token, _ := awsToken(ctx, client, config)
+	body, err := readIdentityEndpoint(ctx, client, config.AWSIdentitySignatureEndpoint, header, token, "AWS instance identity signature")
+	if err != nil {
+		return err
+	}
+	// The signature is served as base64 without PEM armor, wrapped over several lines
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		return fmt.Errorf("failed to decode AWS instance identity signature: %w", err)
+	}
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return fmt.Errorf("failed to parse AWS instance identity signature: %w", err)
+	}
+	p7.Certificates = []*x509.Certificate{certificate}
+	if err := p7.Verify(); err != nil {
+		return fmt.Errorf("failed to verify AWS instance identity signature: %w", err)
+	}
+
+	var document struct {
+		AccountID        string `json:"accountId"`
+		AvailabilityZone string `json:"availabilityZone"`
+		ImageID          string `json:"imageId"`
+		InstanceID       string `json:"instanceId"`
+		InstanceType     string `json:"instanceType"`
+		Region           string `json:"region"`
+	}
+	if err := json.Unmarshal(p7.Content, &document); err != nil {
+		return fmt.Errorf("failed to decode signed AWS instance identity document: %w", err)
+	}
+	if document.Region != identity.Region {
+		return fmt.Errorf("signed region %s does not match detected region %s", document.Region, identity.Region)
+	}
+
+	identity.Zone = document.AvailabilityZone
+	identity.AccountID = document.AccountID
+	identity.InstanceID = document.InstanceID
+	identity.InstanceType = document.InstanceType
+	identity.ImageID = document.ImageID
+	identity.Verified = true
+	return nil
+}
+
+// verifyAzureIdentity verifies the attested document, its signing chain and nonce, and that it
+// attests the detected VM. The region is not attested, so the identity is not marked verified.
+func verifyAzureIdentity(ctx context.Context, client IMDSClient, config IMDSConfig, verification IdentityVerification, identity *InstanceIdentity) error {
+	// A fresh nonce prevents replaying a document attested for another request
+	n, err := rand.Int(rand.Reader, big.NewInt(1e10))
+	if err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := fmt.Sprintf("%010d", n)
+
+	endpoint, err := withQuery(config.AzureAttestedDocumentEndpoint, "nonce", nonce)
+	if err != nil {
+		return fmt.Errorf("invalid Azure attested document endpoint: %w", err)
+	}
+	body, err := readIdentityEndpoint(ctx, client, endpoint, "Metadata", "true", "Azure attested document")
+	if err != nil {
+		return err
+	}
+	var attested struct {
+		Encoding  string `json:"encoding"`
+		Signature string `json:"signature"`
+	}
+	if err := json.Unmarshal(body, &attested); err != nil {
+		return fmt.Errorf("failed to decode Azure attested document: %w", err)
+	}
+	if attested.Encoding != "pkcs7" {
+		return fmt.Errorf("unsupported Azure attested document encoding: %s", attested.Encoding)
+	}
+	der, err := base64.StdEncoding.DecodeString(attested.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode Azure attested document signature: %w", err)
+	}
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return fmt.Errorf("failed to parse Azure attested document signature: %w", err)
+	}
+
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return fmt.Errorf("expected a single Azure attested document signer")
+	}
+	if !hasNameSuffix(signer, verification.AzureSignerName) {
+		return fmt.Errorf("unexpected Azure attested document signer: %s", signer.Subject.CommonName)
+	}
+	roots := verification.AzureRoots
+	if roots == nil {
+		if roots, err = x509.SystemCertPool(); err != nil {
+			return fmt.Errorf("failed to load system roots: %w", err)
+		}
+	}
+	p7.Certificates = append(p7.Certificates, verification.AzureIntermediates...)
+	if err := p7.VerifyWithChainAtTime(roots, verification.Now()); err != nil {
+		return fmt.Errorf("failed to verify Azure attested document: %w", err)
+	}
+
+	var document struct {
+		Nonce          string `json:"nonce"`
+		SubscriptionID string `json:"subscriptionId"`
+		VMID           string `json:"vmId"`
+		TimeStamp      struct {
+			ExpiresOn string `json:"expiresOn"`
+		} `json:"timeStamp"`
+	}
+	if err := json.Unmarshal(p7.Content, &document); err != nil {
+		return fmt.Errorf("failed to decode signed Azure attested document: %w", err)
+	}
+	if document.Nonce != nonce {
+		return fmt.Errorf("nonce mismatch in Azure attested document")
+	}
+	// e.g. "11/28/18 06:16:17 -0000"
+	expiresOn, err := time.Parse("01/02/06 15:04:05 -0700", document.TimeStamp.ExpiresOn)
+	if err != nil {
+		return fmt.Errorf("invalid Azure attested document expiry: %s", document.TimeStamp.ExpiresOn)
+	}
+	if verification.Now().After(expiresOn) {
+		return fmt.Errorf("expired Azure attested document: %s", expiresOn)
+	}
+	if identity.InstanceID == "" {
+		return fmt.Errorf("missing detected VM ID to match the Azure attested document")
+	}
+	if document.VMID != identity.InstanceID {
+		return fmt.Errorf("attested VM ID %s does not match detected VM ID %s", document.VMID, identity.InstanceID)
+	}
+
+	identity.AccountID = document.SubscriptionID
+	identity.InstanceID = document.VMID
+	return nil
+}
+
+// hasNameSuffix reports whether the certificate common name or a DNS name ends with the given name.
+func hasNameSuffix(certificate *x509.Certificate, name string) bool {
+	for _, n := range append([]string{certificate.Subject.CommonName}, certificate.DNSNames...) {
+		if n == name || strings.HasSuffix(n, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyGCPIdentity verifies the RS256 identity token issued by the metadata server.
+func verifyGCPIdentity(ctx context.Context, client IMDSClient, config IMDSConfig, verification IdentityVerification, identity *InstanceIdentity) error {
+	endpoint, err := withQuery(config.GCPIdentityTokenEndpoint, "audience", verification.GCPAudience)
+	if err != nil {
+		return fmt.Errorf("invalid GCP identity token endpoint: %w", err)
+	}
+	body, err := readIdentityEndpoint(ctx, client, endpoint, "Metadata-Flavor", "Google", "GCP identity token")
+	if err != nil {
+		return err
+	}
+
+	parts := strings.Split(strings.TrimSpace(string(body)), ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid GCP identity token format")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("failed to decode GCP identity token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("unsupported GCP identity token algorithm: %s", header.Alg)
+	}
+
+	keys := verification.GCPKeys
+	cached := false
+	if keys == nil {
+		if keys, cached, err = fetchJWKS(ctx, client, verification.GCPCertsURL, verification.Now(), false); err != nil {
+			return err
+		}
+	}
+	key, ok := keys[header.Kid]
+	if !ok && cached {
+		// The keys rotated since they were cached
+		if keys, _, err = fetchJWKS(ctx, client, verification.GCPCertsURL, verification.Now(), true); err != nil {
+			return err
+		}
+		key, ok = keys[header.Kid]
+	}
+	if !ok {
+		return fmt.Errorf("unknown GCP identity token key: %s", header.Kid)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("failed to decode GCP identity token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return fmt.Errorf("failed to verify GCP identity token: %w", err)
+	}
+
+	var claims struct {
+		Iss    string `json:"iss"`
+		Aud    string `json:"aud"`
+		Exp    int64  `json:"exp"`
+		Google struct {
+			ComputeEngine struct {
+				InstanceID string `json:"instance_id"`
+				ProjectID  string `json:"project_id"`
+				Zone       string `json:"zone"`
+			} `json:"compute_engine"`
+		} `json:"google"`
+	}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return fmt.Errorf("failed to decode GCP identity token claims: %w", err)
+	}
+	if claims.Iss != "https://accounts.google.com" && claims.Iss != "accounts.google.com" {
+		return fmt.Errorf("unexpected GCP identity token issuer: %s", claims.Iss)
+	}
+	if claims.Aud != verification.GCPAudience {
+		return fmt.Errorf("unexpected GCP identity token audience: %s", claims.Aud)
+	}
+	if !verification.Now().Before(time.Unix(claims.Exp, 0)) {
+		return fmt.Errorf("expired GCP identity token: %s", time.Unix(claims.Exp, 0))
+	}
+
+	computeEngine := claims.Google.ComputeEngine
+	if computeEngine.Zone == "" {
+		return fmt.Errorf("missing instance claims in GCP identity token, request it with format=full")
+	}
+	zone, region, err := ParseGCPZone("projects/-/zones/" + computeEngine.Zone)
+	if err != nil {
+		return err
+	}
+	if region != identity.Region {
+		return fmt.Errorf("signed region %s does not match detected region %s", region, identity.Region)
+	}
+
+	identity.Zone = zone
+	identity.AccountID = computeEngine.ProjectID
+	identity.InstanceID = computeEngine.InstanceID
+	identity.Verified = true
+	return nil
+}
+
+// decodeJWTSegment decodes a base64url encoded JSON segment of a JWT.
+func decodeJWTSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// withQuery returns the endpoint with the query parameter set.
+func withQuery(endpoint, key, value string) (string, error) {
+	if endpoint == "" {
+		return "", nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(key, value)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// jwksCacheEntry holds signing keys until the expiry published with them.
+type jwksCacheEntry struct {
+	keys    map[string]*rsa.PublicKey
+	expires time.Time
+}
+
+// jwksCache caches the fetched signing keys by URL.
+var jwksCache = struct {
+	mu      sync.Mutex
+	entries map[string]jwksCacheEntry
+}{entries: make(map[string]jwksCacheEntry)}
+
+// fetchJWKS returns the RSA public keys in JWK set format, keyed by key ID. Keys are cached until
+// the expiry of the response, refresh bypasses the cache. It reports whether the keys were cached.
+func fetchJWKS(ctx context.Context, client IMDSClient, endpoint string, now time.Time, refresh bool) (map[string]*rsa.PublicKey, bool, error) {
+	jwksCache.mu.Lock()
+	entry, ok := jwksCache.entries[endpoint]
+	jwksCache.mu.Unlock()
+	if ok && !refresh && now.Before(entry.expires) {
+		return entry.keys, true, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch GCP signing keys: %w", err)
+	}
+	resp, err := doIMDS(client, req)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch GCP signing keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("failed to fetch GCP signing keys: unexpected status %d", resp.StatusCode)
+	}
+	body, err := readIMDSBody(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch GCP signing keys: %w", err)
+	}
+	keys, err := parseJWKS(body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	jwksCache.mu.Lock()
+	defer jwksCache.mu.Unlock()
+	if expires, ok := responseExpiry(resp.Header, now); ok {
+		jwksCache.entries[endpoint] = jwksCacheEntry{keys: keys, expires: expires}
+	} else {
+		delete(jwksCache.entries, endpoint)
+	}
+	return keys, false, nil
+}
+
+// responseExpiry returns the expiry of a response from its Cache-Control max-age or Expires header.
+func responseExpiry(header http.Header, now time.Time) (time.Time, bool) {
+	if cacheControl := header.Get("Cache-Control"); cacheControl != "" {
+		for _, directive := range strings.Split(cacheControl, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "no-store" || directive == "no-cache" {
+				return time.Time{}, false
+			}
+			if value, ok := strings.CutPrefix(directive, "max-age="); ok {
+				seconds, err := strconv.Atoi(value)
+				if err != nil || seconds <= 0 {
+					return time.Time{}, false
+				}
+				return now.Add(time.Duration(seconds) * time.Second), true
+			}
+		}
+	}
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil && expires.After(now) {
+		return expires, true
+	}
+	return time.Time{}, false
+}
+
+// parseJWKS parses RSA public keys in JWK set format, keyed by key ID.
+func parseJWKS(body []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, fmt.Errorf("failed to decode GCP signing keys: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GCP signing key %s: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GCP signing key %s: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,388 @@
+// Package inventory detects the cloud provider, region and zones of a fleet of clusters from the
+// contexts of their kubeconfigs, and renders the fleet inventory as a table, JSON or CSV.
+package inventory
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// DefaultParallelism is the default number of clusters detected at once
+	DefaultParallelism = 8
+	// DefaultTimeout is the default timeout of the detection of a cluster
+	DefaultTimeout = 30 * time.Second
+
+	// ErrorTypeKubeconfig is the error type of the clusters whose kubeconfig cannot be loaded
+	ErrorTypeKubeconfig = "kubeconfig"
+)
+
+// Output formats of Write
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+	FormatCSV   = "csv"
+)
+
+// Cluster is a kubeconfig context to inventory
+type Cluster struct {
+	// Name of the cluster in the inventory: the context name, prefixed with the kubeconfig file
+	// name when several files of a directory have a context of that name
+	Name       string
+	Kubeconfig string
+	Context    string
+}
+
+// Config represents the configuration of an inventory
+type Config struct {
+	// Parallelism is the number of clusters detected at once, DefaultParallelism when 0
+	Parallelism int
+	// Timeout of the detection of each cluster, DefaultTimeout when 0
+	Timeout time.Duration
+	// Node label keys and region policy of the detection
+	Node cloudinfo.NodeConfig
+	// NewClient returns the client of a cluster, built from its kubeconfig context when nil
+	NewClient func(cluster Cluster) (kubernetes.Interface, error)
+}
+
+// ZoneNodes is the number of nodes of a zone
+type ZoneNodes struct {
+	Zone  string `json:"zone"`
+	Nodes int    `json:"nodes"`
+}
+
+// ClusterInventory is the detected cloud info and node counts of a cluster. The region is empty
+// when the nodes span several regions under the strict region policy.
+type ClusterInventory struct {
+	Cluster    string      `json:"cluster"`
+	Context    string      `json:"context"`
+	Kubeconfig string      `json:"kubeconfig"`
+	Provider   string      `json:"provider"`
+	Region     string      `json:"region"`
+	Zones      []ZoneNodes `json:"zones"`
+	Nodes      int         `json:"nodes"`
+	// Node counts by capacity type, e.g. "on-demand" and "spot"
+	CapacityTypes map[string]int `json:"capacityTypes,omitempty"`
+}
+
+// Failure is a cluster whose kubeconfig could not be loaded or whose detection failed
+type Failure struct {
+	Cluster    string `json:"cluster"`
+	Context    string `json:"context,omitempty"`
+	Kubeconfig string `json:"kubeconfig"`
+	// ErrorTypeKubeconfig, or the cloudinfo.ErrorType of the detection error
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
+// Inventory is the inventory of a fleet of clusters, in the order of their kubeconfig contexts
+type Inventory struct {
+	Clusters []ClusterInventory `json:"clusters"`
+	Failures []Failure          `json:"failures"`
+}
+
+// LoadClusters returns the contexts of the kubeconfig at path or, when path is a directory, of
+// every kubeconfig in it, sorted by file and context name. Hidden files and subdirectories are
+// skipped. The files of a directory that cannot be loaded are returned as failures; a single
+// kubeconfig that cannot be loaded is an error.
+func LoadClusters(path string) ([]Cluster, []Failure, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read kubeconfig: %w", err)
+	}
+	if !stat.IsDir() {
+		clusters, err := loadKubeconfig(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return clusters, nil, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read kubeconfig directory: %w", err)
+	}
+	var clusters []Cluster
+	var failures []Failure
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		file := filepath.Join(path, entry.Name())
+		loaded, err := loadKubeconfig(file)
+		if err != nil {
+			failures = append(failures, Failure{Cluster: entry.Name(), Kubeconfig: file, ErrorType: ErrorTypeKubeconfig, Error: err.Error()})
+			continue
+		}
+		clusters = append(clusters, loaded...)
+	}
+
+	prefixSharedNames(clusters)
+	return clusters, failures, nil
+}
+
+// prefixSharedNames prefixes the names shared by several clusters with their file name.
+func prefixSharedNames(clusters []Cluster) {
+	counts := make(map[string]int)
+	for _, c := range clusters {
+		counts[c.Name]++
+	}
+	for i, c := range clusters {
+		if counts[c.Name] > 1 {
+			clusters[i].Name = filepath.Base(c.Kubeconfig) + "/" + c.Name
+		}
+	}
+}
+
+// loadKubeconfig returns the contexts of a kubeconfig file, sorted by name.
+func loadKubeconfig(path string) ([]Cluster, error) {
+	config, err := clientcmd.LoadFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	if len(config.Contexts) == 0 {
+		return nil, fmt.Errorf("failed to load kubeconfig %s: no contexts", path)
+	}
+	var clusters []Cluster
+	for _, name := range slices.Sorted(maps.Keys(config.Contexts)) {
+		clusters = append(clusters, Cluster{Name: name, Kubeconfig: path, Context: name})
+	}
+	return clusters, nil
+}
+
+// Run inventories the clusters of the kubeconfig, or directory of kubeconfigs, at path.
+func Run(ctx context.Context, path string, config Config) (*Inventory, error) {
+	clusters, failures, err := LoadClusters(path)
+	if err != nil {
+		return nil, err
+	}
+	inventory := Collect(ctx, clusters, config)
+	inventory.Failures = append(failures, inventory.Failures...)
+	return inventory, nil
+}
+
+// RunPaths inventories the clusters of several kubeconfigs or directories of kubeconfigs, e.g.
+// the entries of $KUBECONFIG. A single path is inventoried like Run. With several, the paths
+// that cannot be loaded are reported as failures, and the names shared by several files are
+// prefixed with their file name.
+func RunPaths(ctx context.Context, paths []string, config Config) (*Inventory, error) {
+	switch len(paths) {
+	case 0:
+		return nil, errors.New("no kubeconfig path")
+	case 1:
+		return Run(ctx, paths[0], config)
+	}
+	var clusters []Cluster
+	var failures []Failure
+	for _, path := range paths {
+		loaded, loadFailures, err := LoadClusters(path)
+		if err != nil {
+			failures = append(failures, Failure{Cluster: filepath.Base(path), Kubeconfig: path, ErrorType: ErrorTypeKubeconfig, Error: err.Error()})
+			continue
+		}
+		clusters = append(clusters, loaded...)
+		failures = append(failures, loadFailures...)
+	}
+	prefixSharedNames(clusters)
+	inventory := Collect(ctx, clusters, config)
+	inventory.Failures = append(failures, inventory.Failures...)
+	return inventory, nil
+}
+
+// Collect detects the clusters concurrently, at most Config.Parallelism at once. Clusters that
+// fail are returned as failures and do not stop the others. When the context is done, the
+// clusters not started yet are returned as failures with its error.
+func Collect(ctx context.Context, clusters []Cluster, config Config) *Inventory {
+	if config.Parallelism <= 0 {
+		config.Parallelism = DefaultParallelism
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.NewClient == nil {
+		config.NewClient = kubeconfigClient
+	}
+
+	type result struct {
+		cluster *ClusterInventory
+		failure *Failure
+	}
+	results := make([]result, len(clusters))
+	semaphore := make(chan struct{}, config.Parallelism)
+	var wg sync.WaitGroup
+	for i, cluster := range clusters {
+		if ctx.Err() == nil {
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			// The clusters not started yet are reported as failures of the cancelled context
+			for j, cluster := range clusters[i:] {
+				results[i+j] = result{failure: &Failure{
+					Cluster: cluster.Name, Context: cluster.Context, Kubeconfig: cluster.Kubeconfig,
+					ErrorType: cloudinfo.ErrorType(err), Error: err.Error(),
+				}}
+			}
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			inventory, failure := detect(ctx, cluster, config)
+			results[i] = result{cluster: inventory, failure: failure}
+		}()
+	}
+	wg.Wait()
+
+	inventory := &Inventory{Clusters: []ClusterInventory{}, Failures: []Failure{}}
+	for _, r := range results {
+		if r.failure != nil {
+			inventory.Failures = append(inventory.Failures, *r.failure)
+		} else {
+			inventory.Clusters = append(inventory.Clusters, *r.cluster)
+		}
+	}
+	return inventory
+}
+
+// detect returns the inventory of a cluster, or its failure.
+func detect(ctx context.Context, cluster Cluster, config Config) (*ClusterInventory, *Failure) {
+	failure := &Failure{Cluster: cluster.Name, Context: cluster.Context, Kubeconfig: cluster.Kubeconfig}
+	client, err := config.NewClient(cluster)
+	if err != nil {
+		failure.ErrorType, failure.Error = ErrorTypeKubeconfig, err.Error()
+		return nil, failure
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+	attributes, err := cloudinfo.GetNodeAttributesWithConfig(ctx, client, config.Node)
+	var info *cloudinfo.CloudInfo
+	if err == nil {
+		info, err = cloudinfo.CloudInfoFromNodeAttributes(attributes, config.Node.RegionPolicy)
+	}
+	switch {
+	case errors.Is(err, cloudinfo.ErrMultipleRegions):
+		// Clusters spanning several regions are reported without a region, with their zones and nodes
+		var provider string
+		provider, err = cloudinfo.ParseProviderIDs(attributes.ProviderIDs)
+		info = &cloudinfo.CloudInfo{Provider: provider, Source: "node-labels"}
+	case err == nil:
+		err = cloudinfo.ValidateRegion(info.Region)
+	}
+	if err != nil {
+		failure.ErrorType, failure.Error = cloudinfo.ErrorType(err), err.Error()
+		return nil, failure
+	}
+
+	inventory := &ClusterInventory{
+		Cluster:       cluster.Name,
+		Context:       cluster.Context,
+		Kubeconfig:    cluster.Kubeconfig,
+		Provider:      info.Provider,
+		Region:        info.Region,
+		Zones:         []ZoneNodes{},
+		Nodes:         len(attributes.Nodes),
+		CapacityTypes: make(map[string]int),
+	}
+	zones := make(map[string]int)
+	for _, node := range attributes.Nodes {
+		if node.Zone != "" {
+			zones[node.Zone]++
+		}
+		inventory.CapacityTypes[node.CapacityType]++
+	}
+	for _, zone := range slices.Sorted(maps.Keys(zones)) {
+		inventory.Zones = append(inventory.Zones, ZoneNodes{Zone: zone, Nodes: zones[zone]})
+	}
+	return inventory, nil
+}
+
+// kubeconfigClient returns the client of the cluster's kubeconfig context.
+func kubeconfigClient(cluster Cluster) (kubernetes.Interface, error) {
+	rules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: cluster.Kubeconfig}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: cluster.Context}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig context: %w", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// Write renders the inventory in the format: FormatTable, FormatJSON or FormatCSV.
+func (i *Inventory) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatTable:
+		return i.writeTable(w)
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(i)
+	case FormatCSV:
+		return i.writeCSV(w)
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// writeTable renders the clusters, then the failures, as aligned columns.
+func (i *Inventory) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLUSTER\tPROVIDER\tREGION\tZONES\tNODES")
+	for _, c := range i.Clusters {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", c.Cluster, c.Provider, c.Region, formatZones(c.Zones), c.Nodes)
+	}
+	if len(i.Failures) > 0 {
+		fmt.Fprintln(tw, "\nFAILED CLUSTER\tERROR TYPE\tERROR")
+		for _, f := range i.Failures {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Cluster, f.ErrorType, f.Error)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%d clusters, %d failed\n", len(i.Clusters)+len(i.Failures), len(i.Failures))
+	return err
+}
+
+// writeCSV renders a row per cluster, the failures with their error type and error.
+func (i *Inventory) writeCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	rows := [][]string{{"cluster", "context", "kubeconfig", "provider", "region", "zones", "nodes", "error_type", "error"}}
+	for _, c := range i.Clusters {
+		rows = append(rows, []string{c.Cluster, c.Context, c.Kubeconfig, c.Provider, c.Region, formatZones(c.Zones), strconv.Itoa(c.Nodes), "", ""})
+	}
+	for _, f := range i.Failures {
+		rows = append(rows, []string{f.Cluster, f.Context, f.Kubeconfig, "", "", "", "", f.ErrorType, f.Error})
+	}
+	return writer.WriteAll(rows)
+}
+
+// formatZones renders the zones and their node counts, e.g. "us-west-2a=3 us-west-2b=2".
+func formatZones(zones []ZoneNodes) string {
+	parts := make([]string, 0, len(zones))
+	for _, z := range zones {
+		parts = append(parts, z.Zone+"="+strconv.Itoa(z.Nodes))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,192 @@
+// Package labeler provides a controller that labels a Kubernetes node with the cloud info detected
+// from the instance metadata service of the node it runs on.
+package labeler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// ProviderLabel is the label key for the cloud provider of the node
+	ProviderLabel = "cloudinfo.carbon-aware.io/provider"
+	// GridZoneLabel is the label key for the electricity grid zone of the node
+	GridZoneLabel = "cloudinfo.carbon-aware.io/grid-zone"
+)
+
+// ConflictPolicy defines what happens when a node already has a label with a different value
+type ConflictPolicy string
+
+const (
+	// NeverOverwrite keeps existing label values and reports them as conflicts
+	NeverOverwrite ConflictPolicy = "never"
+	// Overwrite replaces existing label values with the detected ones
+	Overwrite ConflictPolicy = "overwrite"
+)
+
+// Config represents the configuration of the node labeler
+type Config struct {
+	// Name of the node to label, usually from the downward API in DaemonSet mode
+	NodeName string
+	// If set, labels are computed but the node is not patched
+	DryRun bool
+	// What to do with existing labels, NeverOverwrite by default
+	ConflictPolicy ConflictPolicy
+	// Interval between reconciliations in Run, DefaultInterval when 0
+	Interval time.Duration
+
+	IMDSClient cloudinfo.IMDSClient
+	// IMDS endpoints, retries and circuit breaker, DefaultIMDSConfig when nil
+	IMDSConfig *cloudinfo.IMDSConfig
+}
+
+// DefaultInterval is the default interval between reconciliations
+const DefaultInterval = 10 * time.Minute
+
+// Conflict represents a label left unchanged because of the conflict policy
+type Conflict struct {
+	Key      string
+	Current  string
+	Detected string
+}
+
+// Result represents the outcome of a reconciliation
+type Result struct {
+	// Labels added or changed on the node, or that would be in dry-run mode
+	Labels map[string]string
+	// Labels with a different existing value that were not overwritten
+	Conflicts []Conflict
+	// Whether the node was patched
+	Patched bool
+}
+
+// Labeler labels a node with its detected region, zone and grid zone
+type Labeler struct {
+	client kubernetes.Interface
+	config Config
+}
+
+// New returns a node labeler for the given node.
+func New(client kubernetes.Interface, config Config) (*Labeler, error) {
+	if config.NodeName == "" {
+		return nil, fmt.Errorf("node name is required")
+	}
+	switch config.ConflictPolicy {
+	case "":
+		config.ConflictPolicy = NeverOverwrite
+	case NeverOverwrite, Overwrite:
+	default:
+		return nil, fmt.Errorf("unknown conflict policy: %s", config.ConflictPolicy)
+	}
+	if config.Interval == 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.IMDSClient == nil {
+		config.IMDSClient = cloudinfo.DefaultIMDSClient()
+	}
+	if config.IMDSConfig == nil {
+		imdsConfig := cloudinfo.DefaultIMDSConfig()
+		config.IMDSConfig = &imdsConfig
+	}
+	return &Labeler{client: client, config: config}, nil
+}
+
+// Labels returns the node labels for a detected instance identity. Empty values are omitted.
+func Labels(identity *cloudinfo.InstanceIdentity) (map[string]string, error) {
+	gridZone, err := cloudinfo.GridZone(identity.Provider, identity.Region)
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string)
+	for key, value := range map[string]string{
+		cloudinfo.RegionLabel: identity.Region,
+		cloudinfo.ZoneLabel:   identity.Zone,
+		ProviderLabel:         identity.Provider,
+		GridZoneLabel:         gridZone,
+	} {
+		if value != "" {
+			labels[key] = value
+		}
+	}
+	return labels, nil
+}
+
+// Reconcile detects the instance identity and patches the missing or outdated node labels.
+func (l *Labeler) Reconcile(ctx context.Context) (*Result, error) {
+	identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(ctx, l.config.IMDSClient, *l.config.IMDSConfig)
+	if err != nil {
+		return nil, err
+	}
+	desired, err := Labels(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := l.client.CoreV1().Nodes().Get(ctx, l.config.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node %s: %w", l.config.NodeName, err)
+	}
+
+	result := &Result{Labels: make(map[string]string)}
+	for key, value := range desired {
+		current, ok := node.Labels[key]
+		switch {
+		case !ok:
+			result.Labels[key] = value
+		case current == value:
+		case l.config.ConflictPolicy == Overwrite:
+			result.Labels[key] = value
+		default:
+			result.Conflicts = append(result.Conflicts, Conflict{Key: key, Current: current, Detected: value})
+		}
+	}
+	sort.Slice(result.Conflicts, func(i, j int) bool {
+		return result.Conflicts[i].Key < result.Conflicts[j].Key
+	})
+
+	if len(result.Labels) == 0 || l.config.DryRun {
+		return result, nil
+	}
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{"labels": result.Labels},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode node patch: %w", err)
+	}
+	_, err = l.client.CoreV1().Nodes().Patch(ctx, l.config.NodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to patch node %s: %w", l.config.NodeName, err)
+	}
+	result.Patched = true
+	return result, nil
+}
+
+// Run reconciles the node labels on the configured interval until the context is cancelled.
+// The first reconciliation error is returned, later ones are reported and retried.
+func (l *Labeler) Run(ctx context.Context) error {
+	if _, err := l.Reconcile(ctx); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(l.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if _, err := l.Reconcile(ctx); err != nil {
+				utilruntime.HandleError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Package metrics provides Prometheus metrics of the detected cloud topology and of the detectors.
+package metrics
+
+import (
+	"time"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics records detections as Prometheus metrics. It implements cloudinfo.Observer:
+//
+//	m, err := metrics.New(registry)
+//	info, err := cloudinfo.DetectCloudInfo(cloudinfo.WithObserver(ctx, m), client, opts)
+type Metrics struct {
+	info              *prometheus.GaugeVec
+	regionNodes       *prometheus.GaugeVec
+	zoneNodes         *prometheus.GaugeVec
+	detectionAttempts *prometheus.CounterVec
+	detectionFailures *prometheus.CounterVec
+	detectionDuration *prometheus.HistogramVec
+	imdsProbeDuration *prometheus.HistogramVec
+}
+
+// New creates the metrics and registers them with the registerer.
+func New(registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		info: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cloudinfo_info",
+			Help: "Cloud provider and region of the last successful detection consensus, always 1.",
+		}, []string{"provider", "region", "source"}),
+		regionNodes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cloudinfo_region_nodes",
+			Help: "Number of cluster nodes per region.",
+		}, []string{"region"}),
+		zoneNodes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cloudinfo_zone_nodes",
+			Help: "Number of cluster nodes per zone.",
+		}, []string{"region", "zone"}),
+		detectionAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cloudinfo_detection_attempts_total",
+			Help: "Number of detection attempts per detector.",
+		}, []string{"detector"}),
+		detectionFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cloudinfo_detection_failures_total",
+			Help: "Number of failed detections per detector and error type.",
+		}, []string{"detector", "error_type"}),
+		detectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cloudinfo_detection_duration_seconds",
+			Help:    "Duration of detection attempts per detector.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}, []string{"detector"}),
+		imdsProbeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cloudinfo_imds_probe_duration_seconds",
+			Help:    "Duration of IMDS probes per provider and result (success, unavailable, unreachable or error).",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}, []string{"provider", "result"}),
+	}
+
+	for _, collector := range []prometheus.Collector{
+		m.info, m.regionNodes, m.zoneNodes,
+		m.detectionAttempts, m.detectionFailures, m.detectionDuration, m.imdsProbeDuration,
+	} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ObserveDetection records a detection attempt of a detector.
+func (m *Metrics) ObserveDetection(detector string, _ *cloudinfo.CloudInfo, duration time.Duration, err error) {
+	m.detectionAttempts.WithLabelValues(detector).Inc()
+	m.detectionDuration.WithLabelValues(detector).Observe(duration.Seconds())
+	if err != nil {
+		m.detectionFailures.WithLabelValues(detector, cloudinfo.ErrorType(err)).Inc()
+	}
+}
+
+// ObserveResult records the detected cloud info.
+func (m *Metrics) ObserveResult(info *cloudinfo.CloudInfo) {
+	m.info.Reset()
+	m.info.WithLabelValues(info.Provider, info.Region, info.Source).Set(1)
+}
+
+// ObserveIMDSProbe records the duration of an IMDS probe.
+func (m *Metrics) ObserveIMDSProbe(provider string, duration time.Duration, err error) {
+	result := "success"
+	switch {
+	case cloudinfo.ErrorType(err) == "unavailable", cloudinfo.ErrorType(err) == "unreachable":
+		result = cloudinfo.ErrorType(err)
+	case err != nil:
+		result = "error"
+	}
+	m.imdsProbeDuration.WithLabelValues(provider, result).Observe(duration.Seconds())
+}
+
+// ObserveNodes records the node counts per region and zone. Regions and zones without nodes
+// are removed.
+func (m *Metrics) ObserveNodes(attributes *cloudinfo.NodeAttributes) {
+	m.regionNodes.Reset()
+	m.zoneNodes.Reset()
+	for _, node := range attributes.Nodes {
+		m.regionNodes.WithLabelValues(node.Region).Inc()
+		m.zoneNodes.WithLabelValues(node.Region, node.Zone).Inc()
+	}
+}
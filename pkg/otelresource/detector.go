@@ -0,0 +1,208 @@
+// Package otelresource provides an OpenTelemetry resource detector populating the cloud.*
+// resource attributes from the cloud info detection.
+package otelresource
+
+import (
+	"context"
+	"errors"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Config represents the configuration of the detector
+type Config struct {
+	// Detection methods and their consensus, as in cloudinfo.DetectCloudInfo. The HTTP client,
+	// IMDS and runtime configurations below are used when the options do not set them.
+	Options cloudinfo.Options
+
+	IMDSClient cloudinfo.IMDSClient
+	// IMDS endpoints, retries and circuit breaker, DefaultIMDSConfig when nil
+	IMDSConfig *cloudinfo.IMDSConfig
+	// Runtime environment, DefaultRuntimeConfig when nil
+	RuntimeConfig *cloudinfo.RuntimeConfig
+}
+
+// DefaultConfig returns the default configuration, detecting from the runtime environment and IMDS
+func DefaultConfig() Config {
+	imdsConfig := cloudinfo.DefaultIMDSConfig()
+	runtimeConfig := cloudinfo.DefaultRuntimeConfig()
+	return Config{
+		Options:       cloudinfo.Options{UseRuntime: true, UseIMDS: true},
+		IMDSClient:    cloudinfo.DefaultIMDSClient(),
+		IMDSConfig:    &imdsConfig,
+		RuntimeConfig: &runtimeConfig,
+	}
+}
+
+// Detector is a resource.Detector setting cloud.provider, cloud.platform, cloud.region,
+// cloud.availability_zone and cloud.account.id when they are detected.
+type Detector struct {
+	client kubernetes.Interface
+	config Config
+}
+
+var _ resource.Detector = (*Detector)(nil)
+
+// New returns a detector. The Kubernetes client is only used with node label detection and may
+// be nil otherwise.
+func New(client kubernetes.Interface, config Config) *Detector {
+	if config.IMDSClient == nil {
+		config.IMDSClient = cloudinfo.DefaultIMDSClient()
+	}
+	if config.IMDSConfig == nil {
+		imdsConfig := cloudinfo.DefaultIMDSConfig()
+		config.IMDSConfig = &imdsConfig
+	}
+	if config.RuntimeConfig == nil {
+		runtimeConfig := cloudinfo.DefaultRuntimeConfig()
+		config.RuntimeConfig = &runtimeConfig
+	}
+	return &Detector{client: client, config: config}
+}
+
+// Detect returns the cloud resource. When no cloud is detected, an empty resource is returned so
+// that the detector can be combined with others in resource.New.
+func (d *Detector) Detect(ctx context.Context) (*resource.Resource, error) {
+	info, identity, zone, err := d.detect(ctx)
+	if errors.Is(err, cloudinfo.ErrNoNodes) || errors.Is(err, cloudinfo.ErrRuntimeNotDetected) || errors.Is(err, cloudinfo.ErrIMDSNotDetected) {
+		return resource.Empty(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := []attribute.KeyValue{CloudProvider(info.Provider)}
+	if platform, ok := CloudPlatform(info); ok {
+		attributes = append(attributes, platform)
+	}
+	if info.Region != "" {
+		attributes = append(attributes, semconv.CloudRegion(info.Region))
+	}
+	if zone != "" {
+		attributes = append(attributes, semconv.CloudAvailabilityZone(zone))
+	}
+	if identity != nil && identity.AccountID != "" {
+		attributes = append(attributes, semconv.CloudAccountID(identity.AccountID))
+	}
+	return resource.NewWithAttributes(semconv.SchemaURL, attributes...), nil
+}
+
+// detect runs cloudinfo.DetectCloudInfo with the configured detectors and completes its result.
+// When IMDS provides it, the instance identity of the detected provider is read for the zone and
+// account on a best effort basis; when node labels do, the zone and managed Kubernetes platform
+// shared by all nodes are reported.
+func (d *Detector) detect(ctx context.Context) (*cloudinfo.CloudInfo, *cloudinfo.InstanceIdentity, string, error) {
+	opts := d.config.Options
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = d.config.IMDSClient
+	}
+	if opts.IMDSConfig == nil {
+		opts.IMDSConfig = d.config.IMDSConfig
+	}
+	if opts.RuntimeConfig == nil {
+		opts.RuntimeConfig = d.config.RuntimeConfig
+	}
+	info, attributes, err := cloudinfo.DetectCloudInfoWithNodes(ctx, d.client, opts)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	switch {
+	case info.Source == "node-labels" && attributes != nil:
+		if info.Platform == "" {
+			info.Platform = commonPlatform(attributes.Nodes)
+		}
+		return info, nil, commonZone(attributes.Nodes), nil
+	case info.Source == "imds":
+		if opts.DetectorTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, opts.DetectorTimeout)
+			defer cancel()
+		}
+		identity, err := cloudinfo.ReadIMDSInstanceIdentityWithClient(ctx, opts.HTTPClient, *opts.IMDSConfig, info, opts.IMDSVerification)
+		if err != nil {
+			opts.Logger.V(1).Info("failed to read the instance identity", "provider", info.Provider, "error", err.Error())
+			return info, nil, "", nil
+		}
+		return info, identity, identity.Zone, nil
+	}
+	return info, nil, "", nil
+}
+
+// commonZone returns the zone of the nodes, or an empty string when they span several zones.
+func commonZone(nodes []cloudinfo.NodeInfo) string {
+	zone := ""
+	for i, node := range nodes {
+		if i > 0 && node.Zone != zone {
+			return ""
+		}
+		zone = node.Zone
+	}
+	return zone
+}
+
+// commonPlatform returns the managed Kubernetes platform of the nodes, or an empty string when
+// some nodes are self-managed or run on another platform.
+func commonPlatform(nodes []cloudinfo.NodeInfo) string {
+	platform := ""
+	for i, node := range nodes {
+		if i > 0 && node.Platform != platform {
+			return ""
+		}
+		platform = node.Platform
+	}
+	return platform
+}
+
+// CloudProvider returns the cloud.provider attribute of a cloudinfo provider name.
+func CloudProvider(provider string) attribute.KeyValue {
+	switch provider {
+	case "alibaba":
+		return semconv.CloudProviderAlibabaCloud
+	case "ibm":
+		return semconv.CloudProviderIbmCloud
+	default:
+		return semconv.CloudProviderKey.String(provider)
+	}
+}
+
+// imdsPlatforms maps the providers detected with IMDS to their virtual machines cloud.platform value
+var imdsPlatforms = map[string]attribute.KeyValue{
+	"aws":     semconv.CloudPlatformAWSEC2,
+	"gcp":     semconv.CloudPlatformGCPComputeEngine,
+	"azure":   semconv.CloudPlatformAzureVM,
+	"alibaba": semconv.CloudPlatformAlibabaCloudECS,
+}
+
+// platforms maps runtime and managed Kubernetes platforms to their cloud.platform value
+var platforms = map[string]attribute.KeyValue{
+	cloudinfo.PlatformAWSECS:             semconv.CloudPlatformAWSECS,
+	cloudinfo.PlatformAWSFargate:         semconv.CloudPlatformAWSECS,
+	cloudinfo.PlatformAWSLambda:          semconv.CloudPlatformAWSLambda,
+	cloudinfo.PlatformGCPCloudRun:        semconv.CloudPlatformGCPCloudRun,
+	cloudinfo.PlatformAzureContainerApps: semconv.CloudPlatformAzureContainerApps,
+	cloudinfo.PlatformAzureAppService:    semconv.CloudPlatformAzureAppService,
+	cloudinfo.PlatformAzureFunctions:     semconv.CloudPlatformAzureFunctions,
+	cloudinfo.PlatformAWSEKS:             semconv.CloudPlatformAWSEKS,
+	cloudinfo.PlatformGKE:                semconv.CloudPlatformGCPKubernetesEngine,
+	cloudinfo.PlatformAKS:                semconv.CloudPlatformAzureAKS,
+}
+
+// CloudPlatform returns the cloud.platform attribute of a detected cloud info: its runtime or
+// managed Kubernetes platform, or the provider's virtual machines with IMDS detection. The second
+// return value is false when there is no matching semconv value.
+func CloudPlatform(info *cloudinfo.CloudInfo) (attribute.KeyValue, bool) {
+	if info.Platform != "" {
+		platform, ok := platforms[info.Platform]
+		return platform, ok
+	}
+	if info.Source == "imds" {
+		platform, ok := imdsPlatforms[info.Provider]
+		return platform, ok
+	}
+	return attribute.KeyValue{}, false
+}
@@ -0,0 +1,309 @@
+// Package publisher provides a controller that publishes the detected cloud info of the cluster
+// into a ConfigMap and, optionally, a ClusterCloudInfo custom resource.
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/carbon-aware/cloudinfo/pkg/apis/cloudinfo/v1alpha1"
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// DefaultNamespace is the namespace of the published ConfigMap
+	DefaultNamespace = "kube-system"
+	// DefaultName is the name of the published ConfigMap
+	DefaultName = "cloudinfo"
+	// ClusterCloudInfoName is the name of the published ClusterCloudInfo
+	ClusterCloudInfoName = "cluster"
+	// DefaultInterval is the default interval between detections
+	DefaultInterval = 5 * time.Minute
+)
+
+// Config represents the configuration of the publisher
+type Config struct {
+	// Detection methods passed to DetectCloudInfo
+	Options cloudinfo.Options
+	// Namespace and name of the ConfigMap, DefaultNamespace and DefaultName when empty
+	Namespace string
+	Name      string
+	// Interval between detections in Run, DefaultInterval when 0. With node label detection,
+	// node changes also trigger a detection.
+	Interval time.Duration
+	// If set, the ClusterCloudInfo custom resource is published too
+	Dynamic dynamic.Interface
+	// Now returns the detection time, time.Now when nil
+	Now func() time.Time
+}
+
+// Publisher publishes the detected cloud info of the cluster
+type Publisher struct {
+	client kubernetes.Interface
+	config Config
+}
+
+// New returns a publisher using the given Kubernetes client for detection and publishing.
+func New(client kubernetes.Interface, config Config) *Publisher {
+	if config.Namespace == "" {
+		config.Namespace = DefaultNamespace
+	}
+	if config.Name == "" {
+		config.Name = DefaultName
+	}
+	if config.Interval == 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	return &Publisher{client: client, config: config}
+}
+
+// Publish detects the cloud info and publishes it. When the nodes span several regions, the
+// provider is published with an empty region. When detection fails, the ConfigMap keeps its
+// previous data and the ClusterCloudInfo Detected condition is set to false.
+func (p *Publisher) Publish(ctx context.Context) error {
+	now := p.config.Now()
+	info, attributes, detectErr := cloudinfo.DetectCloudInfoWithNodes(ctx, p.client, p.config.Options)
+	if errors.Is(detectErr, cloudinfo.ErrMultipleRegions) && attributes != nil {
+		if provider, err := cloudinfo.ParseProviderIDs(attributes.ProviderIDs); err == nil {
+			info, detectErr = &cloudinfo.CloudInfo{Provider: provider, Source: "node-labels"}, nil
+		}
+	}
+
+	var regions []v1alpha1.RegionStatus
+	if attributes != nil {
+		regions = regionBreakdown(info, attributes)
+	}
+
+	if detectErr == nil {
+		if err := p.publishConfigMap(ctx, info, now); err != nil {
+			return err
+		}
+	}
+	if p.config.Dynamic != nil {
+		if err := p.publishClusterCloudInfo(ctx, info, regions, detectErr, now); err != nil {
+			return err
+		}
+	}
+	return detectErr
+}
+
+// ConfigMapData returns the ConfigMap data of a detected cloud info.
+func ConfigMapData(info *cloudinfo.CloudInfo, detected time.Time) (map[string]string, error) {
+	gridZone, err := cloudinfo.GridZone(info.Provider, info.Region)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]string{
+		"provider":     info.Provider,
+		"region":       info.Region,
+		"source":       info.Source,
+		"verified":     strconv.FormatBool(info.Verified),
+		"lastDetected": detected.UTC().Format(time.RFC3339),
+	}
+	for key, value := range map[string]string{
+		"platform":     info.Platform,
+		"capacityType": info.CapacityType,
+		"gridZone":     gridZone,
+	} {
+		if value != "" {
+			data[key] = value
+		}
+	}
+	return data, nil
+}
+
+func (p *Publisher) publishConfigMap(ctx context.Context, info *cloudinfo.CloudInfo, now time.Time) error {
+	data, err := ConfigMapData(info, now)
+	if err != nil {
+		return err
+	}
+	configMaps := p.client.CoreV1().ConfigMaps(p.config.Namespace)
+
+	configMap, err := configMaps.Get(ctx, p.config.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: p.config.Name, Namespace: p.config.Namespace},
+			Data:       data,
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to create ConfigMap %s/%s: %w", p.config.Namespace, p.config.Name, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get ConfigMap %s/%s: %w", p.config.Namespace, p.config.Name, err)
+	}
+
+	configMap.Data = data
+	if _, err := configMaps.Update(ctx, configMap, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update ConfigMap %s/%s: %w", p.config.Namespace, p.config.Name, err)
+	}
+	return nil
+}
+
+func (p *Publisher) publishClusterCloudInfo(ctx context.Context, info *cloudinfo.CloudInfo, regions []v1alpha1.RegionStatus, detectErr error, now time.Time) error {
+	resource := p.config.Dynamic.Resource(v1alpha1.ClusterCloudInfoResource)
+
+	object, err := resource.Get(ctx, ClusterCloudInfoName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		object = &unstructured.Unstructured{}
+		object.SetAPIVersion(v1alpha1.GroupVersion.String())
+		object.SetKind("ClusterCloudInfo")
+		object.SetName(ClusterCloudInfoName)
+		object, err = resource.Create(ctx, object, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to create ClusterCloudInfo: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to get ClusterCloudInfo: %w", err)
+	}
+
+	var clusterInfo v1alpha1.ClusterCloudInfo
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, &clusterInfo); err != nil {
+		return fmt.Errorf("failed to decode ClusterCloudInfo: %w", err)
+	}
+
+	status := &clusterInfo.Status
+	if regions != nil {
+		status.Regions = regions
+	}
+	condition := metav1.Condition{
+		Type:               v1alpha1.ConditionDetected,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Detected",
+		ObservedGeneration: clusterInfo.Generation,
+		LastTransitionTime: metav1.NewTime(now),
+	}
+	if detectErr != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "DetectionFailed"
+		condition.Message = detectErr.Error()
+	} else {
+		gridZone, err := cloudinfo.GridZone(info.Provider, info.Region)
+		if err != nil {
+			return err
+		}
+		status.Provider = info.Provider
+		status.Region = info.Region
+		status.Source = info.Source
+		status.GridZone = gridZone
+		lastDetected := metav1.NewTime(now)
+		status.LastDetected = &lastDetected
+		condition.Message = fmt.Sprintf("Detected %s/%s from %s", info.Provider, info.Region, info.Source)
+		if info.Region == "" {
+			condition.Reason = "MultipleRegions"
+			condition.Message = fmt.Sprintf("Detected %s with nodes in several regions from %s", info.Provider, info.Source)
+		}
+	}
+	meta.SetStatusCondition(&status.Conditions, condition)
+
+	object.Object, err = runtime.DefaultUnstructuredConverter.ToUnstructured(&clusterInfo)
+	if err != nil {
+		return fmt.Errorf("failed to encode ClusterCloudInfo: %w", err)
+	}
+	if _, err := resource.UpdateStatus(ctx, object, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update ClusterCloudInfo status: %w", err)
+	}
+	return nil
+}
+
+// regionBreakdown returns the node count, capacity types and grid zone of each region. The grid
+// zone is looked up with the detected provider, or the provider of the nodes' provider IDs.
+func regionBreakdown(info *cloudinfo.CloudInfo, attributes *cloudinfo.NodeAttributes) []v1alpha1.RegionStatus {
+	provider := ""
+	if info != nil {
+		provider = info.Provider
+	} else if p, err := cloudinfo.ParseProviderIDs(attributes.ProviderIDs); err == nil {
+		provider = p
+	}
+
+	nodes := make(map[string]int32)
+	for _, node := range attributes.Nodes {
+		if node.Region != "" {
+			nodes[node.Region]++
+		}
+	}
+
+	regions := make([]v1alpha1.RegionStatus, 0, len(nodes))
+	for _, region := range slices.Sorted(maps.Keys(nodes)) {
+		status := v1alpha1.RegionStatus{Region: region, Nodes: nodes[region]}
+		if counts := attributes.CapacityTypeCounts[region]; len(counts) > 0 {
+			status.CapacityTypes = make(map[string]int32, len(counts))
+			for capacityType, count := range counts {
+				status.CapacityTypes[capacityType] = int32(count)
+			}
+		}
+		status.GridZone, _ = cloudinfo.GridZone(provider, region)
+		regions = append(regions, status)
+	}
+	return regions
+}
+
+// Run publishes the cloud info on the configured interval, and on node changes with node label
+// detection, until the context is cancelled. Publishing errors, including the first one, are
+// reported and retried.
+func (p *Publisher) Run(ctx context.Context) error {
+	if err := p.Publish(ctx); err != nil {
+		utilruntime.HandleError(err)
+	}
+
+	trigger := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+	if slices.Contains(p.config.Options.EnabledDetectors(), cloudinfo.DetectorNodeLabels) {
+		factory := informers.NewSharedInformerFactory(p.client, 0)
+		_, err := factory.Core().V1().Nodes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(any) { notify() },
+			UpdateFunc: func(oldObj, newObj any) {
+				oldNode, newNode := oldObj.(*corev1.Node), newObj.(*corev1.Node)
+				if !maps.Equal(oldNode.Labels, newNode.Labels) || oldNode.Spec.ProviderID != newNode.Spec.ProviderID {
+					notify()
+				}
+			},
+			DeleteFunc: func(any) { notify() },
+		})
+		if err != nil {
+			return fmt.Errorf("failed to watch nodes: %w", err)
+		}
+		factory.Start(ctx.Done())
+		defer factory.Shutdown()
+		factory.WaitForCacheSync(ctx.Done())
+	}
+
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-trigger:
+		}
+		if err := p.Publish(ctx); err != nil {
+			utilruntime.HandleError(err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Package server provides an HTTP server that periodically detects the cloud info of the cluster
+// and serves it, along with the detection metrics.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultInterval is the default interval between detections
+const DefaultInterval = 5 * time.Minute
+
+// Config represents the configuration of the server
+type Config struct {
+	// Detection methods passed to DetectCloudInfo
+	Options cloudinfo.Options
+	// Interval between detections in Run, DefaultInterval when 0
+	Interval time.Duration
+	// Registry of the served metrics. When nil, a new registry with the Go and process
+	// collectors is used.
+	Registry *prometheus.Registry
+}
+
+// Response is the JSON document served at /cloudinfo
+type Response struct {
+	Provider     string  `json:"provider,omitempty"`
+	Region       string  `json:"region,omitempty"`
+	Source       string  `json:"source,omitempty"`
+	Platform     string  `json:"platform,omitempty"`
+	CapacityType string  `json:"capacityType,omitempty"`
+	Verified     bool    `json:"verified"`
+	Confidence   float64 `json:"confidence,omitempty"`
+	// Detector results disagreeing with the served cloud info
+	Conflicts    []cloudinfo.Conflict `json:"conflicts,omitempty"`
+	LastDetected time.Time            `json:"lastDetected,omitzero"`
+	// Error of the last detection, the other fields are those of the last successful detection
+	Error string `json:"error,omitempty"`
+}
+
+// Server detects and serves the cloud info of the cluster
+type Server struct {
+	client   kubernetes.Interface
+	config   Config
+	metrics  *metrics.Metrics
+	mu       sync.RWMutex
+	response Response
+	report   *cloudinfo.Report
+}
+
+// New returns a server detecting the cloud info with the given Kubernetes client.
+func New(client kubernetes.Interface, config Config) (*Server, error) {
+	if config.Interval == 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.Registry == nil {
+		config.Registry = prometheus.NewRegistry()
+		config.Registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+	m, err := metrics.New(config.Registry)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{client: client, config: config, metrics: m}, nil
+}
+
+// Detect runs a detection, recording its metrics, and updates the served cloud info and report.
+func (s *Server) Detect(ctx context.Context) error {
+	report, err := cloudinfo.ExplainCloudInfo(cloudinfo.WithObserver(ctx, s.metrics), s.client, s.config.Options)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.report = report
+	info := report.Result
+	if err != nil {
+		s.response.Error = err.Error()
+		return err
+	}
+	s.response = Response{
+		Provider:     info.Provider,
+		Region:       info.Region,
+		Source:       info.Source,
+		Platform:     info.Platform,
+		CapacityType: info.CapacityType,
+		Verified:     info.Verified,
+		Confidence:   info.Confidence,
+		Conflicts:    info.Conflicts,
+		LastDetected: time.Now().UTC(),
+	}
+	return nil
+}
+
+// Handler returns the HTTP handler of the server, serving "/cloudinfo", "/explain", "/metrics"
+// and "/healthz".
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(s.config.Registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("GET /cloudinfo", s.serveCloudInfo)
+	mux.HandleFunc("GET /explain", s.serveReport)
+	mux.HandleFunc("GET /healthz", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+// serveCloudInfo serves the last detected cloud info, with a 503 status until a detection succeeds.
+func (s *Server) serveCloudInfo(rw http.ResponseWriter, _ *http.Request) {
+	s.mu.RLock()
+	response := s.response
+	s.mu.RUnlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+	if response.LastDetected.IsZero() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(rw).Encode(&response)
+}
+
+// serveReport serves the report of the last detection as JSON, or as text with "?format=text",
+// with a 503 status until a detection ran.
+func (s *Server) serveReport(rw http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	report := s.report
+	s.mu.RUnlock()
+
+	if report == nil {
+		http.Error(rw, "no detection yet", http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Query().Get("format") == "text" {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.WriteString(rw, report.String())
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(report)
+}
+
+// Run serves HTTP on the listener and detects the cloud info on the configured interval until
+// the context is cancelled. Detection errors are served and recorded, not returned.
+func (s *Server) Run(ctx context.Context, listener net.Listener) error {
+	server := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		_ = s.Detect(ctx)
+		select {
+		case err := <-errs:
+			return err
+		case <-ticker.C:
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				return err
+			}
+			if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		}
+	}
+}
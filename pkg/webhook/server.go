@@ -0,0 +1,110 @@
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertificateReloader serves a TLS certificate from files, reloading it when the files change,
+// e.g. when cert-manager renews the certificate in a mounted Secret.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+// NewCertificateReloader loads the certificate and key from the given PEM files.
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, for use as tls.Config.GetCertificate. When
+// the files cannot be reloaded, the previous certificate is kept.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err == nil && (r.certificate == nil || modTime.After(r.modTime)) {
+		certificate, loadErr := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if loadErr == nil {
+			r.certificate = &certificate
+			r.modTime = modTime
+		}
+		err = loadErr
+	}
+	if r.certificate == nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	return r.certificate, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Handler returns the HTTP handler of the webhook, serving "/mutate" and "/healthz".
+func (w *Webhook) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("POST /mutate", w)
+	mux.HandleFunc("GET /healthz", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+// Serve serves the webhook over TLS on the listener until the context is cancelled.
+func (w *Webhook) Serve(ctx context.Context, listener net.Listener, certificates *CertificateReloader) error {
+	server := &http.Server{
+		Handler:           w.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certificates.GetCertificate,
+		},
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ServeTLS(listener, "", "")
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			return err
+		}
+		if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,274 @@
+// Package webhook provides a mutating admission webhook that injects the cloud info of the node a
+// pod runs on into its environment variables and annotations.
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	// InjectLabel opts pods or namespaces in ("true") or out ("false") of the injection. The pod
+	// label takes precedence over the namespace label.
+	InjectLabel = "cloudinfo.carbon-aware.io/inject"
+
+	// ProviderAnnotation is the annotation key for the cloud provider of the pod
+	ProviderAnnotation = "cloudinfo.carbon-aware.io/provider"
+	// RegionAnnotation is the annotation key for the region of the pod
+	RegionAnnotation = "cloudinfo.carbon-aware.io/region"
+	// ZoneAnnotation is the annotation key for the zone of the pod
+	ZoneAnnotation = "cloudinfo.carbon-aware.io/zone"
+	// GridZoneAnnotation is the annotation key for the electricity grid zone of the pod
+	GridZoneAnnotation = "cloudinfo.carbon-aware.io/grid-zone"
+
+	// ProviderEnv is the environment variable for the cloud provider of the pod
+	ProviderEnv = "CLOUD_PROVIDER"
+	// RegionEnv is the environment variable for the region of the pod
+	RegionEnv = "CLOUD_REGION"
+	// ZoneEnv is the environment variable for the zone of the pod
+	ZoneEnv = "CLOUD_ZONE"
+	// GridZoneEnv is the environment variable for the electricity grid zone of the pod
+	GridZoneEnv = "CLOUD_GRID_ZONE"
+)
+
+// Config represents the configuration of the webhook
+type Config struct {
+	// If set, environment variables are injected into the containers
+	Env bool
+	// If set, annotations are added to the pod
+	Annotations bool
+}
+
+// PodCloudInfo is the cloud info resolved for a pod. Fields are empty when the candidate nodes
+// of the pod disagree.
+type PodCloudInfo struct {
+	Provider string
+	Region   string
+	Zone     string
+	GridZone string
+}
+
+// Webhook is the mutating admission webhook handler
+type Webhook struct {
+	nodes      corelisters.NodeLister
+	namespaces corelisters.NamespaceLister
+	config     Config
+}
+
+// New returns a webhook resolving cloud info from the given node and namespace listers.
+func New(nodes corelisters.NodeLister, namespaces corelisters.NamespaceLister, config Config) *Webhook {
+	return &Webhook{nodes: nodes, namespaces: namespaces, config: config}
+}
+
+// Resolve returns the cloud info of the node a pod is scheduled on. Pods that are not scheduled
+// yet are resolved from the nodes matching their node selector, such as a region selector.
+func (w *Webhook) Resolve(pod *corev1.Pod) (*PodCloudInfo, error) {
+	var nodes []*corev1.Node
+	if pod.Spec.NodeName != "" {
+		node, err := w.nodes.Get(pod.Spec.NodeName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get node %s: %w", pod.Spec.NodeName, err)
+		}
+		nodes = []*corev1.Node{node}
+	} else {
+		var err error
+		nodes, err = w.nodes.List(labels.SelectorFromSet(pod.Spec.NodeSelector))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list nodes: %w", err)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes found")
+	}
+
+	// Only keep the values all the candidate nodes agree on
+	info := &PodCloudInfo{}
+	for i, node := range nodes {
+		provider, _ := cloudinfo.ParseProviderID(node.Spec.ProviderID)
+		if i == 0 {
+			info.Provider = provider
+			info.Region = node.Labels[cloudinfo.RegionLabel]
+			info.Zone = node.Labels[cloudinfo.ZoneLabel]
+			continue
+		}
+		if info.Provider != provider {
+			info.Provider = ""
+		}
+		if info.Region != node.Labels[cloudinfo.RegionLabel] {
+			info.Region = ""
+		}
+		if info.Zone != node.Labels[cloudinfo.ZoneLabel] {
+			info.Zone = ""
+		}
+	}
+
+	if info.Provider != "" && info.Region != "" {
+		gridZone, err := cloudinfo.GridZone(info.Provider, info.Region)
+		if err != nil {
+			return nil, err
+		}
+		info.GridZone = gridZone
+	}
+	return info, nil
+}
+
+// ServeHTTP handles AdmissionReview requests for pods.
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(rw, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = w.Admit(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(&review); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Admit returns the admission response of a pod admission request. Pods are always allowed:
+// when the cloud info cannot be resolved, the pod is admitted unchanged.
+func (w *Webhook) Admit(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{Allowed: true}
+
+	var pod corev1.Pod
+	if err := json.Unmarshal(request.Object.Raw, &pod); err != nil {
+		response.Result = &metav1.Status{Message: fmt.Sprintf("failed to decode pod: %v", err)}
+		return response
+	}
+	// The namespace is not set on pods created by controllers
+	if pod.Namespace == "" {
+		pod.Namespace = request.Namespace
+	}
+	if !w.optedIn(&pod) {
+		return response
+	}
+
+	info, err := w.Resolve(&pod)
+	if err != nil {
+		response.Warnings = []string{fmt.Sprintf("cloudinfo: %v", err)}
+		return response
+	}
+
+	patch, err := json.Marshal(w.patch(&pod, info))
+	if err != nil {
+		response.Result = &metav1.Status{Message: fmt.Sprintf("failed to encode patch: %v", err)}
+		return response
+	}
+	if string(patch) == "[]" {
+		return response
+	}
+	patchType := admissionv1.PatchTypeJSONPatch
+	response.Patch = patch
+	response.PatchType = &patchType
+	return response
+}
+
+// optedIn returns whether the pod, or its namespace, opted in to the injection.
+func (w *Webhook) optedIn(pod *corev1.Pod) bool {
+	if value, ok := pod.Labels[InjectLabel]; ok {
+		return value == "true"
+	}
+	namespace, err := w.namespaces.Get(pod.Namespace)
+	if err != nil {
+		return false
+	}
+	return namespace.Labels[InjectLabel] == "true"
+}
+
+// patchOperation is a JSON patch operation
+type patchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// patch returns the JSON patch injecting the cloud info. Existing environment variables and
+// annotations are left unchanged.
+func (w *Webhook) patch(pod *corev1.Pod, info *PodCloudInfo) []patchOperation {
+	operations := []patchOperation{}
+
+	if w.config.Env {
+		var env []corev1.EnvVar
+		for _, v := range [][2]string{
+			{ProviderEnv, info.Provider},
+			{RegionEnv, info.Region},
+			{ZoneEnv, info.Zone},
+			{GridZoneEnv, info.GridZone},
+		} {
+			if v[1] != "" {
+				env = append(env, corev1.EnvVar{Name: v[0], Value: v[1]})
+			}
+		}
+		for i, container := range pod.Spec.InitContainers {
+			operations = append(operations, envPatch(fmt.Sprintf("/spec/initContainers/%d/env", i), container.Env, env)...)
+		}
+		for i, container := range pod.Spec.Containers {
+			operations = append(operations, envPatch(fmt.Sprintf("/spec/containers/%d/env", i), container.Env, env)...)
+		}
+	}
+
+	if w.config.Annotations {
+		annotations := pod.Annotations
+		for _, a := range [][2]string{
+			{ProviderAnnotation, info.Provider},
+			{RegionAnnotation, info.Region},
+			{ZoneAnnotation, info.Zone},
+			{GridZoneAnnotation, info.GridZone},
+		} {
+			if _, ok := annotations[a[0]]; ok || a[1] == "" {
+				continue
+			}
+			if annotations == nil {
+				annotations = map[string]string{}
+				operations = append(operations, patchOperation{Op: "add", Path: "/metadata/annotations", Value: annotations})
+			}
+			operations = append(operations, patchOperation{Op: "add", Path: "/metadata/annotations/" + escapeJSONPointer(a[0]), Value: a[1]})
+		}
+	}
+
+	return operations
+}
+
+// envPatch returns the operations adding the missing environment variables of a container.
+func envPatch(path string, existing, env []corev1.EnvVar) []patchOperation {
+	var operations []patchOperation
+	for _, v := range env {
+		if containsEnv(existing, v.Name) {
+			continue
+		}
+		if existing == nil {
+			existing = []corev1.EnvVar{}
+			operations = append(operations, patchOperation{Op: "add", Path: path, Value: existing})
+		}
+		operations = append(operations, patchOperation{Op: "add", Path: path + "/-", Value: v})
+	}
+	return operations
+}
+
+func containsEnv(env []corev1.EnvVar, name string) bool {
+	for _, v := range env {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeJSONPointer escapes a JSON pointer reference token (RFC 6901).
+func escapeJSONPointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
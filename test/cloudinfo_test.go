@@ -25,11 +25,11 @@ var _ = ginkgo.Describe("CloudInfo", func() {
 	})
 
 	ginkgo.Context("when both detection methods are specified", func() {
-		ginkgo.It("should prioritize node labels over IMDS", func() {
+		ginkgo.It("should return the errors of both when both fail", func() {
 			client := fake.NewSimpleClientset()
 			_, err := cloudinfo.DetectCloudInfo(ctx, client, cloudinfo.Options{UseNodeLabels: true, UseIMDS: true})
-			gomega.Expect(err).To(gomega.HaveOccurred())
-			gomega.Expect(err.Error()).To(gomega.Equal("no nodes found"))
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrNoNodes))
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
 		})
 	})
 
@@ -42,5 +42,14 @@ var _ = ginkgo.Describe("CloudInfo", func() {
 		})
 	})
 
+	ginkgo.Context("when only runtime detection is specified", func() {
+		ginkgo.It("should attempt runtime detection", func() {
+			client := fake.NewSimpleClientset()
+			_, err := cloudinfo.DetectCloudInfo(ctx, client, cloudinfo.Options{UseRuntime: true})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("failed to detect serverless or container runtime"))
+		})
+	})
+
 	// Detailed node label and IMDS tests are in their respective test files.
 })
@@ -0,0 +1,168 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo/cloudinfotest"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Fake Metadata Server", func() {
+	var ctx context.Context
+
+	newServer := func(instance cloudinfotest.Instance) *cloudinfotest.Server {
+		server := cloudinfotest.NewServer(instance)
+		ginkgo.DeferCleanup(server.Close)
+		return server
+	}
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	ginkgo.DescribeTable("should emulate the provider",
+		func(instance cloudinfotest.Instance, expected cloudinfo.InstanceIdentity) {
+			server := newServer(instance)
+			identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(ctx, server.Client(), server.Config())
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(*identity).To(gomega.Equal(expected))
+		},
+		ginkgo.Entry("AWS", cloudinfotest.Instance{
+			Provider: "aws", Region: "us-west-2", AccountID: "123456789012", InstanceID: "i-0123456789abcdef0",
+			InstanceType: "m5.large", ImageID: "ami-12345678", Hostname: "ip-10-0-0-1.us-west-2.compute.internal",
+			CapacityType: cloudinfo.CapacityTypeSpot,
+		}, cloudinfo.InstanceIdentity{
+			Provider: "aws", Region: "us-west-2", Zone: "us-west-2a", AccountID: "123456789012", InstanceID: "i-0123456789abcdef0",
+			InstanceType: "m5.large", ImageID: "ami-12345678", PrivateHostname: "ip-10-0-0-1.us-west-2.compute.internal",
+			CapacityType: cloudinfo.CapacityTypeSpot,
+		}),
+		ginkgo.Entry("Azure", cloudinfotest.Instance{
+			Provider: "azure", Region: "westeurope", AccountID: "subscription-id", InstanceID: "vm-id",
+			InstanceType: "Standard_D2s_v3", ImageID: "image-id", Hostname: "vm-1", CapacityType: cloudinfo.CapacityTypeOnDemand,
+		}, cloudinfo.InstanceIdentity{
+			Provider: "azure", Region: "westeurope", Zone: "westeurope-1", AccountID: "subscription-id", InstanceID: "vm-id",
+			InstanceType: "Standard_D2s_v3", ImageID: "image-id", PrivateHostname: "vm-1", CapacityType: cloudinfo.CapacityTypeOnDemand,
+		}),
+		ginkgo.Entry("GCP", cloudinfotest.Instance{
+			Provider: "gcp", Region: "us-central1", AccountID: "my-project", InstanceID: "1234567890",
+			InstanceType: "e2-medium", Hostname: "vm-1.c.my-project.internal",
+		}, cloudinfo.InstanceIdentity{
+			Provider: "gcp", Region: "us-central1", Zone: "us-central1-a", AccountID: "my-project", InstanceID: "1234567890",
+			InstanceType: "e2-medium", PrivateHostname: "vm-1.c.my-project.internal", CapacityType: cloudinfo.CapacityTypeUnknown,
+		}),
+	)
+
+	ginkgo.Context("when emulating AWS", func() {
+		ginkgo.It("should require an IMDSv2 session token", func() {
+			server := newServer(cloudinfotest.Instance{Provider: "aws", Region: "eu-west-1"})
+			info, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, server.Client(), server.Config())
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Region).To(gomega.Equal("eu-west-1"))
+
+			requests := server.Requests()
+			gomega.Expect(requests[0].Method).To(gomega.Equal(http.MethodPut))
+			gomega.Expect(requests[0].Path).To(gomega.Equal(cloudinfotest.AWSTokenPath))
+			gomega.Expect(requests[1].Path).To(gomega.Equal(cloudinfotest.AWSRegionPath))
+			gomega.Expect(requests[1].Header.Get("X-aws-ec2-metadata-token")).NotTo(gomega.BeEmpty())
+
+			config := server.Config()
+			config.AWSTokenEndpoint = ""
+			_, err = cloudinfo.DetectIMDSCloudInfoWithClient(ctx, server.Client(), config)
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+		})
+
+		ginkgo.It("should reuse the session token within a detection", func() {
+			server := newServer(cloudinfotest.Instance{
+				Provider: "aws", Region: "eu-west-1", InstanceID: "i-0123456789abcdef0", CapacityType: cloudinfo.CapacityTypeSpot,
+			})
+			_, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(ctx, server.Client(), server.Config())
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+			var puts int
+			for _, request := range server.Requests() {
+				if request.Method == http.MethodPut {
+					puts++
+				}
+			}
+			gomega.Expect(puts).To(gomega.Equal(1))
+			gomega.Expect(len(server.Requests())).To(gomega.BeNumerically(">", 2))
+		})
+
+		ginkgo.It("should fall back to IMDSv1 when no token is issued", func() {
+			server := newServer(cloudinfotest.Instance{Provider: "aws", Region: "eu-west-1", AllowIMDSv1: true})
+			server.SetFault(cloudinfotest.AWSTokenPath, cloudinfotest.Fault{Status: http.StatusForbidden})
+			info, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, server.Client(), server.Config())
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Region).To(gomega.Equal("eu-west-1"))
+			gomega.Expect(server.Requests()[1].Header.Get("X-aws-ec2-metadata-token")).To(gomega.BeEmpty())
+		})
+	})
+
+	ginkgo.It("should derive a numeric GCP instance ID from the others", func() {
+		server := newServer(cloudinfotest.Instance{Provider: "gcp", Region: "us-central1", InstanceID: "vm-1"})
+		identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(ctx, server.Client(), server.Config())
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(identity.InstanceID).To(gomega.MatchRegexp(`^[0-9]+$`))
+
+		again, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(ctx, server.Client(), server.Config())
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(again.InstanceID).To(gomega.Equal(identity.InstanceID))
+	})
+
+	ginkgo.It("should check the Azure and GCP metadata headers", func() {
+		for _, provider := range []string{"azure", "gcp"} {
+			server := newServer(cloudinfotest.Instance{Provider: provider, Region: "region"})
+			resp, err := server.Client().Get(server.Config().AzureEndpoint)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(resp.Body.Close()).To(gomega.Succeed())
+			gomega.Expect(resp.StatusCode).To(gomega.BeNumerically(">=", http.StatusBadRequest))
+			resp, err = server.Client().Get(server.Config().GCPEndpoint)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(resp.Body.Close()).To(gomega.Succeed())
+			gomega.Expect(resp.StatusCode).To(gomega.BeNumerically(">=", http.StatusBadRequest))
+		}
+	})
+
+	ginkgo.Context("when injecting faults", func() {
+		var server *cloudinfotest.Server
+
+		ginkgo.BeforeEach(func() {
+			server = newServer(cloudinfotest.Instance{Provider: "azure", Region: "westeurope"})
+		})
+
+		ginkgo.It("should return malformed bodies", func() {
+			server.SetFault(cloudinfotest.AzureLocationPath, cloudinfotest.Fault{Body: `{"location":`})
+			_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, server.Client(), server.Config())
+			gomega.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("failed to decode Azure location")))
+		})
+
+		ginkgo.It("should return errors and closed connections", func() {
+			server.SetFault(cloudinfotest.AzureLocationPath, cloudinfotest.Fault{Status: http.StatusInternalServerError})
+			_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, server.Client(), server.Config())
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+
+			server.SetFault(cloudinfotest.AzureLocationPath, cloudinfotest.Fault{CloseConnection: true})
+			_, err = cloudinfo.DetectIMDSCloudInfoWithClient(ctx, server.Client(), server.Config())
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+
+			server.ClearFaults()
+			info, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, server.Client(), server.Config())
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Region).To(gomega.Equal("westeurope"))
+		})
+
+		ginkgo.It("should delay the answers", func() {
+			server.SetLatency(time.Second)
+			client := server.Client()
+			client.Timeout = 50 * time.Millisecond
+			start := time.Now()
+			_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, client, server.Config())
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+			gomega.Expect(time.Since(start)).To(gomega.BeNumerically("<", time.Second))
+		})
+	})
+})
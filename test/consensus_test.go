@@ -0,0 +1,114 @@
+package test
+
+import (
+	"context"
+	"os"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo/cloudinfotest"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = ginkgo.Describe("Consensus", func() {
+	var ctx context.Context
+	var client *fake.Clientset
+	opts := cloudinfo.Options{UseNodeLabels: true, UseRuntime: true}
+
+	createNodes := func(region string) {
+		gomega.Expect(cloudinfotest.EKSCluster(region, 2).Load(ctx, client)).To(gomega.Succeed())
+	}
+
+	// setLambdaRegion makes runtime detection report a Lambda function in the region
+	setLambdaRegion := func(region string) {
+		for key, value := range map[string]string{"AWS_LAMBDA_FUNCTION_NAME": "my-function", "AWS_REGION": region} {
+			gomega.Expect(os.Setenv(key, value)).To(gomega.Succeed())
+			ginkgo.DeferCleanup(os.Unsetenv, key)
+		}
+	}
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+		client = fake.NewSimpleClientset()
+	})
+
+	ginkgo.It("should reinforce the confidence of agreeing detectors", func() {
+		createNodes("us-west-2")
+		setLambdaRegion("us-west-2")
+
+		info, err := cloudinfo.DetectCloudInfo(ctx, client, opts)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(info.Provider).To(gomega.Equal("aws"))
+		gomega.Expect(info.Region).To(gomega.Equal("us-west-2"))
+		gomega.Expect(info.Source).To(gomega.Equal("runtime"))
+		gomega.Expect(info.Platform).To(gomega.Equal(cloudinfo.PlatformAWSLambda))
+		gomega.Expect(info.Confidence).To(gomega.BeNumerically("~", 1-0.05*0.1, 1e-9))
+		gomega.Expect(info.Conflicts).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should return the best supported result with the conflicts", func() {
+		createNodes("us-west-2")
+		setLambdaRegion("eu-west-1")
+
+		info, err := cloudinfo.DetectCloudInfo(ctx, client, opts)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(info.Region).To(gomega.Equal("eu-west-1"))
+		gomega.Expect(info.Source).To(gomega.Equal("runtime"))
+		gomega.Expect(info.Confidence).To(gomega.BeNumerically("~", 0.95*0.1, 1e-9))
+		gomega.Expect(info.Conflicts).To(gomega.Equal([]cloudinfo.Conflict{
+			{Detector: "node-labels", Provider: "aws", Region: "us-west-2", Confidence: 0.9},
+		}))
+	})
+
+	ginkgo.It("should fail on conflict when configured to", func() {
+		createNodes("us-west-2")
+		setLambdaRegion("eu-west-1")
+
+		failOpts := opts
+		failOpts.FailOnConflict = true
+		_, err := cloudinfo.DetectCloudInfo(ctx, client, failOpts)
+		gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrConflict))
+		gomega.Expect(err.Error()).To(gomega.Equal("detectors disagree: aws/eu-west-1 from runtime, aws/us-west-2 from node-labels"))
+		gomega.Expect(cloudinfo.ErrorType(err)).To(gomega.Equal("conflict"))
+	})
+
+	ginkgo.It("should ignore failed detectors when another succeeds", func() {
+		setLambdaRegion("eu-west-1")
+
+		info, err := cloudinfo.DetectCloudInfo(ctx, client, opts)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(info.Region).To(gomega.Equal("eu-west-1"))
+		gomega.Expect(info.Confidence).To(gomega.Equal(0.95))
+	})
+
+	ginkgo.It("should scale the node label reliability by the share of nodes in the region", func() {
+		cluster := cloudinfotest.MultiRegionCluster("aws", 3, "us-west-2")
+		cluster.AddNodePool(cloudinfotest.NodePool{Provider: "aws", Name: "east", Region: "us-east-1", Count: 1})
+		gomega.Expect(cluster.Load(ctx, client)).To(gomega.Succeed())
+
+		majority := cloudinfo.Options{Detectors: []string{cloudinfo.DetectorNodeLabels}, RegionPolicy: cloudinfo.RegionPolicyMajority}
+		info, err := cloudinfo.DetectCloudInfo(ctx, client, majority)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(info.Region).To(gomega.Equal("us-west-2"))
+		gomega.Expect(info.Confidence).To(gomega.BeNumerically("~", 0.9*3/4, 1e-9))
+
+		report, err := cloudinfo.ExplainCloudInfo(ctx, client, majority)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(report.Detectors[0].Candidates[0].Confidence).To(gomega.BeNumerically("~", info.Confidence, 1e-9))
+		gomega.Expect(report.Confidence).To(gomega.BeNumerically("~", info.Confidence, 1e-9))
+	})
+
+	ginkgo.It("should report every detector and the consensus confidence", func() {
+		createNodes("us-west-2")
+		setLambdaRegion("eu-west-1")
+
+		report, err := cloudinfo.ExplainCloudInfo(ctx, client, opts)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(report.Detectors).To(gomega.HaveLen(2))
+		gomega.Expect(report.Detectors[0].Detector).To(gomega.Equal("node-labels"))
+		gomega.Expect(report.Detectors[1].Detector).To(gomega.Equal("runtime"))
+		gomega.Expect(report.Confidence).To(gomega.BeNumerically("~", 0.095, 1e-9))
+		gomega.Expect(report.Result.Conflicts).To(gomega.HaveLen(1))
+	})
+})
@@ -0,0 +1,180 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo/cloudinfotest"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Dual-Stack Endpoints", func() {
+	var (
+		ctx      context.Context
+		instance cloudinfotest.Instance
+		// closedIPv4 and closedIPv6 are base URLs refusing connections, like an address family
+		// without a metadata service
+		closedIPv4, closedIPv6 string
+	)
+
+	newIPv4Server := func() *cloudinfotest.Server {
+		server := cloudinfotest.NewServer(instance)
+		ginkgo.DeferCleanup(server.Close)
+		return server
+	}
+	newIPv6Server := func() *cloudinfotest.Server {
+		server, err := cloudinfotest.NewIPv6Server(instance)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		ginkgo.DeferCleanup(server.Close)
+		return server
+	}
+	// awsConfig returns the configuration of the server with the AWS candidates
+	awsConfig := func(server *cloudinfotest.Server, candidates ...string) cloudinfo.IMDSConfig {
+		config := server.Config()
+		config.EndpointCandidates = map[string][]string{"aws": candidates}
+		return config
+	}
+	closedURL := func(server *httptest.Server) string {
+		server.Close()
+		return server.URL
+	}
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+		instance = cloudinfotest.Instance{
+			Provider: "aws", Region: "us-west-2", AccountID: "123456789012", InstanceID: "i-0123456789abcdef0",
+			InstanceType: "m5.large", Hostname: "ip-10-0-0-1.us-west-2.compute.internal",
+		}
+		closedIPv4 = closedURL(httptest.NewServer(http.NotFoundHandler()))
+		ipv6, err := cloudinfotest.NewIPv6Server(instance)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		closedIPv6 = closedURL(ipv6.Server)
+		gomega.Expect(closedIPv6).To(gomega.HavePrefix("http://[::1]:"))
+	})
+
+	ginkgo.It("should detect an IPv6-only instance", func() {
+		server := newIPv6Server()
+		identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(ctx, http.DefaultClient, awsConfig(server, closedIPv4, server.URL))
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(identity.Region).To(gomega.Equal("us-west-2"))
+		gomega.Expect(identity.InstanceID).To(gomega.Equal("i-0123456789abcdef0"))
+	})
+
+	ginkgo.It("should detect an IPv4-only instance", func() {
+		server := newIPv4Server()
+		identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(ctx, http.DefaultClient, awsConfig(server, server.URL, closedIPv6))
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(identity.Region).To(gomega.Equal("us-west-2"))
+		gomega.Expect(identity.InstanceID).To(gomega.Equal("i-0123456789abcdef0"))
+	})
+
+	ginkgo.It("should keep using the endpoint answering first on a dual-stack instance", func() {
+		ipv4, ipv6 := newIPv4Server(), newIPv6Server()
+		identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(ctx, http.DefaultClient, awsConfig(ipv4, ipv4.URL, ipv6.URL))
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(identity.Region).To(gomega.Equal("us-west-2"))
+
+		// Only the token request is raced, the following ones go to the endpoint answering it
+		documents := 0
+		for _, server := range []*cloudinfotest.Server{ipv4, ipv6} {
+			for _, request := range server.Requests() {
+				if request.Path == cloudinfotest.AWSIdentityDocumentPath {
+					documents++
+				}
+			}
+		}
+		gomega.Expect(documents).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should not detect an instance without metadata service on either address family", func() {
+		config := cloudinfo.IMDSConfig{
+			AWSEndpoint:        closedIPv4 + cloudinfotest.AWSRegionPath,
+			EndpointCandidates: map[string][]string{"aws": {closedIPv4, closedIPv6}},
+		}
+		_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, http.DefaultClient, config)
+		gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+	})
+
+	ginkgo.Context("when applying the environment", func() {
+		awsDefaults := func() cloudinfo.IMDSConfig {
+			return cloudinfo.IMDSConfig{
+				AWSTokenEndpoint:   cloudinfo.AWSIMDSIPv4 + cloudinfotest.AWSTokenPath,
+				AWSEndpoint:        cloudinfo.AWSIMDSIPv4 + cloudinfotest.AWSRegionPath,
+				EndpointCandidates: cloudinfo.DefaultEndpointCandidates(),
+			}
+		}
+		env := func(vars map[string]string) func(string) string {
+			return func(key string) string { return vars[key] }
+		}
+
+		ginkgo.It("should use the AWS endpoint of AWS_EC2_METADATA_SERVICE_ENDPOINT", func() {
+			server := newIPv6Server()
+			config := awsDefaults().ApplyEnv(env(map[string]string{"AWS_EC2_METADATA_SERVICE_ENDPOINT": server.URL + "/"}))
+			gomega.Expect(config.AWSEndpoint).To(gomega.Equal(server.URL + cloudinfotest.AWSRegionPath))
+			gomega.Expect(config.EndpointCandidates["aws"]).To(gomega.Equal([]string{server.URL}))
+			gomega.Expect(config.EndpointCandidates["gcp"]).To(gomega.Equal([]string{cloudinfo.GCPIMDSIPv4, cloudinfo.GCPIMDSIPv6}))
+
+			info, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, http.DefaultClient, config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Region).To(gomega.Equal("us-west-2"))
+		})
+
+		ginkgo.DescribeTable("should select the AWS endpoint with AWS_EC2_METADATA_SERVICE_ENDPOINT_MODE",
+			func(mode, base string) {
+				config := awsDefaults().ApplyEnv(env(map[string]string{"AWS_EC2_METADATA_SERVICE_ENDPOINT_MODE": mode}))
+				gomega.Expect(config.AWSTokenEndpoint).To(gomega.Equal(base + cloudinfotest.AWSTokenPath))
+				gomega.Expect(config.AWSEndpoint).To(gomega.Equal(base + cloudinfotest.AWSRegionPath))
+				gomega.Expect(config.EndpointCandidates["aws"]).To(gomega.Equal([]string{base}))
+			},
+			ginkgo.Entry("IPv6", "IPv6", cloudinfo.AWSIMDSIPv6),
+			ginkgo.Entry("IPv4", "ipv4", cloudinfo.AWSIMDSIPv4),
+		)
+
+		ginkgo.It("should disable AWS with AWS_EC2_METADATA_DISABLED", func() {
+			config := awsDefaults().ApplyEnv(env(map[string]string{"AWS_EC2_METADATA_DISABLED": "true"}))
+			gomega.Expect(config.AWSEndpoint).To(gomega.BeEmpty())
+			gomega.Expect(config.EndpointCandidates).NotTo(gomega.HaveKey("aws"))
+		})
+
+		ginkgo.It("should use the GCP host of GCE_METADATA_HOST", func() {
+			instance = cloudinfotest.Instance{Provider: "gcp", Region: "us-central1"}
+			server := newIPv6Server()
+			config := cloudinfo.IMDSConfig{
+				GCPEndpoint:        cloudinfo.GCPIMDSIPv4 + cloudinfotest.GCPZonePath,
+				EndpointCandidates: cloudinfo.DefaultEndpointCandidates(),
+			}.ApplyEnv(env(map[string]string{"GCE_METADATA_HOST": strings.TrimPrefix(server.URL, "http://")}))
+			gomega.Expect(config.GCPEndpoint).To(gomega.Equal(server.URL + cloudinfotest.GCPZonePath))
+
+			info, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, http.DefaultClient, config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Region).To(gomega.Equal("us-central1"))
+		})
+
+		ginkgo.It("should leave the configuration unchanged without the variables", func() {
+			gomega.Expect(awsDefaults().ApplyEnv(env(nil))).To(gomega.Equal(awsDefaults()))
+		})
+
+		ginkgo.It("should only read the process environment when loading options", func() {
+			previous, set := os.LookupEnv("AWS_EC2_METADATA_DISABLED")
+			gomega.Expect(os.Setenv("AWS_EC2_METADATA_DISABLED", "true")).To(gomega.Succeed())
+			ginkgo.DeferCleanup(func() {
+				if set {
+					_ = os.Setenv("AWS_EC2_METADATA_DISABLED", previous)
+				} else {
+					_ = os.Unsetenv("AWS_EC2_METADATA_DISABLED")
+				}
+			})
+
+			gomega.Expect(cloudinfo.DefaultIMDSConfig().AWSEndpoint).NotTo(gomega.BeEmpty())
+			gomega.Expect(cloudinfo.DefaultOptions().IMDSConfig.AWSEndpoint).NotTo(gomega.BeEmpty())
+			opts, err := cloudinfo.LoadOptions("")
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(opts.IMDSConfig.AWSEndpoint).To(gomega.BeEmpty())
+		})
+	})
+})
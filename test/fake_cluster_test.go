@@ -0,0 +1,79 @@
+package test
+
+import (
+	"context"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo/cloudinfotest"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = ginkgo.Describe("Fake Cluster", func() {
+	var ctx context.Context
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	ginkgo.DescribeTable("should generate nodes recognised by the node inspector",
+		func(cluster *cloudinfotest.Cluster, provider, region, instanceType string, zones []string) {
+			attributes, err := cloudinfo.GetNodeAttributes(ctx, cluster.Clientset())
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(attributes.Regions).To(gomega.Equal([]string{region}))
+			gomega.Expect(attributes.ProviderIDs).To(gomega.HaveLen(3))
+			providerName, err := cloudinfo.ParseProviderIDs(attributes.ProviderIDs)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(providerName).To(gomega.Equal(provider))
+
+			var nodeZones []string
+			for _, node := range cluster.Nodes() {
+				gomega.Expect(node.Labels).To(gomega.HaveKeyWithValue(cloudinfo.InstanceTypeLabel, instanceType))
+				gomega.Expect(node.Status.Capacity.Cpu().IsZero()).To(gomega.BeFalse())
+				nodeZones = append(nodeZones, node.Labels[cloudinfo.ZoneLabel])
+			}
+			gomega.Expect(nodeZones).To(gomega.Equal(zones))
+		},
+		ginkgo.Entry("EKS", cloudinfotest.EKSCluster("us-west-2", 3), "aws", "us-west-2", "m5.large",
+			[]string{"us-west-2a", "us-west-2b", "us-west-2c"}),
+		ginkgo.Entry("GKE", cloudinfotest.GKECluster("us-central1", 3), "gcp", "us-central1", "e2-standard-4",
+			[]string{"us-central1-a", "us-central1-b", "us-central1-c"}),
+		ginkgo.Entry("AKS", cloudinfotest.AKSCluster("eastus", 3), "azure", "eastus", "Standard_D2s_v3",
+			[]string{"eastus-1", "eastus-2", "eastus-3"}),
+	)
+
+	ginkgo.It("should set the capacity type labels of the provider", func() {
+		cluster := cloudinfotest.NewCluster()
+		for _, provider := range []string{"aws", "gcp", "azure"} {
+			cluster.AddNodePool(cloudinfotest.NodePool{Provider: provider, Name: "spot", Region: "region", CapacityType: cloudinfo.CapacityTypeSpot, Count: 1})
+		}
+		cluster.AddNodePool(cloudinfotest.NodePool{Provider: "aws", Name: "on-demand", Region: "region", CapacityType: cloudinfo.CapacityTypeOnDemand, Count: 1})
+
+		attributes, err := cloudinfo.GetNodeAttributes(ctx, cluster.Clientset())
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(attributes.CapacityTypeCounts).To(gomega.Equal(map[string]map[string]int{
+			"region": {cloudinfo.CapacityTypeSpot: 3, cloudinfo.CapacityTypeOnDemand: 1},
+		}))
+	})
+
+	ginkgo.It("should generate kind nodes without topology labels", func() {
+		nodes := cloudinfotest.KindCluster(2).Nodes()
+		gomega.Expect(nodes).To(gomega.HaveLen(3))
+		gomega.Expect(nodes[0].Name).To(gomega.Equal("kind-control-plane"))
+		gomega.Expect(nodes[2].Name).To(gomega.Equal("kind-worker2"))
+		gomega.Expect(nodes[2].Spec.ProviderID).To(gomega.Equal("kind://docker/kind/kind-worker2"))
+		gomega.Expect(nodes[2].Labels).NotTo(gomega.HaveKey(cloudinfo.RegionLabel))
+	})
+
+	ginkgo.It("should generate unique nodes across regions and load them into a clientset", func() {
+		cluster := cloudinfotest.MultiRegionCluster("gcp", 2, "us-central1", "europe-west1")
+		client := fake.NewSimpleClientset()
+		gomega.Expect(cluster.Load(ctx, client)).To(gomega.Succeed())
+
+		attributes, err := cloudinfo.GetNodeAttributes(ctx, client)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(attributes.ProviderIDs).To(gomega.HaveLen(4))
+		gomega.Expect(attributes.Regions).To(gomega.ConsistOf("us-central1", "europe-west1"))
+	})
+})
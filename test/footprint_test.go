@@ -0,0 +1,132 @@
+package test
+
+import (
+	"context"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = ginkgo.Describe("Footprint Estimation", func() {
+	var (
+		ctx    context.Context
+		client *fake.Clientset
+	)
+
+	createNode := func(name, instanceType, cpu string) {
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					"topology.kubernetes.io/region":    "us-east-1",
+					"node.kubernetes.io/instance-type": instanceType,
+				},
+			},
+			Spec: corev1.NodeSpec{
+				ProviderID: "aws:///us-east-1a/" + name,
+			},
+		}
+		if cpu != "" {
+			node.Status.Capacity = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)}
+		}
+		_, err := client.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	}
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+		client = fake.NewSimpleClientset()
+	})
+
+	ginkgo.Context("when all instance types are known", func() {
+		ginkgo.BeforeEach(func() {
+			createNode("node1", "m5.large", "2")
+			createNode("node2", "m5.xlarge", "")
+		})
+
+		ginkgo.It("should estimate power and emissions from the coefficients", func() {
+			estimate, err := cloudinfo.EstimateClusterFootprint(ctx, client)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(estimate.Provider).To(gomega.Equal("aws"))
+			gomega.Expect(estimate.Region).To(gomega.Equal("us-east-1"))
+			gomega.Expect(estimate.UnknownInstanceTypes).To(gomega.BeEmpty())
+
+			// Cascade Lake: 0.64-3.97 W per vCPU, 6 vCPUs in total
+			gomega.Expect(estimate.Nodes).To(gomega.HaveLen(2))
+			gomega.Expect(estimate.Nodes[1].VCPUs).To(gomega.Equal(int64(4)))
+			gomega.Expect(estimate.MinWatts).To(gomega.BeNumerically("~", 3.84, 1e-9))
+			gomega.Expect(estimate.MaxWatts).To(gomega.BeNumerically("~", 23.82, 1e-9))
+
+			gomega.Expect(estimate.GridIntensity).To(gomega.BeNumerically("~", 379.069, 1e-9))
+			gomega.Expect(estimate.MaxOperationalRate).To(gomega.BeNumerically("~", 23.82/1000*1.135*379.069, 1e-9))
+			gomega.Expect(estimate.EmbodiedRate).To(gomega.BeNumerically("~", 1542.7*1000*6/96/35040, 1e-9))
+		})
+	})
+
+	ginkgo.Context("when an instance type is unknown", func() {
+		ginkgo.BeforeEach(func() {
+			createNode("node1", "x99.huge", "8")
+		})
+
+		ginkgo.It("should fall back to provider averages", func() {
+			estimate, err := cloudinfo.EstimateClusterFootprint(ctx, client)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(estimate.UnknownInstanceTypes).To(gomega.Equal([]string{"x99.huge"}))
+			gomega.Expect(estimate.MinWatts).To(gomega.BeNumerically("~", 8*0.74, 1e-9))
+			gomega.Expect(estimate.MaxWatts).To(gomega.BeNumerically("~", 8*3.50, 1e-9))
+			// 15.6076 kgCO2e is the average embodied emissions per vCPU of the aws instances
+			gomega.Expect(estimate.EmbodiedRate).To(gomega.BeNumerically("~", 15.6076*1000*8/35040, 1e-3))
+		})
+	})
+
+	ginkgo.Context("when a node has no instance type label", func() {
+		ginkgo.BeforeEach(func() {
+			createNode("node1", "", "8")
+		})
+
+		ginkgo.It("should fall back to provider averages without reporting an unknown instance type", func() {
+			estimate, err := cloudinfo.EstimateClusterFootprint(ctx, client)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(estimate.UnknownInstanceTypes).To(gomega.BeEmpty())
+			gomega.Expect(estimate.MaxWatts).To(gomega.BeNumerically("~", 8*3.50, 1e-9))
+			gomega.Expect(estimate.EmbodiedRate).To(gomega.BeNumerically("~", 15.6076*1000*8/35040, 1e-3))
+		})
+	})
+
+	ginkgo.Context("when the vCPU count cannot be determined", func() {
+		ginkgo.BeforeEach(func() {
+			createNode("node1", "x99.huge", "")
+		})
+
+		ginkgo.It("should return an error", func() {
+			_, err := cloudinfo.EstimateClusterFootprint(ctx, client)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("unable to determine vCPU count for node: node1"))
+		})
+	})
+
+	ginkgo.Context("when the provider has no coefficients", func() {
+		ginkgo.It("should return an error", func() {
+			_, err := cloudinfo.EstimateFootprint("unknown", "somewhere", &cloudinfo.NodeAttributes{})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("no coefficients for provider: unknown"))
+		})
+	})
+
+	ginkgo.DescribeTable("should map regions to grid zones",
+		func(provider, region, zone string) {
+			gridZone, err := cloudinfo.GridZone(provider, region)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(gridZone).To(gomega.Equal(zone))
+		},
+		ginkgo.Entry("AWS", "aws", "us-west-2", "US-NW-BPAT"),
+		ginkgo.Entry("GCP", "gcp", "europe-west1", "BE"),
+		ginkgo.Entry("Azure", "azure", "westeurope", "NL"),
+		ginkgo.Entry("unknown region", "aws", "mars-north-1", ""),
+	)
+})
@@ -0,0 +1,84 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+)
+
+// The fuzz targets run their seed corpus with "go test ./test/", and fuzz with e.g.
+// "go test ./test/ -run '^$' -fuzz FuzzParseGCPZone -fuzztime 30s"
+
+func FuzzParseProviderID(f *testing.F) {
+	for _, seed := range []string{
+		"aws:///us-west-2a/i-0123456789abcdef0",
+		"gce://my-project/us-central1-a/gke-cluster-default-pool-1a2b3c4d-0000",
+		"azure:///subscriptions/12345678-1234-1234-1234-123456789012/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm",
+		"kind://docker/kind/kind-worker",
+		"://", "aws://", "", "no-scheme", "aws:///\n",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, providerID string) {
+		provider, err := cloudinfo.ParseProviderID(providerID)
+		if err == nil && (provider == "" || !strings.Contains(providerID, "://")) {
+			t.Errorf("ParseProviderID(%q) = %q without a scheme", providerID, provider)
+		}
+		providers, listErr := cloudinfo.ParseProviderIDs([]string{providerID, providerID})
+		if (listErr == nil) != (err == nil) || providers != provider {
+			t.Errorf("ParseProviderIDs(%q) = %q, %v, ParseProviderID = %q, %v", providerID, providers, listErr, provider, err)
+		}
+	})
+}
+
+func FuzzParseGCPZone(f *testing.F) {
+	for _, seed := range []string{
+		"projects/123456789/zones/us-central1-a",
+		"projects/-/zones/europe-west1-b",
+		"projects/123456789/zones/-",
+		"projects/123456789/zones/us-central1-",
+		"projects/123456789/zones/us central1-a",
+		"projects//zones//", "////", "", "-",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, zone string) {
+		zoneName, region, err := cloudinfo.ParseGCPZone(zone)
+		if err != nil {
+			return
+		}
+		if err := cloudinfo.ValidateRegion(region); err != nil {
+			t.Errorf("ParseGCPZone(%q) returned an invalid region: %v", zone, err)
+		}
+		if err := cloudinfo.ValidateZone(zoneName); err != nil {
+			t.Errorf("ParseGCPZone(%q) returned an invalid zone: %v", zone, err)
+		}
+		if !strings.HasPrefix(zoneName, region+"-") || !strings.HasSuffix(zone, "/"+zoneName) {
+			t.Errorf("ParseGCPZone(%q) = %q, %q", zone, zoneName, region)
+		}
+	})
+}
+
+func FuzzParseAzureLocation(f *testing.F) {
+	for _, seed := range []string{
+		`{"location": "westeurope"}`,
+		`{"location": "west europe"}`,
+		`{"location": "westeurope\n"}`,
+		`{"location": ""}`,
+		`{"location": 1}`,
+		`{"location":`,
+		`null`, `[]`, ``,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		location, err := cloudinfo.ParseAzureLocation(body)
+		if err != nil {
+			return
+		}
+		if err := cloudinfo.ValidateRegion(location); err != nil {
+			t.Errorf("ParseAzureLocation(%q) returned an invalid region: %v", body, err)
+		}
+	})
+}
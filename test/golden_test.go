@@ -0,0 +1,138 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo/cloudinfotest"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+)
+
+// updateGolden rewrites the golden files from the detection output, with
+// "go test ./test/ -update"
+var updateGolden = flag.Bool("update", false, "update the golden files of the fixture tests")
+
+// golden is the detection output replayed from a fixture
+type golden struct {
+	IMDS       *cloudinfo.InstanceIdentity `json:"imds,omitempty"`
+	IMDSError  string                      `json:"imdsError,omitempty"`
+	Nodes      *cloudinfo.CloudInfo        `json:"nodes,omitempty"`
+	NodesError string                      `json:"nodesError,omitempty"`
+}
+
+var _ = ginkgo.Describe("Golden Fixtures", func() {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "fixtures", "*.json"))
+	if err != nil {
+		panic(err)
+	}
+
+	for _, path := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		ginkgo.It("should detect "+name+" like the golden file", func() {
+			ctx := context.Background()
+			fixture, err := cloudinfotest.LoadFixture(path)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+			var result golden
+			if len(fixture.IMDS) > 0 {
+				result.IMDS, err = cloudinfo.DetectIMDSInstanceIdentityWithClient(ctx, fixture.IMDSClient(), fixture.IMDSConfig())
+				if err != nil {
+					result.IMDSError = err.Error()
+				}
+			}
+			if len(fixture.Nodes) > 0 {
+				result.Nodes, err = cloudinfo.DetectNodeCloudInfo(ctx, fixture.Clientset())
+				if err != nil {
+					result.NodesError = err.Error()
+				}
+			}
+			actual, err := json.MarshalIndent(&result, "", "  ")
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			actual = append(actual, '\n')
+
+			goldenPath := filepath.Join("testdata", "golden", name+".json")
+			if *updateGolden {
+				gomega.Expect(os.MkdirAll(filepath.Dir(goldenPath), 0o755)).To(gomega.Succeed())
+				gomega.Expect(os.WriteFile(goldenPath, actual, 0o644)).To(gomega.Succeed())
+			}
+			expected, err := os.ReadFile(goldenPath)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred(), "run go test ./test/ -update to create the golden file")
+			gomega.Expect(string(actual)).To(gomega.Equal(string(expected)))
+		})
+
+		ginkgo.It("should keep "+name+" sanitized", func() {
+			fixture, err := cloudinfotest.LoadFixture(path)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			expected, err := json.Marshal(fixture)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+			gomega.Expect(cloudinfotest.Sanitize(fixture)).To(gomega.Succeed())
+			actual, err := json.Marshal(fixture)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(string(actual)).To(gomega.Equal(string(expected)), "sanitize the fixture again")
+		})
+	}
+
+	ginkgo.It("should record and sanitize exchanges for replay", func() {
+		ctx := context.Background()
+		server := cloudinfotest.NewServer(cloudinfotest.Instance{
+			Provider: "aws", Region: "us-west-2", AccountID: "210987654321", InstanceID: "i-0fedcba9876543210",
+			InstanceType: "m5.large", Hostname: "ip-172-31-20-45.us-west-2.compute.internal",
+		})
+		ginkgo.DeferCleanup(server.Close)
+
+		fixture, err := cloudinfotest.Capture(ctx, cloudinfotest.CaptureConfig{
+			Name:       "aws",
+			IMDSClient: server.Client(),
+			IMDSConfig: server.Config(),
+			KubeClient: cloudinfotest.EKSCluster("us-west-2", 2).Clientset(),
+		})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		data, err := json.Marshal(fixture)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		for _, secret := range []string{"210987654321", "i-0fedcba9876543210", "172.31.20.45", "ip-172-31-20-45", "fake-imds-token"} {
+			gomega.Expect(string(data)).NotTo(gomega.ContainSubstring(secret))
+		}
+
+		identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(ctx, fixture.IMDSClient(), server.Config())
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(identity.Region).To(gomega.Equal("us-west-2"))
+		gomega.Expect(identity.AccountID).To(gomega.Equal("000000000001"))
+		gomega.Expect(identity.InstanceID).To(gomega.Equal("i-00000000000000001"))
+		gomega.Expect(identity.PrivateHostname).To(gomega.Equal("ip-10-0-0-1.us-west-2.compute.internal"))
+
+		info, err := cloudinfo.DetectNodeCloudInfo(ctx, fixture.Clientset())
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(info.Region).To(gomega.Equal("us-west-2"))
+	})
+
+	ginkgo.It("should drop the secrets of the recorded documents", func() {
+		fixture := &cloudinfotest.Fixture{IMDS: []cloudinfotest.Exchange{
+			{Method: "GET", URL: "http://metadata.google.internal/computeMetadata/v1/instance/?recursive=true", Status: 200,
+				Body: `{"id":1234567890123456789,"machineType":"projects/1/machineTypes/e2-medium","attributes":{"kube-env":"KUBELET_CERT: c2VjcmV0","ssh-keys":"admin:ssh-rsa AAAA","startup-script":"echo secret"}}`},
+			{Method: "GET", URL: "http://169.254.169.254/metadata/instance?api-version=2021-02-01", Status: 200,
+				Body: `{"compute":{"vmSize":"Standard_D2s_v3","adminUsername":"azureadmin","resourceGroupName":"secret-rg","tagsList":[{"name":"owner","value":"alice"}],"publicKeys":[{"keyData":"ssh-rsa BBBB","path":"/home/azureadmin/.ssh/authorized_keys"}]}}`},
+			{Method: "GET", URL: "http://169.254.169.254/opc/v2/instance/", Status: 200,
+				Body: `{"canonicalRegionName":"us-ashburn-1","shape":"VM.Standard.E4.Flex","metadata":{"ssh_authorized_keys":"ssh-rsa CCCC","user_data":"c2VjcmV0"}}`},
+			{Method: "GET", URL: "http://169.254.169.254/latest/meta-data/placement/region", Status: 200, Body: "us-west-2"},
+		}}
+		gomega.Expect(cloudinfotest.Sanitize(fixture)).To(gomega.Succeed())
+
+		data, err := json.Marshal(fixture)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		for _, secret := range []string{"attributes", "kube-env", "ssh-keys", "startup-script", "adminUsername", "azureadmin",
+			"resourceGroupName", "secret-rg", "tagsList", "alice", "publicKeys", "ssh-rsa", "ssh_authorized_keys", "user_data"} {
+			gomega.Expect(string(data)).NotTo(gomega.ContainSubstring(secret))
+		}
+		gomega.Expect(fixture.IMDS[0].Body).To(gomega.Equal(`{"id":1234567890123456789,"machineType":"projects/1/machineTypes/e2-medium"}`))
+		gomega.Expect(fixture.IMDS[1].Body).To(gomega.Equal(`{"compute":{"vmSize":"Standard_D2s_v3"}}`))
+		gomega.Expect(fixture.IMDS[2].Body).To(gomega.Equal(`{"canonicalRegionName":"us-ashburn-1","shape":"VM.Standard.E4.Flex"}`))
+		gomega.Expect(fixture.IMDS[3].Body).To(gomega.Equal("us-west-2"))
+	})
+})
@@ -0,0 +1,167 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("IMDS Instance Identity", func() {
+	var server *httptest.Server
+	var config cloudinfo.IMDSConfig
+
+	// Responses served by the fake IMDS, keyed by path
+	var responses map[string]string
+
+	ginkgo.BeforeEach(func() {
+		responses = map[string]string{}
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, ok := responses[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, "/metadata/") && r.Header.Get("Metadata") != "true" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, "/computeMetadata/") && r.Header.Get("Metadata-Flavor") != "Google" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, err := w.Write([]byte(body))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		}))
+
+		config = cloudinfo.IMDSConfig{
+			AWSEndpoint:   server.URL + "/latest/meta-data/placement/region",
+			AzureEndpoint: server.URL + "/metadata/instance/compute/location?api-version=2021-02-01",
+			GCPEndpoint:   server.URL + "/computeMetadata/v1/instance/zone",
+
+			AWSIdentityDocumentEndpoint: server.URL + "/latest/dynamic/instance-identity/document",
+			AWSHostnameEndpoint:         server.URL + "/latest/meta-data/local-hostname",
+			AzureInstanceEndpoint:       server.URL + "/metadata/instance?api-version=2021-02-01",
+			GCPProjectIDEndpoint:        server.URL + "/computeMetadata/v1/project/project-id",
+			GCPInstanceEndpoint:         server.URL + "/computeMetadata/v1/instance/?recursive=true",
+		}
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Close()
+	})
+
+	ginkgo.Context("when running on AWS", func() {
+		ginkgo.BeforeEach(func() {
+			responses["/latest/meta-data/placement/region"] = "us-west-2"
+			responses["/latest/dynamic/instance-identity/document"] = `{
+				"accountId": "123456789012",
+				"architecture": "x86_64",
+				"availabilityZone": "us-west-2b",
+				"imageId": "ami-5fb8c835",
+				"instanceId": "i-1234567890abcdef0",
+				"instanceType": "m5.large",
+				"privateIp": "10.158.112.84",
+				"region": "us-west-2"
+			}`
+			responses["/latest/meta-data/local-hostname"] = "ip-10-158-112-84.us-west-2.compute.internal"
+		})
+
+		ginkgo.It("should read the instance identity document", func() {
+			identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(*identity).To(gomega.Equal(cloudinfo.InstanceIdentity{
+				Provider:        "aws",
+				Region:          "us-west-2",
+				Zone:            "us-west-2b",
+				AccountID:       "123456789012",
+				InstanceID:      "i-1234567890abcdef0",
+				InstanceType:    "m5.large",
+				ImageID:         "ami-5fb8c835",
+				PrivateHostname: "ip-10-158-112-84.us-west-2.compute.internal",
+				CapacityType:    cloudinfo.CapacityTypeUnknown,
+			}))
+		})
+
+		ginkgo.It("should project to the cloud info", func() {
+			identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			info, err := cloudinfo.DetectIMDSCloudInfoWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(identity.CloudInfo()).To(gomega.Equal(info))
+		})
+	})
+
+	ginkgo.Context("when running on Azure", func() {
+		ginkgo.BeforeEach(func() {
+			responses["/metadata/instance/compute/location"] = `{"location": "eastus"}`
+			responses["/metadata/instance"] = `{
+				"compute": {
+					"location": "eastus",
+					"name": "myVM",
+					"osProfile": {"computerName": "myvm-host"},
+					"storageProfile": {"imageReference": {"id": "", "offer": "UbuntuServer", "publisher": "Canonical", "sku": "18.04-LTS", "version": "latest"}},
+					"subscriptionId": "12345678-1234-1234-1234-123456789012",
+					"vmId": "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+					"vmSize": "Standard_D2s_v3",
+					"zone": "2"
+				}
+			}`
+		})
+
+		ginkgo.It("should read the instance metadata document", func() {
+			identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(identity.Provider).To(gomega.Equal("azure"))
+			gomega.Expect(identity.Zone).To(gomega.Equal("eastus-2"))
+			gomega.Expect(identity.AccountID).To(gomega.Equal("12345678-1234-1234-1234-123456789012"))
+			gomega.Expect(identity.InstanceID).To(gomega.Equal("02aab8a4-74ef-476e-8182-f6d2ba4166a6"))
+			gomega.Expect(identity.InstanceType).To(gomega.Equal("Standard_D2s_v3"))
+			gomega.Expect(identity.ImageID).To(gomega.Equal("Canonical:UbuntuServer:18.04-LTS:latest"))
+			gomega.Expect(identity.PrivateHostname).To(gomega.Equal("myvm-host"))
+		})
+	})
+
+	ginkgo.Context("when running on GCP", func() {
+		ginkgo.BeforeEach(func() {
+			responses["/computeMetadata/v1/instance/zone"] = "projects/123456789/zones/us-central1-a"
+			responses["/computeMetadata/v1/project/project-id"] = "my-project"
+			responses["/computeMetadata/v1/instance/"] = `{
+				"id": 4520031799277581759,
+				"image": "projects/debian-cloud/global/images/debian-12-bookworm-v20240110",
+				"hostname": "my-instance.us-central1-a.c.my-project.internal",
+				"machineType": "projects/123456789/machineTypes/e2-medium",
+				"zone": "projects/123456789/zones/us-central1-a"
+			}`
+		})
+
+		ginkgo.It("should read the project ID and instance attributes", func() {
+			identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(identity.Provider).To(gomega.Equal("gcp"))
+			gomega.Expect(identity.Region).To(gomega.Equal("us-central1"))
+			gomega.Expect(identity.Zone).To(gomega.Equal("us-central1-a"))
+			gomega.Expect(identity.AccountID).To(gomega.Equal("my-project"))
+			gomega.Expect(identity.InstanceID).To(gomega.Equal("4520031799277581759"))
+			gomega.Expect(identity.InstanceType).To(gomega.Equal("e2-medium"))
+			gomega.Expect(identity.ImageID).To(gomega.Equal("projects/debian-cloud/global/images/debian-12-bookworm-v20240110"))
+			gomega.Expect(identity.PrivateHostname).To(gomega.Equal("my-instance.us-central1-a.c.my-project.internal"))
+		})
+	})
+
+	ginkgo.Context("when the identity document is unavailable", func() {
+		ginkgo.BeforeEach(func() {
+			responses["/latest/meta-data/placement/region"] = "us-west-2"
+		})
+
+		ginkgo.It("should return an error", func() {
+			_, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("failed to read AWS instance identity document: unexpected status 404"))
+		})
+	})
+})
@@ -0,0 +1,186 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("IMDS Event Watcher", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		server *httptest.Server
+		config cloudinfo.IMDSConfig
+		// Lifecycle stage served by the fake IMDS, advanced by the tests
+		stage atomic.Int32
+	)
+
+	const interval = 10 * time.Millisecond
+
+	ginkgo.BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+		stage.Store(0)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		config = cloudinfo.IMDSConfig{
+			AWSSpotEventsEndpoint:        server.URL + "/latest/meta-data/spot/instance-action",
+			AWSMaintenanceEventsEndpoint: server.URL + "/latest/meta-data/events/maintenance/scheduled",
+			AzureScheduledEventsEndpoint: server.URL + "/metadata/scheduledevents?api-version=2020-07-01",
+			GCPMaintenanceEventEndpoint:  server.URL + "/computeMetadata/v1/instance/maintenance-event",
+		}
+	})
+
+	ginkgo.AfterEach(func() {
+		cancel()
+		server.Close()
+	})
+
+	write := func(w http.ResponseWriter, body string) {
+		_, err := w.Write([]byte(body))
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	}
+
+	receive := func(events <-chan cloudinfo.IMDSEvent) cloudinfo.IMDSEvent {
+		var event cloudinfo.IMDSEvent
+		gomega.Eventually(events).Should(gomega.Receive(&event))
+		return event
+	}
+
+	ginkgo.Context("when running on AWS", func() {
+		ginkgo.BeforeEach(func() {
+			server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/spot/instance-action") && stage.Load() >= 1:
+					write(w, `{"action": "terminate", "time": "2017-09-18T08:22:00Z"}`)
+				case strings.HasSuffix(r.URL.Path, "/events/maintenance/scheduled") && stage.Load() >= 2:
+					write(w, `[{"NotBefore": "21 Jan 2019 09:00:43 GMT", "Code": "system-reboot", "Description": "scheduled reboot", "EventId": "instance-event-0d59937288b749b32", "State": "active"}]`)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+		})
+
+		ginkgo.It("should emit spot interruption and maintenance events", func() {
+			events, err := cloudinfo.WatchIMDSEventsWithClient(ctx, "aws", interval, server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Consistently(events, 5*interval).ShouldNot(gomega.Receive())
+
+			stage.Store(1)
+			event := receive(events)
+			gomega.Expect(event.Type).To(gomega.Equal(cloudinfo.IMDSEventSpotInterruption))
+			gomega.Expect(event.Status).To(gomega.Equal(cloudinfo.IMDSEventScheduled))
+			gomega.Expect(event.Action).To(gomega.Equal("terminate"))
+			gomega.Expect(event.NotBefore).To(gomega.BeTemporally("==", time.Date(2017, 9, 18, 8, 22, 0, 0, time.UTC)))
+
+			stage.Store(2)
+			event = receive(events)
+			gomega.Expect(event.Type).To(gomega.Equal(cloudinfo.IMDSEventMaintenance))
+			gomega.Expect(event.ID).To(gomega.Equal("instance-event-0d59937288b749b32"))
+			gomega.Expect(event.Action).To(gomega.Equal("system-reboot"))
+			gomega.Expect(event.NotBefore).To(gomega.BeTemporally("==", time.Date(2019, 1, 21, 9, 0, 43, 0, time.UTC)))
+
+			// Events are only emitted once per status
+			gomega.Consistently(events, 5*interval).ShouldNot(gomega.Receive())
+		})
+	})
+
+	ginkgo.Context("when running on Azure", func() {
+		ginkgo.BeforeEach(func() {
+			server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/metadata/scheduledevents") || r.Header.Get("Metadata") != "true" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				switch stage.Load() {
+				case 0:
+					write(w, `{"DocumentIncarnation": 1, "Events": []}`)
+				case 1:
+					write(w, `{"DocumentIncarnation": 2, "Events": [{"EventId": "602d9444-d2cd-49c7-8624-8643e7171297", "EventType": "Preempt", "EventStatus": "Scheduled", "NotBefore": "Mon, 19 Sep 2016 18:29:47 GMT"}]}`)
+				case 2:
+					write(w, `{"DocumentIncarnation": 3, "Events": [{"EventId": "602d9444-d2cd-49c7-8624-8643e7171297", "EventType": "Preempt", "EventStatus": "Started", "NotBefore": ""}]}`)
+				default:
+					write(w, `{"DocumentIncarnation": 4, "Events": []}`)
+				}
+			})
+		})
+
+		ginkgo.It("should follow the scheduled event lifecycle", func() {
+			events, err := cloudinfo.WatchIMDSEventsWithClient(ctx, "azure", interval, server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+			stage.Store(1)
+			event := receive(events)
+			gomega.Expect(event.Provider).To(gomega.Equal("azure"))
+			gomega.Expect(event.Type).To(gomega.Equal(cloudinfo.IMDSEventSpotInterruption))
+			gomega.Expect(event.Status).To(gomega.Equal(cloudinfo.IMDSEventScheduled))
+			gomega.Expect(event.NotBefore).To(gomega.BeTemporally("==", time.Date(2016, 9, 19, 18, 29, 47, 0, time.UTC)))
+
+			stage.Store(2)
+			event = receive(events)
+			gomega.Expect(event.Status).To(gomega.Equal(cloudinfo.IMDSEventStarted))
+
+			stage.Store(3)
+			event = receive(events)
+			gomega.Expect(event.ID).To(gomega.Equal("602d9444-d2cd-49c7-8624-8643e7171297"))
+			gomega.Expect(event.Status).To(gomega.Equal(cloudinfo.IMDSEventCompleted))
+		})
+	})
+
+	ginkgo.Context("when running on GCP", func() {
+		ginkgo.BeforeEach(func() {
+			server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/instance/maintenance-event") || r.Header.Get("Metadata-Flavor") != "Google" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if stage.Load() == 1 {
+					write(w, "MIGRATE_ON_HOST_MAINTENANCE")
+					return
+				}
+				write(w, "NONE")
+			})
+		})
+
+		ginkgo.It("should emit a maintenance event until it is over", func() {
+			events, err := cloudinfo.WatchIMDSEventsWithClient(ctx, "gcp", interval, server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+			stage.Store(1)
+			event := receive(events)
+			gomega.Expect(event.Type).To(gomega.Equal(cloudinfo.IMDSEventMaintenance))
+			gomega.Expect(event.Action).To(gomega.Equal("MIGRATE_ON_HOST_MAINTENANCE"))
+			gomega.Expect(event.Status).To(gomega.Equal(cloudinfo.IMDSEventScheduled))
+
+			stage.Store(2)
+			event = receive(events)
+			gomega.Expect(event.Status).To(gomega.Equal(cloudinfo.IMDSEventCompleted))
+		})
+	})
+
+	ginkgo.Context("when the context is cancelled", func() {
+		ginkgo.It("should close the channel", func() {
+			events, err := cloudinfo.WatchIMDSEventsWithClient(ctx, "gcp", interval, server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			cancel()
+			gomega.Eventually(events).Should(gomega.BeClosed())
+		})
+	})
+
+	ginkgo.Context("when the provider is not supported", func() {
+		ginkgo.It("should return an error", func() {
+			_, err := cloudinfo.WatchIMDSEventsWithClient(ctx, "unknown", interval, server.Client(), config)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("IMDS events not supported for provider: unknown"))
+		})
+	})
+})
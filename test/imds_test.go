@@ -27,6 +27,22 @@ var _ = ginkgo.Describe("IMDS Detection", func() {
 			AWSEndpoint:   server.URL + "/latest/meta-data/placement/region",
 			AzureEndpoint: server.URL + "/metadata/instance/compute/location?api-version=2021-02-01",
 			GCPEndpoint:   server.URL + "/computeMetadata/v1/instance/zone",
+
+			OCIEndpoint:      server.URL + "/opc/v2/instance/",
+			AlibabaEndpoint:  server.URL + "/latest/meta-data/region-id",
+			IBMTokenEndpoint: server.URL + "/identity/v1/token?version=2022-03-01",
+			IBMEndpoint:      server.URL + "/metadata/v1/instance?version=2022-03-01",
+
+			DigitalOceanEndpoint: server.URL + "/metadata/v1/region",
+			HetznerEndpoint:      server.URL + "/hetzner/v1/metadata",
+			LinodeTokenEndpoint:  server.URL + "/v1/token",
+			LinodeEndpoint:       server.URL + "/v1/instance",
+			VultrEndpoint:        server.URL + "/v1.json",
+			ScalewayEndpoint:     server.URL + "/conf?format=json",
+
+			AWSCapacityTypeEndpoint:   server.URL + "/latest/meta-data/instance-life-cycle",
+			AzureCapacityTypeEndpoint: server.URL + "/metadata/instance/compute/priority?api-version=2021-02-01&format=text",
+			GCPCapacityTypeEndpoint:   server.URL + "/computeMetadata/v1/instance/scheduling/preemptible",
 		}
 	})
 
@@ -42,6 +58,11 @@ var _ = ginkgo.Describe("IMDS Detection", func() {
 					gomega.Expect(err).NotTo(gomega.HaveOccurred())
 					return
 				}
+				if strings.HasSuffix(r.URL.Path, "/latest/meta-data/instance-life-cycle") {
+					_, err := w.Write([]byte("spot"))
+					gomega.Expect(err).NotTo(gomega.HaveOccurred())
+					return
+				}
 				w.WriteHeader(http.StatusNotFound)
 			})
 		})
@@ -52,6 +73,7 @@ var _ = ginkgo.Describe("IMDS Detection", func() {
 			gomega.Expect(info.Provider).To(gomega.Equal("aws"))
 			gomega.Expect(info.Region).To(gomega.Equal("us-west-2"))
 			gomega.Expect(info.Source).To(gomega.Equal("imds"))
+			gomega.Expect(info.CapacityType).To(gomega.Equal(cloudinfo.CapacityTypeSpot))
 		})
 	})
 
@@ -66,6 +88,11 @@ var _ = ginkgo.Describe("IMDS Detection", func() {
 					gomega.Expect(err).NotTo(gomega.HaveOccurred())
 					return
 				}
+				if strings.Contains(r.URL.Path, "/metadata/instance/compute/priority") && r.Header.Get("Metadata") == "true" {
+					_, err := w.Write([]byte("Regular"))
+					gomega.Expect(err).NotTo(gomega.HaveOccurred())
+					return
+				}
 				w.WriteHeader(http.StatusNotFound)
 			})
 		})
@@ -76,6 +103,7 @@ var _ = ginkgo.Describe("IMDS Detection", func() {
 			gomega.Expect(info.Provider).To(gomega.Equal("azure"))
 			gomega.Expect(info.Region).To(gomega.Equal("eastus"))
 			gomega.Expect(info.Source).To(gomega.Equal("imds"))
+			gomega.Expect(info.CapacityType).To(gomega.Equal(cloudinfo.CapacityTypeOnDemand))
 		})
 	})
 
@@ -87,6 +115,11 @@ var _ = ginkgo.Describe("IMDS Detection", func() {
 					gomega.Expect(err).NotTo(gomega.HaveOccurred())
 					return
 				}
+				if strings.Contains(r.URL.Path, "/computeMetadata/v1/instance/scheduling/preemptible") && r.Header.Get("Metadata-Flavor") == "Google" {
+					_, err := w.Write([]byte("TRUE"))
+					gomega.Expect(err).NotTo(gomega.HaveOccurred())
+					return
+				}
 				w.WriteHeader(http.StatusNotFound)
 			})
 		})
@@ -97,6 +130,180 @@ var _ = ginkgo.Describe("IMDS Detection", func() {
 			gomega.Expect(info.Provider).To(gomega.Equal("gcp"))
 			gomega.Expect(info.Region).To(gomega.Equal("us-central1"))
 			gomega.Expect(info.Source).To(gomega.Equal("imds"))
+			gomega.Expect(info.CapacityType).To(gomega.Equal(cloudinfo.CapacityTypeSpot))
+		})
+	})
+
+	ginkgo.Context("when running on OCI", func() {
+		ginkgo.BeforeEach(func() {
+			server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/opc/v2/instance/" && r.Header.Get("Authorization") == "Bearer Oracle" {
+					w.Header().Set("Content-Type", "application/json")
+					err := json.NewEncoder(w).Encode(map[string]string{
+						"availabilityDomain":  "Uocm:PHX-AD-1",
+						"canonicalRegionName": "us-phoenix-1",
+						"compartmentId":       "ocid1.compartment.oc1..aaaaaaaa",
+						"id":                  "ocid1.instance.oc1.phx.abyhqljr",
+						"region":              "phx",
+						"shape":               "VM.Standard.E4.Flex",
+					})
+					gomega.Expect(err).NotTo(gomega.HaveOccurred())
+					return
+				}
+				w.WriteHeader(http.StatusNotFound)
+			})
+		})
+
+		ginkgo.It("should detect OCI region", func() {
+			info, err := cloudinfo.DetectIMDSCloudInfoWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Provider).To(gomega.Equal("oci"))
+			gomega.Expect(info.Region).To(gomega.Equal("us-phoenix-1"))
+			gomega.Expect(info.Source).To(gomega.Equal("imds"))
+		})
+
+		ginkgo.It("should read the OCI instance identity", func() {
+			identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(identity.Zone).To(gomega.Equal("Uocm:PHX-AD-1"))
+			gomega.Expect(identity.InstanceID).To(gomega.Equal("ocid1.instance.oc1.phx.abyhqljr"))
+			gomega.Expect(identity.InstanceType).To(gomega.Equal("VM.Standard.E4.Flex"))
+		})
+	})
+
+	ginkgo.Context("when running on Alibaba Cloud", func() {
+		ginkgo.BeforeEach(func() {
+			server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/latest/meta-data/region-id" {
+					_, err := w.Write([]byte("cn-hangzhou"))
+					gomega.Expect(err).NotTo(gomega.HaveOccurred())
+					return
+				}
+				w.WriteHeader(http.StatusNotFound)
+			})
+		})
+
+		ginkgo.It("should detect Alibaba Cloud region", func() {
+			info, err := cloudinfo.DetectIMDSCloudInfoWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Provider).To(gomega.Equal("alibaba"))
+			gomega.Expect(info.Region).To(gomega.Equal("cn-hangzhou"))
+			gomega.Expect(info.Source).To(gomega.Equal("imds"))
+		})
+	})
+
+	ginkgo.Context("when running on IBM Cloud", func() {
+		ginkgo.BeforeEach(func() {
+			server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodPut && r.URL.Path == "/identity/v1/token" && r.Header.Get("Metadata-Flavor") == "ibm":
+					_, err := w.Write([]byte(`{"access_token": "test-token", "expires_in": 300}`))
+					gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				case r.URL.Path == "/metadata/v1/instance" && r.Header.Get("Authorization") == "Bearer test-token":
+					_, err := w.Write([]byte(`{
+						"id": "0717_e21b7391-2ca2-4ab5-84a8-b92157a633b0",
+						"crn": "crn:v1:bluemix:public:is:us-south-1:a/123456::instance:0717_e21b7391-2ca2-4ab5-84a8-b92157a633b0",
+						"zone": {"name": "us-south-1"},
+						"profile": {"name": "bx2-2x8"}
+					}`))
+					gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+		})
+
+		ginkgo.It("should detect IBM Cloud region with the token flow", func() {
+			info, err := cloudinfo.DetectIMDSCloudInfoWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Provider).To(gomega.Equal("ibm"))
+			gomega.Expect(info.Region).To(gomega.Equal("us-south"))
+			gomega.Expect(info.Source).To(gomega.Equal("imds"))
+		})
+
+		ginkgo.It("should read the IBM Cloud instance identity", func() {
+			identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(identity.Zone).To(gomega.Equal("us-south-1"))
+			gomega.Expect(identity.AccountID).To(gomega.Equal("123456"))
+			gomega.Expect(identity.InstanceType).To(gomega.Equal("bx2-2x8"))
+		})
+	})
+
+	ginkgo.Context("when running on a metadata service without authentication", func() {
+		ginkgo.DescribeTable("should detect provider and region",
+			func(path, body, provider, region string) {
+				server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == path {
+						_, err := w.Write([]byte(body))
+						gomega.Expect(err).NotTo(gomega.HaveOccurred())
+						return
+					}
+					w.WriteHeader(http.StatusNotFound)
+				})
+
+				info, err := cloudinfo.DetectIMDSCloudInfoWithClient(context.Background(), server.Client(), config)
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				gomega.Expect(info.Provider).To(gomega.Equal(provider))
+				gomega.Expect(info.Region).To(gomega.Equal(region))
+				gomega.Expect(info.Source).To(gomega.Equal("imds"))
+			},
+			ginkgo.Entry("DigitalOcean", "/metadata/v1/region", "nyc3", "digitalocean", "nyc3"),
+			ginkgo.Entry("Hetzner", "/hetzner/v1/metadata",
+				"availability-zone: fsn1-dc14\nhostname: my-server\ninstance-id: 42\nregion: eu-central\n",
+				"hetzner", "fsn1"),
+			ginkgo.Entry("Vultr", "/v1.json",
+				`{"hostname": "my-server", "instance-v2-id": "a747bfz6-385a-4b5e-b3c8-bd3fa8e8e3e1", "region": {"regioncode": "EWR"}}`,
+				"vultr", "ewr"),
+			ginkgo.Entry("Scaleway", "/conf",
+				`{"id": "3a7e1a6c-bb8a-4a7c-8b8b-5fb0b1c9d0a1", "commercial_type": "DEV1-S", "zone": "fr-par-1"}`,
+				"scaleway", "fr-par"),
+		)
+	})
+
+	ginkgo.Context("when running on Linode", func() {
+		ginkgo.BeforeEach(func() {
+			server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodPut && r.URL.Path == "/v1/token" && r.Header.Get("Metadata-Token-Expiry-Seconds") != "":
+					_, err := w.Write([]byte("test-token"))
+					gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				case r.URL.Path == "/v1/instance" && r.Header.Get("Metadata-Token") == "test-token":
+					_, err := w.Write([]byte(`{"id": 12345, "label": "my-linode", "region": "us-ord", "type": "g6-standard-1"}`))
+					gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				default:
+					w.WriteHeader(http.StatusUnauthorized)
+				}
+			})
+		})
+
+		ginkgo.It("should detect Linode region with the token flow", func() {
+			identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(identity.Provider).To(gomega.Equal("linode"))
+			gomega.Expect(identity.Region).To(gomega.Equal("us-ord"))
+			gomega.Expect(identity.InstanceID).To(gomega.Equal("12345"))
+			gomega.Expect(identity.InstanceType).To(gomega.Equal("g6-standard-1"))
+		})
+	})
+
+	ginkgo.Context("when the capacity type endpoint is unavailable", func() {
+		ginkgo.BeforeEach(func() {
+			server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/latest/meta-data/placement/region") {
+					_, err := w.Write([]byte("us-west-2"))
+					gomega.Expect(err).NotTo(gomega.HaveOccurred())
+					return
+				}
+				w.WriteHeader(http.StatusNotFound)
+			})
+		})
+
+		ginkgo.It("should still detect the region with an unknown capacity type", func() {
+			info, err := cloudinfo.DetectIMDSCloudInfoWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Region).To(gomega.Equal("us-west-2"))
+			gomega.Expect(info.CapacityType).To(gomega.Equal(cloudinfo.CapacityTypeUnknown))
 		})
 	})
 
@@ -0,0 +1,296 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo/cloudinfotest"
+	"github.com/carbon-aware/cloudinfo/pkg/inventory"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+var _ = ginkgo.Describe("Inventory", func() {
+	var (
+		ctx context.Context
+		dir string
+	)
+
+	// writeKubeconfig writes a kubeconfig whose contexts all point to the server
+	writeKubeconfig := func(name, server string, contexts ...string) string {
+		config := clientcmdapi.NewConfig()
+		config.Clusters["cluster"] = &clientcmdapi.Cluster{Server: server}
+		config.AuthInfos["user"] = &clientcmdapi.AuthInfo{Token: "token"}
+		for _, context := range contexts {
+			config.Contexts[context] = &clientcmdapi.Context{Cluster: "cluster", AuthInfo: "user"}
+		}
+		path := filepath.Join(dir, name)
+		gomega.Expect(clientcmd.WriteToFile(*config, path)).To(gomega.Succeed())
+		return path
+	}
+
+	// clients returns the clients of the clusters by name
+	clients := func(clusters map[string]kubernetes.Interface) func(inventory.Cluster) (kubernetes.Interface, error) {
+		return func(cluster inventory.Cluster) (kubernetes.Interface, error) {
+			client, ok := clusters[cluster.Name]
+			if !ok {
+				return nil, errors.New("no client")
+			}
+			return client, nil
+		}
+	}
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+		dir = ginkgo.GinkgoT().TempDir()
+	})
+
+	ginkgo.Context("when loading kubeconfigs", func() {
+		ginkgo.It("should list the contexts of a kubeconfig", func() {
+			path := writeKubeconfig("config", "https://127.0.0.1:6443", "prod", "dev")
+			clusters, failures, err := inventory.LoadClusters(path)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(failures).To(gomega.BeEmpty())
+			gomega.Expect(clusters).To(gomega.Equal([]inventory.Cluster{
+				{Name: "dev", Kubeconfig: path, Context: "dev"},
+				{Name: "prod", Kubeconfig: path, Context: "prod"},
+			}))
+		})
+
+		ginkgo.It("should list the contexts of a directory and report the invalid files", func() {
+			east := writeKubeconfig("east.yaml", "https://127.0.0.1:6443", "prod-east", "kind-kind")
+			west := writeKubeconfig("west.yaml", "https://127.0.0.1:6443", "prod-west", "kind-kind")
+			gomega.Expect(os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not: [a kubeconfig"), 0o600)).To(gomega.Succeed())
+			gomega.Expect(os.WriteFile(filepath.Join(dir, ".hidden"), []byte("ignored"), 0o600)).To(gomega.Succeed())
+			gomega.Expect(os.Mkdir(filepath.Join(dir, "archive"), 0o700)).To(gomega.Succeed())
+
+			clusters, failures, err := inventory.LoadClusters(dir)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(clusters).To(gomega.Equal([]inventory.Cluster{
+				{Name: "east.yaml/kind-kind", Kubeconfig: east, Context: "kind-kind"},
+				{Name: "prod-east", Kubeconfig: east, Context: "prod-east"},
+				{Name: "west.yaml/kind-kind", Kubeconfig: west, Context: "kind-kind"},
+				{Name: "prod-west", Kubeconfig: west, Context: "prod-west"},
+			}))
+			gomega.Expect(failures).To(gomega.ConsistOf(gomega.And(
+				gomega.HaveField("Cluster", "notes.txt"),
+				gomega.HaveField("ErrorType", inventory.ErrorTypeKubeconfig),
+			)))
+		})
+
+		ginkgo.It("should fail on a missing path", func() {
+			_, _, err := inventory.LoadClusters(filepath.Join(dir, "missing"))
+			gomega.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("failed to read kubeconfig")))
+		})
+
+		ginkgo.It("should inventory every path of a list", func() {
+			east := writeKubeconfig("east.yaml", "https://127.0.0.1:6443", "prod-east", "kind-kind")
+			west := writeKubeconfig("west.yaml", "https://127.0.0.1:6443", "prod-west", "kind-kind")
+			missing := filepath.Join(dir, "missing")
+			fleet, err := inventory.RunPaths(ctx, []string{east, missing, west}, inventory.Config{NewClient: clients(map[string]kubernetes.Interface{
+				"prod-east": cloudinfotest.EKSCluster("us-east-1", 1).Clientset(),
+				"prod-west": cloudinfotest.EKSCluster("us-west-2", 1).Clientset(),
+			})})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(fleet.Clusters).To(gomega.HaveLen(2))
+			gomega.Expect(fleet.Clusters[0]).To(gomega.And(gomega.HaveField("Cluster", "prod-east"), gomega.HaveField("Region", "us-east-1")))
+			gomega.Expect(fleet.Clusters[1]).To(gomega.And(gomega.HaveField("Cluster", "prod-west"), gomega.HaveField("Region", "us-west-2")))
+			gomega.Expect(fleet.Failures).To(gomega.HaveLen(3))
+			gomega.Expect(fleet.Failures[0]).To(gomega.And(
+				gomega.HaveField("Kubeconfig", missing),
+				gomega.HaveField("ErrorType", inventory.ErrorTypeKubeconfig),
+			))
+			gomega.Expect([]string{fleet.Failures[1].Cluster, fleet.Failures[2].Cluster}).To(gomega.Equal([]string{"east.yaml/kind-kind", "west.yaml/kind-kind"}))
+		})
+	})
+
+	ginkgo.Context("when collecting the inventory", func() {
+		ginkgo.It("should detect every cluster and report the failures separately", func() {
+			clusters := []inventory.Cluster{{Name: "eks"}, {Name: "gke"}, {Name: "multi-region"}, {Name: "empty"}, {Name: "unknown"}, {Name: "aks"}}
+			fleet := inventory.Collect(ctx, clusters, inventory.Config{NewClient: clients(map[string]kubernetes.Interface{
+				"eks":          cloudinfotest.EKSCluster("us-west-2", 5).Clientset(),
+				"gke":          cloudinfotest.GKECluster("europe-west1", 2).Clientset(),
+				"multi-region": cloudinfotest.MultiRegionCluster("aws", 1, "us-east-1", "us-west-2").Clientset(),
+				"empty":        cloudinfotest.NewCluster().Clientset(),
+				"aks":          cloudinfotest.AKSCluster("westeurope", 1).Clientset(),
+			})})
+
+			gomega.Expect(fleet.Clusters).To(gomega.HaveLen(4))
+			gomega.Expect(fleet.Clusters[0]).To(gomega.Equal(inventory.ClusterInventory{
+				Cluster: "eks", Provider: "aws", Region: "us-west-2", Nodes: 5,
+				Zones:         []inventory.ZoneNodes{{Zone: "us-west-2a", Nodes: 2}, {Zone: "us-west-2b", Nodes: 2}, {Zone: "us-west-2c", Nodes: 1}},
+				CapacityTypes: map[string]int{cloudinfo.CapacityTypeOnDemand: 5},
+			}))
+			gomega.Expect(fleet.Clusters[1]).To(gomega.And(gomega.HaveField("Cluster", "gke"), gomega.HaveField("Provider", "gcp"), gomega.HaveField("Nodes", 2)))
+			gomega.Expect(fleet.Clusters[2]).To(gomega.Equal(inventory.ClusterInventory{
+				Cluster: "multi-region", Provider: "aws", Region: "", Nodes: 2,
+				Zones:         []inventory.ZoneNodes{{Zone: "us-east-1a", Nodes: 1}, {Zone: "us-west-2a", Nodes: 1}},
+				CapacityTypes: map[string]int{cloudinfo.CapacityTypeOnDemand: 2},
+			}))
+			gomega.Expect(fleet.Clusters[3]).To(gomega.And(gomega.HaveField("Cluster", "aks"), gomega.HaveField("Region", "westeurope")))
+
+			gomega.Expect(fleet.Failures).To(gomega.Equal([]inventory.Failure{
+				{Cluster: "empty", ErrorType: "no_nodes", Error: "no nodes found"},
+				{Cluster: "unknown", ErrorType: inventory.ErrorTypeKubeconfig, Error: "no client"},
+			}))
+		})
+
+		ginkgo.It("should apply the region policy", func() {
+			fleet := inventory.Collect(ctx, []inventory.Cluster{{Name: "multi-region"}}, inventory.Config{
+				Node: cloudinfo.NodeConfig{RegionPolicy: cloudinfo.RegionPolicyMajority},
+				NewClient: clients(map[string]kubernetes.Interface{
+					"multi-region": cloudinfotest.EKSCluster("us-east-1", 1).AddNodePool(cloudinfotest.NodePool{
+						Provider: "aws", Name: "west", Region: "us-west-2", Count: 2,
+					}).Clientset(),
+				}),
+			})
+			gomega.Expect(fleet.Failures).To(gomega.BeEmpty())
+			gomega.Expect(fleet.Clusters[0].Region).To(gomega.Equal("us-west-2"))
+			gomega.Expect(fleet.Clusters[0].Nodes).To(gomega.Equal(3))
+		})
+
+		ginkgo.It("should detect at most Parallelism clusters at once", func() {
+			var running, peak atomic.Int32
+			newClient := func(inventory.Cluster) (kubernetes.Interface, error) {
+				client := cloudinfotest.EKSCluster("us-west-2", 1).Clientset()
+				client.PrependReactor("list", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+					n := running.Add(1)
+					for {
+						current := peak.Load()
+						if n <= current || peak.CompareAndSwap(current, n) {
+							break
+						}
+					}
+					time.Sleep(20 * time.Millisecond)
+					running.Add(-1)
+					return false, nil, nil
+				})
+				return client, nil
+			}
+			clusters := make([]inventory.Cluster, 10)
+			for i := range clusters {
+				clusters[i] = inventory.Cluster{Name: string(rune('a' + i))}
+			}
+			fleet := inventory.Collect(ctx, clusters, inventory.Config{Parallelism: 3, NewClient: newClient})
+			gomega.Expect(fleet.Clusters).To(gomega.HaveLen(10))
+			gomega.Expect(fleet.Clusters[0].Cluster).To(gomega.Equal("a"))
+			gomega.Expect(peak.Load()).To(gomega.BeNumerically("<=", 3))
+			gomega.Expect(peak.Load()).To(gomega.BeNumerically(">", 1))
+		})
+
+		ginkgo.It("should not start the remaining clusters once the context is done", func() {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			var started atomic.Int32
+			newClient := func(inventory.Cluster) (kubernetes.Interface, error) {
+				started.Add(1)
+				cancel()
+				return cloudinfotest.EKSCluster("us-west-2", 1).Clientset(), nil
+			}
+			clusters := []inventory.Cluster{{Name: "a"}, {Name: "b", Context: "kind-b", Kubeconfig: "b.yaml"}, {Name: "c"}}
+			fleet := inventory.Collect(ctx, clusters, inventory.Config{Parallelism: 1, NewClient: newClient})
+			gomega.Expect(started.Load()).To(gomega.BeEquivalentTo(1))
+			gomega.Expect(fleet.Failures).To(gomega.ContainElements(
+				inventory.Failure{Cluster: "b", Context: "kind-b", Kubeconfig: "b.yaml", ErrorType: "canceled", Error: context.Canceled.Error()},
+				inventory.Failure{Cluster: "c", ErrorType: "canceled", Error: context.Canceled.Error()},
+			))
+		})
+
+		ginkgo.It("should inventory the contexts of a kubeconfig through their API server", func() {
+			var mu sync.Mutex
+			var paths []string
+			nodes := corev1.NodeList{}
+			nodes.Kind, nodes.APIVersion = "NodeList", "v1"
+			for _, node := range cloudinfotest.GKECluster("us-central1", 3).Nodes() {
+				nodes.Items = append(nodes.Items, *node)
+			}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				paths = append(paths, r.URL.Path)
+				mu.Unlock()
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(nodes)
+			}))
+			ginkgo.DeferCleanup(server.Close)
+			writeKubeconfig("fleet.yaml", server.URL, "prod", "staging")
+			writeKubeconfig("broken.yaml", "https://127.0.0.1:1", "broken")
+
+			fleet, err := inventory.Run(ctx, dir, inventory.Config{Timeout: 5 * time.Second})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(fleet.Clusters).To(gomega.HaveLen(2))
+			gomega.Expect(fleet.Clusters[0]).To(gomega.And(
+				gomega.HaveField("Cluster", "prod"), gomega.HaveField("Provider", "gcp"), gomega.HaveField("Region", "us-central1"),
+			))
+			gomega.Expect(fleet.Failures).To(gomega.ConsistOf(gomega.HaveField("Cluster", "broken")))
+			gomega.Expect(paths).To(gomega.ConsistOf("/api/v1/nodes", "/api/v1/nodes"))
+		})
+	})
+
+	ginkgo.Context("when writing the inventory", func() {
+		var fleet *inventory.Inventory
+
+		ginkgo.BeforeEach(func() {
+			fleet = &inventory.Inventory{
+				Clusters: []inventory.ClusterInventory{{
+					Cluster: "prod", Context: "prod", Kubeconfig: "fleet.yaml", Provider: "aws", Region: "us-west-2", Nodes: 3,
+					Zones: []inventory.ZoneNodes{{Zone: "us-west-2a", Nodes: 2}, {Zone: "us-west-2b", Nodes: 1}},
+				}},
+				Failures: []inventory.Failure{{Cluster: "dev", Context: "dev", Kubeconfig: "fleet.yaml", ErrorType: "no_nodes", Error: "no nodes found"}},
+			}
+		})
+
+		ginkgo.It("should render a table of the clusters and failures", func() {
+			var out bytes.Buffer
+			gomega.Expect(fleet.Write(&out, inventory.FormatTable)).To(gomega.Succeed())
+			gomega.Expect(out.String()).To(gomega.Equal(
+				"CLUSTER  PROVIDER  REGION     ZONES                      NODES\n" +
+					"prod     aws       us-west-2  us-west-2a=2 us-west-2b=1  3\n" +
+					"\n" +
+					"FAILED CLUSTER  ERROR TYPE  ERROR\n" +
+					"dev             no_nodes    no nodes found\n" +
+					"\n" +
+					"2 clusters, 1 failed\n"))
+		})
+
+		ginkgo.It("should render JSON", func() {
+			var out bytes.Buffer
+			gomega.Expect(fleet.Write(&out, inventory.FormatJSON)).To(gomega.Succeed())
+			var decoded inventory.Inventory
+			gomega.Expect(json.Unmarshal(out.Bytes(), &decoded)).To(gomega.Succeed())
+			gomega.Expect(&decoded).To(gomega.Equal(fleet))
+		})
+
+		ginkgo.It("should render CSV", func() {
+			var out bytes.Buffer
+			gomega.Expect(fleet.Write(&out, inventory.FormatCSV)).To(gomega.Succeed())
+			rows, err := csv.NewReader(&out).ReadAll()
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(rows).To(gomega.Equal([][]string{
+				{"cluster", "context", "kubeconfig", "provider", "region", "zones", "nodes", "error_type", "error"},
+				{"prod", "prod", "fleet.yaml", "aws", "us-west-2", "us-west-2a=2 us-west-2b=1", "3", "", ""},
+				{"dev", "dev", "fleet.yaml", "", "", "", "", "no_nodes", "no nodes found"},
+			}))
+		})
+
+		ginkgo.It("should reject unknown formats", func() {
+			gomega.Expect(fleet.Write(&bytes.Buffer{}, "yaml")).To(gomega.MatchError("unknown output format: yaml"))
+		})
+	})
+})
@@ -0,0 +1,147 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/labeler"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = ginkgo.Describe("Node Labeler", func() {
+	var ctx context.Context
+	var server *httptest.Server
+	var client *fake.Clientset
+	var config labeler.Config
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/latest/meta-data/placement/region":
+				_, err := w.Write([]byte("us-west-2"))
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			case "/latest/dynamic/instance-identity/document":
+				_, err := w.Write([]byte(`{"accountId": "123456789012", "availabilityZone": "us-west-2b", "instanceId": "i-0123456789abcdef0", "instanceType": "m5.large"}`))
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		client = fake.NewSimpleClientset(&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "worker-1",
+				Labels: map[string]string{"kubernetes.io/hostname": "worker-1"},
+			},
+		})
+		config = labeler.Config{
+			NodeName:   "worker-1",
+			IMDSClient: server.Client(),
+			IMDSConfig: &cloudinfo.IMDSConfig{
+				AWSEndpoint:                 server.URL + "/latest/meta-data/placement/region",
+				AWSIdentityDocumentEndpoint: server.URL + "/latest/dynamic/instance-identity/document",
+			},
+		}
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Close()
+	})
+
+	nodeLabels := func() map[string]string {
+		node, err := client.CoreV1().Nodes().Get(ctx, "worker-1", metav1.GetOptions{})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		return node.Labels
+	}
+
+	ginkgo.It("should label a node without topology labels", func() {
+		l, err := labeler.New(client, config)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		result, err := l.Reconcile(ctx)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(result.Patched).To(gomega.BeTrue())
+		gomega.Expect(nodeLabels()).To(gomega.Equal(map[string]string{
+			"kubernetes.io/hostname": "worker-1",
+			cloudinfo.RegionLabel:    "us-west-2",
+			cloudinfo.ZoneLabel:      "us-west-2b",
+			labeler.ProviderLabel:    "aws",
+			labeler.GridZoneLabel:    "US-NW-BPAT",
+		}))
+	})
+
+	ginkgo.It("should not patch the node in dry-run mode", func() {
+		config.DryRun = true
+		l, err := labeler.New(client, config)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		result, err := l.Reconcile(ctx)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(result.Patched).To(gomega.BeFalse())
+		gomega.Expect(result.Labels).To(gomega.HaveKeyWithValue(cloudinfo.RegionLabel, "us-west-2"))
+		gomega.Expect(nodeLabels()).NotTo(gomega.HaveKey(cloudinfo.RegionLabel))
+	})
+
+	ginkgo.It("should not patch a node that is already labelled", func() {
+		l, err := labeler.New(client, config)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		_, err = l.Reconcile(ctx)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		result, err := l.Reconcile(ctx)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(result.Patched).To(gomega.BeFalse())
+		gomega.Expect(result.Labels).To(gomega.BeEmpty())
+	})
+
+	ginkgo.Context("when the node has a different zone label", func() {
+		ginkgo.BeforeEach(func() {
+			node, err := client.CoreV1().Nodes().Get(ctx, "worker-1", metav1.GetOptions{})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			node.Labels[cloudinfo.ZoneLabel] = "custom-zone"
+			_, err = client.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		})
+
+		ginkgo.It("should keep the existing value by default", func() {
+			l, err := labeler.New(client, config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			result, err := l.Reconcile(ctx)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(result.Conflicts).To(gomega.Equal([]labeler.Conflict{
+				{Key: cloudinfo.ZoneLabel, Current: "custom-zone", Detected: "us-west-2b"},
+			}))
+			gomega.Expect(nodeLabels()).To(gomega.HaveKeyWithValue(cloudinfo.ZoneLabel, "custom-zone"))
+			gomega.Expect(nodeLabels()).To(gomega.HaveKeyWithValue(cloudinfo.RegionLabel, "us-west-2"))
+		})
+
+		ginkgo.It("should overwrite the existing value with the overwrite policy", func() {
+			config.ConflictPolicy = labeler.Overwrite
+			l, err := labeler.New(client, config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			result, err := l.Reconcile(ctx)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(result.Conflicts).To(gomega.BeEmpty())
+			gomega.Expect(nodeLabels()).To(gomega.HaveKeyWithValue(cloudinfo.ZoneLabel, "us-west-2b"))
+		})
+	})
+
+	ginkgo.It("should reject an unknown conflict policy", func() {
+		config.ConflictPolicy = "sometimes"
+		_, err := labeler.New(client, config)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(err.Error()).To(gomega.Equal("unknown conflict policy: sometimes"))
+	})
+
+	ginkgo.It("should return an error when the node does not exist", func() {
+		config.NodeName = "missing"
+		l, err := labeler.New(client, config)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		_, err = l.Reconcile(ctx)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(err.Error()).To(gomega.ContainSubstring("failed to get node missing"))
+	})
+})
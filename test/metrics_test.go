@@ -0,0 +1,203 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/metrics"
+	"github.com/carbon-aware/cloudinfo/pkg/server"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = ginkgo.Describe("Metrics", func() {
+	var ctx context.Context
+	var client *fake.Clientset
+	var registry *prometheus.Registry
+
+	createNode := func(name, region, zone string) {
+		_, err := client.CoreV1().Nodes().Create(ctx, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{cloudinfo.RegionLabel: region, cloudinfo.ZoneLabel: zone},
+			},
+			Spec: corev1.NodeSpec{ProviderID: "aws:///" + zone + "/" + name},
+		}, metav1.CreateOptions{})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	}
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+		client = fake.NewSimpleClientset()
+		registry = prometheus.NewRegistry()
+	})
+
+	ginkgo.It("should record the detected topology in a custom registry", func() {
+		createNode("node1", "us-west-2", "us-west-2a")
+		createNode("node2", "us-west-2", "us-west-2a")
+		createNode("node3", "us-west-2", "us-west-2b")
+		m, err := metrics.New(registry)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+		_, err = cloudinfo.DetectCloudInfo(cloudinfo.WithObserver(ctx, m), client, cloudinfo.Options{UseNodeLabels: true})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+		gomega.Expect(testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP cloudinfo_info Cloud provider and region of the last successful detection consensus, always 1.
+# TYPE cloudinfo_info gauge
+cloudinfo_info{provider="aws",region="us-west-2",source="node-labels"} 1
+# HELP cloudinfo_region_nodes Number of cluster nodes per region.
+# TYPE cloudinfo_region_nodes gauge
+cloudinfo_region_nodes{region="us-west-2"} 3
+# HELP cloudinfo_zone_nodes Number of cluster nodes per zone.
+# TYPE cloudinfo_zone_nodes gauge
+cloudinfo_zone_nodes{region="us-west-2",zone="us-west-2a"} 2
+cloudinfo_zone_nodes{region="us-west-2",zone="us-west-2b"} 1
+# HELP cloudinfo_detection_attempts_total Number of detection attempts per detector.
+# TYPE cloudinfo_detection_attempts_total counter
+cloudinfo_detection_attempts_total{detector="node-labels"} 1
+`), "cloudinfo_info", "cloudinfo_region_nodes", "cloudinfo_zone_nodes", "cloudinfo_detection_attempts_total")).To(gomega.Succeed())
+		gomega.Expect(testutil.CollectAndCount(registry, "cloudinfo_detection_failures_total")).To(gomega.Equal(0))
+	})
+
+	ginkgo.It("should label failures by error type", func() {
+		createNode("node1", "us-west-2", "us-west-2a")
+		createNode("node2", "eu-west-1", "eu-west-1a")
+		m, err := metrics.New(registry)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+		_, err = cloudinfo.DetectCloudInfo(cloudinfo.WithObserver(ctx, m), client, cloudinfo.Options{UseNodeLabels: true})
+		gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrMultipleRegions))
+
+		gomega.Expect(testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP cloudinfo_detection_failures_total Number of failed detections per detector and error type.
+# TYPE cloudinfo_detection_failures_total counter
+cloudinfo_detection_failures_total{detector="node-labels",error_type="multiple_regions"} 1
+# HELP cloudinfo_region_nodes Number of cluster nodes per region.
+# TYPE cloudinfo_region_nodes gauge
+cloudinfo_region_nodes{region="eu-west-1"} 1
+cloudinfo_region_nodes{region="us-west-2"} 1
+`), "cloudinfo_detection_failures_total", "cloudinfo_region_nodes")).To(gomega.Succeed())
+		gomega.Expect(testutil.CollectAndCount(registry, "cloudinfo_info")).To(gomega.Equal(0))
+	})
+
+	ginkgo.It("should record the consensus rather than the last detector", func() {
+		createNode("node1", "us-west-2", "us-west-2a")
+		imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/computeMetadata/v1/instance/zone" {
+				_, err := w.Write([]byte("projects/123456789/zones/us-central1-a"))
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer imds.Close()
+		m, err := metrics.New(registry)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+		// IMDS runs last and disagrees with the more reliable node labels
+		_, err = cloudinfo.DetectCloudInfo(cloudinfo.WithObserver(ctx, m), client, cloudinfo.Options{
+			Detectors:  []string{cloudinfo.DetectorNodeLabels, cloudinfo.DetectorIMDS},
+			HTTPClient: imds.Client(),
+			IMDSConfig: &cloudinfo.IMDSConfig{GCPEndpoint: imds.URL + "/computeMetadata/v1/instance/zone"},
+		})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP cloudinfo_info Cloud provider and region of the last successful detection consensus, always 1.
+# TYPE cloudinfo_info gauge
+cloudinfo_info{provider="aws",region="us-west-2",source="node-labels"} 1
+# HELP cloudinfo_detection_attempts_total Number of detection attempts per detector.
+# TYPE cloudinfo_detection_attempts_total counter
+cloudinfo_detection_attempts_total{detector="imds"} 1
+cloudinfo_detection_attempts_total{detector="node-labels"} 1
+`), "cloudinfo_info", "cloudinfo_detection_attempts_total")).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should record IMDS probe latency per provider", func() {
+		imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/computeMetadata/v1/instance/zone" {
+				_, err := w.Write([]byte("projects/123456789/zones/us-central1-a"))
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer imds.Close()
+		m, err := metrics.New(registry)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+		_, err = cloudinfo.DetectIMDSCloudInfoWithClient(cloudinfo.WithObserver(ctx, m), imds.Client(), cloudinfo.IMDSConfig{
+			AWSEndpoint:   imds.URL + "/latest/meta-data/placement/region",
+			AzureEndpoint: imds.URL + "/metadata/instance/compute/location",
+			GCPEndpoint:   imds.URL + "/computeMetadata/v1/instance/zone",
+		})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+		families, err := registry.Gather()
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		probes := map[string]uint64{}
+		for _, family := range families {
+			if family.GetName() != "cloudinfo_imds_probe_duration_seconds" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				labels := map[string]string{}
+				for _, label := range metric.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				probes[labels["provider"]+"/"+labels["result"]] = metric.GetHistogram().GetSampleCount()
+			}
+		}
+		gomega.Expect(probes).To(gomega.Equal(map[string]uint64{
+			"aws/unavailable":   1,
+			"azure/unavailable": 1,
+			"gcp/success":       1,
+		}))
+	})
+
+	ginkgo.It("should reject a registry with the metrics already registered", func() {
+		_, err := metrics.New(registry)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		_, err = metrics.New(registry)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.Context("when serving over HTTP", func() {
+		ginkgo.It("should serve the cloud info and the metrics", func() {
+			createNode("node1", "us-west-2", "us-west-2a")
+			s, err := server.New(client, server.Config{
+				Options:  cloudinfo.Options{UseNodeLabels: true},
+				Registry: registry,
+			})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			handler := s.Handler()
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/cloudinfo", nil))
+			gomega.Expect(recorder.Code).To(gomega.Equal(http.StatusServiceUnavailable))
+
+			gomega.Expect(s.Detect(ctx)).To(gomega.Succeed())
+			recorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/cloudinfo", nil))
+			gomega.Expect(recorder.Code).To(gomega.Equal(http.StatusOK))
+			var response server.Response
+			gomega.Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(gomega.Succeed())
+			gomega.Expect(response.Provider).To(gomega.Equal("aws"))
+			gomega.Expect(response.Region).To(gomega.Equal("us-west-2"))
+
+			recorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			gomega.Expect(recorder.Code).To(gomega.Equal(http.StatusOK))
+			gomega.Expect(recorder.Body.String()).To(gomega.ContainSubstring(`cloudinfo_info{provider="aws",region="us-west-2",source="node-labels"} 1`))
+		})
+	})
+})
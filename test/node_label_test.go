@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo/cloudinfotest"
 	"github.com/onsi/ginkgo/v2"
 	"github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
@@ -41,6 +42,18 @@ var _ = ginkgo.Describe("Node Label Detection", func() {
 			gomega.Expect(provider).To(gomega.Equal("gcp"))
 		})
 
+		ginkgo.It("should parse OpenStack provider ID", func() {
+			provider, err := cloudinfo.ParseProviderID("openstack:///a6b3c9e2-3f0e-4a8b-9c1d-2e5f7a8b9c0d")
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(provider).To(gomega.Equal("openstack"))
+		})
+
+		ginkgo.It("should parse vSphere provider ID", func() {
+			provider, err := cloudinfo.ParseProviderID("vsphere://4230a8b5-8d3e-6f1c-2b9a-7e4d5c6b1a2f")
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(provider).To(gomega.Equal("vsphere"))
+		})
+
 		ginkgo.It("should handle empty provider ID", func() {
 			_, err := cloudinfo.ParseProviderID("")
 			gomega.Expect(err).To(gomega.HaveOccurred())
@@ -54,41 +67,52 @@ var _ = ginkgo.Describe("Node Label Detection", func() {
 		})
 	})
 
-	ginkgo.Describe("DetectNodeCloudInfo", func() {
-		ginkgo.Context("when multiple cloud providers are found", func() {
-			ginkgo.BeforeEach(func() {
-				// Create nodes with different provider IDs
+	ginkgo.Context("when reading capacity type labels", func() {
+		ginkgo.DescribeTable("should map labels to a capacity type",
+			func(labels map[string]string, expected string) {
+				gomega.Expect(cloudinfo.NodeCapacityType(labels)).To(gomega.Equal(expected))
+			},
+			ginkgo.Entry("EKS spot", map[string]string{"eks.amazonaws.com/capacityType": "SPOT"}, cloudinfo.CapacityTypeSpot),
+			ginkgo.Entry("EKS on-demand", map[string]string{"eks.amazonaws.com/capacityType": "ON_DEMAND"}, cloudinfo.CapacityTypeOnDemand),
+			ginkgo.Entry("Karpenter spot", map[string]string{"karpenter.sh/capacity-type": "spot"}, cloudinfo.CapacityTypeSpot),
+			ginkgo.Entry("Karpenter reserved", map[string]string{"karpenter.sh/capacity-type": "reserved"}, cloudinfo.CapacityTypeOnDemand),
+			ginkgo.Entry("GKE spot", map[string]string{"cloud.google.com/gke-spot": "true"}, cloudinfo.CapacityTypeSpot),
+			ginkgo.Entry("GKE preemptible", map[string]string{"cloud.google.com/gke-preemptible": "true"}, cloudinfo.CapacityTypeSpot),
+			ginkgo.Entry("AKS spot", map[string]string{"kubernetes.azure.com/scalesetpriority": "spot"}, cloudinfo.CapacityTypeSpot),
+			ginkgo.Entry("no labels", map[string]string{}, cloudinfo.CapacityTypeUnknown),
+		)
+	})
+
+	ginkgo.Describe("GetNodeAttributes", func() {
+		ginkgo.BeforeEach(func() {
+			for name, labels := range map[string]map[string]string{
+				"spot1":     {"topology.kubernetes.io/region": "us-west-2", "eks.amazonaws.com/capacityType": "SPOT"},
+				"spot2":     {"topology.kubernetes.io/region": "us-west-2", "karpenter.sh/capacity-type": "spot"},
+				"ondemand1": {"topology.kubernetes.io/region": "us-west-2", "eks.amazonaws.com/capacityType": "ON_DEMAND"},
+				"ondemand2": {"topology.kubernetes.io/region": "us-east-1", "eks.amazonaws.com/capacityType": "ON_DEMAND"},
+			} {
 				_, err := client.CoreV1().Nodes().Create(ctx, &corev1.Node{
-					ObjectMeta: metav1.ObjectMeta{
-						Name: "node1",
-						Labels: map[string]string{
-							"topology.kubernetes.io/region": "us-west-2",
-						},
-						Annotations: map[string]string{
-							"csi.volume.kubernetes.io/nodeid": `{"ebs.csi.aws.com":"i-1234567890abcdef0"}`,
-						},
-					},
-					Spec: corev1.NodeSpec{
-						ProviderID: "aws:///us-west-2a/i-1234567890abcdef0",
-					},
+					ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
 				}, metav1.CreateOptions{})
 				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			}
+		})
 
-				_, err = client.CoreV1().Nodes().Create(ctx, &corev1.Node{
-					ObjectMeta: metav1.ObjectMeta{
-						Name: "node2",
-						Labels: map[string]string{
-							"topology.kubernetes.io/region": "eastus",
-						},
-						Annotations: map[string]string{
-							"csi.volume.kubernetes.io/nodeid": `{"disk.csi.azure.com":"/subscriptions/12345678-1234-1234-1234-123456789012/resourceGroups/myResourceGroup/providers/Microsoft.Compute/virtualMachines/myVM"}`,
-						},
-					},
-					Spec: corev1.NodeSpec{
-						ProviderID: "azure:///subscriptions/12345678-1234-1234-1234-123456789012/resourceGroups/myResourceGroup/providers/Microsoft.Compute/virtualMachines/myVM",
-					},
-				}, metav1.CreateOptions{})
-				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		ginkgo.It("should count nodes by region and capacity type", func() {
+			attributes, err := cloudinfo.GetNodeAttributes(ctx, client)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(attributes.CapacityTypeCounts).To(gomega.Equal(map[string]map[string]int{
+				"us-west-2": {cloudinfo.CapacityTypeSpot: 2, cloudinfo.CapacityTypeOnDemand: 1},
+				"us-east-1": {cloudinfo.CapacityTypeOnDemand: 1},
+			}))
+		})
+	})
+
+	ginkgo.Describe("DetectNodeCloudInfo", func() {
+		ginkgo.Context("when multiple cloud providers are found", func() {
+			ginkgo.BeforeEach(func() {
+				gomega.Expect(cloudinfotest.EKSCluster("us-west-2", 1).Load(ctx, client)).To(gomega.Succeed())
+				gomega.Expect(cloudinfotest.AKSCluster("eastus", 1).Load(ctx, client)).To(gomega.Succeed())
 			})
 
 			ginkgo.It("should return an error", func() {
@@ -100,38 +124,7 @@ var _ = ginkgo.Describe("Node Label Detection", func() {
 
 		ginkgo.Context("when multiple regions are found", func() {
 			ginkgo.BeforeEach(func() {
-				// Create nodes with different regions
-				_, err := client.CoreV1().Nodes().Create(ctx, &corev1.Node{
-					ObjectMeta: metav1.ObjectMeta{
-						Name: "node1",
-						Labels: map[string]string{
-							"topology.kubernetes.io/region": "us-west-2",
-						},
-						Annotations: map[string]string{
-							"csi.volume.kubernetes.io/nodeid": `{"ebs.csi.aws.com":"i-1234567890abcdef0"}`,
-						},
-					},
-					Spec: corev1.NodeSpec{
-						ProviderID: "aws:///us-west-2a/i-1234567890abcdef0",
-					},
-				}, metav1.CreateOptions{})
-				gomega.Expect(err).NotTo(gomega.HaveOccurred())
-
-				_, err = client.CoreV1().Nodes().Create(ctx, &corev1.Node{
-					ObjectMeta: metav1.ObjectMeta{
-						Name: "node2",
-						Labels: map[string]string{
-							"topology.kubernetes.io/region": "us-east-1",
-						},
-						Annotations: map[string]string{
-							"csi.volume.kubernetes.io/nodeid": `{"ebs.csi.aws.com":"i-0987654321fedcba0"}`,
-						},
-					},
-					Spec: corev1.NodeSpec{
-						ProviderID: "aws:///us-east-1a/i-0987654321fedcba0",
-					},
-				}, metav1.CreateOptions{})
-				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				client = cloudinfotest.MultiRegionCluster("aws", 1, "us-west-2", "us-east-1").Clientset()
 			})
 
 			ginkgo.It("should return an error", func() {
@@ -165,30 +158,24 @@ var _ = ginkgo.Describe("Node Label Detection", func() {
 		})
 
 		ginkgo.Context("when provider and region are correctly set", func() {
-			ginkgo.BeforeEach(func() {
-				_, err := client.CoreV1().Nodes().Create(ctx, &corev1.Node{
-					ObjectMeta: metav1.ObjectMeta{
-						Name: "node1",
-						Labels: map[string]string{
-							"topology.kubernetes.io/region": "us-west-2",
-						},
-						Annotations: map[string]string{
-							"csi.volume.kubernetes.io/nodeid": `{"ebs.csi.aws.com":"i-1234567890abcdef0"}`,
-						},
-					},
-					Spec: corev1.NodeSpec{
-						ProviderID: "aws:///us-west-2a/i-1234567890abcdef0",
-					},
-				}, metav1.CreateOptions{})
-				gomega.Expect(err).NotTo(gomega.HaveOccurred())
-			})
+			ginkgo.DescribeTable("should return provider and region",
+				func(cluster *cloudinfotest.Cluster, provider, region string) {
+					info, err := cloudinfo.DetectNodeCloudInfo(ctx, cluster.Clientset())
+					gomega.Expect(err).NotTo(gomega.HaveOccurred())
+					gomega.Expect(info.Provider).To(gomega.Equal(provider))
+					gomega.Expect(info.Region).To(gomega.Equal(region))
+					gomega.Expect(info.Source).To(gomega.Equal("node-labels"))
+				},
+				ginkgo.Entry("EKS", cloudinfotest.EKSCluster("us-west-2", 3), "aws", "us-west-2"),
+				ginkgo.Entry("GKE", cloudinfotest.GKECluster("europe-west1", 3), "gcp", "europe-west1"),
+				ginkgo.Entry("AKS", cloudinfotest.AKSCluster("westeurope", 3), "azure", "westeurope"),
+			)
+		})
 
-			ginkgo.It("should return provider and region", func() {
-				info, err := cloudinfo.DetectNodeCloudInfo(ctx, client)
-				gomega.Expect(err).NotTo(gomega.HaveOccurred())
-				gomega.Expect(info.Provider).To(gomega.Equal("aws"))
-				gomega.Expect(info.Region).To(gomega.Equal("us-west-2"))
-				gomega.Expect(info.Source).To(gomega.Equal("node-labels"))
+		ginkgo.Context("when running on kind", func() {
+			ginkgo.It("should return an error", func() {
+				_, err := cloudinfo.DetectNodeCloudInfo(ctx, cloudinfotest.KindCluster(2).Clientset())
+				gomega.Expect(err).To(gomega.HaveOccurred())
 			})
 		})
 	})
@@ -0,0 +1,292 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo/cloudinfotest"
+	"github.com/go-logr/logr/funcr"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+)
+
+// blockingClient answers no request before its context is done
+type blockingClient struct{}
+
+func (blockingClient) Do(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+var _ = ginkgo.Describe("Options", func() {
+	var ctx context.Context
+
+	env := func(vars map[string]string) func(string) string {
+		return func(key string) string { return vars[key] }
+	}
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	ginkgo.Context("when building options", func() {
+		ginkgo.It("should return the documented defaults", func() {
+			opts, err := cloudinfo.NewOptions()
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(opts.Detectors).To(gomega.Equal([]string{cloudinfo.DetectorNodeLabels}))
+			gomega.Expect(opts.Timeout).To(gomega.Equal(30 * time.Second))
+			gomega.Expect(opts.DetectorTimeout).To(gomega.Equal(10 * time.Second))
+			gomega.Expect(opts.IMDSTimeout).To(gomega.Equal(5 * time.Second))
+			gomega.Expect(opts.LabelKeys).To(gomega.Equal(cloudinfo.DefaultLabelKeys()))
+			gomega.Expect(opts.RegionPolicy).To(gomega.Equal(cloudinfo.RegionPolicyStrict))
+			gomega.Expect(opts.CacheTTL).To(gomega.BeZero())
+			gomega.Expect(opts.IMDSConfig.Retry).To(gomega.Equal(cloudinfo.DefaultRetryPolicy()))
+		})
+
+		ginkgo.It("should enable the detectors of the legacy fields without detectors", func() {
+			opts := cloudinfo.Options{UseNodeLabels: true, UseIMDS: true}
+			gomega.Expect(opts.EnabledDetectors()).To(gomega.Equal([]string{cloudinfo.DetectorNodeLabels, cloudinfo.DetectorIMDS}))
+			opts.Detectors = []string{cloudinfo.DetectorRuntime}
+			gomega.Expect(opts.EnabledDetectors()).To(gomega.Equal([]string{cloudinfo.DetectorRuntime}))
+		})
+
+		ginkgo.It("should apply the options in order", func() {
+			opts, err := cloudinfo.NewOptions(
+				cloudinfo.WithDetectors(cloudinfo.DetectorIMDS),
+				cloudinfo.WithTimeout(time.Minute),
+				cloudinfo.WithLabelKeys(cloudinfo.LabelKeys{Zone: "example.com/zone"}),
+				cloudinfo.WithRegionPolicy(cloudinfo.RegionPolicyMajority),
+				cloudinfo.WithTimeout(2*time.Minute),
+			)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(opts.Detectors).To(gomega.Equal([]string{cloudinfo.DetectorIMDS}))
+			gomega.Expect(opts.Timeout).To(gomega.Equal(2 * time.Minute))
+			gomega.Expect(opts.LabelKeys).To(gomega.Equal(cloudinfo.LabelKeys{
+				Region: cloudinfo.RegionLabel, Zone: "example.com/zone", InstanceType: cloudinfo.InstanceTypeLabel,
+			}))
+			gomega.Expect(opts.RegionPolicy).To(gomega.Equal(cloudinfo.RegionPolicyMajority))
+		})
+
+		ginkgo.DescribeTable("should reject invalid options",
+			func(opt cloudinfo.Option, problem string) {
+				_, err := cloudinfo.NewOptions(opt)
+				gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrInvalidOptions))
+				gomega.Expect(err.Error()).To(gomega.ContainSubstring(problem))
+			},
+			ginkgo.Entry("unknown detector", cloudinfo.WithDetectors("dns"), `unknown detector "dns"`),
+			ginkgo.Entry("duplicate detector", cloudinfo.WithDetectors("imds", "imds"), `duplicate detector "imds"`),
+			ginkgo.Entry("negative timeout", cloudinfo.WithTimeout(-time.Second), "timeout must not be negative"),
+			ginkgo.Entry("unknown region policy", cloudinfo.WithRegionPolicy("first"), `unknown region policy "first"`),
+			ginkgo.Entry("invalid label key", cloudinfo.WithLabelKeys(cloudinfo.LabelKeys{Region: "not a label"}), `invalid region label key "not a label"`),
+			ginkgo.Entry("invalid backoff", cloudinfo.WithIMDSConfig(cloudinfo.IMDSConfig{
+				Retry: cloudinfo.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Millisecond},
+			}), "initial backoff exceeds max backoff"),
+		)
+
+		ginkgo.It("should reject invalid options in DetectCloudInfo", func() {
+			_, err := cloudinfo.DetectCloudInfo(ctx, nil, cloudinfo.Options{Detectors: []string{"dns"}})
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrInvalidOptions))
+		})
+	})
+
+	ginkgo.Context("when loading a configuration file", func() {
+		ginkgo.It("should override the defaults with the file", func() {
+			opts, err := cloudinfo.NewOptions(cloudinfo.WithConfigFile("testdata/config/cloudinfo.yaml"))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(opts.Detectors).To(gomega.Equal([]string{cloudinfo.DetectorIMDS, cloudinfo.DetectorNodeLabels}))
+			gomega.Expect(opts.Timeout).To(gomega.Equal(time.Minute))
+			gomega.Expect(opts.DetectorTimeout).To(gomega.Equal(15 * time.Second))
+			gomega.Expect(opts.IMDSTimeout).To(gomega.Equal(2 * time.Second))
+			gomega.Expect(opts.CacheTTL).To(gomega.Equal(5 * time.Minute))
+			gomega.Expect(opts.FailOnConflict).To(gomega.BeTrue())
+			gomega.Expect(opts.RegionPolicy).To(gomega.Equal(cloudinfo.RegionPolicyMajority))
+			gomega.Expect(opts.LabelKeys.Region).To(gomega.Equal("example.com/region"))
+			gomega.Expect(opts.LabelKeys.Zone).To(gomega.Equal(cloudinfo.ZoneLabel))
+
+			config := opts.IMDSConfig
+			gomega.Expect(config.AWSEndpoint).To(gomega.Equal(cloudinfo.AWSIMDSIPv6 + "/latest/meta-data/placement/region"))
+			gomega.Expect(config.AWSTokenEndpoint).To(gomega.Equal(cloudinfo.AWSIMDSIPv6 + "/latest/api/token"))
+			gomega.Expect(config.EndpointCandidates["aws"]).To(gomega.Equal([]string{cloudinfo.AWSIMDSIPv6}))
+			gomega.Expect(config.HetznerEndpoint).To(gomega.BeEmpty())
+			gomega.Expect(config.AzureEndpoint).To(gomega.HavePrefix("http://169.254.169.254/"))
+			gomega.Expect(config.Retry).To(gomega.Equal(cloudinfo.RetryPolicy{
+				MaxAttempts: 5, InitialBackoff: 50 * time.Millisecond, MaxBackoff: 2 * time.Second,
+			}))
+			gomega.Expect(config.CircuitBreaker).NotTo(gomega.BeNil())
+		})
+
+		ginkgo.DescribeTable("should reject invalid files",
+			func(content, problem string) {
+				path := filepath.Join(ginkgo.GinkgoT().TempDir(), "cloudinfo.yaml")
+				gomega.Expect(os.WriteFile(path, []byte(content), 0o600)).To(gomega.Succeed())
+				_, err := cloudinfo.NewOptions(cloudinfo.WithConfigFile(path))
+				gomega.Expect(err).To(gomega.HaveOccurred())
+				gomega.Expect(err.Error()).To(gomega.ContainSubstring(problem))
+			},
+			ginkgo.Entry("unknown field", "detector: [imds]", `unknown field "detector"`),
+			ginkgo.Entry("invalid duration", "timeout: soon", "invalid duration"),
+			ginkgo.Entry("unknown provider", "imds: {endpoints: {example: http://localhost}}", `unknown IMDS provider "example"`),
+			ginkgo.Entry("invalid endpoint", "imds: {endpoints: {aws: 169.254.169.254}}", "invalid IMDS endpoint of aws"),
+			ginkgo.Entry("invalid option", "regionPolicy: first", `unknown region policy "first"`),
+		)
+
+		ginkgo.It("should fail on a missing file", func() {
+			_, err := cloudinfo.NewOptions(cloudinfo.WithConfigFile("testdata/config/missing.yaml"))
+			gomega.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("failed to read config file")))
+		})
+
+		ginkgo.It("should override the file with the environment", func() {
+			opts, err := cloudinfo.NewOptions(
+				cloudinfo.WithConfigFile("testdata/config/cloudinfo.yaml"),
+				cloudinfo.WithEnv(env(map[string]string{
+					"CLOUDINFO_DETECTORS":         "node-labels, runtime",
+					"CLOUDINFO_TIMEOUT":           "45s",
+					"CLOUDINFO_FAIL_ON_CONFLICT":  "false",
+					"CLOUDINFO_ZONE_LABEL":        "example.com/zone",
+					"CLOUDINFO_IMDS_MAX_ATTEMPTS": "1",
+					"GCE_METADATA_HOST":           "169.254.169.254",
+				})),
+			)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(opts.Detectors).To(gomega.Equal([]string{cloudinfo.DetectorNodeLabels, cloudinfo.DetectorRuntime}))
+			gomega.Expect(opts.Timeout).To(gomega.Equal(45 * time.Second))
+			gomega.Expect(opts.DetectorTimeout).To(gomega.Equal(15 * time.Second))
+			gomega.Expect(opts.FailOnConflict).To(gomega.BeFalse())
+			gomega.Expect(opts.LabelKeys.Region).To(gomega.Equal("example.com/region"))
+			gomega.Expect(opts.LabelKeys.Zone).To(gomega.Equal("example.com/zone"))
+			gomega.Expect(opts.IMDSConfig.Retry.MaxAttempts).To(gomega.Equal(1))
+			gomega.Expect(opts.IMDSConfig.GCPEndpoint).To(gomega.HavePrefix("http://169.254.169.254/"))
+		})
+
+		ginkgo.It("should reject invalid environment variables", func() {
+			_, err := cloudinfo.NewOptions(cloudinfo.WithEnv(env(map[string]string{"CLOUDINFO_CACHE_TTL": "1 hour"})))
+			gomega.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("invalid CLOUDINFO_CACHE_TTL")))
+		})
+	})
+
+	ginkgo.Context("when detecting", func() {
+		ginkgo.It("should read the configured label keys", func() {
+			cluster := cloudinfotest.NewCluster()
+			for _, node := range cloudinfotest.EKSCluster("us-west-2", 2).Nodes() {
+				node.Labels["example.com/region"] = node.Labels[cloudinfo.RegionLabel]
+				delete(node.Labels, cloudinfo.RegionLabel)
+				cluster.AddNode(node)
+			}
+			_, err := cloudinfo.DetectCloudInfo(ctx, cluster.Clientset(), cloudinfo.Options{UseNodeLabels: true})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+
+			opts, err := cloudinfo.NewOptions(cloudinfo.WithLabelKeys(cloudinfo.LabelKeys{Region: "example.com/region"}))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			info, err := cloudinfo.DetectCloudInfo(ctx, cluster.Clientset(), opts)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Provider).To(gomega.Equal("aws"))
+			gomega.Expect(info.Region).To(gomega.Equal("us-west-2"))
+		})
+
+		ginkgo.It("should select the region of the most nodes with the majority policy", func() {
+			cluster := cloudinfotest.EKSCluster("us-east-1", 1).AddNodePool(cloudinfotest.NodePool{
+				Provider: "aws", Name: "west", Region: "us-west-2", Count: 3,
+			})
+			_, err := cloudinfo.DetectCloudInfo(ctx, cluster.Clientset(), cloudinfo.Options{UseNodeLabels: true})
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrMultipleRegions))
+
+			info, err := cloudinfo.DetectCloudInfo(ctx, cluster.Clientset(), cloudinfo.Options{
+				UseNodeLabels: true, RegionPolicy: cloudinfo.RegionPolicyMajority,
+			})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Region).To(gomega.Equal("us-west-2"))
+		})
+
+		ginkgo.It("should run the detectors in order with the configured client and endpoints", func() {
+			server := cloudinfotest.NewServer(cloudinfotest.Instance{Provider: "aws", Region: "us-east-1"})
+			ginkgo.DeferCleanup(server.Close)
+			cluster := cloudinfotest.EKSCluster("us-west-2", 1)
+			opts, err := cloudinfo.NewOptions(
+				cloudinfo.WithDetectors(cloudinfo.DetectorIMDS, cloudinfo.DetectorNodeLabels),
+				cloudinfo.WithHTTPClient(server.Client()),
+				cloudinfo.WithIMDSConfig(server.Config()),
+			)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			info, err := cloudinfo.DetectCloudInfo(ctx, cluster.Clientset(), opts)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Region).To(gomega.Equal("us-west-2"))
+			gomega.Expect(info.Conflicts).To(gomega.ConsistOf(gomega.HaveField("Detector", "imds")))
+			gomega.Expect(server.Requests()).NotTo(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should bound each detector with the detector timeout", func() {
+			opts, err := cloudinfo.NewOptions(
+				cloudinfo.WithDetectors(cloudinfo.DetectorIMDS),
+				cloudinfo.WithHTTPClient(blockingClient{}),
+				cloudinfo.WithIMDSConfig(cloudinfo.IMDSConfig{AWSEndpoint: "http://169.254.169.254/latest/meta-data/placement/region"}),
+				cloudinfo.WithDetectorTimeout(20*time.Millisecond),
+			)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			start := time.Now()
+			_, err = cloudinfo.DetectCloudInfo(ctx, nil, opts)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(time.Since(start)).To(gomega.BeNumerically("<", time.Second))
+		})
+
+		ginkgo.It("should log with the configured logger", func() {
+			var logs []string
+			logger := funcr.New(func(prefix, args string) { logs = append(logs, args) }, funcr.Options{Verbosity: 1})
+			opts, err := cloudinfo.NewOptions(cloudinfo.WithDetectionLogger(logger))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			_, err = cloudinfo.DetectCloudInfo(ctx, cloudinfotest.GKECluster("europe-west1", 1).Clientset(), opts)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(strings.Join(logs, "\n")).To(gomega.ContainSubstring(`"msg"="detected cloud info"`))
+		})
+	})
+
+	ginkgo.Context("with a Detector", func() {
+		ginkgo.It("should reuse its result for the cache TTL", func() {
+			client := cloudinfotest.AKSCluster("westeurope", 2).Clientset()
+			detector, err := cloudinfo.NewDetector(client, cloudinfo.WithCacheTTL(time.Hour))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+			for range 3 {
+				info, err := detector.Detect(ctx)
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				gomega.Expect(info.Region).To(gomega.Equal("westeurope"))
+				info.Region = "modified"
+			}
+			gomega.Expect(client.Actions()).To(gomega.HaveLen(1))
+
+			detector.Invalidate()
+			_, err = detector.Detect(ctx)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(client.Actions()).To(gomega.HaveLen(2))
+		})
+
+		ginkgo.It("should not cache without a TTL or on failure", func() {
+			client := cloudinfotest.NewCluster().Clientset()
+			detector, err := cloudinfo.NewDetector(client, cloudinfo.WithCacheTTL(time.Hour))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			for range 2 {
+				_, err := detector.Detect(ctx)
+				gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrNoNodes))
+			}
+			gomega.Expect(client.Actions()).To(gomega.HaveLen(2))
+
+			client = cloudinfotest.AKSCluster("westeurope", 1).Clientset()
+			detector, err = cloudinfo.NewDetector(client)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			for range 2 {
+				_, err := detector.Detect(ctx)
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			}
+			gomega.Expect(client.Actions()).To(gomega.HaveLen(2))
+		})
+
+		ginkgo.It("should reject invalid options", func() {
+			_, err := cloudinfo.NewDetector(nil, cloudinfo.WithCacheTTL(-time.Second))
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrInvalidOptions))
+		})
+	})
+})
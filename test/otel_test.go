@@ -0,0 +1,271 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/otelresource"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = ginkgo.Describe("OpenTelemetry Resource Detector", func() {
+	var ctx context.Context
+	var server *httptest.Server
+	var env map[string]string
+	var config otelresource.Config
+
+	// Responses served by the fake IMDS, keyed by path
+	var responses map[string]string
+
+	attributes := func(r *resource.Resource) map[attribute.Key]string {
+		result := map[attribute.Key]string{}
+		for _, kv := range r.Attributes() {
+			result[kv.Key] = kv.Value.AsString()
+		}
+		return result
+	}
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+		responses = map[string]string{}
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, ok := responses[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, err := w.Write([]byte(body))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		}))
+		env = map[string]string{}
+		config = otelresource.Config{
+			Options:    cloudinfo.Options{UseRuntime: true, UseIMDS: true},
+			IMDSClient: server.Client(),
+			IMDSConfig: &cloudinfo.IMDSConfig{
+				AWSEndpoint:                 server.URL + "/latest/meta-data/placement/region",
+				AzureEndpoint:               server.URL + "/metadata/instance/compute/location",
+				GCPEndpoint:                 server.URL + "/computeMetadata/v1/instance/zone",
+				AWSIdentityDocumentEndpoint: server.URL + "/latest/dynamic/instance-identity/document",
+				GCPProjectIDEndpoint:        server.URL + "/computeMetadata/v1/project/project-id",
+			},
+			RuntimeConfig: &cloudinfo.RuntimeConfig{
+				Getenv: func(key string) string { return env[key] },
+			},
+		}
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Close()
+	})
+
+	ginkgo.It("should detect an EC2 instance from IMDS", func() {
+		responses["/latest/meta-data/placement/region"] = "us-west-2"
+		responses["/latest/dynamic/instance-identity/document"] = `{
+			"accountId": "123456789012",
+			"availabilityZone": "us-west-2b",
+			"instanceId": "i-1234567890abcdef0",
+			"region": "us-west-2"
+		}`
+
+		r, err := otelresource.New(nil, config).Detect(ctx)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(r.SchemaURL()).To(gomega.Equal(semconv.SchemaURL))
+		gomega.Expect(attributes(r)).To(gomega.Equal(map[attribute.Key]string{
+			semconv.CloudProviderKey:         "aws",
+			semconv.CloudPlatformKey:         "aws_ec2",
+			semconv.CloudRegionKey:           "us-west-2",
+			semconv.CloudAvailabilityZoneKey: "us-west-2b",
+			semconv.CloudAccountIDKey:        "123456789012",
+		}))
+	})
+
+	ginkgo.It("should detect a GCE instance from IMDS", func() {
+		responses["/computeMetadata/v1/instance/zone"] = "projects/123456789/zones/us-central1-a"
+		responses["/computeMetadata/v1/project/project-id"] = "my-project"
+
+		r, err := otelresource.New(nil, config).Detect(ctx)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(attributes(r)).To(gomega.Equal(map[attribute.Key]string{
+			semconv.CloudProviderKey:         "gcp",
+			semconv.CloudPlatformKey:         "gcp_compute_engine",
+			semconv.CloudRegionKey:           "us-central1",
+			semconv.CloudAvailabilityZoneKey: "us-central1-a",
+			semconv.CloudAccountIDKey:        "my-project",
+		}))
+	})
+
+	ginkgo.It("should only probe the detected provider for its identity", func() {
+		responses["/computeMetadata/v1/instance/zone"] = "projects/123456789/zones/us-central1-a"
+		probes := map[string]int{}
+		handler := server.Config.Handler
+		server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			probes[r.URL.Path]++
+			handler.ServeHTTP(w, r)
+		})
+
+		_, err := otelresource.New(nil, config).Detect(ctx)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(probes["/latest/meta-data/placement/region"]).To(gomega.Equal(1))
+		gomega.Expect(probes["/metadata/instance/compute/location"]).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should report the region when the instance identity cannot be read", func() {
+		responses["/latest/meta-data/placement/region"] = "us-west-2"
+		responses["/latest/dynamic/instance-identity/document"] = "not json"
+
+		r, err := otelresource.New(nil, config).Detect(ctx)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(attributes(r)).To(gomega.Equal(map[attribute.Key]string{
+			semconv.CloudProviderKey: "aws",
+			semconv.CloudPlatformKey: "aws_ec2",
+			semconv.CloudRegionKey:   "us-west-2",
+		}))
+	})
+
+	ginkgo.It("should default the IMDS and runtime configurations", func() {
+		for key, value := range map[string]string{"AWS_LAMBDA_FUNCTION_NAME": "my-function", "AWS_REGION": "eu-west-1"} {
+			gomega.Expect(os.Setenv(key, value)).To(gomega.Succeed())
+			ginkgo.DeferCleanup(os.Unsetenv, key)
+		}
+
+		detector := otelresource.New(nil, otelresource.Config{Options: cloudinfo.Options{UseRuntime: true}})
+		r, err := detector.Detect(ctx)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(attributes(r)).To(gomega.Equal(map[attribute.Key]string{
+			semconv.CloudProviderKey: "aws",
+			semconv.CloudPlatformKey: "aws_lambda",
+			semconv.CloudRegionKey:   "eu-west-1",
+		}))
+	})
+
+	ginkgo.It("should prefer the runtime environment over IMDS", func() {
+		env["AWS_LAMBDA_FUNCTION_NAME"] = "my-function"
+		env["AWS_REGION"] = "eu-west-1"
+		responses["/latest/meta-data/placement/region"] = "us-west-2"
+
+		r, err := otelresource.New(nil, config).Detect(ctx)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(attributes(r)).To(gomega.Equal(map[attribute.Key]string{
+			semconv.CloudProviderKey: "aws",
+			semconv.CloudPlatformKey: "aws_lambda",
+			semconv.CloudRegionKey:   "eu-west-1",
+		}))
+	})
+
+	ginkgo.Context("with node label detection", func() {
+		var client *fake.Clientset
+
+		createNode := func(name string, labels map[string]string) {
+			labels[cloudinfo.RegionLabel] = "europe-west1"
+			labels[cloudinfo.ZoneLabel] = "europe-west1-b"
+			_, err := client.CoreV1().Nodes().Create(ctx, &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+				Spec:       corev1.NodeSpec{ProviderID: "gce://my-project/europe-west1-b/" + name},
+			}, metav1.CreateOptions{})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		}
+
+		ginkgo.BeforeEach(func() {
+			client = fake.NewSimpleClientset()
+			config.Options = cloudinfo.Options{UseNodeLabels: true}
+		})
+
+		ginkgo.It("should map managed node pools to the managed Kubernetes platform", func() {
+			createNode("node1", map[string]string{cloudinfo.GKENodePoolLabel: "default-pool"})
+			createNode("node2", map[string]string{cloudinfo.GKENodePoolLabel: "default-pool"})
+
+			r, err := otelresource.New(client, config).Detect(ctx)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(attributes(r)).To(gomega.Equal(map[attribute.Key]string{
+				semconv.CloudProviderKey:         "gcp",
+				semconv.CloudPlatformKey:         "gcp_kubernetes_engine",
+				semconv.CloudRegionKey:           "europe-west1",
+				semconv.CloudAvailabilityZoneKey: "europe-west1-b",
+			}))
+
+			lists := 0
+			for _, action := range client.Actions() {
+				if action.GetVerb() == "list" {
+					lists++
+				}
+			}
+			gomega.Expect(lists).To(gomega.Equal(1))
+		})
+
+		ginkgo.It("should not report a platform for self-managed nodes", func() {
+			createNode("node1", map[string]string{cloudinfo.GKENodePoolLabel: "default-pool"})
+			createNode("node2", map[string]string{})
+
+			r, err := otelresource.New(client, config).Detect(ctx)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(attributes(r)).To(gomega.Equal(map[attribute.Key]string{
+				semconv.CloudProviderKey:         "gcp",
+				semconv.CloudRegionKey:           "europe-west1",
+				semconv.CloudAvailabilityZoneKey: "europe-west1-b",
+			}))
+		})
+
+		ginkgo.It("should report the consensus of the detectors", func() {
+			_, err := client.CoreV1().Nodes().Create(ctx, &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{cloudinfo.RegionLabel: "us-west-2"}},
+				Spec:       corev1.NodeSpec{ProviderID: "aws:///us-west-2a/i-0123456789abcdef0"},
+			}, metav1.CreateOptions{})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			env["AWS_LAMBDA_FUNCTION_NAME"] = "my-function"
+			env["AWS_REGION"] = "eu-west-1"
+			responses["/latest/meta-data/placement/region"] = "eu-west-1"
+			config.Options = cloudinfo.Options{UseNodeLabels: true, UseRuntime: true, UseIMDS: true}
+
+			// The runtime and IMDS agree and outweigh the node labels
+			r, err := otelresource.New(client, config).Detect(ctx)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(attributes(r)).To(gomega.Equal(map[attribute.Key]string{
+				semconv.CloudProviderKey: "aws",
+				semconv.CloudPlatformKey: "aws_lambda",
+				semconv.CloudRegionKey:   "eu-west-1",
+			}))
+		})
+	})
+
+	ginkgo.It("should return an empty resource when no cloud is detected", func() {
+		r, err := otelresource.New(nil, config).Detect(ctx)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(r.Len()).To(gomega.Equal(0))
+
+		r, err = resource.New(ctx, resource.WithDetectors(otelresource.New(nil, config)), resource.WithAttributes(semconv.ServiceName("my-service")))
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(attributes(r)).To(gomega.Equal(map[attribute.Key]string{semconv.ServiceNameKey: "my-service"}))
+	})
+
+	ginkgo.DescribeTable("should map providers and platforms to semantic conventions",
+		func(info cloudinfo.CloudInfo, provider, platform string) {
+			gomega.Expect(otelresource.CloudProvider(info.Provider).Value.AsString()).To(gomega.Equal(provider))
+			kv, ok := otelresource.CloudPlatform(&info)
+			if platform == "" {
+				gomega.Expect(ok).To(gomega.BeFalse())
+				return
+			}
+			gomega.Expect(ok).To(gomega.BeTrue())
+			gomega.Expect(kv.Value.AsString()).To(gomega.Equal(platform))
+		},
+		ginkgo.Entry("EKS", cloudinfo.CloudInfo{Provider: "aws", Source: "node-labels", Platform: cloudinfo.PlatformAWSEKS}, "aws", "aws_eks"),
+		ginkgo.Entry("AKS", cloudinfo.CloudInfo{Provider: "azure", Source: "node-labels", Platform: cloudinfo.PlatformAKS}, "azure", "azure_aks"),
+		ginkgo.Entry("Self-managed nodes", cloudinfo.CloudInfo{Provider: "aws", Source: "node-labels"}, "aws", ""),
+		ginkgo.Entry("Azure VM", cloudinfo.CloudInfo{Provider: "azure", Source: "imds"}, "azure", "azure_vm"),
+		ginkgo.Entry("Alibaba ECS", cloudinfo.CloudInfo{Provider: "alibaba", Source: "imds"}, "alibaba_cloud", "alibaba_cloud_ecs"),
+		ginkgo.Entry("Fargate", cloudinfo.CloudInfo{Provider: "aws", Source: "runtime", Platform: cloudinfo.PlatformAWSFargate}, "aws", "aws_ecs"),
+		ginkgo.Entry("Cloud Run", cloudinfo.CloudInfo{Provider: "gcp", Source: "runtime", Platform: cloudinfo.PlatformGCPCloudRun}, "gcp", "gcp_cloud_run"),
+		ginkgo.Entry("IBM without platform", cloudinfo.CloudInfo{Provider: "ibm", Source: "imds"}, "ibm_cloud", ""),
+		ginkgo.Entry("Hetzner", cloudinfo.CloudInfo{Provider: "hetzner", Source: "imds"}, "hetzner", ""),
+	)
+})
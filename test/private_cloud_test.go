@@ -0,0 +1,145 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+)
+
+const openStackMetadata = `{
+	"uuid": "a6b3c9e2-3f0e-4a8b-9c1d-2e5f7a8b9c0d",
+	"availability_zone": "nova",
+	"hostname": "worker-1.novalocal",
+	"project_id": "6f1c2b9a7e4d5c6b"
+}`
+
+var _ = ginkgo.Describe("Private Cloud Detection", func() {
+	var server *httptest.Server
+	var config cloudinfo.IMDSConfig
+
+	ginkgo.BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		config = cloudinfo.IMDSConfig{
+			AWSEndpoint:       server.URL + "/latest/meta-data/placement/region",
+			OpenStackEndpoint: server.URL + "/openstack/latest/meta_data.json",
+		}
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Close()
+	})
+
+	ginkgo.Context("when running on OpenStack", func() {
+		ginkgo.BeforeEach(func() {
+			server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/openstack/latest/meta_data.json" {
+					_, err := w.Write([]byte(openStackMetadata))
+					gomega.Expect(err).NotTo(gomega.HaveOccurred())
+					return
+				}
+				w.WriteHeader(http.StatusNotFound)
+			})
+		})
+
+		ginkgo.It("should fail when no region is configured", func() {
+			_, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal(`no region configured for OpenStack availability zone "nova", set IMDSConfig.OpenStackRegion`))
+		})
+
+		ginkgo.It("should read the identity with the configured region", func() {
+			config.OpenStackRegion = "RegionOne"
+			identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(identity.Provider).To(gomega.Equal("openstack"))
+			gomega.Expect(identity.Region).To(gomega.Equal("RegionOne"))
+			gomega.Expect(identity.Zone).To(gomega.Equal("nova"))
+			gomega.Expect(identity.AccountID).To(gomega.Equal("6f1c2b9a7e4d5c6b"))
+			gomega.Expect(identity.InstanceID).To(gomega.Equal("a6b3c9e2-3f0e-4a8b-9c1d-2e5f7a8b9c0d"))
+		})
+
+		ginkgo.It("should use the configured region", func() {
+			config.OpenStackRegion = "RegionOne"
+			info, err := cloudinfo.DetectIMDSCloudInfoWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Provider).To(gomega.Equal("openstack"))
+			gomega.Expect(info.Region).To(gomega.Equal("RegionOne"))
+		})
+	})
+
+	ginkgo.Context("when an OpenStack config drive is mounted", func() {
+		ginkgo.BeforeEach(func() {
+			mount := ginkgo.GinkgoT().TempDir()
+			dir := filepath.Join(mount, "openstack", "latest")
+			gomega.Expect(os.MkdirAll(dir, 0o755)).To(gomega.Succeed())
+			gomega.Expect(os.WriteFile(filepath.Join(dir, "meta_data.json"), []byte(openStackMetadata), 0o600)).To(gomega.Succeed())
+			config.OpenStackConfigDrivePath = mount
+			config.OpenStackRegion = "RegionOne"
+		})
+
+		ginkgo.It("should read the metadata from the config drive", func() {
+			info, err := cloudinfo.DetectIMDSCloudInfoWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Provider).To(gomega.Equal("openstack"))
+			gomega.Expect(info.Region).To(gomega.Equal("RegionOne"))
+		})
+	})
+
+	ginkgo.Context("when running on vSphere", func() {
+		ginkgo.BeforeEach(func() {
+			dir := ginkgo.GinkgoT().TempDir()
+			vendor := filepath.Join(dir, "sys_vendor")
+			gomega.Expect(os.WriteFile(vendor, []byte("VMware, Inc.\n"), 0o600)).To(gomega.Succeed())
+			rpctool := filepath.Join(dir, "vmware-rpctool")
+			script := "#!/bin/sh\ncase \"$1\" in\n" +
+				"\"info-get guestinfo.cloudinfo.region\") echo dc-east ;;\n" +
+				"\"info-get guestinfo.cloudinfo.zone\") echo cluster-a ;;\n" +
+				"*) exit 1 ;;\nesac\n"
+			gomega.Expect(os.WriteFile(rpctool, []byte(script), 0o700)).To(gomega.Succeed())
+			config.VSphereSysVendorPath = vendor
+			config.VSphereRPCToolPath = rpctool
+		})
+
+		ginkgo.It("should read the region and zone from guestinfo", func() {
+			identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(identity.Provider).To(gomega.Equal("vsphere"))
+			gomega.Expect(identity.Region).To(gomega.Equal("dc-east"))
+			gomega.Expect(identity.Zone).To(gomega.Equal("cluster-a"))
+		})
+
+		ginkgo.It("should prefer the configured region", func() {
+			config.VSphereRegion = "on-prem"
+			info, err := cloudinfo.DetectIMDSCloudInfoWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Region).To(gomega.Equal("on-prem"))
+		})
+
+		ginkgo.It("should return an error when no region is available", func() {
+			config.VSphereRPCToolPath = ""
+			_, err := cloudinfo.DetectIMDSCloudInfoWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("no region configured for vSphere"))
+		})
+	})
+
+	ginkgo.Context("when the DMI vendor is not VMware", func() {
+		ginkgo.It("should not detect vSphere", func() {
+			vendor := filepath.Join(ginkgo.GinkgoT().TempDir(), "sys_vendor")
+			gomega.Expect(os.WriteFile(vendor, []byte("QEMU\n"), 0o600)).To(gomega.Succeed())
+			config.VSphereSysVendorPath = vendor
+			config.VSphereRegion = "on-prem"
+			_, err := cloudinfo.DetectIMDSCloudInfoWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("failed to detect cloud provider using IMDS"))
+		})
+	})
+})
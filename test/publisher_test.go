@@ -0,0 +1,236 @@
+package test
+
+import (
+	"context"
+	"time"
+
+	"github.com/carbon-aware/cloudinfo/pkg/apis/cloudinfo/v1alpha1"
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/publisher"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var _ = ginkgo.Describe("Publisher", func() {
+	var ctx context.Context
+	var client *fake.Clientset
+	var dynamicClient *dynamicfake.FakeDynamicClient
+	var now time.Time
+	var config publisher.Config
+
+	createNode := func(name, region, capacityType string) {
+		_, err := client.CoreV1().Nodes().Create(ctx, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					cloudinfo.RegionLabel:                region,
+					cloudinfo.KarpenterCapacityTypeLabel: capacityType,
+				},
+			},
+			Spec: corev1.NodeSpec{ProviderID: "aws:///" + region + "a/" + name},
+		}, metav1.CreateOptions{})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	}
+
+	clusterCloudInfo := func() *v1alpha1.ClusterCloudInfo {
+		object, err := dynamicClient.Resource(v1alpha1.ClusterCloudInfoResource).Get(ctx, publisher.ClusterCloudInfoName, metav1.GetOptions{})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		var clusterInfo v1alpha1.ClusterCloudInfo
+		gomega.Expect(runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, &clusterInfo)).To(gomega.Succeed())
+		return &clusterInfo
+	}
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+		client = fake.NewSimpleClientset()
+		dynamicClient = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{v1alpha1.ClusterCloudInfoResource: "ClusterCloudInfoList"})
+		now = time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+		config = publisher.Config{
+			Options: cloudinfo.Options{UseNodeLabels: true},
+			Now:     func() time.Time { return now },
+		}
+	})
+
+	ginkgo.Context("when the cluster runs in a single region", func() {
+		ginkgo.BeforeEach(func() {
+			createNode("node1", "us-west-2", "on-demand")
+			createNode("node2", "us-west-2", "spot")
+		})
+
+		ginkgo.It("should publish the ConfigMap", func() {
+			gomega.Expect(publisher.New(client, config).Publish(ctx)).To(gomega.Succeed())
+			configMap, err := client.CoreV1().ConfigMaps("kube-system").Get(ctx, "cloudinfo", metav1.GetOptions{})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(configMap.Data).To(gomega.Equal(map[string]string{
+				"provider":     "aws",
+				"region":       "us-west-2",
+				"source":       "node-labels",
+				"verified":     "false",
+				"gridZone":     "US-NW-BPAT",
+				"lastDetected": "2025-06-01T12:00:00Z",
+			}))
+		})
+
+		ginkgo.It("should update an existing ConfigMap", func() {
+			p := publisher.New(client, config)
+			gomega.Expect(p.Publish(ctx)).To(gomega.Succeed())
+			now = now.Add(time.Hour)
+			gomega.Expect(p.Publish(ctx)).To(gomega.Succeed())
+			configMap, err := client.CoreV1().ConfigMaps("kube-system").Get(ctx, "cloudinfo", metav1.GetOptions{})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(configMap.Data).To(gomega.HaveKeyWithValue("lastDetected", "2025-06-01T13:00:00Z"))
+		})
+
+		ginkgo.It("should publish the ClusterCloudInfo status", func() {
+			config.Dynamic = dynamicClient
+			gomega.Expect(publisher.New(client, config).Publish(ctx)).To(gomega.Succeed())
+			status := clusterCloudInfo().Status
+			gomega.Expect(status.Provider).To(gomega.Equal("aws"))
+			gomega.Expect(status.Region).To(gomega.Equal("us-west-2"))
+			gomega.Expect(status.GridZone).To(gomega.Equal("US-NW-BPAT"))
+			gomega.Expect(status.LastDetected.Time).To(gomega.BeTemporally("==", now))
+			gomega.Expect(status.Regions).To(gomega.Equal([]v1alpha1.RegionStatus{{
+				Region:        "us-west-2",
+				Nodes:         2,
+				CapacityTypes: map[string]int32{"on-demand": 1, "spot": 1},
+				GridZone:      "US-NW-BPAT",
+			}}))
+			gomega.Expect(status.Conditions).To(gomega.HaveLen(1))
+			gomega.Expect(status.Conditions[0].Type).To(gomega.Equal(v1alpha1.ConditionDetected))
+			gomega.Expect(status.Conditions[0].Status).To(gomega.Equal(metav1.ConditionTrue))
+		})
+	})
+
+	ginkgo.Context("when the cluster spans several regions", func() {
+		ginkgo.BeforeEach(func() {
+			createNode("node1", "us-west-2", "on-demand")
+			createNode("node2", "us-east-1", "on-demand")
+			config.Dynamic = dynamicClient
+		})
+
+		ginkgo.It("should publish the provider with an empty region and the region breakdown", func() {
+			gomega.Expect(publisher.New(client, config).Publish(ctx)).To(gomega.Succeed())
+
+			configMap, err := client.CoreV1().ConfigMaps("kube-system").Get(ctx, "cloudinfo", metav1.GetOptions{})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(configMap.Data).To(gomega.HaveKeyWithValue("provider", "aws"))
+			gomega.Expect(configMap.Data).To(gomega.HaveKeyWithValue("region", ""))
+			gomega.Expect(configMap.Data).NotTo(gomega.HaveKey("gridZone"))
+
+			status := clusterCloudInfo().Status
+			gomega.Expect(status.Provider).To(gomega.Equal("aws"))
+			gomega.Expect(status.Region).To(gomega.BeEmpty())
+			gomega.Expect(status.Regions).To(gomega.HaveLen(2))
+			gomega.Expect(status.Regions[0].Region).To(gomega.Equal("us-east-1"))
+			gomega.Expect(status.Regions[0].GridZone).To(gomega.Equal("US-MIDA-PJM"))
+			gomega.Expect(status.Regions[1].Region).To(gomega.Equal("us-west-2"))
+			gomega.Expect(status.Conditions).To(gomega.HaveLen(1))
+			gomega.Expect(status.Conditions[0].Status).To(gomega.Equal(metav1.ConditionTrue))
+			gomega.Expect(status.Conditions[0].Reason).To(gomega.Equal("MultipleRegions"))
+		})
+	})
+
+	ginkgo.Context("when detection fails", func() {
+		ginkgo.BeforeEach(func() {
+			config.Dynamic = dynamicClient
+		})
+
+		ginkgo.It("should report the failure", func() {
+			err := publisher.New(client, config).Publish(ctx)
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrNoNodes))
+
+			_, err = client.CoreV1().ConfigMaps("kube-system").Get(ctx, "cloudinfo", metav1.GetOptions{})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+
+			status := clusterCloudInfo().Status
+			gomega.Expect(status.Regions).To(gomega.BeEmpty())
+			gomega.Expect(status.Conditions).To(gomega.HaveLen(1))
+			gomega.Expect(status.Conditions[0].Status).To(gomega.Equal(metav1.ConditionFalse))
+			gomega.Expect(status.Conditions[0].Reason).To(gomega.Equal("DetectionFailed"))
+		})
+
+		ginkgo.It("should retry after a failure on start", func() {
+			runCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			config.Interval = 10 * time.Millisecond
+			done := make(chan error)
+			go func() {
+				done <- publisher.New(client, config).Run(runCtx)
+			}()
+
+			gomega.Consistently(done, 50*time.Millisecond).ShouldNot(gomega.Receive())
+			createNode("node1", "us-west-2", "on-demand")
+			gomega.Eventually(func() string {
+				configMap, err := client.CoreV1().ConfigMaps("kube-system").Get(ctx, "cloudinfo", metav1.GetOptions{})
+				if err != nil {
+					return ""
+				}
+				return configMap.Data["region"]
+			}).Should(gomega.Equal("us-west-2"))
+
+			cancel()
+			gomega.Eventually(done).Should(gomega.Receive(gomega.BeNil()))
+		})
+	})
+
+	ginkgo.Context("when running", func() {
+		ginkgo.BeforeEach(func() {
+			createNode("node1", "us-west-2", "on-demand")
+		})
+
+		ginkgo.DescribeTable("should publish again when nodes change", func(options func() cloudinfo.Options) {
+			config.Options = options()
+			// Signal when the informer watches nodes, the fake clientset drops earlier events
+			watching := make(chan struct{})
+			client.PrependWatchReactor("nodes", func(action k8stesting.Action) (bool, watch.Interface, error) {
+				w, err := client.Tracker().Watch(action.GetResource(), action.GetNamespace())
+				close(watching)
+				return true, w, err
+			})
+
+			runCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			config.Interval = time.Hour
+			done := make(chan error)
+			go func() {
+				done <- publisher.New(client, config).Run(runCtx)
+			}()
+
+			gomega.Eventually(func() string {
+				configMap, err := client.CoreV1().ConfigMaps("kube-system").Get(ctx, "cloudinfo", metav1.GetOptions{})
+				if err != nil {
+					return ""
+				}
+				return configMap.Data["region"]
+			}).Should(gomega.Equal("us-west-2"))
+			gomega.Eventually(watching).Should(gomega.BeClosed())
+
+			gomega.Expect(client.CoreV1().Nodes().Delete(ctx, "node1", metav1.DeleteOptions{})).To(gomega.Succeed())
+			createNode("node2", "eu-west-1", "on-demand")
+			gomega.Eventually(func() string {
+				configMap, err := client.CoreV1().ConfigMaps("kube-system").Get(ctx, "cloudinfo", metav1.GetOptions{})
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				return configMap.Data["region"]
+			}).Should(gomega.Equal("eu-west-1"))
+
+			cancel()
+			gomega.Eventually(done).Should(gomega.Receive(gomega.BeNil()))
+		},
+			ginkgo.Entry("with UseNodeLabels", func() cloudinfo.Options { return cloudinfo.Options{UseNodeLabels: true} }),
+			ginkgo.Entry("with the default detectors", func() cloudinfo.Options {
+				options, err := cloudinfo.NewOptions()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				return options
+			}),
+		)
+	})
+})
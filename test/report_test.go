@@ -0,0 +1,210 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/server"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = ginkgo.Describe("Detection Report", func() {
+	var ctx context.Context
+	var client *fake.Clientset
+
+	createNode := func(name, region, providerID string) {
+		labels := map[string]string{}
+		if region != "" {
+			labels[cloudinfo.RegionLabel] = region
+		}
+		_, err := client.CoreV1().Nodes().Create(ctx, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+			Spec:       corev1.NodeSpec{ProviderID: providerID},
+		}, metav1.CreateOptions{})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	}
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+		client = fake.NewSimpleClientset()
+	})
+
+	ginkgo.Context("when detecting from node labels", func() {
+		ginkgo.It("should report the signals, candidates and final pick", func() {
+			createNode("node1", "us-west-2", "aws:///us-west-2a/i-1")
+			createNode("node2", "us-west-2", "aws:///us-west-2b/i-2")
+
+			report, err := cloudinfo.ExplainCloudInfo(ctx, client, cloudinfo.Options{UseNodeLabels: true})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(report.Detectors).To(gomega.HaveLen(1))
+			detector := report.Detectors[0]
+			gomega.Expect(detector.Detector).To(gomega.Equal("node-labels"))
+			gomega.Expect(detector.Signals).To(gomega.ConsistOf(
+				cloudinfo.Signal{Kind: cloudinfo.SignalLabel, Name: "node1/" + cloudinfo.RegionLabel, Value: "us-west-2"},
+				cloudinfo.Signal{Kind: cloudinfo.SignalProviderID, Name: "node1", Value: "aws"},
+				cloudinfo.Signal{Kind: cloudinfo.SignalLabel, Name: "node2/" + cloudinfo.RegionLabel, Value: "us-west-2"},
+				cloudinfo.Signal{Kind: cloudinfo.SignalProviderID, Name: "node2", Value: "aws"},
+			))
+			gomega.Expect(detector.Candidates).To(gomega.Equal([]cloudinfo.Candidate{
+				{Provider: "aws", Region: "us-west-2", Confidence: 0.9, Nodes: 2},
+			}))
+			gomega.Expect(report.Result).To(gomega.Equal(&cloudinfo.CloudInfo{Provider: "aws", Region: "us-west-2", Source: "node-labels", Confidence: 0.9}))
+			gomega.Expect(report.Confidence).To(gomega.Equal(0.9))
+			gomega.Expect(report.Error).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should report discarded signals and competing candidates on failure", func() {
+			createNode("node1", "us-west-2", "aws:///us-west-2a/i-1")
+			createNode("node2", "us-west-2", "aws:///us-west-2a/i-2")
+			createNode("node3", "eu-west-1", "aws:///eu-west-1a/i-3")
+			createNode("node4", "", "")
+
+			report, err := cloudinfo.ExplainCloudInfo(ctx, client, cloudinfo.Options{UseNodeLabels: true})
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrMultipleRegions))
+			detector := report.Detectors[0]
+			gomega.Expect(detector.ErrorType).To(gomega.Equal("multiple_regions"))
+			gomega.Expect(detector.Signals).To(gomega.ContainElements(
+				cloudinfo.Signal{Kind: cloudinfo.SignalLabel, Name: "node4/" + cloudinfo.RegionLabel, Discarded: "missing region label"},
+				cloudinfo.Signal{Kind: cloudinfo.SignalProviderID, Name: "node4", Discarded: "missing provider ID"},
+			))
+			gomega.Expect(detector.Candidates).To(gomega.Equal([]cloudinfo.Candidate{
+				{Provider: "aws", Region: "us-west-2", Confidence: 0.45, Nodes: 2},
+				{Provider: "aws", Region: "eu-west-1", Confidence: 0.225, Nodes: 1},
+			}))
+			gomega.Expect(report.Result).To(gomega.BeNil())
+			gomega.Expect(report.Error).To(gomega.ContainSubstring("multiple regions found"))
+		})
+
+		ginkgo.It("should discard unknown provider IDs", func() {
+			createNode("node1", "dc-1", "baremetal://rack-1/node1")
+
+			report, err := cloudinfo.ExplainCloudInfo(ctx, client, cloudinfo.Options{UseNodeLabels: true})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(report.Detectors[0].Signals).To(gomega.ContainElement(cloudinfo.Signal{
+				Kind: cloudinfo.SignalProviderID, Name: "node1", Value: "baremetal://rack-1/node1", Discarded: "unknown provider ID format",
+			}))
+		})
+	})
+
+	ginkgo.Context("when detecting from IMDS", func() {
+		var imds *httptest.Server
+
+		ginkgo.BeforeEach(func() {
+			imds = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/computeMetadata/v1/instance/zone" {
+					_, err := w.Write([]byte("projects/123456789/zones/us-central1-a"))
+					gomega.Expect(err).NotTo(gomega.HaveOccurred())
+					return
+				}
+				w.WriteHeader(http.StatusNotFound)
+			}))
+		})
+
+		ginkgo.AfterEach(func() {
+			imds.Close()
+		})
+
+		ginkgo.It("should report the HTTP statuses and probe outcomes", func() {
+			config := cloudinfo.IMDSConfig{
+				AWSEndpoint: imds.URL + "/latest/meta-data/placement/region",
+				GCPEndpoint: imds.URL + "/computeMetadata/v1/instance/zone",
+			}
+			report, err := cloudinfo.Explain(ctx, func(ctx context.Context) (*cloudinfo.CloudInfo, error) {
+				return cloudinfo.DetectIMDSCloudInfoWithClient(ctx, imds.Client(), config)
+			})
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			detector := report.Detectors[0]
+			gomega.Expect(detector.Detector).To(gomega.Equal("imds"))
+			gomega.Expect(detector.Signals).To(gomega.Equal([]cloudinfo.Signal{
+				{Kind: cloudinfo.SignalIMDSStatus, Name: config.AWSEndpoint, Value: "404", Discarded: "unexpected status"},
+				{Kind: cloudinfo.SignalIMDSProbe, Name: "aws", Value: "unavailable", Discarded: "metadata service did not answer"},
+				{Kind: cloudinfo.SignalIMDSProbe, Name: "azure", Value: "unavailable", Discarded: "metadata service did not answer"},
+				{Kind: cloudinfo.SignalIMDSStatus, Name: config.GCPEndpoint, Value: "200"},
+				{Kind: cloudinfo.SignalIMDSProbe, Name: "gcp", Value: "us-central1"},
+			}))
+			gomega.Expect(detector.Candidates).To(gomega.Equal([]cloudinfo.Candidate{{Provider: "gcp", Region: "us-central1", Confidence: 0.8}}))
+			gomega.Expect(report.Confidence).To(gomega.Equal(0.8))
+		})
+	})
+
+	ginkgo.It("should report the runtime environment variables", func() {
+		env := map[string]string{"AWS_LAMBDA_FUNCTION_NAME": "my-function", "AWS_REGION": "eu-west-1"}
+		report, err := cloudinfo.Explain(ctx, func(ctx context.Context) (*cloudinfo.CloudInfo, error) {
+			return cloudinfo.DetectRuntimeCloudInfoWithClient(ctx, http.DefaultClient, cloudinfo.RuntimeConfig{
+				Getenv: func(key string) string { return env[key] },
+			})
+		})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(report.Detectors[0].Signals).To(gomega.Equal([]cloudinfo.Signal{
+			{Kind: cloudinfo.SignalEnv, Name: "AWS_LAMBDA_FUNCTION_NAME", Value: "my-function"},
+			{Kind: cloudinfo.SignalEnv, Name: "AWS_REGION", Value: "eu-west-1"},
+		}))
+		gomega.Expect(report.Confidence).To(gomega.Equal(0.95))
+	})
+
+	ginkgo.It("should render the report as text and JSON", func() {
+		createNode("node1", "us-west-2", "aws:///us-west-2a/i-1")
+		createNode("node2", "", "aws:///us-west-2a/i-2")
+
+		report, err := cloudinfo.ExplainCloudInfo(ctx, client, cloudinfo.Options{UseNodeLabels: true})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+		text := report.String()
+		gomega.Expect(text).To(gomega.MatchRegexp(`^detector node-labels \(.+\)\n  signals:\n`))
+		gomega.Expect(text).To(gomega.ContainSubstring(`    label node2/topology.kubernetes.io/region = "" (discarded: missing region label)`))
+		gomega.Expect(text).To(gomega.ContainSubstring("  candidates:\n    aws/us-west-2 confidence 0.45 (1 nodes)\n"))
+		gomega.Expect(text).To(gomega.HaveSuffix("result: aws/us-west-2 from node-labels, confidence 0.45\n"))
+
+		data, err := json.Marshal(report)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		var decoded map[string]any
+		gomega.Expect(json.Unmarshal(data, &decoded)).To(gomega.Succeed())
+		gomega.Expect(decoded).To(gomega.HaveKeyWithValue("result", gomega.SatisfyAll(
+			gomega.HaveKeyWithValue("provider", "aws"),
+			gomega.HaveKeyWithValue("region", "us-west-2"),
+			gomega.HaveKeyWithValue("source", "node-labels"),
+			gomega.HaveKeyWithValue("verified", false),
+			gomega.HaveKeyWithValue("confidence", gomega.BeNumerically("~", 0.45, 1e-9)),
+		)))
+		gomega.Expect(decoded).To(gomega.HaveKeyWithValue("confidence", gomega.BeNumerically("~", 0.45, 1e-9)))
+	})
+
+	ginkgo.It("should serve the report of the last detection", func() {
+		createNode("node1", "us-west-2", "aws:///us-west-2a/i-1")
+		s, err := server.New(client, server.Config{
+			Options:  cloudinfo.Options{UseNodeLabels: true},
+			Registry: prometheus.NewRegistry(),
+		})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		handler := s.Handler()
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/explain", nil))
+		gomega.Expect(recorder.Code).To(gomega.Equal(http.StatusServiceUnavailable))
+
+		gomega.Expect(s.Detect(ctx)).To(gomega.Succeed())
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/explain", nil))
+		gomega.Expect(recorder.Code).To(gomega.Equal(http.StatusOK))
+		var report cloudinfo.Report
+		gomega.Expect(json.Unmarshal(recorder.Body.Bytes(), &report)).To(gomega.Succeed())
+		gomega.Expect(report.Result.Region).To(gomega.Equal("us-west-2"))
+		gomega.Expect(report.Detectors[0].Candidates).To(gomega.HaveLen(1))
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/explain?format=text", nil))
+		gomega.Expect(recorder.Header().Get("Content-Type")).To(gomega.HavePrefix("text/plain"))
+		body, err := io.ReadAll(recorder.Body)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(string(body)).To(gomega.ContainSubstring("result: aws/us-west-2 from node-labels"))
+	})
+})
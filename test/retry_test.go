@@ -0,0 +1,239 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+)
+
+// unreachableClient fails every request like a metadata service that does not exist
+type unreachableClient struct {
+	requests atomic.Int32
+}
+
+func (c *unreachableClient) Do(*http.Request) (*http.Response, error) {
+	c.requests.Add(1)
+	return nil, errors.New("connection refused")
+}
+
+var _ = ginkgo.Describe("IMDS Retries", func() {
+	var (
+		ctx      context.Context
+		imds     *httptest.Server
+		requests atomic.Int32
+		// failures is the number of requests answered with status before the location
+		failures int32
+		status   int
+		header   http.Header
+	)
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+		requests.Store(0)
+		failures, status, header = 0, http.StatusTooManyRequests, http.Header{}
+		imds = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) <= failures {
+				for key, values := range header {
+					w.Header()[key] = values
+				}
+				w.WriteHeader(status)
+				return
+			}
+			_, _ = w.Write([]byte(`{"location": "westeurope"}`))
+		}))
+		ginkgo.DeferCleanup(imds.Close)
+	})
+
+	config := func(retry cloudinfo.RetryPolicy) cloudinfo.IMDSConfig {
+		return cloudinfo.IMDSConfig{AzureEndpoint: imds.URL + "/metadata/instance/compute/location", Retry: retry}
+	}
+
+	ginkgo.It("should retry throttled requests", func() {
+		failures = 2
+		info, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, imds.Client(), config(cloudinfo.RetryPolicy{
+			MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond,
+		}))
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(info.Region).To(gomega.Equal("westeurope"))
+		gomega.Expect(requests.Load()).To(gomega.BeEquivalentTo(3))
+	})
+
+	ginkgo.It("should report a reachable metadata service that keeps failing", func() {
+		failures, status = 10, http.StatusServiceUnavailable
+		_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, imds.Client(), config(cloudinfo.RetryPolicy{
+			MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond,
+		}))
+		gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+		var statusErr *cloudinfo.IMDSStatusError
+		gomega.Expect(errors.As(err, &statusErr)).To(gomega.BeTrue())
+		gomega.Expect(statusErr.StatusCode).To(gomega.Equal(http.StatusServiceUnavailable))
+		gomega.Expect(requests.Load()).To(gomega.BeEquivalentTo(3))
+	})
+
+	ginkgo.It("should honor Retry-After up to the maximum backoff", func() {
+		failures = 1
+		header.Set("Retry-After", "60")
+		start := time.Now()
+		_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, imds.Client(), config(cloudinfo.RetryPolicy{
+			MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: 50 * time.Millisecond,
+		}))
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(time.Since(start)).To(gomega.BeNumerically(">=", 50*time.Millisecond))
+		gomega.Expect(time.Since(start)).To(gomega.BeNumerically("<", 5*time.Second))
+	})
+
+	ginkgo.It("should stop retrying when the context is done", func() {
+		failures = 10
+		header.Set("Retry-After", "1")
+		ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, imds.Client(), config(cloudinfo.RetryPolicy{
+			MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: time.Second,
+		}))
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(requests.Load()).To(gomega.BeEquivalentTo(1))
+	})
+
+	ginkgo.It("should not retry without a policy or client errors", func() {
+		failures = 1
+		_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, imds.Client(), config(cloudinfo.RetryPolicy{}))
+		gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+		gomega.Expect(requests.Load()).To(gomega.BeEquivalentTo(1))
+
+		requests.Store(0)
+		status = http.StatusNotFound
+		_, err = cloudinfo.DetectIMDSCloudInfoWithClient(ctx, imds.Client(), config(cloudinfo.DefaultRetryPolicy()))
+		gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+		gomega.Expect(requests.Load()).To(gomega.BeEquivalentTo(1))
+	})
+
+	ginkgo.It("should distinguish unreachable and erroring metadata services", func() {
+		failures, status = 1, http.StatusInternalServerError
+		client := &unreachableClient{}
+		awsEndpoint := "http://169.254.169.254/latest/meta-data/placement/region"
+		report, err := cloudinfo.Explain(ctx, func(ctx context.Context) (*cloudinfo.CloudInfo, error) {
+			_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, client, cloudinfo.IMDSConfig{AWSEndpoint: awsEndpoint})
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+			return cloudinfo.DetectIMDSCloudInfoWithClient(ctx, imds.Client(), config(cloudinfo.RetryPolicy{}))
+		})
+		gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+		gomega.Expect(report.Detectors[0].Signals).To(gomega.ContainElement(cloudinfo.Signal{
+			Kind: cloudinfo.SignalIMDSProbe, Name: "aws", Value: "unreachable", Discarded: "metadata service did not answer",
+		}))
+		gomega.Expect(report.Detectors[1].Signals).To(gomega.ContainElement(cloudinfo.Signal{
+			Kind: cloudinfo.SignalIMDSProbe, Name: "azure", Value: "error", Discarded: "IMDS " + imds.URL + "/metadata/instance/compute/location answered 500",
+		}))
+	})
+
+	ginkgo.It("should retry unreachable metadata services when enabled", func() {
+		client := &unreachableClient{}
+		_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, client, cloudinfo.IMDSConfig{
+			AWSEndpoint: "http://169.254.169.254/latest/meta-data/placement/region",
+			Retry:       cloudinfo.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, RetryUnreachable: true},
+		})
+		gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+		gomega.Expect(client.requests.Load()).To(gomega.BeEquivalentTo(3))
+	})
+
+	ginkgo.Context("with a circuit breaker", func() {
+		ginkgo.It("should skip unreachable providers until the cooldown has passed", func() {
+			breaker := cloudinfo.NewCircuitBreaker(2, 50*time.Millisecond)
+			client := &unreachableClient{}
+			config := cloudinfo.IMDSConfig{AWSEndpoint: "http://169.254.169.254/latest/meta-data/placement/region", CircuitBreaker: breaker}
+			for range 2 {
+				_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, client, config)
+				gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+			}
+			gomega.Expect(breaker.State("aws")).To(gomega.Equal(cloudinfo.CircuitOpen))
+
+			report, err := cloudinfo.Explain(ctx, func(ctx context.Context) (*cloudinfo.CloudInfo, error) {
+				return cloudinfo.DetectIMDSCloudInfoWithClient(ctx, client, config)
+			})
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+			gomega.Expect(client.requests.Load()).To(gomega.BeEquivalentTo(2))
+			gomega.Expect(report.Detectors[0].Signals).To(gomega.ContainElement(cloudinfo.Signal{
+				Kind: cloudinfo.SignalIMDSProbe, Name: "aws", Value: "skipped", Discarded: "circuit breaker open",
+			}))
+
+			gomega.Eventually(func() string { return breaker.State("aws") }).Should(gomega.Equal(cloudinfo.CircuitHalfOpen))
+			_, err = cloudinfo.DetectIMDSCloudInfoWithClient(ctx, client, config)
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+			gomega.Expect(client.requests.Load()).To(gomega.BeEquivalentTo(3))
+			gomega.Expect(breaker.State("aws")).To(gomega.Equal(cloudinfo.CircuitOpen))
+		})
+
+		ginkgo.It("should keep the circuits of other endpoints apart", func() {
+			breaker := cloudinfo.NewCircuitBreaker(2, time.Minute)
+			client := &unreachableClient{}
+			config := cloudinfo.IMDSConfig{AWSEndpoint: "http://169.254.169.254/latest/meta-data/placement/region", CircuitBreaker: breaker}
+			for range 2 {
+				_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, client, config)
+				gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+			}
+			gomega.Expect(breaker.State("aws")).To(gomega.Equal(cloudinfo.CircuitOpen))
+
+			other := &unreachableClient{}
+			config.AWSEndpoint = "http://[fd00:ec2::254]/latest/meta-data/placement/region"
+			_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, other, config)
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+			gomega.Expect(other.requests.Load()).To(gomega.BeEquivalentTo(1))
+		})
+
+		ginkgo.It("should reset a nil circuit breaker", func() {
+			var breaker *cloudinfo.CircuitBreaker
+			gomega.Expect(breaker.Reset).NotTo(gomega.Panic())
+			gomega.Expect(breaker.State("aws")).To(gomega.Equal(cloudinfo.CircuitClosed))
+		})
+
+		ginkgo.It("should share the circuit breaker of the default configurations", func() {
+			breaker := cloudinfo.DefaultIMDSConfig().CircuitBreaker
+			breaker.Reset()
+			ginkgo.DeferCleanup(breaker.Reset)
+			client := &unreachableClient{}
+			options := cloudinfo.Options{Detectors: []string{cloudinfo.DetectorIMDS}, HTTPClient: client}
+			for range 3 {
+				_, err := cloudinfo.DetectCloudInfo(ctx, nil, options)
+				gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+			}
+			gomega.Expect(breaker.State("aws")).To(gomega.Equal(cloudinfo.CircuitOpen))
+
+			requests := client.requests.Load()
+			_, err := cloudinfo.DetectCloudInfo(ctx, nil, options)
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+			_, err = cloudinfo.DetectIMDSCloudInfoWithClient(ctx, client, cloudinfo.DefaultIMDSConfig())
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+			gomega.Expect(client.requests.Load()).To(gomega.Equal(requests))
+		})
+
+		ginkgo.It("should close the circuit when the metadata service answers", func() {
+			breaker := cloudinfo.NewCircuitBreaker(1, time.Millisecond)
+			config := cloudinfo.IMDSConfig{AzureEndpoint: imds.URL + "/metadata/instance/compute/location", CircuitBreaker: breaker}
+			address := imds.Listener.Addr().String()
+			imds.Close()
+			_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, imds.Client(), config)
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+			gomega.Expect(breaker.State("azure")).NotTo(gomega.Equal(cloudinfo.CircuitClosed))
+
+			// The metadata service comes back at the same address
+			listener, err := net.Listen("tcp", address)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			imds = &httptest.Server{Listener: listener, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+			})}}
+			imds.Start()
+			ginkgo.DeferCleanup(imds.Close)
+			gomega.Eventually(func() string { return breaker.State("azure") }).Should(gomega.Equal(cloudinfo.CircuitHalfOpen))
+			_, err = cloudinfo.DetectIMDSCloudInfoWithClient(ctx, imds.Client(), config)
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+			gomega.Expect(breaker.State("azure")).To(gomega.Equal(cloudinfo.CircuitClosed))
+		})
+	})
+})
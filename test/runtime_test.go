@@ -0,0 +1,116 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Runtime Detection", func() {
+	var server *httptest.Server
+	var env map[string]string
+	var config cloudinfo.RuntimeConfig
+
+	ginkgo.BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/v4/fargate/task":
+				_, err := w.Write([]byte(`{
+					"Cluster": "arn:aws:ecs:us-west-2:111122223333:cluster/default",
+					"TaskARN": "arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c",
+					"AvailabilityZone": "us-west-2a",
+					"LaunchType": "FARGATE"
+				}`))
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			case r.URL.Path == "/v4/ec2/task":
+				_, err := w.Write([]byte(`{"AvailabilityZone": "eu-west-1b", "LaunchType": "EC2"}`))
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			case r.URL.Path == "/computeMetadata/v1/instance/region" && r.Header.Get("Metadata-Flavor") == "Google":
+				_, err := w.Write([]byte("projects/123456789/regions/europe-west1"))
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		env = map[string]string{}
+		config = cloudinfo.RuntimeConfig{
+			Getenv:                 func(key string) string { return env[key] },
+			CloudRunRegionEndpoint: server.URL + "/computeMetadata/v1/instance/region",
+		}
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Close()
+	})
+
+	ginkgo.DescribeTable("should detect the provider, region and platform",
+		func(vars map[string]string, provider, region, platform string) {
+			for key, value := range vars {
+				env[key] = value
+			}
+			if uri, ok := env["ECS_CONTAINER_METADATA_URI_V4"]; ok {
+				env["ECS_CONTAINER_METADATA_URI_V4"] = server.URL + uri
+			}
+			info, err := cloudinfo.DetectRuntimeCloudInfoWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Provider).To(gomega.Equal(provider))
+			gomega.Expect(info.Region).To(gomega.Equal(region))
+			gomega.Expect(info.Platform).To(gomega.Equal(platform))
+			gomega.Expect(info.Source).To(gomega.Equal("runtime"))
+		},
+		ginkgo.Entry("Lambda",
+			map[string]string{"AWS_LAMBDA_FUNCTION_NAME": "my-function", "AWS_REGION": "us-east-1"},
+			"aws", "us-east-1", cloudinfo.PlatformAWSLambda),
+		ginkgo.Entry("Fargate",
+			map[string]string{"ECS_CONTAINER_METADATA_URI_V4": "/v4/fargate"},
+			"aws", "us-west-2", cloudinfo.PlatformAWSFargate),
+		ginkgo.Entry("ECS on EC2",
+			map[string]string{"ECS_CONTAINER_METADATA_URI_V4": "/v4/ec2"},
+			"aws", "eu-west-1", cloudinfo.PlatformAWSECS),
+		ginkgo.Entry("Cloud Run",
+			map[string]string{"K_SERVICE": "my-service"},
+			"gcp", "europe-west1", cloudinfo.PlatformGCPCloudRun),
+		ginkgo.Entry("Cloud Run jobs",
+			map[string]string{"CLOUD_RUN_JOB": "my-job"},
+			"gcp", "europe-west1", cloudinfo.PlatformGCPCloudRun),
+		ginkgo.Entry("Azure Container Apps",
+			map[string]string{"CONTAINER_APP_NAME": "my-app", "REGION_NAME": "West Europe"},
+			"azure", "westeurope", cloudinfo.PlatformAzureContainerApps),
+		ginkgo.Entry("Azure App Service",
+			map[string]string{"WEBSITE_SITE_NAME": "my-site", "REGION_NAME": "East US 2"},
+			"azure", "eastus2", cloudinfo.PlatformAzureAppService),
+		ginkgo.Entry("Azure Functions",
+			map[string]string{"WEBSITE_SITE_NAME": "my-site", "FUNCTIONS_WORKER_RUNTIME": "node", "REGION_NAME": "North Europe"},
+			"azure", "northeurope", cloudinfo.PlatformAzureFunctions),
+	)
+
+	ginkgo.Context("when the Lambda region is missing", func() {
+		ginkgo.It("should return an error", func() {
+			env["AWS_LAMBDA_FUNCTION_NAME"] = "my-function"
+			_, err := cloudinfo.DetectRuntimeCloudInfoWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("AWS_REGION not set in Lambda environment"))
+		})
+	})
+
+	ginkgo.Context("when the ECS task metadata endpoint fails", func() {
+		ginkgo.It("should return an error", func() {
+			env["ECS_CONTAINER_METADATA_URI_V4"] = server.URL + "/v4/missing"
+			_, err := cloudinfo.DetectRuntimeCloudInfoWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("failed to read ECS task metadata: unexpected status 404"))
+		})
+	})
+
+	ginkgo.Context("when no runtime is detected", func() {
+		ginkgo.It("should return an error", func() {
+			_, err := cloudinfo.DetectRuntimeCloudInfoWithClient(context.Background(), server.Client(), config)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("failed to detect serverless or container runtime"))
+		})
+	})
+})
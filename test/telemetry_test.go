@@ -0,0 +1,170 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/go-logr/logr/funcr"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = ginkgo.Describe("Logging and Tracing", func() {
+	var ctx context.Context
+	var logs []string
+	var recorder *tracetest.SpanRecorder
+
+	// spans returns the ended spans by name
+	spans := func() map[string]sdktrace.ReadOnlySpan {
+		result := map[string]sdktrace.ReadOnlySpan{}
+		for _, span := range recorder.Ended() {
+			result[span.Name()] = span
+		}
+		return result
+	}
+
+	// attributes returns the attributes of a span
+	attributes := func(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+		result := map[attribute.Key]attribute.Value{}
+		for _, kv := range span.Attributes() {
+			result[kv.Key] = kv.Value
+		}
+		return result
+	}
+
+	ginkgo.BeforeEach(func() {
+		logs = nil
+		logger := funcr.New(func(prefix, args string) {
+			logs = append(logs, args)
+		}, funcr.Options{Verbosity: 2})
+		recorder = tracetest.NewSpanRecorder()
+		ctx = cloudinfo.WithLogger(context.Background(), logger)
+		ctx = cloudinfo.WithTracerProvider(ctx, sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	})
+
+	ginkgo.Context("when detecting from node labels", func() {
+		var client *fake.Clientset
+
+		ginkgo.BeforeEach(func() {
+			client = fake.NewSimpleClientset()
+			for _, node := range []struct{ name, region string }{
+				{"node1", "us-west-2"},
+				{"node2", "us-west-2"},
+				{"node3", "eu-west-1"},
+			} {
+				_, err := client.CoreV1().Nodes().Create(ctx, &corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{Name: node.name, Labels: map[string]string{cloudinfo.RegionLabel: node.region}},
+					Spec:       corev1.NodeSpec{ProviderID: "aws:///" + node.region + "a/" + node.name},
+				}, metav1.CreateOptions{})
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			}
+		})
+
+		ginkgo.It("should log the node list size and the final decision", func() {
+			_, err := cloudinfo.DetectCloudInfo(ctx, client, cloudinfo.Options{UseNodeLabels: true})
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrMultipleRegions))
+
+			gomega.Expect(logs).To(gomega.ContainElements(
+				gomega.ContainSubstring(`"msg"="detecting cloud info" "nodeLabels"=true`),
+				gomega.ContainSubstring(`"msg"="listed nodes" "nodes"=3 "providerIDs"=3`),
+				gomega.And(gomega.ContainSubstring(`"msg"="detector failed"`), gomega.ContainSubstring(`"detector"="node-labels"`), gomega.ContainSubstring(`"errorType"="multiple_regions"`)),
+				gomega.ContainSubstring(`"msg"="cloud info detection failed"`),
+			))
+		})
+
+		ginkgo.It("should trace the detection, the detector and the node list", func() {
+			_, err := cloudinfo.DetectCloudInfo(ctx, client, cloudinfo.Options{UseNodeLabels: true})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+
+			result := spans()
+			gomega.Expect(result).To(gomega.HaveKey("DetectCloudInfo"))
+			gomega.Expect(result).To(gomega.HaveKey("detect node-labels"))
+			gomega.Expect(result).To(gomega.HaveKey("list nodes"))
+			gomega.Expect(result["list nodes"].Parent().SpanID()).To(gomega.Equal(result["detect node-labels"].SpanContext().SpanID()))
+			gomega.Expect(result["detect node-labels"].Parent().SpanID()).To(gomega.Equal(result["DetectCloudInfo"].SpanContext().SpanID()))
+
+			gomega.Expect(attributes(result["list nodes"])).To(gomega.HaveKeyWithValue(attribute.Key("cloudinfo.nodes"), attribute.IntValue(3)))
+			gomega.Expect(result["detect node-labels"].Status().Code).To(gomega.Equal(codes.Error))
+			gomega.Expect(attributes(result["detect node-labels"])).To(gomega.HaveKeyWithValue(attribute.Key("cloudinfo.error_type"), attribute.StringValue("multiple_regions")))
+		})
+	})
+
+	ginkgo.Context("when detecting from IMDS", func() {
+		var server *httptest.Server
+		var config cloudinfo.IMDSConfig
+
+		ginkgo.BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/computeMetadata/v1/instance/zone" {
+					_, err := w.Write([]byte("projects/123456789/zones/us-central1-a"))
+					gomega.Expect(err).NotTo(gomega.HaveOccurred())
+					return
+				}
+				w.WriteHeader(http.StatusNotFound)
+			}))
+			config = cloudinfo.IMDSConfig{
+				AWSEndpoint: server.URL + "/latest/meta-data/placement/region",
+				GCPEndpoint: server.URL + "/computeMetadata/v1/instance/zone",
+			}
+		})
+
+		ginkgo.AfterEach(func() {
+			server.Close()
+		})
+
+		ginkgo.It("should log each IMDS request and probe", func() {
+			_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+			gomega.Expect(logs).To(gomega.ContainElements(
+				gomega.And(gomega.ContainSubstring(`"msg"="IMDS request"`), gomega.ContainSubstring(`/latest/meta-data/placement/region`), gomega.ContainSubstring(`"status"=404`)),
+				gomega.And(gomega.ContainSubstring(`"msg"="IMDS probe unavailable"`), gomega.ContainSubstring(`"provider"="aws"`)),
+				gomega.And(gomega.ContainSubstring(`"msg"="IMDS request"`), gomega.ContainSubstring(`/computeMetadata/v1/instance/zone`), gomega.ContainSubstring(`"status"=200`)),
+				gomega.And(gomega.ContainSubstring(`"msg"="IMDS probe succeeded"`), gomega.ContainSubstring(`"provider"="gcp"`), gomega.ContainSubstring(`"region"="us-central1"`)),
+				gomega.And(gomega.ContainSubstring(`"msg"="detector succeeded"`), gomega.ContainSubstring(`"detector"="imds"`)),
+			))
+		})
+
+		ginkgo.It("should trace each probe and its HTTP requests", func() {
+			_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, server.Client(), config)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+			probes := map[string]string{}
+			requests := map[string]int64{}
+			for _, span := range recorder.Ended() {
+				switch span.Name() {
+				case "probe aws", "probe azure", "probe gcp":
+					probes[span.Name()] = attributes(span)["cloudinfo.result"].AsString()
+				case "IMDS GET":
+					requests[attributes(span)["url.full"].AsString()] = attributes(span)["http.response.status_code"].AsInt64()
+				}
+			}
+			gomega.Expect(probes).To(gomega.Equal(map[string]string{
+				"probe aws":   "unavailable",
+				"probe azure": "unavailable",
+				"probe gcp":   "success",
+			}))
+			gomega.Expect(requests).To(gomega.Equal(map[string]int64{
+				server.URL + "/latest/meta-data/placement/region": 404,
+				server.URL + "/computeMetadata/v1/instance/zone":  200,
+			}))
+			gomega.Expect(attributes(spans()["detect imds"])).To(gomega.HaveKeyWithValue(attribute.Key("cloud.provider"), attribute.StringValue("gcp")))
+		})
+	})
+
+	ginkgo.It("should not log or trace without a logger or tracer provider", func() {
+		_, err := cloudinfo.DetectCloudInfo(context.Background(), fake.NewSimpleClientset(), cloudinfo.Options{UseNodeLabels: true})
+		gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrNoNodes))
+		gomega.Expect(logs).To(gomega.BeEmpty())
+		gomega.Expect(recorder.Ended()).To(gomega.BeEmpty())
+	})
+})
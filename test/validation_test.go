@@ -0,0 +1,134 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo/cloudinfotest"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = ginkgo.Describe("Validation", func() {
+	var ctx context.Context
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	ginkgo.DescribeTable("should validate regions",
+		func(region string, valid bool) {
+			err := cloudinfo.ValidateRegion(region)
+			if valid {
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			} else {
+				gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrInvalidRegion))
+			}
+		},
+		ginkgo.Entry("AWS", "us-west-2", true),
+		ginkgo.Entry("OpenStack", "RegionOne", true),
+		ginkgo.Entry("Oracle", "us-ashburn-1", true),
+		ginkgo.Entry("dotted", "eu.frankfurt_1", true),
+		ginkgo.Entry("empty", "", false),
+		ginkgo.Entry("whitespace", "west europe", false),
+		ginkgo.Entry("newline", "westeurope\n", false),
+		ginkgo.Entry("control character", "us-west-2\x00", false),
+		ginkgo.Entry("non-ASCII", "eu-wést-1", false),
+		ginkgo.Entry("too long", strings.Repeat("a", cloudinfo.MaxRegionLength+1), false),
+	)
+
+	ginkgo.DescribeTable("should validate zones",
+		func(zone string, valid bool) {
+			err := cloudinfo.ValidateZone(zone)
+			if valid {
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			} else {
+				gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrInvalidZone))
+			}
+		},
+		ginkgo.Entry("AWS", "us-west-2a", true),
+		ginkgo.Entry("Azure", "westeurope-1", true),
+		ginkgo.Entry("empty", "", false),
+		ginkgo.Entry("newline", "us-west-2a\n", false),
+		ginkgo.Entry("too long", strings.Repeat("a", cloudinfo.MaxRegionLength+1), false),
+	)
+
+	ginkgo.Context("when the metadata service answers unexpected documents", func() {
+		var server *cloudinfotest.Server
+
+		ginkgo.BeforeEach(func() {
+			server = cloudinfotest.NewServer(cloudinfotest.Instance{Provider: "azure", Region: "westeurope"})
+			ginkgo.DeferCleanup(server.Close)
+		})
+
+		ginkgo.It("should reject invalid regions", func() {
+			server.SetFault(cloudinfotest.AzureLocationPath, cloudinfotest.Fault{Body: `{"location": "westeurope\nregion: injected"}`})
+			info, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, server.Client(), server.Config())
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrInvalidRegion))
+			gomega.Expect(cloudinfo.ErrorType(err)).To(gomega.Equal("invalid_region"))
+			gomega.Expect(info).To(gomega.BeNil())
+		})
+
+		ginkgo.It("should reject oversized bodies", func() {
+			server.SetFault(cloudinfotest.AzureLocationPath, cloudinfotest.Fault{Body: `{"location": "` + strings.Repeat("a", 2<<20) + `"}`})
+			_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, server.Client(), server.Config())
+			gomega.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("larger than")))
+		})
+
+		ginkgo.It("should reject oversized bodies of unsuccessful answers", func() {
+			server.SetFault(cloudinfotest.AzureLocationPath, cloudinfotest.Fault{Status: http.StatusNotFound, Body: strings.Repeat("a", 2<<20)})
+			_, err := cloudinfo.DetectIMDSCloudInfoWithClient(ctx, server.Client(), server.Config())
+			gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrIMDSNotDetected))
+		})
+	})
+
+	ginkgo.It("should reject invalid region labels", func() {
+		client := fake.NewSimpleClientset(&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{cloudinfo.RegionLabel: "us west 2"}},
+			Spec:       corev1.NodeSpec{ProviderID: "aws:///us-west-2a/i-0123456789abcdef0"},
+		})
+		_, err := cloudinfo.DetectNodeCloudInfo(ctx, client)
+		gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrInvalidRegion))
+	})
+
+	ginkgo.It("should return an error for an empty provider ID list", func() {
+		_, err := cloudinfo.ParseProviderIDs(nil)
+		gomega.Expect(err).To(gomega.MatchError("no provider IDs"))
+	})
+
+	ginkgo.DescribeTable("should parse GCP zones strictly",
+		func(zone, expectedZone, expectedRegion string) {
+			zoneName, region, err := cloudinfo.ParseGCPZone(zone)
+			if expectedZone == "" {
+				gomega.Expect(err).To(gomega.HaveOccurred())
+				return
+			}
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(zoneName).To(gomega.Equal(expectedZone))
+			gomega.Expect(region).To(gomega.Equal(expectedRegion))
+		},
+		ginkgo.Entry("zone path", "projects/123456789/zones/us-central1-a", "us-central1-a", "us-central1"),
+		ginkgo.Entry("missing project", "projects//zones/us-central1-a", "", ""),
+		ginkgo.Entry("extra segment", "projects/123456789/zones/us-central1-a/extra", "", ""),
+		ginkgo.Entry("wrong collection", "projects/123456789/regions/us-central1-a", "", ""),
+		ginkgo.Entry("zone without region", "projects/123456789/zones/-a", "", ""),
+		ginkgo.Entry("region without zone", "projects/123456789/zones/us-central1-", "", ""),
+		ginkgo.Entry("whitespace", "projects/123456789/zones/us central1-a", "", ""),
+		ginkgo.Entry("invalid zone suffix", "projects/123456789/zones/us-central1-a\n", "", ""),
+		ginkgo.Entry("zone too long", "projects/123456789/zones/us-central1-"+strings.Repeat("a", cloudinfo.MaxRegionLength), "", ""),
+	)
+
+	ginkgo.It("should reject invalid zones of the identity documents", func() {
+		server := cloudinfotest.NewServer(cloudinfotest.Instance{Provider: "aws", Region: "us-west-2", Zone: "us-west-2a\nzone: injected"})
+		ginkgo.DeferCleanup(server.Close)
+		identity, err := cloudinfo.DetectIMDSInstanceIdentityWithClient(ctx, server.Client(), server.Config())
+		gomega.Expect(err).To(gomega.MatchError(cloudinfo.ErrInvalidZone))
+		gomega.Expect(cloudinfo.ErrorType(err)).To(gomega.Equal("invalid_zone"))
+		gomega.Expect(identity).To(gomega.BeNil())
+	})
+})
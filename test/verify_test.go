@@ -0,0 +1,387 @@
+package test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/smallstep/pkcs7"
+)
+
+// newTestCertificate creates an RSA key and a certificate signed by the parent, self-signed when parent is nil.
+func newTestCertificate(template *x509.Certificate, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	certificate, err := x509.ParseCertificate(der)
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	return certificate, key
+}
+
+// signPKCS7 signs the content with SHA-256, embedding the signer certificate.
+func signPKCS7(content []byte, certificate *x509.Certificate, key *rsa.PrivateKey) string {
+	signed, err := pkcs7.NewSignedData(content)
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	signed.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	gomega.Expect(signed.AddSigner(certificate, key, pkcs7.SignerInfoConfig{})).To(gomega.Succeed())
+	der, err := signed.Finish()
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+// signJWT creates an RS256 JWT with the given claims.
+func signJWT(kid string, key *rsa.PrivateKey, claims any) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	payload, err := json.Marshal(claims)
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+var _ = ginkgo.Describe("IMDS Identity Verification", func() {
+	var (
+		ctx          context.Context
+		server       *httptest.Server
+		config       cloudinfo.IMDSConfig
+		verification cloudinfo.IdentityVerification
+		handlers     map[string]http.HandlerFunc
+	)
+
+	serve := func(path, body string) {
+		handlers[path] = func(w http.ResponseWriter, _ *http.Request) {
+			_, err := w.Write([]byte(body))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		}
+	}
+
+	ginkgo.BeforeEach(func() {
+		ctx = context.Background()
+		handlers = map[string]http.HandlerFunc{}
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if handler, ok := handlers[r.URL.Path]; ok {
+				handler(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+
+		config = cloudinfo.IMDSConfig{
+			AWSEndpoint:   server.URL + "/latest/meta-data/placement/region",
+			AzureEndpoint: server.URL + "/metadata/instance/compute/location?api-version=2021-02-01",
+			GCPEndpoint:   server.URL + "/computeMetadata/v1/instance/zone",
+
+			AWSIdentitySignatureEndpoint:  server.URL + "/latest/dynamic/instance-identity/rsa2048",
+			AzureAttestedDocumentEndpoint: server.URL + "/metadata/attested/document?api-version=2020-09-01",
+			GCPIdentityTokenEndpoint:      server.URL + "/computeMetadata/v1/instance/service-accounts/default/identity?format=full",
+		}
+		verification = cloudinfo.DefaultIdentityVerification()
+		verification.GCPCertsURL = server.URL + "/oauth2/v3/certs"
+	})
+
+	ginkgo.AfterEach(func() {
+		server.Close()
+	})
+
+	ginkgo.Context("when running on AWS", func() {
+		var certificate *x509.Certificate
+		var key *rsa.PrivateKey
+
+		ginkgo.BeforeEach(func() {
+			certificate, key = newTestCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "ec2.amazonaws.com"}}, nil, nil)
+			verification.AWSCertificates = map[string]*x509.Certificate{"us-west-2": certificate}
+			serve("/latest/meta-data/placement/region", "us-west-2")
+		})
+
+		ginkgo.It("should verify the signed identity document", func() {
+			document := `{"accountId": "123456789012", "availabilityZone": "us-west-2b", "instanceId": "i-1234567890abcdef0", "instanceType": "m5.large", "region": "us-west-2"}`
+			serve("/latest/dynamic/instance-identity/rsa2048", signPKCS7([]byte(document), certificate, key))
+
+			info, err := cloudinfo.DetectVerifiedIMDSCloudInfoWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Provider).To(gomega.Equal("aws"))
+			gomega.Expect(info.Region).To(gomega.Equal("us-west-2"))
+			gomega.Expect(info.Verified).To(gomega.BeTrue())
+
+			identity, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(identity.AccountID).To(gomega.Equal("123456789012"))
+			gomega.Expect(identity.Zone).To(gomega.Equal("us-west-2b"))
+		})
+
+		ginkgo.It("should reject a document signed by another key", func() {
+			otherCertificate, otherKey := newTestCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "ec2.amazonaws.com"}}, nil, nil)
+			document := `{"region": "us-west-2"}`
+			serve("/latest/dynamic/instance-identity/rsa2048", signPKCS7([]byte(document), otherCertificate, otherKey))
+
+			_, err := cloudinfo.DetectVerifiedIMDSCloudInfoWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.HavePrefix("failed to verify AWS instance identity signature"))
+		})
+
+		ginkgo.It("should reject a signed region that does not match", func() {
+			document := `{"region": "us-east-1"}`
+			serve("/latest/dynamic/instance-identity/rsa2048", signPKCS7([]byte(document), certificate, key))
+
+			_, err := cloudinfo.DetectVerifiedIMDSCloudInfoWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("signed region us-east-1 does not match detected region us-west-2"))
+		})
+
+		ginkgo.It("should fail without a certificate for the region", func() {
+			verification.AWSCertificates = nil
+			_, err := cloudinfo.DetectVerifiedIMDSCloudInfoWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("no AWS certificate for region: us-west-2"))
+		})
+	})
+
+	ginkgo.Context("when running on Azure", func() {
+		var leaf *x509.Certificate
+		var leafKey *rsa.PrivateKey
+		var expiresOn string
+
+		ginkgo.BeforeEach(func() {
+			root, rootKey := newTestCertificate(&x509.Certificate{
+				Subject:               pkix.Name{CommonName: "Test Root CA"},
+				IsCA:                  true,
+				BasicConstraintsValid: true,
+				KeyUsage:              x509.KeyUsageCertSign,
+			}, nil, nil)
+			leaf, leafKey = newTestCertificate(&x509.Certificate{
+				Subject:  pkix.Name{CommonName: "metadata.azure.com"},
+				DNSNames: []string{"metadata.azure.com", "eastus.metadata.azure.com"},
+				KeyUsage: x509.KeyUsageDigitalSignature,
+			}, root, rootKey)
+			verification.AzureRoots = x509.NewCertPool()
+			verification.AzureRoots.AddCert(root)
+			expiresOn = time.Now().Add(time.Hour).UTC().Format("01/02/06 15:04:05 -0700")
+
+			config.AzureInstanceEndpoint = server.URL + "/metadata/instance?api-version=2021-02-01"
+			serve("/metadata/instance/compute/location", `{"location": "eastus"}`)
+			serve("/metadata/instance", `{"compute": {"location": "eastus", "vmId": "02aab8a4-74ef-476e-8182-f6d2ba4166a6"}}`)
+			handlers["/metadata/attested/document"] = func(w http.ResponseWriter, r *http.Request) {
+				gomega.Expect(r.Header.Get("Metadata")).To(gomega.Equal("true"))
+				document, err := json.Marshal(map[string]any{
+					"nonce":          r.URL.Query().Get("nonce"),
+					"subscriptionId": "12345678-1234-1234-1234-123456789012",
+					"vmId":           "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+					"timeStamp":      map[string]string{"expiresOn": expiresOn},
+				})
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				gomega.Expect(json.NewEncoder(w).Encode(map[string]string{
+					"encoding":  "pkcs7",
+					"signature": signPKCS7(document, leaf, leafKey),
+				})).To(gomega.Succeed())
+			}
+		})
+
+		ginkgo.It("should verify the attested document without verifying the region", func() {
+			identity, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(identity.Verified).To(gomega.BeFalse())
+			gomega.Expect(identity.AccountID).To(gomega.Equal("12345678-1234-1234-1234-123456789012"))
+			gomega.Expect(identity.InstanceID).To(gomega.Equal("02aab8a4-74ef-476e-8182-f6d2ba4166a6"))
+		})
+
+		ginkgo.It("should add the nonce to an endpoint without a query", func() {
+			config.AzureAttestedDocumentEndpoint = server.URL + "/metadata/attested/document"
+			identity, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(identity.AccountID).To(gomega.Equal("12345678-1234-1234-1234-123456789012"))
+		})
+
+		ginkgo.It("should not detect a verified region", func() {
+			_, err := cloudinfo.DetectVerifiedIMDSCloudInfoWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("region not signed by provider: azure"))
+			gomega.Expect(cloudinfo.ErrorType(err)).To(gomega.Equal("verification"))
+		})
+
+		ginkgo.It("should reject a document attesting another VM", func() {
+			serve("/metadata/instance", `{"compute": {"location": "eastus", "vmId": "11111111-2222-3333-4444-555555555555"}}`)
+			_, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.HavePrefix("attested VM ID 02aab8a4-74ef-476e-8182-f6d2ba4166a6 does not match"))
+		})
+
+		ginkgo.It("should require the detected VM ID", func() {
+			config.AzureInstanceEndpoint = ""
+			_, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("missing detected VM ID to match the Azure attested document"))
+		})
+
+		ginkgo.It("should reject a chain to an untrusted root", func() {
+			verification.AzureRoots = x509.NewCertPool()
+			_, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.HavePrefix("failed to verify Azure attested document"))
+		})
+
+		ginkgo.It("should reject an expired document", func() {
+			expiresOn = time.Now().Add(-time.Minute).UTC().Format("01/02/06 15:04:05 -0700")
+			_, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.HavePrefix("expired Azure attested document"))
+		})
+
+		ginkgo.It("should reject an unexpected signer", func() {
+			verification.AzureSignerName = "example.com"
+			_, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("unexpected Azure attested document signer: metadata.azure.com"))
+		})
+	})
+
+	ginkgo.Context("when running on GCP", func() {
+		var key *rsa.PrivateKey
+		var claims map[string]any
+
+		ginkgo.BeforeEach(func() {
+			var err error
+			key, err = rsa.GenerateKey(rand.Reader, 2048)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			claims = map[string]any{
+				"iss": "https://accounts.google.com",
+				"aud": "cloudinfo",
+				"exp": time.Now().Add(time.Hour).Unix(),
+				"google": map[string]any{
+					"compute_engine": map[string]string{
+						"instance_id": "4520031799277581759",
+						"project_id":  "my-project",
+						"zone":        "us-central1-a",
+					},
+				},
+			}
+
+			serve("/computeMetadata/v1/instance/zone", "projects/123456789/zones/us-central1-a")
+			serve("/oauth2/v3/certs", `{"keys": [{"kid": "test-key", "kty": "RSA", "alg": "RS256", "n": "`+
+				base64.RawURLEncoding.EncodeToString(key.N.Bytes())+`", "e": "AQAB"}]}`)
+			handlers["/computeMetadata/v1/instance/service-accounts/default/identity"] = func(w http.ResponseWriter, r *http.Request) {
+				gomega.Expect(r.Header.Get("Metadata-Flavor")).To(gomega.Equal("Google"))
+				gomega.Expect(r.URL.Query().Get("audience")).To(gomega.Equal("cloudinfo"))
+				_, err := w.Write([]byte(signJWT("test-key", key, claims)))
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			}
+		})
+
+		ginkgo.It("should verify the identity token with the published keys", func() {
+			identity, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(identity.Verified).To(gomega.BeTrue())
+			gomega.Expect(identity.Region).To(gomega.Equal("us-central1"))
+			gomega.Expect(identity.AccountID).To(gomega.Equal("my-project"))
+			gomega.Expect(identity.InstanceID).To(gomega.Equal("4520031799277581759"))
+		})
+
+		ginkgo.It("should verify the identity token with configured keys", func() {
+			verification.GCPCertsURL = ""
+			verification.GCPKeys = map[string]*rsa.PublicKey{"test-key": &key.PublicKey}
+			info, err := cloudinfo.DetectVerifiedIMDSCloudInfoWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(info.Verified).To(gomega.BeTrue())
+		})
+
+		ginkgo.It("should add the audience to an endpoint without a query", func() {
+			config.GCPIdentityTokenEndpoint = server.URL + "/computeMetadata/v1/instance/service-accounts/default/identity"
+			identity, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(identity.Verified).To(gomega.BeTrue())
+		})
+
+		ginkgo.It("should cache the published keys until they expire", func() {
+			fetches := 0
+			handlers["/oauth2/v3/certs"] = func(w http.ResponseWriter, _ *http.Request) {
+				fetches++
+				w.Header().Set("Cache-Control", "public, max-age=3600")
+				_, err := w.Write([]byte(`{"keys": [{"kid": "test-key", "kty": "RSA", "alg": "RS256", "n": "` +
+					base64.RawURLEncoding.EncodeToString(key.N.Bytes()) + `", "e": "AQAB"}]}`))
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			}
+
+			for range 2 {
+				_, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			}
+			gomega.Expect(fetches).To(gomega.Equal(1))
+
+			verification.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+			claims["exp"] = time.Now().Add(3 * time.Hour).Unix()
+			_, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(fetches).To(gomega.Equal(2))
+		})
+
+		ginkgo.It("should fetch the published keys again when they rotate", func() {
+			kid := "old-key"
+			handlers["/oauth2/v3/certs"] = func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=3600")
+				_, err := w.Write([]byte(`{"keys": [{"kid": "` + kid + `", "kty": "RSA", "alg": "RS256", "n": "` +
+					base64.RawURLEncoding.EncodeToString(key.N.Bytes()) + `", "e": "AQAB"}]}`))
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			}
+			_, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+
+			kid = "test-key"
+			_, err = cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		})
+
+		ginkgo.It("should reject a token for another audience", func() {
+			claims["aud"] = "someone-else"
+			_, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("unexpected GCP identity token audience: someone-else"))
+		})
+
+		ginkgo.It("should reject a token signed by another key", func() {
+			otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			verification.GCPKeys = map[string]*rsa.PublicKey{"test-key": &otherKey.PublicKey}
+			_, err = cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.HavePrefix("failed to verify GCP identity token"))
+		})
+
+		ginkgo.It("should reject a signed zone in another region", func() {
+			claims["google"].(map[string]any)["compute_engine"].(map[string]string)["zone"] = "europe-west1-b"
+			_, err := cloudinfo.VerifyIMDSInstanceIdentityWithClient(ctx, server.Client(), config, verification)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("signed region europe-west1 does not match detected region us-central1"))
+		})
+	})
+
+	ginkgo.Context("when parsing PEM certificates", func() {
+		ginkgo.It("should reject a bundle without certificates", func() {
+			_, err := cloudinfo.ParsePEMCertificates([]byte(strings.Repeat("garbage", 3)))
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.Equal("no certificate found"))
+		})
+	})
+})
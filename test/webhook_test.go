@@ -0,0 +1,259 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/carbon-aware/cloudinfo/pkg/cloudinfo"
+	"github.com/carbon-aware/cloudinfo/pkg/webhook"
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var _ = ginkgo.Describe("Webhook", func() {
+	var nodes cache.Indexer
+	var namespaces cache.Indexer
+	var config webhook.Config
+
+	addNode := func(name, region, zone string) {
+		gomega.Expect(nodes.Add(&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{cloudinfo.RegionLabel: region, cloudinfo.ZoneLabel: zone},
+			},
+			Spec: corev1.NodeSpec{ProviderID: "aws:///" + zone + "/" + name},
+		})).To(gomega.Succeed())
+	}
+
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "app",
+				Labels: map[string]string{webhook.InjectLabel: "true"},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "app", Env: []corev1.EnvVar{{Name: webhook.RegionEnv, Value: "custom"}}},
+					{Name: "sidecar"},
+				},
+			},
+		}
+	}
+
+	// review posts a fabricated AdmissionReview and returns the response and the patched pod
+	review := func(pod *corev1.Pod) (*admissionv1.AdmissionResponse, *corev1.Pod) {
+		raw, err := json.Marshal(pod)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		body, err := json.Marshal(&admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       types.UID("3f1e5c1a-8b6f-4f3e-9c1d-2a7b5e9d0c4f"),
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Operation: admissionv1.Create,
+				Namespace: "apps",
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+		w := webhook.New(corelisters.NewNodeLister(nodes), corelisters.NewNamespaceLister(namespaces), config)
+		recorder := httptest.NewRecorder()
+		w.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)))
+		gomega.Expect(recorder.Code).To(gomega.Equal(http.StatusOK))
+
+		var response admissionv1.AdmissionReview
+		gomega.Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(gomega.Succeed())
+		gomega.Expect(response.Response.UID).To(gomega.Equal(types.UID("3f1e5c1a-8b6f-4f3e-9c1d-2a7b5e9d0c4f")))
+		gomega.Expect(response.Response.Allowed).To(gomega.BeTrue())
+		if response.Response.Patch == nil {
+			return response.Response, pod
+		}
+
+		patch, err := jsonpatch.DecodePatch(response.Response.Patch)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		patched, err := patch.Apply(raw)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		var patchedPod corev1.Pod
+		gomega.Expect(json.Unmarshal(patched, &patchedPod)).To(gomega.Succeed())
+		return response.Response, &patchedPod
+	}
+
+	ginkgo.BeforeEach(func() {
+		nodes = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		namespaces = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		gomega.Expect(namespaces.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps"}})).To(gomega.Succeed())
+		config = webhook.Config{Env: true, Annotations: true}
+		addNode("node1", "us-west-2", "us-west-2a")
+		addNode("node2", "us-west-2", "us-west-2b")
+	})
+
+	ginkgo.It("should inject the cluster region into unscheduled pods", func() {
+		_, pod := review(newPod())
+		gomega.Expect(pod.Spec.Containers[0].Env).To(gomega.Equal([]corev1.EnvVar{
+			{Name: webhook.RegionEnv, Value: "custom"},
+			{Name: webhook.ProviderEnv, Value: "aws"},
+			{Name: webhook.GridZoneEnv, Value: "US-NW-BPAT"},
+		}))
+		gomega.Expect(pod.Spec.Containers[1].Env).To(gomega.Equal([]corev1.EnvVar{
+			{Name: webhook.ProviderEnv, Value: "aws"},
+			{Name: webhook.RegionEnv, Value: "us-west-2"},
+			{Name: webhook.GridZoneEnv, Value: "US-NW-BPAT"},
+		}))
+		gomega.Expect(pod.Annotations).To(gomega.Equal(map[string]string{
+			webhook.ProviderAnnotation: "aws",
+			webhook.RegionAnnotation:   "us-west-2",
+			webhook.GridZoneAnnotation: "US-NW-BPAT",
+		}))
+	})
+
+	ginkgo.It("should inject the zone of the scheduled node", func() {
+		pod := newPod()
+		pod.Spec.NodeName = "node2"
+		_, pod = review(pod)
+		gomega.Expect(pod.Annotations).To(gomega.HaveKeyWithValue(webhook.ZoneAnnotation, "us-west-2b"))
+		gomega.Expect(pod.Spec.Containers[1].Env).To(gomega.ContainElement(corev1.EnvVar{Name: webhook.ZoneEnv, Value: "us-west-2b"}))
+	})
+
+	ginkgo.It("should resolve the target nodes from the node selector", func() {
+		addNode("node3", "eu-west-1", "eu-west-1a")
+		pod := newPod()
+		pod.Spec.NodeSelector = map[string]string{cloudinfo.RegionLabel: "eu-west-1"}
+		_, pod = review(pod)
+		gomega.Expect(pod.Annotations).To(gomega.HaveKeyWithValue(webhook.RegionAnnotation, "eu-west-1"))
+		gomega.Expect(pod.Annotations).To(gomega.HaveKeyWithValue(webhook.GridZoneAnnotation, "IE"))
+	})
+
+	ginkgo.It("should only add annotations when env injection is disabled", func() {
+		config.Env = false
+		_, pod := review(newPod())
+		gomega.Expect(pod.Spec.Containers[1].Env).To(gomega.BeEmpty())
+		gomega.Expect(pod.Annotations).To(gomega.HaveKeyWithValue(webhook.RegionAnnotation, "us-west-2"))
+	})
+
+	ginkgo.It("should skip pods that did not opt in", func() {
+		pod := newPod()
+		pod.Labels = nil
+		response, _ := review(pod)
+		gomega.Expect(response.Patch).To(gomega.BeNil())
+	})
+
+	ginkgo.It("should inject pods of namespaces that opted in", func() {
+		gomega.Expect(namespaces.Update(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   "apps",
+			Labels: map[string]string{webhook.InjectLabel: "true"},
+		}})).To(gomega.Succeed())
+		pod := newPod()
+		pod.Labels = nil
+		_, pod = review(pod)
+		gomega.Expect(pod.Annotations).To(gomega.HaveKeyWithValue(webhook.RegionAnnotation, "us-west-2"))
+
+		optedOut := newPod()
+		optedOut.Labels[webhook.InjectLabel] = "false"
+		response, _ := review(optedOut)
+		gomega.Expect(response.Patch).To(gomega.BeNil())
+	})
+
+	ginkgo.It("should admit pods unchanged with a warning when no node matches", func() {
+		pod := newPod()
+		pod.Spec.NodeSelector = map[string]string{cloudinfo.RegionLabel: "ap-south-1"}
+		response, _ := review(pod)
+		gomega.Expect(response.Patch).To(gomega.BeNil())
+		gomega.Expect(response.Warnings).To(gomega.Equal([]string{"cloudinfo: no nodes found"}))
+	})
+
+	ginkgo.It("should reject invalid admission reviews", func() {
+		w := webhook.New(corelisters.NewNodeLister(nodes), corelisters.NewNamespaceLister(namespaces), config)
+		recorder := httptest.NewRecorder()
+		w.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader([]byte("{}"))))
+		gomega.Expect(recorder.Code).To(gomega.Equal(http.StatusBadRequest))
+	})
+
+	ginkgo.Context("when serving over TLS", func() {
+		var dir string
+
+		writeCertificate := func(serial int64, modTime time.Time) {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(serial),
+				Subject:      pkix.Name{CommonName: "cloudinfo-webhook.kube-system.svc"},
+				IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+				ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			keyDER, err := x509.MarshalECPrivateKey(key)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+			certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+			gomega.Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)).To(gomega.Succeed())
+			gomega.Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)).To(gomega.Succeed())
+			gomega.Expect(os.Chtimes(certFile, modTime, modTime)).To(gomega.Succeed())
+			gomega.Expect(os.Chtimes(keyFile, modTime, modTime)).To(gomega.Succeed())
+		}
+
+		servedSerial := func(addr string) int64 {
+			conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true}) //nolint:gosec // the test inspects the served certificate
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			defer conn.Close()
+			return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+		}
+
+		ginkgo.BeforeEach(func() {
+			dir = ginkgo.GinkgoT().TempDir()
+		})
+
+		ginkgo.It("should reload the certificate when it is renewed", func() {
+			writeCertificate(1, time.Now().Add(-time.Minute))
+			certificates, err := webhook.NewCertificateReloader(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() {
+				w := webhook.New(corelisters.NewNodeLister(nodes), corelisters.NewNamespaceLister(namespaces), config)
+				done <- w.Serve(ctx, listener, certificates)
+			}()
+
+			gomega.Expect(servedSerial(listener.Addr().String())).To(gomega.Equal(int64(1)))
+			writeCertificate(2, time.Now())
+			gomega.Expect(servedSerial(listener.Addr().String())).To(gomega.Equal(int64(2)))
+
+			cancel()
+			gomega.Eventually(done).Should(gomega.Receive(gomega.BeNil()))
+		})
+
+		ginkgo.It("should fail without a certificate", func() {
+			_, err := webhook.NewCertificateReloader(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Error()).To(gomega.HavePrefix("failed to load TLS certificate"))
+		})
+	})
+})